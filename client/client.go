@@ -0,0 +1,274 @@
+// Package client exposes an http.Handler or a local port through a tunnl.gg
+// server from within a Go program, such as a test harness or a bot, the way
+// "ssh -R 80:localhost:<port>" does from a terminal.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultUser is the username sessions connect as unless Options.User is set.
+// It is one of the generic names, so the tunnel belongs to no account.
+const DefaultUser = "tunnl"
+
+// Options configures a tunnel session
+type Options struct {
+	Addr            string              // SSH address of the server, e.g. "tunnl.gg:22", or a wss:// URL such as "wss://tunnl.gg/__tunnl/ssh" to connect over HTTPS
+	User            string              // account name, optionally ending in +entropy=<low|default|high>, <subdomain>+<token> to join a tunnel, or DefaultUser if empty
+	Signer          ssh.Signer          // key to authenticate with; servers without authorized keys need none
+	HostKeyCallback ssh.HostKeyCallback // verifies the server's host key; required
+
+	// Exactly one of Handler and LocalAddr says what visitors reach
+	Handler   http.Handler // served in-process
+	LocalAddr string       // host:port that visitors' connections are relayed to
+
+	// TunnelOptions are the options an ssh client passes as its command,
+	// e.g. "compress rate=5"
+	TunnelOptions string
+
+	// Output receives the session's output after the banner, such as the
+	// request log and notices; it is discarded if nil
+	Output io.Writer
+
+	// DialContext connects to the server, or to the HTTPS proxy in front of
+	// it; a net.Dialer is used if nil
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSConfig secures connections to wss:// addresses; the server's
+	// certificate is verified against the system roots if nil
+	TLSConfig *tls.Config
+}
+
+// Session is an open tunnel. It stays up until Close is called or the
+// server ends it.
+type Session struct {
+	URL string // public URL of the tunnel, e.g. https://happy-tiger-a1b2c3d4.tunnl.gg
+
+	conn     *ssh.Client
+	session  *ssh.Session
+	stdin    *io.PipeWriter
+	listener net.Listener
+	server   *http.Server // nil when relaying to LocalAddr
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// ansiEscape matches the color codes of the server's output
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// Open connects to the server, forwards a tunnel and waits for its public
+// URL. ctx bounds the setup only; the session outlives it.
+func Open(ctx context.Context, opts Options) (*Session, error) {
+	if opts.Addr == "" {
+		return nil, errors.New("client: no server address")
+	}
+	if opts.HostKeyCallback == nil {
+		return nil, errors.New("client: no host key callback")
+	}
+	if (opts.Handler == nil) == (opts.LocalAddr == "") {
+		return nil, errors.New("client: exactly one of Handler and LocalAddr must be set")
+	}
+	user := opts.User
+	if user == "" {
+		user = DefaultUser
+	}
+
+	netConn, addr, err := dial(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	// Abort the handshake and the wait for the banner if ctx ends first
+	stop := context.AfterFunc(ctx, func() { netConn.Close() })
+	defer stop()
+
+	// Servers turning a client away say why in a pre-auth banner
+	var banner string
+	config := &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: opts.HostKeyCallback,
+		BannerCallback: func(message string) error {
+			banner += message
+			return nil
+		},
+	}
+	if opts.Signer != nil {
+		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(opts.Signer)}
+	}
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	if err != nil {
+		netConn.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("client: %w", ctx.Err())
+		}
+		if msg := strings.TrimSpace(banner); msg != "" {
+			return nil, fmt.Errorf("client: %s", msg)
+		}
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	conn := ssh.NewClient(c, chans, reqs)
+
+	s, err := open(conn, opts)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("client: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	if !stop() {
+		// ctx ended as setup completed and took the connection with it
+		s.Close()
+		return nil, fmt.Errorf("client: %w", ctx.Err())
+	}
+	return s, nil
+}
+
+// open forwards the tunnel over an established connection, starts the
+// session and reads the banner
+func open(conn *ssh.Client, opts Options) (*Session, error) {
+	// The server takes the first forward as the tunnel, whatever its port
+	ln, err := conn.Listen("tcp", "0.0.0.0:80")
+	if err != nil {
+		return nil, err
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	// The server ends the session when its input ends, so it is held open
+	stdin, stdinWriter := io.Pipe()
+	session.Stdin = stdin
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if opts.TunnelOptions != "" {
+		err = session.Start(opts.TunnelOptions)
+	} else {
+		err = session.Shell()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(stdout)
+	url, err := readURL(r)
+	if err != nil {
+		return nil, err
+	}
+	output := opts.Output
+	if output == nil {
+		output = io.Discard
+	}
+	// Keep reading, or the server blocks once the channel's window is full
+	go io.Copy(output, r)
+
+	s := &Session{
+		URL:      url,
+		conn:     conn,
+		session:  session,
+		stdin:    stdinWriter,
+		listener: ln,
+		done:     make(chan struct{}),
+	}
+	if opts.Handler != nil {
+		s.server = &http.Server{Handler: opts.Handler, ReadHeaderTimeout: time.Minute}
+		go s.server.Serve(ln)
+	} else {
+		go relay(ln, opts.LocalAddr)
+	}
+	go func() {
+		err := conn.Wait()
+		s.closeOnce.Do(func() { s.err = err })
+		s.shutdown()
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// readURL reads the banner up to its "Public URL:" row. If the server ends
+// the session first, the error carries what it wrote, e.g. why it rejected
+// the tunnel options.
+func readURL(r *bufio.Reader) (string, error) {
+	var text strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(ansiEscape.ReplaceAllString(line, ""))
+		if url, ok := strings.CutPrefix(line, "Public URL:"); ok {
+			return strings.TrimSpace(url), nil
+		}
+		text.WriteString(line + "\n")
+		if err != nil {
+			// Leave out the usage listing that follows option errors
+			msg, _, _ := strings.Cut(text.String(), "Usage:")
+			if msg = strings.TrimSpace(msg); msg != "" {
+				return "", fmt.Errorf("session ended: %s", msg)
+			}
+			return "", fmt.Errorf("session ended before the tunnel was ready: %w", err)
+		}
+	}
+}
+
+// relay copies the connections arriving over the tunnel to and from addr
+func relay(ln net.Listener, addr string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			local, err := net.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer local.Close()
+			go func() {
+				io.Copy(local, conn)
+				local.(*net.TCPConn).CloseWrite()
+			}()
+			io.Copy(conn, local)
+		}()
+	}
+}
+
+// shutdown stops serving and closes the connection to the server
+func (s *Session) shutdown() {
+	if s.server != nil {
+		s.server.Close()
+	}
+	s.listener.Close()
+	s.stdin.Close()
+	s.session.Close()
+	s.conn.Close()
+}
+
+// Close ends the session and its tunnel
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {})
+	s.shutdown()
+	<-s.done
+	return nil
+}
+
+// Wait blocks until the session ends, and returns the reason if the server
+// or the network ended it rather than Close
+func (s *Session) Wait() error {
+	<-s.done
+	return s.err
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/server"
+)
+
+// startServer runs a tunnl server accepting SSH connections on a local port
+// and returns it with that port's address
+func startServer(t *testing.T) (*server.Server, string) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.HostKeyPath = t.TempDir() + "/host_key"
+	srv, err := server.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		srv.Stop()
+	})
+	go srv.ServeSSH(ln)
+	return srv, ln.Addr().String()
+}
+
+// get requests path from the tunnel at url through the server's HTTPS handler
+func get(t *testing.T, srv *server.Server, url string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestOpen_Handler(t *testing.T) {
+	srv, addr := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, err := Open(ctx, Options{
+		Addr:            addr,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello from "+r.URL.Path)
+		}),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !strings.HasPrefix(s.URL, "https://") || !strings.HasSuffix(s.URL, "."+config.Default().Domain) {
+		t.Fatalf("URL = %q, want https://<subdomain>.%s", s.URL, config.Default().Domain)
+	}
+
+	if code, body := get(t, srv, s.URL+"/ping"); code != http.StatusOK || body != "hello from /ping" {
+		t.Errorf("GET = %d %q, want 200 %q", code, body, "hello from /ping")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := s.Wait(); err != nil {
+		t.Errorf("Wait after Close = %v, want nil", err)
+	}
+}
+
+func TestOpen_LocalAddr(t *testing.T) {
+	srv, addr := startServer(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "local")
+	}))
+	defer backend.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, err := Open(ctx, Options{
+		Addr:            addr,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		LocalAddr:       strings.TrimPrefix(backend.URL, "http://"),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+
+	if code, body := get(t, srv, s.URL+"/"); code != http.StatusOK || body != "local" {
+		t.Errorf("GET = %d %q, want 200 %q", code, body, "local")
+	}
+}
+
+func TestOpen_RejectedOptions(t *testing.T) {
+	_, addr := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := Open(ctx, Options{
+		Addr:            addr,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Handler:         http.NotFoundHandler(),
+		TunnelOptions:   "rate=fast",
+	})
+	if err == nil {
+		t.Fatal("Open succeeded with invalid options")
+	}
+	if !strings.Contains(err.Error(), "invalid tunnel options") || strings.Contains(err.Error(), "Usage:") {
+		t.Errorf("error = %q, want the server's complaint without the usage", err)
+	}
+}
+
+func TestOpen_Entropy(t *testing.T) {
+	_, addr := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, err := Open(ctx, Options{
+		Addr:            addr,
+		User:            "alice+entropy=high",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Handler:         http.NotFoundHandler(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	sub, _, _ := strings.Cut(strings.TrimPrefix(s.URL, "https://"), ".")
+	if suffix := sub[strings.LastIndex(sub, "-")+1:]; len(suffix) != 16 {
+		t.Errorf("subdomain = %q, want a 16-character suffix", sub)
+	}
+
+	_, err = Open(ctx, Options{
+		Addr:            addr,
+		User:            "alice+entropy=max",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Handler:         http.NotFoundHandler(),
+	})
+	if err == nil {
+		t.Error("Open succeeded with an unknown entropy level")
+	}
+}
+
+func TestOpen_Validation(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"no address", Options{HostKeyCallback: ssh.InsecureIgnoreHostKey(), Handler: http.NotFoundHandler()}},
+		{"no host key callback", Options{Addr: "127.0.0.1:22", Handler: http.NotFoundHandler()}},
+		{"no target", Options{Addr: "127.0.0.1:22", HostKeyCallback: ssh.InsecureIgnoreHostKey()}},
+		{"both targets", Options{Addr: "127.0.0.1:22", HostKeyCallback: ssh.InsecureIgnoreHostKey(), Handler: http.NotFoundHandler(), LocalAddr: "127.0.0.1:8080"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Open(context.Background(), tt.opts); err == nil {
+				t.Error("Open succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"tunnl.gg/internal/websocket"
+)
+
+// dial connects to the server: straight to its SSH port, or for a wss://
+// address with a WebSocket to its HTTPS port, through the proxy set in the
+// environment (HTTPS_PROXY, NO_PROXY) if any. It also returns the server's
+// host:port, which host key callbacks are given.
+func dial(ctx context.Context, opts Options) (net.Conn, string, error) {
+	dialContext := opts.DialContext
+	if dialContext == nil {
+		var d net.Dialer
+		dialContext = d.DialContext
+	}
+	if !strings.HasPrefix(opts.Addr, "wss://") {
+		conn, err := dialContext(ctx, "tcp", opts.Addr)
+		return conn, opts.Addr, err
+	}
+
+	u, err := url.Parse(opts.Addr)
+	if err != nil {
+		return nil, "", err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, "", err
+	}
+	target := addr
+	if proxy != nil {
+		if proxy.Scheme != "http" {
+			return nil, "", fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+		}
+		target = proxy.Host
+		if proxy.Port() == "" {
+			target = net.JoinHostPort(proxy.Hostname(), "80")
+		}
+	}
+
+	conn, err := dialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, "", err
+	}
+	// Abort the proxy, TLS and WebSocket handshakes if ctx ends first
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	ws, err := openWebSocket(conn, u, addr, proxy, opts.TLSConfig)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		return nil, "", err
+	}
+	return ws, addr, nil
+}
+
+// openWebSocket has the proxy, if any, connect conn to addr, then secures
+// it with TLS and opens a WebSocket to u over it
+func openWebSocket(conn net.Conn, u *url.URL, addr string, proxy *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	if proxy != nil {
+		if err := connectProxy(conn, proxy, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &tls.Config{}
+	if tlsConfig != nil {
+		cfg = tlsConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	// The handshake is an HTTP/1.1 upgrade
+	cfg.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return websocket.Handshake(tlsConn, u)
+}
+
+// connectProxy asks an HTTP proxy to open a tunnel to addr over conn
+func connectProxy(conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// Nothing follows the response until the TLS handshake starts
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused to connect to %s: %s", addr, resp.Status)
+	}
+	return nil
+}
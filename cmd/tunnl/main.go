@@ -3,16 +3,18 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
 	"log"
-	"net"
-	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
-	"tunnl.gg/internal/config"
-	"tunnl.gg/internal/server"
+	"tunnl.gg/internal/certs"
+	"tunnl.gg/internal/storage"
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnl"
 )
 
 func main() {
@@ -27,6 +29,20 @@ func main() {
 	if v := os.Getenv("HTTPS_ADDR"); v != "" {
 		cfg.HTTPSAddr = v
 	}
+	if v := os.Getenv("SSH_ON_HTTPS_PORT"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid SSH_ON_HTTPS_PORT %q: must be true or false", v)
+		}
+		cfg.SSHOnHTTPSPort = b
+	}
+	if v := os.Getenv("AGENT_ALPN"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid AGENT_ALPN %q: must be true or false", v)
+		}
+		cfg.AgentALPN = b
+	}
 	if v := os.Getenv("HOST_KEY_PATH"); v != "" {
 		cfg.HostKeyPath = v
 	}
@@ -36,129 +52,356 @@ func main() {
 	if v := os.Getenv("TLS_KEY"); v != "" {
 		cfg.TLSKey = v
 	}
+	if v := os.Getenv("SECRETS_PROVIDER"); v != "" {
+		cfg.SecretsProvider = v
+	}
+	if v := os.Getenv("TLS_CERT_SECRET"); v != "" {
+		cfg.TLSCertSecret = v
+	}
+	if v := os.Getenv("TLS_KEY_SECRET"); v != "" {
+		cfg.TLSKeySecret = v
+	}
+	if v := os.Getenv("HOST_KEY_SECRET"); v != "" {
+		cfg.HostKeySecret = v
+	}
 	if v := os.Getenv("STATS_ADDR"); v != "" {
 		cfg.StatsAddr = v
 	}
 	if v := os.Getenv("DOMAIN"); v != "" {
 		cfg.Domain = v
 	}
-
-	srv, err := server.New(cfg.HostKeyPath, cfg.Domain)
-	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
+	if v := os.Getenv("EXTRA_DOMAINS"); v != "" {
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), "."); d != "" && d != cfg.Domain {
+				cfg.ExtraDomains = append(cfg.ExtraDomains, d)
+			}
+		}
 	}
-
-	// Start SSH server
-	sshListener, err := net.Listen("tcp", cfg.SSHAddr)
-	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", cfg.SSHAddr, err)
+	if v := os.Getenv("DAILY_BANDWIDTH_QUOTA"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid DAILY_BANDWIDTH_QUOTA %q: must be a non-negative number of bytes", v)
+		}
+		cfg.DailyBandwidthQuota = n
 	}
-	log.Printf("SSH server listening on %s", cfg.SSHAddr)
-
-	sshShutdown := make(chan struct{})
-	sshDone := make(chan struct{})
-	go func() {
-		defer close(sshDone)
-		for {
-			conn, err := sshListener.Accept()
-			if err != nil {
-				// Check if shutdown was requested
-				select {
-				case <-sshShutdown:
-					return
-				default:
-				}
-				log.Printf("Failed to accept SSH connection: %v", err)
-				continue
+	if v := os.Getenv("MAX_CONCURRENT_REQUESTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid MAX_CONCURRENT_REQUESTS %q: must be a non-negative integer", v)
+		}
+		cfg.MaxConcurrentRequests = n
+	}
+	if v := os.Getenv("OVERLOAD_ACCEPTS_PER_SECOND"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid OVERLOAD_ACCEPTS_PER_SECOND %q: must be a non-negative integer", v)
+		}
+		cfg.OverloadAcceptsPerSecond = n
+	}
+	if v := os.Getenv("OVERLOAD_IN_FLIGHT_REQUESTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid OVERLOAD_IN_FLIGHT_REQUESTS %q: must be a non-negative integer", v)
+		}
+		cfg.OverloadInFlightRequests = n
+	}
+	if v := os.Getenv("OVERLOAD_CPU_PERCENT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			log.Fatalf("Invalid OVERLOAD_CPU_PERCENT %q: must be a percentage between 0 and 100", v)
+		}
+		cfg.OverloadCPUPercent = n
+	}
+	if v := os.Getenv("ACCOUNT_DAILY_BANDWIDTH_QUOTA"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid ACCOUNT_DAILY_BANDWIDTH_QUOTA %q: must be a non-negative number of bytes", v)
+		}
+		cfg.AccountDailyBandwidthQuota = n
+	}
+	if v := os.Getenv("ACCOUNT_REQUESTS_PER_SECOND"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid ACCOUNT_REQUESTS_PER_SECOND %q: must be a non-negative integer", v)
+		}
+		cfg.AccountRequestsPerSecond = n
+	}
+	if v := os.Getenv("IP_REQUESTS_PER_SECOND"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid IP_REQUESTS_PER_SECOND %q: must be a non-negative integer", v)
+		}
+		cfg.IPRequestsPerSecond = n
+	}
+	if v := os.Getenv("IPV6_PREFIX"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 128 {
+			log.Fatalf("Invalid IPV6_PREFIX %q: must be a prefix length between 1 and 128", v)
+		}
+		cfg.IPv6Prefix = n
+	}
+	if v := os.Getenv("MAX_RESPONSE_SIZE_CEILING"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid MAX_RESPONSE_SIZE_CEILING %q: must be a positive number of bytes", v)
+		}
+		cfg.MaxResponseSizeCeiling = n
+	}
+	if v := os.Getenv("UPSTREAM_RESPONSE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid UPSTREAM_RESPONSE_TIMEOUT %q: must be a non-negative duration (e.g. 25s)", v)
+		}
+		cfg.UpstreamResponseTimeout = d
+	}
+	if v := os.Getenv("NFT_SET"); v != "" {
+		cfg.NFTSet = v
+	}
+	if v := os.Getenv("NFT_SET6"); v != "" {
+		cfg.NFTSet6 = v
+	}
+	if v := os.Getenv("TRUSTED_IPS"); v != "" {
+		cfg.TrustedIPs = splitList(v)
+	}
+	for _, p := range []struct {
+		prefix   string
+		after    *int
+		duration *time.Duration
+	}{
+		{"CONNECTION_RATE", &cfg.ConnectionRateBlockAfter, &cfg.ConnectionRateBlockDuration},
+		{"HTTP_ABUSE", &cfg.HTTPAbuseBlockAfter, &cfg.HTTPAbuseBlockDuration},
+	} {
+		if v := os.Getenv(p.prefix + "_BLOCK_AFTER"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				log.Fatalf("Invalid %s_BLOCK_AFTER %q: must be a non-negative number of violations", p.prefix, v)
 			}
-			go srv.HandleSSHConnection(conn)
+			*p.after = n
+		}
+		if v := os.Getenv(p.prefix + "_BLOCK_DURATION"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				log.Fatalf("Invalid %s_BLOCK_DURATION %q: must be a positive duration", p.prefix, v)
+			}
+			*p.duration = d
 		}
-	}()
-
-	// HTTP server for redirect
-	httpServer := &http.Server{
-		Addr:         cfg.HTTPAddr,
-		Handler:      srv.HTTPRedirectHandler(),
-		ReadTimeout:  config.HTTPReadTimeout,
-		WriteTimeout: config.HTTPWriteTimeout,
-		IdleTimeout:  config.HTTPIdleTimeout,
 	}
-
-	// HTTPS server
-	httpsServer := &http.Server{
-		Addr:           cfg.HTTPSAddr,
-		Handler:        srv,
-		ReadTimeout:    config.HTTPSReadTimeout,
-		WriteTimeout:   config.HTTPSWriteTimeout,
-		IdleTimeout:    config.HTTPSIdleTimeout,
-		MaxHeaderBytes: 1 << 20,
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
+	if v := os.Getenv("BLOCKLISTS"); v != "" {
+		for _, src := range strings.Split(v, ",") {
+			if src = strings.TrimSpace(src); src != "" {
+				cfg.Blocklists = append(cfg.Blocklists, src)
+			}
+		}
 	}
-
-	// Stats server (localhost only)
-	statsServer := &http.Server{
-		Addr:         cfg.StatsAddr,
-		Handler:      srv.StatsHandler(),
-		ReadTimeout:  config.StatsReadTimeout,
-		WriteTimeout: config.StatsWriteTimeout,
+	if v := os.Getenv("WARNING_LOCALES_DIR"); v != "" {
+		cfg.WarningLocalesDir = v
 	}
-
-	// Channel to signal fatal server errors
-	serverErr := make(chan error, 3)
-
-	log.Printf("HTTP server listening on %s (redirects to HTTPS)", cfg.HTTPAddr)
-	go func() {
-		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-			serverErr <- fmt.Errorf("HTTP server error: %w", err)
+	if v := os.Getenv("WARNING_COOKIE_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid WARNING_COOKIE_MAX_AGE %q: must be a non-negative duration (e.g. 24h)", v)
 		}
-	}()
-
-	log.Printf("HTTPS server listening on %s", cfg.HTTPSAddr)
-	go func() {
-		if err := httpsServer.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey); err != http.ErrServerClosed {
-			serverErr <- fmt.Errorf("HTTPS server error: %w", err)
+		cfg.WarningCookieMaxAge = d
+	}
+	if v := os.Getenv("WARNING_COOKIE_SAMESITE"); v != "" {
+		cfg.WarningCookieSameSite = v
+	}
+	if v := os.Getenv("WARNING_COOKIE_SCOPE"); v != "" {
+		cfg.WarningCookieScope = v
+	}
+	if v := os.Getenv("AUTHORIZED_KEYS"); v != "" {
+		cfg.AuthorizedKeysPath = v
+	}
+	if v := os.Getenv("AUTHORIZED_KEYS_REQUIRED"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid AUTHORIZED_KEYS_REQUIRED %q: must be true or false", v)
 		}
-	}()
-
-	log.Printf("Stats server listening on %s", cfg.StatsAddr)
-	go func() {
-		if err := statsServer.ListenAndServe(); err != http.ErrServerClosed {
-			serverErr <- fmt.Errorf("stats server error: %w", err)
+		cfg.RequireAuthorizedKey = b
+	}
+	if v := os.Getenv("TIERS_FILE"); v != "" {
+		cfg.TiersPath = v
+	}
+	if v := os.Getenv("STORE_PATH"); v != "" {
+		cfg.StorePath = v
+	}
+	if v := os.Getenv("DNS_PROVIDER"); v != "" {
+		cfg.DNSProvider = v
+	}
+	if v := os.Getenv("ACME_EMAIL"); v != "" {
+		cfg.ACMEEmail = v
+	}
+	if v := os.Getenv("ACME_DIRECTORY"); v != "" {
+		cfg.ACMEDirectory = v
+	}
+	if v := os.Getenv("TLS_MIN_VERSION"); v != "" {
+		cfg.TLSMinVersion = v
+	}
+	if v := os.Getenv("TLS_CIPHER_SUITES"); v != "" {
+		cfg.TLSCipherSuites = splitList(v)
+	}
+	if v := os.Getenv("TLS_CURVES"); v != "" {
+		cfg.TLSCurves = splitList(v)
+	}
+	if v := os.Getenv("TLS_ALPN"); v != "" {
+		cfg.TLSALPN = splitList(v)
+	}
+	if v := os.Getenv("GEOIP_CSV"); v != "" {
+		cfg.GeoIPPath = v
+	}
+	if v := os.Getenv("TLS_FINGERPRINT_BLOCKLIST"); v != "" {
+		cfg.TLSFingerprintBlocklist = splitList(v)
+	}
+	if v := os.Getenv("CERTS_DIR"); v != "" {
+		cfg.CertsDir = v
+	}
+	if v := os.Getenv("ACME_CACHE_DIR"); v != "" {
+		cfg.ACMECacheDir = v
+	}
+	if v := os.Getenv("STORAGE_URL"); v != "" {
+		cfg.StorageURL = v
+	}
+	if v := os.Getenv("MIGRATION_NODES"); v != "" {
+		cfg.MigrationNodes = splitList(v)
+	}
+	if v := os.Getenv("CAPTURE_BODY_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid CAPTURE_BODY_LIMIT %q: must be a non-negative number of bytes", v)
 		}
-	}()
+		cfg.CaptureBodyLimit = n
+	}
+	if v := os.Getenv("CAPTURE_SPILL_URL"); v != "" {
+		cfg.CaptureSpillURL = v
+	}
+	if v := os.Getenv("MEMORY_BUDGET"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid MEMORY_BUDGET %q: must be a non-negative number of bytes", v)
+		}
+		cfg.MemoryBudget = n
+	}
+	if v := os.Getenv("STICKY_SESSIONS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid STICKY_SESSIONS %q: must be true or false", v)
+		}
+		cfg.StickySessions = b
+	}
+	if v := os.Getenv("LISTENER_RESTARTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid LISTENER_RESTARTS %q: must be a non-negative integer", v)
+		}
+		cfg.ListenerRestarts = n
+	}
 
-	// Wait for shutdown signal or fatal server error
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	// TLS and host key material may come from a secret manager instead of files
+	var secrets certs.SecretsProvider
+	if (cfg.TLSCertSecret == "") != (cfg.TLSKeySecret == "") {
+		log.Fatalf("TLS_CERT_SECRET and TLS_KEY_SECRET must be set together")
+	}
+	if cfg.SecretsProvider != "" {
+		provider, err := certs.NewSecretsProvider(cfg.SecretsProvider, os.Getenv)
+		if err != nil {
+			log.Fatalf("Invalid SECRETS_PROVIDER: %v", err)
+		}
+		secrets = provider
+	} else if cfg.TLSCertSecret != "" || cfg.HostKeySecret != "" {
+		log.Fatalf("TLS_CERT_SECRET, TLS_KEY_SECRET and HOST_KEY_SECRET require SECRETS_PROVIDER")
+	}
 
-	select {
-	case sig := <-sigCh:
-		log.Printf("Received signal %v, shutting down...", sig)
-	case err := <-serverErr:
-		log.Printf("Fatal error: %v, shutting down...", err)
+	// Certificates are picked by SNI from a store fed by ACME DNS-01 (one
+	// wildcard per serving domain) or the certificate files, plus CERTS_DIR
+	certStore := certs.NewStore()
+	srv, err := tunnl.NewServer(tunnl.Options{Config: cfg, GetCertificate: certStore.GetCertificate})
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
-	defer cancel()
+	var secretWatchers []*certs.SecretWatcher
+	if cfg.HostKeySecret != "" {
+		w := certs.NewSecretWatcher(secrets, func(values [][]byte) error {
+			return srv.Core().SetHostKey(values[0])
+		}, cfg.HostKeySecret)
+		if err := w.Load(); err != nil {
+			log.Fatalf("Failed to load host key from %s: %v", cfg.SecretsProvider, err)
+		}
+		secretWatchers = append(secretWatchers, w)
+	}
 
-	// Shutdown HTTP servers gracefully
-	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Printf("HTTP server shutdown error: %v", err)
+	var certManagers []*certs.Manager
+	var certFiles []certs.KeyPair
+	if cfg.DNSProvider != "" {
+		provider, err := certs.NewDNSProvider(cfg.DNSProvider, os.Getenv)
+		if err != nil {
+			log.Fatalf("Invalid DNS_PROVIDER: %v", err)
+		}
+		// Servers sharing a storage share the ACME account and certificates
+		var cache storage.Storage = storage.NewDir(cfg.ACMECacheDir)
+		if cfg.StorageURL != "" {
+			shared, err := storage.Open(cfg.StorageURL, os.Getenv)
+			if err != nil {
+				log.Fatalf("Invalid STORAGE_URL: %v", err)
+			}
+			cache = storage.WithPrefix(shared, "acme/")
+		}
+		for _, domain := range srv.Core().Domains() {
+			m := certs.NewManager(domain, cfg.ACMEEmail, cfg.ACMEDirectory, cache, provider, certStore)
+			if err := m.Start(); err != nil {
+				log.Fatalf("Failed to obtain certificate for %s: %v", domain, err)
+			}
+			certManagers = append(certManagers, m)
+		}
+	} else if cfg.TLSCertSecret != "" {
+		w := certs.NewSecretWatcher(secrets, func(values [][]byte) error {
+			cert, err := tls.X509KeyPair(values[0], values[1])
+			if err != nil {
+				return err
+			}
+			return certStore.Set("secret:"+cfg.TLSCertSecret, &cert)
+		}, cfg.TLSCertSecret, cfg.TLSKeySecret)
+		if err := w.Load(); err != nil {
+			log.Fatalf("Failed to load certificate from %s: %v", cfg.SecretsProvider, err)
+		}
+		secretWatchers = append(secretWatchers, w)
+	} else {
+		certFiles = append(certFiles, certs.KeyPair{CertFile: cfg.TLSCert, KeyFile: cfg.TLSKey})
 	}
-	if err := httpsServer.Shutdown(ctx); err != nil {
-		log.Printf("HTTPS server shutdown error: %v", err)
+	for _, w := range secretWatchers {
+		w.Start()
 	}
-	if err := statsServer.Shutdown(ctx); err != nil {
-		log.Printf("Stats server shutdown error: %v", err)
+	certWatcher := certs.NewWatcher(certStore, cfg.CertsDir, certFiles...)
+	if err := certWatcher.Load(); err != nil {
+		log.Fatalf("Failed to load certificates: %v", err)
 	}
+	certWatcher.Start()
 
-	// Signal SSH goroutine to stop, then close listener
-	close(sshShutdown)
-	sshListener.Close()
-	<-sshDone // Wait for SSH accept loop to finish
+	// Serve until a shutdown signal or a fatal server error
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	runErr := srv.Run(ctx)
 
-	srv.Stop()
+	certWatcher.Stop()
+	for _, w := range secretWatchers {
+		w.Stop()
+	}
+	for _, m := range certManagers {
+		m.Stop()
+	}
+	if runErr != nil {
+		log.Fatalf("Server stopped: %v", runErr)
+	}
 	log.Println("Shutdown complete")
 }
+
+// splitList splits a comma-separated environment value, dropping empty items
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,267 @@
+package e2e
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestTunnel_HTTPS(t *testing.T) {
+	h := newHarness(t)
+	c := h.connect("tunnl", "", forward{80, echoBackend(t, "app")})
+
+	if !strings.HasSuffix(c.Host(), "."+config.Default().Domain) {
+		t.Fatalf("URL = %q, want a subdomain of %s", c.URL, config.Default().Domain)
+	}
+	resp, body := h.get(c.URL + "/hello?x=1")
+	if resp.StatusCode != http.StatusOK || body != "app GET /hello" {
+		t.Errorf("GET = %d %q, want 200 %q", resp.StatusCode, body, "app GET /hello")
+	}
+	if resp.Header.Get("X-Frame-Options") == "" {
+		t.Error("response lacks the security headers")
+	}
+
+	// Unknown subdomains are not routed anywhere, and malformed ones rejected
+	resp, _ = h.get("https://happy-tiger-a1b2c3d4." + config.Default().Domain + "/")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown subdomain: status %d, want 404", resp.StatusCode)
+	}
+	resp, _ = h.get("https://no-such-tunnel." + config.Default().Domain + "/")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed subdomain: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestTunnel_SSHOnHTTPSPort(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) { cfg.SSHOnHTTPSPort = true })
+	h.sshAddr = h.srv.HTTPSAddr().String()
+	c := h.connect("tunnl", "", forward{80, echoBackend(t, "app")})
+
+	// Visitors share the port with the client
+	resp, body := h.get(c.URL + "/")
+	if resp.StatusCode != http.StatusOK || body != "app GET /" {
+		t.Errorf("GET = %d %q, want 200 %q", resp.StatusCode, body, "app GET /")
+	}
+}
+
+func TestTunnel_RoutesAndServices(t *testing.T) {
+	h := newHarness(t)
+	c := h.connect("tunnl", "route=/api:8080 service=admin:9090",
+		forward{80, echoBackend(t, "web")},
+		forward{8080, echoBackend(t, "api")},
+		forward{9090, echoBackend(t, "admin")},
+	)
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{c.URL + "/", "web GET /"},
+		{c.URL + "/apiary", "web GET /apiary"},
+		{c.URL + "/api", "api GET /"},
+		{c.URL + "/api/users", "api GET /users"},
+		{"https://admin--" + c.Host() + "/users", "admin GET /users"},
+	}
+	for _, tt := range tests {
+		resp, body := h.get(tt.url)
+		if resp.StatusCode != http.StatusOK || body != tt.want {
+			t.Errorf("GET %s = %d %q, want 200 %q", tt.url, resp.StatusCode, body, tt.want)
+		}
+	}
+
+	resp, _ := h.get("https://billing--" + c.Host() + "/")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown service: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestTunnel_WebSocket(t *testing.T) {
+	h := newHarness(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, buf)
+	}))
+	defer backend.Close()
+	c := h.connect("tunnl", "", forward{80, backend})
+
+	conn, err := tls.Dial("tcp", h.srv.HTTPSAddr().String(), &tls.Config{ServerName: c.Host(), InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: "+c.Host()+"\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("reading the upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade status %d, want 101", resp.StatusCode)
+	}
+
+	io.WriteString(conn, "ping")
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(r, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("echo = %q (%v), want %q", echo, err, "ping")
+	}
+}
+
+func TestTunnel_Interstitial(t *testing.T) {
+	h := newHarness(t)
+	c := h.connect("tunnl", "", forward{80, echoBackend(t, "app")})
+	browser := func(method, target string, body io.Reader) *http.Request {
+		req, _ := http.NewRequest(method, target, body)
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:89.0) Gecko/20100101 Firefox/89.0")
+		return req
+	}
+
+	// Browsers see the warning instead of the app
+	resp, body := h.do(browser("GET", c.URL+"/page", nil))
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, "app GET") || !strings.Contains(body, config.WarningPath) {
+		t.Fatalf("first visit = %d %q, want the warning page", resp.StatusCode, body)
+	}
+
+	// Other clients go straight through
+	if _, body := h.get(c.URL + "/page"); body != "app GET /page" {
+		t.Errorf("non-browser visit = %q, want the app", body)
+	}
+
+	// Continuing sets a cookie and sends the browser back to its page
+	form := url.Values{"next": {"/page"}}
+	req := browser("POST", c.URL+config.WarningPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, _ = h.do(req)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/page" {
+		t.Fatalf("continue = %d to %q, want 303 to /page", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if _, body := h.do(browser("GET", c.URL+"/page", nil)); body != "app GET /page" {
+		t.Errorf("visit after continuing = %q, want the app", body)
+	}
+
+	// The cookie belongs to the visitor who continued
+	if _, body := h.doAs(h.newVisitor(), browser("GET", c.URL+"/page", nil)); strings.Contains(body, "app GET") {
+		t.Error("another browser skipped the warning")
+	}
+}
+
+func TestTunnel_BasicAuth(t *testing.T) {
+	h := newHarness(t)
+	c := h.connect("tunnl", "auth=alice:s3cret", forward{80, echoBackend(t, "app")})
+
+	resp, _ := h.get(c.URL + "/")
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("without credentials: status %d, want 401 with a challenge", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", c.URL+"/", nil)
+	req.SetBasicAuth("alice", "s3cret")
+	if resp, body := h.do(req); resp.StatusCode != http.StatusOK || body != "app GET /" {
+		t.Errorf("with credentials = %d %q, want 200 from the app", resp.StatusCode, body)
+	}
+}
+
+func TestTunnel_RateLimit(t *testing.T) {
+	h := newHarness(t)
+	c := h.connect("tunnl", "rate=1", forward{80, echoBackend(t, "app")})
+
+	// More requests at once than the burst and the queue hold
+	n := config.RequestQueueSize + 10
+	resps := make(chan *http.Response, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := h.get(c.URL + "/")
+			resps <- resp
+		}()
+	}
+	wg.Wait()
+	close(resps)
+
+	counts := make(map[int]int)
+	for resp := range resps {
+		counts[resp.StatusCode]++
+		// Rejections say when to come back
+		if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Error("429 without Retry-After")
+		}
+	}
+	if counts[http.StatusOK] == 0 || counts[http.StatusTooManyRequests] == 0 || len(counts) != 2 {
+		t.Errorf("statuses = %v, want some 200 and some 429", counts)
+	}
+}
+
+func TestTunnel_QueueOption(t *testing.T) {
+	h := newHarness(t)
+	c := h.connect("tunnl", "rate=1 queue=0", forward{80, echoBackend(t, "app")})
+
+	// Nothing waits for a token: past the burst of two, requests fail at once
+	h.get(c.URL + "/")
+	h.get(c.URL + "/")
+	if resp, _ := h.get(c.URL + "/"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("request past the burst: status %d, want 429", resp.StatusCode)
+	}
+
+	// Twice the burst at once: the last requests wait about two seconds for
+	// their tokens, longer than the default queue timeout
+	c = h.connect("tunnl", "rate=2 queue=5", forward{80, echoBackend(t, "app")})
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for range cap(codes) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := h.get(c.URL + "/")
+			codes <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("queued request: status %d, want 200", code)
+		}
+	}
+}
+
+func TestTunnel_RejectedOptions(t *testing.T) {
+	h := newHarness(t)
+	_, err := h.dial("tunnl", "rate=fast", forward{80, echoBackend(t, "app")})
+	if err == nil || !strings.Contains(err.Error(), "invalid tunnel options") {
+		t.Errorf("dial = %v, want the options error", err)
+	}
+}
+
+func TestTunnel_RequestLog(t *testing.T) {
+	h := newHarness(t)
+	c := h.connect("tunnl", "", forward{80, echoBackend(t, "app")})
+
+	h.get(c.URL + "/logged")
+	waitFor(t, func() bool { return strings.Contains(c.Output(), "/logged") }, "the request in the session log")
+}
+
+func TestTunnel_EndsWithClient(t *testing.T) {
+	h := newHarness(t)
+	c := h.connect("tunnl", "", forward{80, echoBackend(t, "app")})
+	c.conn.Close()
+
+	waitFor(t, func() bool {
+		resp, _ := h.get(c.URL + "/")
+		return resp.StatusCode == http.StatusNotFound
+	}, "the tunnel to be removed")
+}
@@ -0,0 +1,302 @@
+// Package e2e runs a whole tunnl server in-process and drives it the way
+// real clients and visitors do: over SSH with golang.org/x/crypto/ssh, and
+// over HTTPS to the tunnel hostnames.
+package e2e
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnl"
+)
+
+// harness is a tunnl server listening on local ports, and a visitor that
+// reaches every tunnel hostname at its HTTPS listener
+type harness struct {
+	t       *testing.T
+	srv     *tunnl.Server
+	visitor *http.Client
+	sshAddr string // where clients connect, the SSH listener by default
+}
+
+// newHarness starts a server with the default configuration, changed by
+// configure if given, and stops it when the test ends
+func newHarness(t *testing.T, configure ...func(*config.Config)) *harness {
+	t.Helper()
+	cfg := config.Default()
+	cfg.HostKeyPath = t.TempDir() + "/host_key"
+	cfg.SSHAddr = "127.0.0.1:0"
+	cfg.HTTPSAddr = "127.0.0.1:0"
+	cfg.HTTPAddr = ""
+	cfg.StatsAddr = "127.0.0.1:0"
+	for _, f := range configure {
+		f(cfg)
+	}
+
+	cert := selfSignedCert(t)
+	srv, err := tunnl.NewServer(tunnl.Options{
+		Config:         cfg,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil },
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+
+	h := &harness{t: t, srv: srv, sshAddr: srv.SSHAddr().String()}
+	h.visitor = h.newVisitor()
+	return h
+}
+
+// newVisitor returns an HTTP client with its own cookies that connects to
+// the server's HTTPS listener whatever the URL's host, and does not follow
+// redirects
+func (h *harness) newVisitor() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	httpsAddr := h.srv.HTTPSAddr().String()
+	return &http.Client{
+		Jar: jar,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, httpsAddr)
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		Timeout:       10 * time.Second,
+	}
+}
+
+// selfSignedCert returns a certificate the visitor accepts without checking
+func selfSignedCert(t *testing.T) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// forward is a remote port a client forwards, like -R <port>:<backend>
+type forward struct {
+	port    uint32
+	backend *httptest.Server
+}
+
+// sshClient is a client connected over SSH whose forwards relay to
+// httptest backends
+type sshClient struct {
+	URL  string // public URL from the banner
+	conn *ssh.Client
+
+	mu     sync.Mutex
+	output strings.Builder // session output after the banner
+}
+
+// ansiEscape matches the color codes of the session output
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// connect dials the SSH server as user, forwards the ports, the first of
+// which is the tunnel's, and starts a session with the tunnel options. It
+// fails the test unless the banner shows a public URL.
+func (h *harness) connect(user, options string, forwards ...forward) *sshClient {
+	h.t.Helper()
+	c, err := h.dial(user, options, forwards...)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return c
+}
+
+// dial is connect, returning what went wrong instead of failing the test
+func (h *harness) dial(user, options string, forwards ...forward) (*sshClient, error) {
+	conn, err := ssh.Dial("tcp", h.sshAddr, &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ssh dial: %w", err)
+	}
+	h.t.Cleanup(func() { conn.Close() })
+
+	for _, f := range forwards {
+		ln, err := conn.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", f.port))
+		if err != nil {
+			return nil, fmt.Errorf("forward %d: %w", f.port, err)
+		}
+		go relay(ln, f.backend.Listener.Addr().String())
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+	// The server ends the session when its input ends
+	stdin, _ := io.Pipe()
+	session.Stdin = stdin
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if options != "" {
+		err = session.Start(options)
+	} else {
+		err = session.Shell()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("start session: %w", err)
+	}
+
+	c := &sshClient{conn: conn}
+	r := bufio.NewReader(stdout)
+	var banner strings.Builder
+	for c.URL == "" {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(ansiEscape.ReplaceAllString(line, ""))
+		banner.WriteString(line + "\n")
+		if url, ok := strings.CutPrefix(line, "Public URL:"); ok {
+			c.URL = strings.TrimSpace(url)
+		} else if err != nil {
+			return nil, fmt.Errorf("session ended before the banner's URL:\n%s", banner.String())
+		}
+	}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			c.mu.Lock()
+			c.output.Write(buf[:n])
+			c.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+// Output returns what the session printed after the banner, without colors
+func (c *sshClient) Output() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ansiEscape.ReplaceAllString(c.output.String(), "")
+}
+
+// Host returns the tunnel's hostname
+func (c *sshClient) Host() string {
+	return strings.TrimPrefix(c.URL, "https://")
+}
+
+// relay copies the connections the server opens over a forward to and from
+// the backend at addr
+func relay(ln net.Listener, addr string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			backend, err := net.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer backend.Close()
+			go func() {
+				io.Copy(backend, conn)
+				backend.(*net.TCPConn).CloseWrite()
+			}()
+			io.Copy(conn, backend)
+		}()
+	}
+}
+
+// do sends req as the default visitor and returns the response with its body read
+func (h *harness) do(req *http.Request) (*http.Response, string) {
+	h.t.Helper()
+	return h.doAs(h.visitor, req)
+}
+
+// doAs sends req as the given visitor
+func (h *harness) doAs(visitor *http.Client, req *http.Request) (*http.Response, string) {
+	h.t.Helper()
+	resp, err := visitor.Do(req)
+	if err != nil {
+		h.t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatalf("reading %s: %v", req.URL, err)
+	}
+	return resp, string(body)
+}
+
+// get requests url as the default visitor, without a browser's user agent
+func (h *harness) get(url string) (*http.Response, string) {
+	h.t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return h.do(req)
+}
+
+// echoBackend answers every request with its method and path
+func echoBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", name, r.Method, r.URL.Path)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
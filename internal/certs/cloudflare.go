@@ -0,0 +1,155 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"tunnl.gg/pkg/config"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflare manages records through the Cloudflare API with a token that
+// has Zone:DNS:Edit permission
+type cloudflare struct {
+	token   string
+	zoneID  string // looked up from the record name if empty
+	baseURL string
+	client  *http.Client
+}
+
+func newCloudflare(getenv func(string) string) (*cloudflare, error) {
+	env, err := requireEnv(getenv, "CLOUDFLARE_API_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	return &cloudflare{
+		token:   env[0],
+		zoneID:  getenv("CLOUDFLARE_ZONE_ID"),
+		baseURL: cloudflareAPI,
+		client:  &http.Client{Timeout: config.DNSProviderTimeout},
+	}, nil
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+func (c *cloudflare) SetTXT(ctx context.Context, name string, values []string) error {
+	zone, err := c.zone(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		record := cloudflareRecord{Type: "TXT", Name: name, Content: v, TTL: config.DNSRecordTTL}
+		if err := c.do(ctx, http.MethodPost, "/zones/"+zone+"/dns_records", record, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cloudflare) DeleteTXT(ctx context.Context, name string, values []string) error {
+	zone, err := c.zone(ctx, name)
+	if err != nil {
+		return err
+	}
+	var records []cloudflareRecord
+	query := url.Values{"type": {"TXT"}, "name": {name}}
+	if err := c.do(ctx, http.MethodGet, "/zones/"+zone+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		// Cloudflare may return TXT content quoted
+		for _, v := range values {
+			if strings.Trim(r.Content, `"`) == v {
+				if err := c.do(ctx, http.MethodDelete, "/zones/"+zone+"/dns_records/"+r.ID, nil, nil); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// zone returns the configured zone ID, or the ID of the closest enclosing
+// zone of name in the account
+func (c *cloudflare) zone(ctx context.Context, name string) (string, error) {
+	if c.zoneID != "" {
+		return c.zoneID, nil
+	}
+	labels := strings.Split(name, ".")
+	for i := range len(labels) - 1 {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		query := url.Values{"name": {strings.Join(labels[i:], ".")}}
+		if err := c.do(ctx, http.MethodGet, "/zones?"+query.Encode(), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			c.zoneID = zones[0].ID
+			return c.zoneID, nil
+		}
+	}
+	return "", fmt.Errorf("no Cloudflare zone found for %s", name)
+}
+
+// do calls the API and decodes the result field of the response envelope into out
+func (c *cloudflare) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare %s %s: %s", method, path, resp.Status)
+	}
+	if !envelope.Success {
+		if len(envelope.Errors) > 0 {
+			return fmt.Errorf("cloudflare %s %s: %s (code %d)", method, path, envelope.Errors[0].Message, envelope.Errors[0].Code)
+		}
+		return fmt.Errorf("cloudflare %s %s: %s", method, path, resp.Status)
+	}
+	if out != nil {
+		return json.Unmarshal(envelope.Result, out)
+	}
+	return nil
+}
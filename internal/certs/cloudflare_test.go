@@ -0,0 +1,112 @@
+package certs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCloudflare serves the parts of the Cloudflare API the provider uses
+// for a single zone "example.com"
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	records map[string]cloudflareRecord
+	nextID  int
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reply := func(result any) {
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "errors": []any{}, "result": result})
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]any{"success": false, "errors": []any{map[string]any{"code": 10000, "message": "Authentication error"}}})
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/zones":
+		if r.URL.Query().Get("name") == "example.com" {
+			reply([]map[string]string{{"id": "zone1"}})
+		} else {
+			reply([]any{})
+		}
+	case r.Method == "POST" && r.URL.Path == "/zones/zone1/dns_records":
+		var rec cloudflareRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		f.nextID++
+		rec.ID = fmt.Sprint(f.nextID)
+		rec.Content = `"` + rec.Content + `"`
+		f.records[rec.ID] = rec
+		reply(rec)
+	case r.Method == "GET" && r.URL.Path == "/zones/zone1/dns_records":
+		var out []cloudflareRecord
+		for _, rec := range f.records {
+			if rec.Name == r.URL.Query().Get("name") && rec.Type == r.URL.Query().Get("type") {
+				out = append(out, rec)
+			}
+		}
+		reply(out)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/zones/zone1/dns_records/"):
+		delete(f.records, strings.TrimPrefix(r.URL.Path, "/zones/zone1/dns_records/"))
+		reply(map[string]string{})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestCloudflare(t *testing.T) {
+	fake := &fakeCloudflare{records: map[string]cloudflareRecord{
+		"keep": {ID: "keep", Type: "TXT", Name: "_acme-challenge.example.com", Content: `"unrelated"`},
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c, err := newCloudflare(func(k string) string {
+		return map[string]string{"CLOUDFLARE_API_TOKEN": "token"}[k]
+	})
+	if err != nil {
+		t.Fatalf("newCloudflare() error = %v", err)
+	}
+	c.baseURL = srv.URL
+
+	name := "_acme-challenge.example.com"
+	if err := c.SetTXT(t.Context(), name, []string{"one", "two"}); err != nil {
+		t.Fatalf("SetTXT() error = %v", err)
+	}
+	if c.zoneID != "zone1" {
+		t.Errorf("zoneID = %q, want the enclosing zone zone1", c.zoneID)
+	}
+	if len(fake.records) != 3 {
+		t.Errorf("got %d records, want 3", len(fake.records))
+	}
+
+	if err := c.DeleteTXT(t.Context(), name, []string{"one", "two"}); err != nil {
+		t.Fatalf("DeleteTXT() error = %v", err)
+	}
+	if len(fake.records) != 1 || fake.records["keep"].ID == "" {
+		t.Errorf("records = %v, want only the unrelated record left", fake.records)
+	}
+
+	c.token = "wrong"
+	if err := c.SetTXT(t.Context(), name, []string{"one"}); err == nil || !strings.Contains(err.Error(), "Authentication error") {
+		t.Errorf("SetTXT() error = %v, want the API error", err)
+	}
+}
+
+func TestCloudflare_NoZone(t *testing.T) {
+	srv := httptest.NewServer(&fakeCloudflare{records: map[string]cloudflareRecord{}})
+	defer srv.Close()
+
+	c := &cloudflare{token: "token", baseURL: srv.URL, client: srv.Client()}
+	if err := c.SetTXT(t.Context(), "_acme-challenge.other.org", []string{"one"}); err == nil {
+		t.Error("SetTXT() should fail when no zone encloses the name")
+	}
+}
@@ -0,0 +1,44 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DNSProvider publishes the TXT records that answer ACME DNS-01 challenges.
+// Names are fully qualified without a trailing dot.
+type DNSProvider interface {
+	// SetTXT adds values as TXT records of name, alongside any existing ones
+	SetTXT(ctx context.Context, name string, values []string) error
+	// DeleteTXT removes values previously added by SetTXT
+	DeleteTXT(ctx context.Context, name string, values []string) error
+}
+
+// DNSProviders lists the supported provider names
+var DNSProviders = []string{"cloudflare", "route53", "rfc2136"}
+
+// NewDNSProvider returns the named provider, configured from the environment
+// variables read through getenv
+func NewDNSProvider(name string, getenv func(string) string) (DNSProvider, error) {
+	switch name {
+	case "cloudflare":
+		return newCloudflare(getenv)
+	case "route53":
+		return newRoute53(getenv)
+	case "rfc2136":
+		return newRFC2136(getenv)
+	}
+	return nil, fmt.Errorf("unknown DNS provider %q (want one of %s)", name, strings.Join(DNSProviders, ", "))
+}
+
+// requireEnv reads the named variables, failing on the first one that is unset
+func requireEnv(getenv func(string) string, names ...string) ([]string, error) {
+	values := make([]string, len(names))
+	for i, name := range names {
+		if values[i] = getenv(name); values[i] == "" {
+			return nil, fmt.Errorf("%s must be set", name)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,26 @@
+package certs
+
+import "testing"
+
+func TestNewDNSProvider(t *testing.T) {
+	env := map[string]string{
+		"CLOUDFLARE_API_TOKEN":   "token",
+		"AWS_ACCESS_KEY_ID":      "AKID",
+		"AWS_SECRET_ACCESS_KEY":  "secret",
+		"ROUTE53_HOSTED_ZONE_ID": "Z123",
+		"RFC2136_NAMESERVER":     "ns1.example.com",
+		"RFC2136_ZONE":           "example.com",
+	}
+	getenv := func(k string) string { return env[k] }
+	for _, name := range DNSProviders {
+		if _, err := NewDNSProvider(name, getenv); err != nil {
+			t.Errorf("NewDNSProvider(%q) error = %v", name, err)
+		}
+		if _, err := NewDNSProvider(name, func(string) string { return "" }); err == nil {
+			t.Errorf("NewDNSProvider(%q) without credentials: expected error", name)
+		}
+	}
+	if _, err := NewDNSProvider("godaddy", getenv); err == nil {
+		t.Error("NewDNSProvider(godaddy): expected error")
+	}
+}
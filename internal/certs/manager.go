@@ -0,0 +1,355 @@
+// Package certs obtains and renews wildcard TLS certificates through ACME
+// DNS-01 challenges published by a pluggable DNS provider.
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"tunnl.gg/internal/storage"
+	"tunnl.gg/pkg/config"
+)
+
+// Manager keeps a certificate for a domain and its wildcard, obtaining it on
+// start and renewing it before it expires. Issued certificates and the ACME
+// account key are cached in a storage, on disk or shared by a cluster, so
+// restarts do not hit the CA.
+type Manager struct {
+	domain    string
+	email     string
+	directory string
+	cache     storage.Storage
+	provider  DNSProvider
+	store     *Store // also receives the certificate if not nil
+
+	cert atomic.Pointer[tls.Certificate]
+
+	// lookupTXT resolves TXT records while waiting for propagation
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewManager creates a manager for domain and *.domain that publishes its
+// certificate to store (which may be nil). email may be empty.
+func NewManager(domain, email, directory string, cache storage.Storage, provider DNSProvider, store *Store) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		domain:    domain,
+		email:     email,
+		directory: directory,
+		cache:     cache,
+		provider:  provider,
+		store:     store,
+		lookupTXT: net.DefaultResolver.LookupTXT,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start loads the cached certificate, obtaining a new one first if there is
+// none or it is due for renewal, then renews it in the background. It fails
+// only if no usable certificate is available.
+func (m *Manager) Start() error {
+	if err := m.load(); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Ignoring cached certificate for %s: %v", m.domain, err)
+	}
+	if m.needsRenewal(time.Now()) {
+		if err := m.renew(); err != nil {
+			if m.cert.Load() == nil {
+				return err
+			}
+			log.Printf("Certificate renewal for %s failed, serving the cached certificate: %v", m.domain, err)
+		}
+	}
+
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(config.CertCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+				if !m.needsRenewal(time.Now()) {
+					continue
+				}
+				// Another server sharing the cache may have renewed it already
+				if err := m.load(); err == nil && !m.needsRenewal(time.Now()) {
+					log.Printf("Loaded certificate for %s renewed by another server", m.domain)
+					continue
+				}
+				if err := m.renew(); err != nil {
+					log.Printf("Certificate renewal for %s failed, retrying in %v: %v", m.domain, config.CertCheckInterval, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop cancels any renewal in progress and stops the background loop
+func (m *Manager) Stop() {
+	m.cancel()
+	<-m.done
+}
+
+// GetCertificate serves the current certificate; use it as tls.Config.GetCertificate
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := m.cert.Load()
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate for %s yet", m.domain)
+	}
+	return cert, nil
+}
+
+// needsRenewal reports whether there is no certificate or it expires within CertRenewBefore
+func (m *Manager) needsRenewal(now time.Time) bool {
+	cert := m.cert.Load()
+	return cert == nil || cert.Leaf == nil || cert.Leaf.NotAfter.Sub(now) < config.CertRenewBefore
+}
+
+// renew obtains a new certificate, caches it and starts serving it
+func (m *Manager) renew() error {
+	ctx, cancel := context.WithTimeout(m.ctx, config.CertObtainTimeout)
+	defer cancel()
+
+	log.Printf("Obtaining certificate for %s and *.%s", m.domain, m.domain)
+	certPEM, keyPEM, err := m.obtain(ctx)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("issued certificate: %w", err)
+	}
+	if err := m.cache.Put(ctx, m.keyName(), keyPEM); err != nil {
+		return err
+	}
+	if err := m.cache.Put(ctx, m.certName(), certPEM); err != nil {
+		return err
+	}
+	m.setCert(&cert)
+	log.Printf("Certificate for %s issued, valid until %s", m.domain, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// load reads the cached certificate
+func (m *Manager) load() error {
+	ctx, cancel := context.WithTimeout(m.ctx, config.StorageTimeout)
+	defer cancel()
+	certPEM, err := m.cache.Get(ctx, m.certName())
+	if err != nil {
+		return err
+	}
+	keyPEM, err := m.cache.Get(ctx, m.keyName())
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if err := cert.Leaf.VerifyHostname("*." + m.domain); err != nil {
+		return err
+	}
+	m.setCert(&cert)
+	return nil
+}
+
+func (m *Manager) setCert(cert *tls.Certificate) {
+	m.cert.Store(cert)
+	if m.store != nil {
+		m.store.Set("acme:"+m.domain, cert)
+	}
+}
+
+func (m *Manager) certName() string { return m.domain + ".crt" }
+func (m *Manager) keyName() string  { return m.domain + ".key" }
+
+// obtain runs an ACME order for the domain and its wildcard, answering the
+// DNS-01 challenges through the provider. It returns the PEM chain and key.
+func (m *Manager) obtain(ctx context.Context) (certPEM, keyPEM []byte, err error) {
+	accountKey, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: m.directory, UserAgent: "tunnl.gg"}
+
+	account := &acme.Account{}
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, nil, fmt.Errorf("registering ACME account: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.domain, "*."+m.domain))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating order: %w", err)
+	}
+
+	// The domain and its wildcard are validated through the same record name,
+	// so all values are collected before anything is published
+	records := make(map[string][]string)
+	var pending []*acme.Authorization
+	var challenges []*acme.Challenge
+	for _, u := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fetching authorization: %w", err)
+		}
+		if authz.Status != acme.StatusPending {
+			continue
+		}
+		i := slices.IndexFunc(authz.Challenges, func(c *acme.Challenge) bool { return c.Type == "dns-01" })
+		if i < 0 {
+			return nil, nil, fmt.Errorf("CA offered no dns-01 challenge for %s", authz.Identifier.Value)
+		}
+		value, err := client.DNS01ChallengeRecord(authz.Challenges[i].Token)
+		if err != nil {
+			return nil, nil, err
+		}
+		name := "_acme-challenge." + authz.Identifier.Value
+		records[name] = append(records[name], value)
+		pending = append(pending, authz)
+		challenges = append(challenges, authz.Challenges[i])
+	}
+
+	for name, values := range records {
+		if err := m.provider.SetTXT(ctx, name, values); err != nil {
+			return nil, nil, fmt.Errorf("publishing %s: %w", name, err)
+		}
+		defer func() {
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), config.DNSProviderTimeout)
+			defer cancel()
+			if err := m.provider.DeleteTXT(cleanupCtx, name, values); err != nil {
+				log.Printf("Failed to remove challenge record %s: %v", name, err)
+			}
+		}()
+	}
+	for name, values := range records {
+		if err := m.waitForTXT(ctx, name, values); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for i, chal := range challenges {
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return nil, nil, fmt.Errorf("accepting challenge for %s: %w", pending[i].Identifier.Value, err)
+		}
+		if _, err := client.WaitAuthorization(ctx, pending[i].URI); err != nil {
+			return nil, nil, fmt.Errorf("validating %s: %w", pending[i].Identifier.Value, err)
+		}
+	}
+
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, fmt.Errorf("waiting for order: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.domain},
+		DNSNames: []string{m.domain, "*." + m.domain},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("finalizing order: %w", err)
+	}
+
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// waitForTXT polls DNS until name has all values or DNSPropagationTimeout passes
+func (m *Manager) waitForTXT(ctx context.Context, name string, values []string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.DNSPropagationTimeout)
+	defer cancel()
+	for {
+		found, err := m.lookupTXT(ctx, name)
+		if err == nil && containsAll(found, values) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("TXT records for %s not visible after %v", name, config.DNSPropagationTimeout)
+		case <-time.After(config.DNSPropagationInterval):
+		}
+	}
+}
+
+func containsAll(have, want []string) bool {
+	for _, v := range want {
+		if !slices.Contains(have, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// accountKey loads the ACME account key, creating it on first use
+func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := m.cache.Get(ctx, "account.key")
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("account.key: no PEM data")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cache.Put(ctx, "account.key", keyPEM); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
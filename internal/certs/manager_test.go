@@ -0,0 +1,121 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"tunnl.gg/internal/storage"
+)
+
+// newTestCert returns a self-signed certificate for names and its key, PEM encoded
+func newTestCert(t *testing.T, notAfter time.Time, names ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: names[0]}}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM
+}
+
+// writeTestCert caches a self-signed certificate for names in m's cache
+func writeTestCert(t *testing.T, m *Manager, notAfter time.Time, names ...string) {
+	t.Helper()
+	certPEM, keyPEM := newTestCert(t, notAfter, names...)
+	if err := m.cache.Put(t.Context(), m.certName(), certPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.cache.Put(t.Context(), m.keyName(), keyPEM); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManager_Load(t *testing.T) {
+	m := NewManager("example.com", "", "", storage.NewDir(t.TempDir()), nil, nil)
+
+	if _, err := m.GetCertificate(nil); err == nil {
+		t.Error("GetCertificate() should fail before a certificate is loaded")
+	}
+	if !m.needsRenewal(time.Now()) {
+		t.Error("needsRenewal() = false without a certificate, want true")
+	}
+
+	notAfter := time.Now().Add(60 * 24 * time.Hour)
+	writeTestCert(t, m, notAfter, "example.com", "*.example.com")
+	if err := m.load(); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if cert, err := m.GetCertificate(nil); err != nil || cert.Leaf.NotAfter.Unix() != notAfter.Unix() {
+		t.Errorf("GetCertificate() = %v, %v, want the cached certificate", cert, err)
+	}
+	if m.needsRenewal(time.Now()) {
+		t.Error("needsRenewal() = true with 60 days left, want false")
+	}
+	if !m.needsRenewal(time.Now().Add(31 * 24 * time.Hour)) {
+		t.Error("needsRenewal() = false with 29 days left, want true")
+	}
+}
+
+func TestManager_LoadWrongDomain(t *testing.T) {
+	m := NewManager("example.com", "", "", storage.NewDir(t.TempDir()), nil, nil)
+	writeTestCert(t, m, time.Now().Add(60*24*time.Hour), "example.com")
+	if err := m.load(); err == nil {
+		t.Error("load() should reject a certificate without the wildcard")
+	}
+}
+
+func TestManager_AccountKey(t *testing.T) {
+	m := NewManager("example.com", "", "", storage.NewDir(t.TempDir()), nil, nil)
+	first, err := m.accountKey(t.Context())
+	if err != nil {
+		t.Fatalf("accountKey() error = %v", err)
+	}
+	second, err := m.accountKey(t.Context())
+	if err != nil {
+		t.Fatalf("accountKey() error = %v", err)
+	}
+	if !first.(*ecdsa.PrivateKey).Equal(second) {
+		t.Error("accountKey() should reuse the cached key")
+	}
+}
+
+func TestManager_WaitForTXT(t *testing.T) {
+	m := NewManager("example.com", "", "", storage.NewDir(t.TempDir()), nil, nil)
+	m.lookupTXT = func(_ context.Context, name string) ([]string, error) {
+		if name != "_acme-challenge.example.com" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"one", "two", "stale"}, nil
+	}
+	if err := m.waitForTXT(t.Context(), "_acme-challenge.example.com", []string{"one", "two"}); err != nil {
+		t.Errorf("waitForTXT() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := m.waitForTXT(ctx, "_acme-challenge.example.com", []string{"three"}); err == nil {
+		t.Error("waitForTXT() should fail when the records never appear")
+	}
+}
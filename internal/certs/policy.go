@@ -0,0 +1,76 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+
+	"tunnl.gg/pkg/config"
+)
+
+// tlsVersions are the accepted TLS_MIN_VERSION values
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the accepted TLS_CURVES names
+var tlsCurves = map[string]tls.CurveID{
+	"x25519":         tls.X25519,
+	"x25519mlkem768": tls.X25519MLKEM768,
+	"p256":           tls.CurveP256,
+	"p384":           tls.CurveP384,
+	"p521":           tls.CurveP521,
+}
+
+// alpnProtocols are the protocols the HTTPS server can negotiate
+var alpnProtocols = []string{"h2", "http/1.1"}
+
+// TLSConfig builds the HTTPS server's TLS settings from the operator's
+// policy, serving certificates from store. Empty cipher suite and curve
+// lists keep Go's defaults.
+func TLSConfig(cfg *config.Config, store *Store) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[cfg.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid TLS minimum version %q (want 1.2 or 1.3)", cfg.TLSMinVersion)
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: store.GetCertificate,
+	}
+
+	if len(cfg.TLSCipherSuites) > 0 {
+		// Go does not allow choosing TLS 1.3 suites, which are all strong
+		if minVersion == tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher suites only apply to TLS 1.2 and cannot be set with TLS 1.3 only")
+		}
+		for _, name := range cfg.TLSCipherSuites {
+			i := slices.IndexFunc(tls.CipherSuites(), func(c *tls.CipherSuite) bool { return c.Name == name })
+			if i < 0 {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			suite := tls.CipherSuites()[i]
+			if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+				return nil, fmt.Errorf("cipher suite %s is TLS 1.3 only and always enabled", name)
+			}
+			tlsCfg.CipherSuites = append(tlsCfg.CipherSuites, suite.ID)
+		}
+	}
+
+	for _, name := range cfg.TLSCurves {
+		curve, ok := tlsCurves[strings.ToLower(strings.ReplaceAll(name, "-", ""))]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q (want X25519, X25519MLKEM768, P256, P384 or P521)", name)
+		}
+		tlsCfg.CurvePreferences = append(tlsCfg.CurvePreferences, curve)
+	}
+
+	for _, proto := range cfg.TLSALPN {
+		if !slices.Contains(alpnProtocols, proto) {
+			return nil, fmt.Errorf("unsupported ALPN protocol %q (want h2 or http/1.1)", proto)
+		}
+	}
+	tlsCfg.NextProtos = slices.Clone(cfg.TLSALPN)
+	return tlsCfg, nil
+}
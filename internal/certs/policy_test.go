@@ -0,0 +1,68 @@
+package certs
+
+import (
+	"crypto/tls"
+	"slices"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestTLSConfig(t *testing.T) {
+	cfg := config.Default()
+	got, err := TLSConfig(cfg, NewStore())
+	if err != nil {
+		t.Fatalf("TLSConfig(defaults) error = %v", err)
+	}
+	if got.MinVersion != tls.VersionTLS12 || got.CipherSuites != nil || got.CurvePreferences != nil ||
+		!slices.Equal(got.NextProtos, []string{"h2", "http/1.1"}) || got.GetCertificate == nil {
+		t.Errorf("TLSConfig(defaults) = %+v, want TLS 1.2+ with Go's default suites and curves", got)
+	}
+
+	cfg.TLSCipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}
+	cfg.TLSCurves = []string{"P-384", "x25519"}
+	cfg.TLSALPN = []string{"http/1.1"}
+	got, err = TLSConfig(cfg, NewStore())
+	if err != nil {
+		t.Fatalf("TLSConfig() error = %v", err)
+	}
+	if !slices.Equal(got.CipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}) {
+		t.Errorf("CipherSuites = %v, want the configured suites in order", got.CipherSuites)
+	}
+	if !slices.Equal(got.CurvePreferences, []tls.CurveID{tls.CurveP384, tls.X25519}) {
+		t.Errorf("CurvePreferences = %v, want P384, X25519", got.CurvePreferences)
+	}
+	if !slices.Equal(got.NextProtos, []string{"http/1.1"}) {
+		t.Errorf("NextProtos = %v, want http/1.1", got.NextProtos)
+	}
+
+	cfg = config.Default()
+	cfg.TLSMinVersion = "1.3"
+	if got, err = TLSConfig(cfg, NewStore()); err != nil || got.MinVersion != tls.VersionTLS13 {
+		t.Errorf("TLSConfig(1.3) = %v, %v, want TLS 1.3 only", got, err)
+	}
+}
+
+func TestTLSConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(*config.Config)
+	}{
+		{"version", func(c *config.Config) { c.TLSMinVersion = "1.0" }},
+		{"insecure suite", func(c *config.Config) { c.TLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} }},
+		{"TLS 1.3 suite", func(c *config.Config) { c.TLSCipherSuites = []string{"TLS_AES_128_GCM_SHA256"} }},
+		{"suites with 1.3 only", func(c *config.Config) {
+			c.TLSMinVersion = "1.3"
+			c.TLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}
+		}},
+		{"curve", func(c *config.Config) { c.TLSCurves = []string{"P224"} }},
+		{"alpn", func(c *config.Config) { c.TLSALPN = []string{"h3"} }},
+	}
+	for _, tt := range tests {
+		cfg := config.Default()
+		tt.set(cfg)
+		if _, err := TLSConfig(cfg, NewStore()); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
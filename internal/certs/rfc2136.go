@@ -0,0 +1,233 @@
+package certs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// DNS wire constants used by dynamic updates
+const (
+	dnsOpcodeUpdate = 5
+	dnsTypeSOA      = 6
+	dnsTypeTXT      = 16
+	dnsTypeTSIG     = 250
+	dnsClassIN      = 1
+	dnsClassNone    = 254
+	dnsClassAny     = 255
+	tsigFudge       = 300 // seconds of clock skew tolerated by the server
+)
+
+// dnsRcodes names the response codes an update can fail with
+var dnsRcodes = map[int]string{
+	1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED",
+	6: "YXDOMAIN", 7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE",
+}
+
+// tsigAlgorithms maps supported TSIG algorithm names to their hash
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256.": sha256.New,
+	"hmac-sha512.": sha512.New,
+}
+
+// rfc2136 sends DNS UPDATE messages (RFC 2136) to an authoritative server,
+// signed with TSIG (RFC 8945) when a key is configured
+type rfc2136 struct {
+	nameserver string // host:port
+	zone       string
+	keyName    string // empty = unsigned updates
+	secret     []byte
+	algorithm  string
+	now        func() time.Time
+}
+
+func newRFC2136(getenv func(string) string) (*rfc2136, error) {
+	env, err := requireEnv(getenv, "RFC2136_NAMESERVER", "RFC2136_ZONE")
+	if err != nil {
+		return nil, err
+	}
+	r := &rfc2136{
+		nameserver: env[0],
+		zone:       strings.TrimSuffix(env[1], "."),
+		algorithm:  "hmac-sha256.",
+		now:        time.Now,
+	}
+	if _, _, err := net.SplitHostPort(r.nameserver); err != nil {
+		r.nameserver = net.JoinHostPort(r.nameserver, "53")
+	}
+
+	if keyName := getenv("RFC2136_TSIG_KEY"); keyName != "" {
+		secret, err := base64.StdEncoding.DecodeString(getenv("RFC2136_TSIG_SECRET"))
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("RFC2136_TSIG_SECRET must be the base64 key secret")
+		}
+		r.keyName = strings.TrimSuffix(keyName, ".") + "."
+		r.secret = secret
+	}
+	if v := getenv("RFC2136_TSIG_ALGORITHM"); v != "" {
+		r.algorithm = strings.ToLower(strings.TrimSuffix(v, ".")) + "."
+		if tsigAlgorithms[r.algorithm] == nil {
+			return nil, fmt.Errorf("unsupported RFC2136_TSIG_ALGORITHM %q (want hmac-sha256 or hmac-sha512)", v)
+		}
+	}
+	return r, nil
+}
+
+func (r *rfc2136) SetTXT(ctx context.Context, name string, values []string) error {
+	return r.update(ctx, name, values, dnsClassIN, config.DNSRecordTTL)
+}
+
+func (r *rfc2136) DeleteTXT(ctx context.Context, name string, values []string) error {
+	// Class NONE deletes the given records from the set (RFC 2136 2.5.4)
+	return r.update(ctx, name, values, dnsClassNone, 0)
+}
+
+func (r *rfc2136) update(ctx context.Context, name string, values []string, class uint16, ttl uint32) error {
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+	msg, err := r.message(id, name, values, class, ttl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.DNSProviderTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", r.nameserver)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("rfc2136 update of %s: %w", name, err)
+		}
+		if n < 12 || binary.BigEndian.Uint16(buf) != id || buf[2]&0x80 == 0 {
+			continue // not a response to this update
+		}
+		if rcode := int(buf[3] & 0x0f); rcode != 0 {
+			text := dnsRcodes[rcode]
+			if text == "" {
+				text = fmt.Sprintf("rcode %d", rcode)
+			}
+			return fmt.Errorf("rfc2136 update of %s: %s", name, text)
+		}
+		return nil
+	}
+}
+
+// message builds an UPDATE for the zone adding (class IN) or deleting
+// (class NONE) the TXT records of name, TSIG-signed if a key is set
+func (r *rfc2136) message(id uint16, name string, values []string, class uint16, ttl uint32) ([]byte, error) {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, dnsOpcodeUpdate<<11)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // zone count
+	msg = binary.BigEndian.AppendUint16(msg, 0) // prerequisite count
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(values)))
+	msg = binary.BigEndian.AppendUint16(msg, 0) // additional count, set by sign
+
+	var err error
+	if msg, err = appendName(msg, r.zone); err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	for _, v := range values {
+		if len(v) > 255 {
+			return nil, fmt.Errorf("TXT value too long")
+		}
+		if msg, err = appendName(msg, name); err != nil {
+			return nil, err
+		}
+		msg = binary.BigEndian.AppendUint16(msg, dnsTypeTXT)
+		msg = binary.BigEndian.AppendUint16(msg, class)
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(v)+1))
+		msg = append(msg, byte(len(v)))
+		msg = append(msg, v...)
+	}
+
+	if r.keyName == "" {
+		return msg, nil
+	}
+	return r.sign(msg, id)
+}
+
+// sign appends a TSIG record computed over msg (RFC 8945 4.3)
+func (r *rfc2136) sign(msg []byte, id uint16) ([]byte, error) {
+	keyName, err := appendName(nil, r.keyName)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := appendName(nil, r.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	signed := uint64(r.now().Unix())
+	timers := []byte{byte(signed >> 40), byte(signed >> 32), byte(signed >> 24), byte(signed >> 16), byte(signed >> 8), byte(signed)}
+	timers = binary.BigEndian.AppendUint16(timers, tsigFudge)
+
+	mac := hmac.New(tsigAlgorithms[r.algorithm], r.secret)
+	mac.Write(msg)
+	mac.Write(keyName)
+	mac.Write([]byte{0, dnsClassAny, 0, 0, 0, 0}) // class, TTL
+	mac.Write(algorithm)
+	mac.Write(timers)
+	mac.Write([]byte{0, 0, 0, 0}) // error, other length
+	sum := mac.Sum(nil)
+
+	rdata := append(algorithm, timers...)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = binary.BigEndian.AppendUint16(rdata, id)
+	rdata = append(rdata, 0, 0, 0, 0) // error, other length
+
+	msg = append(msg, keyName...)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeTSIG)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassAny)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	msg = append(msg, rdata...)
+	binary.BigEndian.PutUint16(msg[10:], 1) // additional count
+	return msg, nil
+}
+
+// appendName appends name in uncompressed wire format, lowercased as TSIG
+// requires for key and algorithm names
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("invalid DNS name %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
@@ -0,0 +1,140 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveDNSUpdates answers each UPDATE received on a UDP socket with rcode and
+// passes the request to the returned channel
+func serveDNSUpdates(t *testing.T, rcode byte) (string, <-chan []byte) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	msgs := make(chan []byte, 4)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg := append([]byte(nil), buf[:n]...)
+			msgs <- msg
+			resp := []byte{msg[0], msg[1], 0x80 | dnsOpcodeUpdate<<3, rcode, 0, 0, 0, 0, 0, 0, 0, 0}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), msgs
+}
+
+func TestRFC2136(t *testing.T) {
+	addr, msgs := serveDNSUpdates(t, 0)
+	env := map[string]string{
+		"RFC2136_NAMESERVER":  addr,
+		"RFC2136_ZONE":        "example.com.",
+		"RFC2136_TSIG_KEY":    "acme-key",
+		"RFC2136_TSIG_SECRET": "c2VjcmV0",
+	}
+	r, err := newRFC2136(func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("newRFC2136() error = %v", err)
+	}
+	signedAt := time.Unix(1700000000, 0)
+	r.now = func() time.Time { return signedAt }
+
+	if err := r.SetTXT(t.Context(), "_acme-challenge.example.com", []string{"one", "two"}); err != nil {
+		t.Fatalf("SetTXT() error = %v", err)
+	}
+	msg := <-msgs
+
+	if op := binary.BigEndian.Uint16(msg[2:]) >> 11; op != dnsOpcodeUpdate {
+		t.Errorf("opcode = %d, want UPDATE", op)
+	}
+	if zones, updates, additional := binary.BigEndian.Uint16(msg[4:]), binary.BigEndian.Uint16(msg[8:]), binary.BigEndian.Uint16(msg[10:]); zones != 1 || updates != 2 || additional != 1 {
+		t.Errorf("counts = %d zone, %d update, %d additional, want 1, 2, 1", zones, updates, additional)
+	}
+
+	// The TSIG MAC covers the unsigned message followed by the TSIG variables
+	unsignedR := *r
+	unsignedR.keyName = ""
+	unsigned, err := unsignedR.message(binary.BigEndian.Uint16(msg), "_acme-challenge.example.com", []string{"one", "two"}, dnsClassIN, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[12:len(unsigned)], unsigned[12:]) {
+		t.Fatal("signed message should start with the unsigned update")
+	}
+	keyName := []byte("\x08acme-key\x00")
+	algorithm := []byte("\x0bhmac-sha256\x00")
+	timers := []byte{0, 0, 0x65, 0x53, 0xf1, 0x00, 0x01, 0x2c} // 1700000000, fudge 300
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(unsigned)
+	mac.Write(keyName)
+	mac.Write([]byte{0, 255, 0, 0, 0, 0})
+	mac.Write(algorithm)
+	mac.Write(timers)
+	mac.Write([]byte{0, 0, 0, 0})
+	want := mac.Sum(nil)
+
+	tsig := msg[len(unsigned):]
+	rdata := tsig[len(keyName)+10:]
+	if !bytes.HasPrefix(tsig, keyName) || binary.BigEndian.Uint16(tsig[len(keyName):]) != dnsTypeTSIG {
+		t.Fatal("message should end with a TSIG record for the key")
+	}
+	if !bytes.HasPrefix(rdata, append(algorithm, timers...)) {
+		t.Error("TSIG record should carry the algorithm and signing time")
+	}
+	macStart := len(algorithm) + len(timers) + 2
+	if got := rdata[macStart : macStart+len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("TSIG MAC = %x, want %x", got, want)
+	}
+
+	if err := r.DeleteTXT(t.Context(), "_acme-challenge.example.com", []string{"one"}); err != nil {
+		t.Fatalf("DeleteTXT() error = %v", err)
+	}
+	msg = <-msgs
+	// Update record after the 12-byte header and the zone section
+	rr := msg[12+len("\x07example\x03com\x00")+4+len("\x0f_acme-challenge\x07example\x03com\x00"):]
+	if class := binary.BigEndian.Uint16(rr[2:]); class != dnsClassNone {
+		t.Errorf("delete class = %d, want NONE", class)
+	}
+}
+
+func TestRFC2136_Refused(t *testing.T) {
+	addr, _ := serveDNSUpdates(t, 5)
+	r, err := newRFC2136(func(k string) string {
+		return map[string]string{"RFC2136_NAMESERVER": addr, "RFC2136_ZONE": "example.com"}[k]
+	})
+	if err != nil {
+		t.Fatalf("newRFC2136() error = %v", err)
+	}
+	err = r.SetTXT(t.Context(), "_acme-challenge.example.com", []string{"one"})
+	if err == nil || err.Error() != "rfc2136 update of _acme-challenge.example.com: REFUSED" {
+		t.Errorf("SetTXT() error = %v, want REFUSED", err)
+	}
+}
+
+func TestNewRFC2136_Errors(t *testing.T) {
+	tests := []map[string]string{
+		{"RFC2136_ZONE": "example.com"},
+		{"RFC2136_NAMESERVER": "ns1.example.com"},
+		{"RFC2136_NAMESERVER": "ns1.example.com", "RFC2136_ZONE": "example.com", "RFC2136_TSIG_KEY": "k", "RFC2136_TSIG_SECRET": "not base64!"},
+		{"RFC2136_NAMESERVER": "ns1.example.com", "RFC2136_ZONE": "example.com", "RFC2136_TSIG_ALGORITHM": "hmac-md5"},
+	}
+	for _, env := range tests {
+		if _, err := newRFC2136(func(k string) string { return env[k] }); err == nil {
+			t.Errorf("newRFC2136(%v): expected error", env)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"tunnl.gg/internal/awsv4"
+	"tunnl.gg/pkg/config"
+)
+
+const route53API = "https://route53.amazonaws.com"
+
+// route53 manages records in one Route 53 hosted zone, signing requests with
+// AWS Signature Version 4
+type route53 struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	zoneID       string
+	baseURL      string
+	client       *http.Client
+	now          func() time.Time
+}
+
+func newRoute53(getenv func(string) string) (*route53, error) {
+	env, err := requireEnv(getenv, "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "ROUTE53_HOSTED_ZONE_ID")
+	if err != nil {
+		return nil, err
+	}
+	return &route53{
+		accessKey:    env[0],
+		secretKey:    env[1],
+		sessionToken: getenv("AWS_SESSION_TOKEN"),
+		zoneID:       strings.TrimPrefix(env[2], "/hostedzone/"),
+		baseURL:      route53API,
+		client:       &http.Client{Timeout: config.DNSProviderTimeout},
+		now:          time.Now,
+	}, nil
+}
+
+type route53Change struct {
+	XMLName xml.Name `xml:"ChangeResourceRecordSetsRequest"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Values  []string `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+// SetTXT replaces the record set of name. Route 53 keeps one set per name and
+// type, so the challenge values are written together.
+func (r *route53) SetTXT(ctx context.Context, name string, values []string) error {
+	return r.change(ctx, "UPSERT", name, values)
+}
+
+// DeleteTXT deletes the record set written by SetTXT
+func (r *route53) DeleteTXT(ctx context.Context, name string, values []string) error {
+	return r.change(ctx, "DELETE", name, values)
+}
+
+func (r *route53) change(ctx context.Context, action, name string, values []string) error {
+	change := route53Change{
+		Xmlns:  "https://route53.amazonaws.com/doc/2013-04-01/",
+		Action: action,
+		Name:   name + ".",
+		Type:   "TXT",
+		TTL:    config.DNSRecordTTL,
+	}
+	for _, v := range values {
+		change.Values = append(change.Values, `"`+v+`"`)
+	}
+	body, err := xml.Marshal(change)
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.baseURL+"/2013-04-01/hostedzone/"+r.zoneID+"/rrset", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	if r.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", r.sessionToken)
+	}
+	awsv4.Sign(req, body, r.accessKey, r.secretKey, "us-east-1", "route53", r.now())
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var apiErr struct {
+		Code    string `xml:"Error>Code"`
+		Message string `xml:"Error>Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+		return fmt.Errorf("route53 %s %s: %s: %s", action, name, apiErr.Code, apiErr.Message)
+	}
+	return fmt.Errorf("route53 %s %s: %s", action, name, resp.Status)
+}
@@ -0,0 +1,69 @@
+package certs
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRoute53(t *testing.T) {
+	var got route53Change
+	var path, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = route53Change{}
+		path, auth = r.URL.Path, r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &got); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+		if got.Name == "_acme-challenge.denied.example.com." {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>not allowed</Message></Error></ErrorResponse>`)
+			return
+		}
+		io.WriteString(w, `<ChangeResourceRecordSetsResponse><ChangeInfo><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`)
+	}))
+	defer srv.Close()
+
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":      "AKID",
+		"AWS_SECRET_ACCESS_KEY":  "secret",
+		"ROUTE53_HOSTED_ZONE_ID": "/hostedzone/Z123",
+	}
+	r, err := newRoute53(func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("newRoute53() error = %v", err)
+	}
+	r.baseURL = srv.URL
+
+	values := []string{"one", "two"}
+	if err := r.SetTXT(t.Context(), "_acme-challenge.example.com", values); err != nil {
+		t.Fatalf("SetTXT() error = %v", err)
+	}
+	if path != "/2013-04-01/hostedzone/Z123/rrset" {
+		t.Errorf("path = %q, want the rrset endpoint of zone Z123", path)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-east-1/route53/aws4_request") {
+		t.Errorf("Authorization = %q, want a route53 SigV4 signature", auth)
+	}
+	if got.Action != "UPSERT" || got.Name != "_acme-challenge.example.com." || got.Type != "TXT" ||
+		!slices.Equal(got.Values, []string{`"one"`, `"two"`}) {
+		t.Errorf("change = %+v, want an UPSERT of both quoted values", got)
+	}
+
+	if err := r.DeleteTXT(t.Context(), "_acme-challenge.example.com", values); err != nil {
+		t.Fatalf("DeleteTXT() error = %v", err)
+	}
+	if got.Action != "DELETE" || len(got.Values) != 2 {
+		t.Errorf("change = %+v, want a DELETE of both values", got)
+	}
+
+	err = r.SetTXT(t.Context(), "_acme-challenge.denied.example.com", values)
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("SetTXT() error = %v, want the API error", err)
+	}
+}
@@ -0,0 +1,289 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"tunnl.gg/internal/awsv4"
+	"tunnl.gg/pkg/config"
+)
+
+// SecretsProvider fetches key material such as PEM certificates and keys
+// from a secret manager. Names are provider paths, optionally followed by
+// "#field" to pick one field of a secret holding several.
+type SecretsProvider interface {
+	Secret(ctx context.Context, name string) ([]byte, error)
+}
+
+// SecretsProviders lists the supported provider names
+var SecretsProviders = []string{"vault", "aws"}
+
+// NewSecretsProvider returns the named provider, configured from the
+// environment variables read through getenv
+func NewSecretsProvider(name string, getenv func(string) string) (SecretsProvider, error) {
+	switch name {
+	case "vault":
+		return newVault(getenv)
+	case "aws":
+		return newSecretsManager(getenv)
+	}
+	return nil, fmt.Errorf("unknown secrets provider %q (want one of %s)", name, strings.Join(SecretsProviders, ", "))
+}
+
+// splitSecretName splits "path#field" into its path and field ("" if none)
+func splitSecretName(name string) (path, field string) {
+	path, field, _ = strings.Cut(name, "#")
+	return path, field
+}
+
+// vault reads secrets from a HashiCorp Vault KV engine (version 1 or 2)
+// over its HTTP API. Names are API paths below /v1/, e.g.
+// "secret/data/tunnl#tls_cert" for the tls_cert field of a KV v2 secret.
+type vault struct {
+	addr      string
+	token     string
+	namespace string // Vault Enterprise namespace, "" if none
+	client    *http.Client
+}
+
+func newVault(getenv func(string) string) (*vault, error) {
+	env, err := requireEnv(getenv, "VAULT_ADDR", "VAULT_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	return &vault{
+		addr:      strings.TrimSuffix(env[0], "/"),
+		token:     env[1],
+		namespace: getenv("VAULT_NAMESPACE"),
+		client:    &http.Client{Timeout: config.SecretsProviderTimeout},
+	}, nil
+}
+
+func (v *vault) Secret(ctx context.Context, name string) ([]byte, error) {
+	path, field := splitSecretName(name)
+	if field == "" {
+		return nil, fmt.Errorf("vault secret %q: name a field as <path>#<field>", name)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", v.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault GET %s: %s", path, resp.Status)
+	}
+
+	// KV v2 nests the fields in data.data, KV v1 has them in data
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, config.MaxSecretSize)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("vault GET %s: %w", path, err)
+	}
+	fields := body.Data
+	if nested, ok := body.Data["data"]; ok {
+		if err := json.Unmarshal(nested, &fields); err != nil {
+			return nil, fmt.Errorf("vault GET %s: %w", path, err)
+		}
+	}
+	var value string
+	if raw, ok := fields[field]; !ok || json.Unmarshal(raw, &value) != nil {
+		return nil, fmt.Errorf("vault secret %s has no string field %q", path, field)
+	}
+	return []byte(value), nil
+}
+
+// secretsManager reads secrets from AWS Secrets Manager, signing requests
+// with AWS Signature Version 4. Names are secret IDs or ARNs; "#key" picks
+// a key of a secret whose string is a JSON object.
+type secretsManager struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+	baseURL      string // "" = the regional endpoint
+	client       *http.Client
+	now          func() time.Time
+}
+
+func newSecretsManager(getenv func(string) string) (*secretsManager, error) {
+	env, err := requireEnv(getenv, "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_REGION")
+	if err != nil {
+		return nil, err
+	}
+	return &secretsManager{
+		accessKey:    env[0],
+		secretKey:    env[1],
+		sessionToken: getenv("AWS_SESSION_TOKEN"),
+		region:       env[2],
+		client:       &http.Client{Timeout: config.SecretsProviderTimeout},
+		now:          time.Now,
+	}, nil
+}
+
+func (m *secretsManager) Secret(ctx context.Context, name string) ([]byte, error) {
+	id, key := splitSecretName(name)
+	body, err := json.Marshal(struct {
+		SecretID string `json:"SecretId"`
+	}{id})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := m.baseURL
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + m.region + ".amazonaws.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if m.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", m.sessionToken)
+	}
+	awsv4.Sign(req, body, m.accessKey, m.secretKey, m.region, "secretsmanager", m.now())
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var awsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&awsErr)
+		return nil, fmt.Errorf("secretsmanager GetSecretValue %s: %s %s %s", id, resp.Status, awsErr.Type, awsErr.Message)
+	}
+
+	var out struct {
+		SecretString string `json:"SecretString"`
+		SecretBinary string `json:"SecretBinary"` // base64
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, config.MaxSecretSize)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("secretsmanager GetSecretValue %s: %w", id, err)
+	}
+	if out.SecretBinary != "" {
+		if key != "" {
+			return nil, fmt.Errorf("secret %s is binary and has no key %q", id, key)
+		}
+		return base64.StdEncoding.DecodeString(out.SecretBinary)
+	}
+	if key == "" {
+		return []byte(out.SecretString), nil
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(out.SecretString), &fields); err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object of strings: %w", id, err)
+	}
+	value, ok := fields[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no key %q", id, key)
+	}
+	return []byte(value), nil
+}
+
+// SecretWatcher fetches a set of secrets and hands them to apply, then
+// fetches them again every SecretRefreshInterval and applies them whenever
+// one has changed, so rotated material is picked up without a restart
+type SecretWatcher struct {
+	provider SecretsProvider
+	names    []string
+	apply    func(values [][]byte) error
+	last     [sha256.Size]byte // hash of the values last applied
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewSecretWatcher creates a watcher for the named secrets; apply receives
+// their values in the same order
+func NewSecretWatcher(provider SecretsProvider, apply func(values [][]byte) error, names ...string) *SecretWatcher {
+	return &SecretWatcher{
+		provider: provider,
+		names:    names,
+		apply:    apply,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Load fetches and applies the secrets once
+func (w *SecretWatcher) Load() error {
+	_, err := w.refresh()
+	return err
+}
+
+// Start refreshes the secrets periodically
+func (w *SecretWatcher) Start() {
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(config.SecretRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				changed, err := w.refresh()
+				if err != nil {
+					log.Printf("Failed to refresh secrets %s, keeping the current ones: %v", strings.Join(w.names, ", "), err)
+				} else if changed {
+					log.Printf("Applied rotated secrets %s", strings.Join(w.names, ", "))
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing
+func (w *SecretWatcher) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+// refresh fetches the secrets and applies them if they changed since the
+// last successful apply
+func (w *SecretWatcher) refresh() (changed bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.SecretsProviderTimeout)
+	defer cancel()
+	values := make([][]byte, len(w.names))
+	h := sha256.New()
+	for i, name := range w.names {
+		if values[i], err = w.provider.Secret(ctx, name); err != nil {
+			return false, fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Fprintf(h, "%d:", len(values[i]))
+		h.Write(values[i])
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	if sum == w.last {
+		return false, nil
+	}
+	if err := w.apply(values); err != nil {
+		return false, err
+	}
+	w.last = sum
+	return true, nil
+}
@@ -0,0 +1,134 @@
+package certs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVault(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/tunnl": // KV v2
+			io.WriteString(w, `{"data": {"data": {"tls_cert": "CERT"}, "metadata": {"version": 3}}}`)
+		case "/v1/kv/tunnl": // KV v1
+			io.WriteString(w, `{"data": {"host_key": "KEY"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	env := map[string]string{"VAULT_ADDR": srv.URL + "/", "VAULT_TOKEN": "s.token"}
+	p, err := NewSecretsProvider("vault", func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("NewSecretsProvider() error = %v", err)
+	}
+
+	ctx := context.Background()
+	if got, err := p.Secret(ctx, "secret/data/tunnl#tls_cert"); err != nil || string(got) != "CERT" {
+		t.Errorf("KV v2 secret = %q, %v, want CERT", got, err)
+	}
+	if got, err := p.Secret(ctx, "kv/tunnl#host_key"); err != nil || string(got) != "KEY" {
+		t.Errorf("KV v1 secret = %q, %v, want KEY", got, err)
+	}
+	for _, name := range []string{"secret/data/tunnl", "secret/data/tunnl#missing", "secret/data/other#tls_cert"} {
+		if _, err := p.Secret(ctx, name); err == nil {
+			t.Errorf("Secret(%q) should fail", name)
+		}
+	}
+}
+
+func TestSecretsManager(t *testing.T) {
+	var target, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, auth = r.Header.Get("X-Amz-Target"), r.Header.Get("Authorization")
+		var req struct{ SecretId string }
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.SecretId {
+		case "tunnl/tls":
+			io.WriteString(w, `{"Name": "tunnl/tls", "SecretString": "{\"cert\": \"CERT\", \"key\": \"KEY\"}"}`)
+		case "tunnl/host-key":
+			io.WriteString(w, `{"Name": "tunnl/host-key", "SecretBinary": "SE9TVEtFWQ=="}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"__type": "ResourceNotFoundException", "message": "Secrets Manager can't find the specified secret."}`)
+		}
+	}))
+	defer srv.Close()
+
+	env := map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_REGION": "eu-west-1"}
+	m, err := newSecretsManager(func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("newSecretsManager() error = %v", err)
+	}
+	m.baseURL = srv.URL
+
+	ctx := context.Background()
+	if got, err := m.Secret(ctx, "tunnl/tls#key"); err != nil || string(got) != "KEY" {
+		t.Errorf("JSON key = %q, %v, want KEY", got, err)
+	}
+	if target != "secretsmanager.GetSecretValue" || !strings.Contains(auth, "/eu-west-1/secretsmanager/aws4_request") {
+		t.Errorf("X-Amz-Target = %q, Authorization = %q", target, auth)
+	}
+	if got, err := m.Secret(ctx, "tunnl/host-key"); err != nil || string(got) != "HOSTKEY" {
+		t.Errorf("binary secret = %q, %v, want HOSTKEY", got, err)
+	}
+	if _, err := m.Secret(ctx, "tunnl/missing"); err == nil || !strings.Contains(err.Error(), "ResourceNotFoundException") {
+		t.Errorf("missing secret error = %v", err)
+	}
+}
+
+// fakeSecrets serves secrets from a map
+type fakeSecrets map[string]string
+
+func (f fakeSecrets) Secret(_ context.Context, name string) ([]byte, error) {
+	v, ok := f[name]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return []byte(v), nil
+}
+
+func TestSecretWatcher(t *testing.T) {
+	secrets := fakeSecrets{"cert": "c1", "key": "k1"}
+	var applied []string
+	w := NewSecretWatcher(secrets, func(values [][]byte) error {
+		if string(values[0]) == "bad" {
+			return errors.New("invalid certificate")
+		}
+		applied = append(applied, string(values[0])+"+"+string(values[1]))
+		return nil
+	}, "cert", "key")
+
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if changed, err := w.refresh(); changed || err != nil {
+		t.Errorf("unchanged secrets: changed = %v, err = %v", changed, err)
+	}
+	secrets["key"] = "k2"
+	if changed, err := w.refresh(); !changed || err != nil {
+		t.Errorf("rotated key: changed = %v, err = %v", changed, err)
+	}
+	secrets["cert"] = "bad"
+	if _, err := w.refresh(); err == nil {
+		t.Error("a value rejected by apply should be reported")
+	}
+	delete(secrets, "key")
+	if _, err := w.refresh(); err == nil {
+		t.Error("a missing secret should be reported")
+	}
+	if strings.Join(applied, ",") != "c1+k1,c1+k2" {
+		t.Errorf("applied = %v, want c1+k1,c1+k2", applied)
+	}
+}
@@ -0,0 +1,101 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Store selects a certificate by TLS server name. Certificates are indexed by
+// the names they cover, so wildcard, apex and custom-domain certificates can
+// coexist, and each is registered under a source (a file or ACME domain) that
+// replaces or removes it at runtime.
+type Store struct {
+	mu       sync.RWMutex
+	byName   map[string]*tls.Certificate // "tunnl.gg", "*.tunnl.gg", ...
+	sources  map[string]*tls.Certificate
+	fallback string // source served to clients that send no matching name
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{
+		byName:  make(map[string]*tls.Certificate),
+		sources: make(map[string]*tls.Certificate),
+	}
+}
+
+// Set registers cert under source, replacing the certificate the source had.
+// The first source set is also served to clients whose name matches nothing.
+func (s *Store) Set(source string, cert *tls.Certificate) error {
+	if cert.Leaf == nil {
+		return fmt.Errorf("%s: certificate has no parsed leaf", source)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources[source] = cert
+	if s.fallback == "" {
+		s.fallback = source
+	}
+	s.reindex()
+	return nil
+}
+
+// Remove drops the certificate of source
+func (s *Store) Remove(source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sources, source)
+	if s.fallback == source {
+		s.fallback = ""
+	}
+	s.reindex()
+}
+
+// Len returns the number of certificates in the store
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sources)
+}
+
+// reindex rebuilds the name index. When certificates overlap, the one
+// expiring last wins, so a renewed copy takes over from an old one.
+func (s *Store) reindex() {
+	s.byName = make(map[string]*tls.Certificate)
+	for _, cert := range s.sources {
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if cur := s.byName[name]; cur == nil || cert.Leaf.NotAfter.After(cur.Leaf.NotAfter) {
+				s.byName[name] = cert
+			}
+		}
+	}
+}
+
+// GetCertificate picks the certificate for the client's server name: an
+// exact match, then a wildcard one level up, then the fallback. Use it as
+// tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert := s.byName[name]; cert != nil {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert := s.byName["*."+parent]; cert != nil {
+			return cert, nil
+		}
+	}
+	if cert := s.sources[s.fallback]; cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
@@ -0,0 +1,79 @@
+package certs
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func loadTestCert(t *testing.T, notAfter time.Time, names ...string) *tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM := newTestCert(t, notAfter, names...)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+func TestStore_GetCertificate(t *testing.T) {
+	later := time.Now().Add(90 * 24 * time.Hour)
+	wildcard := loadTestCert(t, later, "tunnl.gg", "*.tunnl.gg")
+	dev := loadTestCert(t, later, "*.tunnl.dev")
+	custom := loadTestCert(t, later, "app.example.com")
+
+	s := NewStore()
+	if err := s.Set("acme:tunnl.gg", wildcard); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	s.Set("acme:tunnl.dev", dev)
+	s.Set("file:app.crt", custom)
+
+	tests := []struct {
+		serverName string
+		want       *tls.Certificate
+	}{
+		{"tunnl.gg", wildcard},
+		{"myapp.tunnl.gg", wildcard},
+		{"MyApp.Tunnl.GG.", wildcard},
+		{"myapp.tunnl.dev", dev},
+		{"app.example.com", custom},
+		{"other.example.com", wildcard}, // fallback: first source
+		{"", wildcard},
+	}
+	for _, tt := range tests {
+		got, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if err != nil || got != tt.want {
+			t.Errorf("GetCertificate(%q) = %v, %v, want %v", tt.serverName, got, err, tt.want)
+		}
+	}
+
+	s.Remove("file:app.crt")
+	if got, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "app.example.com"}); got == custom {
+		t.Error("removed certificate should no longer be served")
+	}
+}
+
+func TestStore_Overlap(t *testing.T) {
+	older := loadTestCert(t, time.Now().Add(10*24*time.Hour), "*.tunnl.gg")
+	newer := loadTestCert(t, time.Now().Add(90*24*time.Hour), "*.tunnl.gg")
+
+	s := NewStore()
+	s.Set("file:old.crt", older)
+	s.Set("acme:tunnl.gg", newer)
+	if got, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "myapp.tunnl.gg"}); got != newer {
+		t.Error("the certificate expiring last should win for overlapping names")
+	}
+
+	// Replacing a source's certificate drops the old one
+	s.Set("acme:tunnl.gg", older)
+	if s.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", s.Len())
+	}
+}
+
+func TestStore_Empty(t *testing.T) {
+	if _, err := NewStore().GetCertificate(&tls.ClientHelloInfo{ServerName: "tunnl.gg"}); err == nil {
+		t.Error("GetCertificate() on an empty store should fail")
+	}
+}
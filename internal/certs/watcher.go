@@ -0,0 +1,148 @@
+package certs
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// KeyPair names a certificate chain file and its private key file
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Watcher keeps a Store in sync with certificate files on disk: explicit key
+// pairs (e.g. renewed by certbot) and a directory of <name>.crt and
+// <name>.key pairs that certificates can be dropped into or removed from.
+// Changes are picked up every CertReloadInterval without a restart.
+type Watcher struct {
+	store  *Store
+	pairs  []KeyPair
+	dir    string               // "" = no directory
+	loaded map[string]time.Time // cert file -> modification time when loaded
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWatcher creates a watcher for the given pairs and, if dir is not
+// empty, the pairs found in dir
+func NewWatcher(store *Store, dir string, pairs ...KeyPair) *Watcher {
+	return &Watcher{
+		store:  store,
+		pairs:  pairs,
+		dir:    dir,
+		loaded: make(map[string]time.Time),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Load reads every certificate once. It fails if an explicit pair or the
+// directory cannot be read; broken files in the directory are skipped.
+func (w *Watcher) Load() error {
+	for _, p := range w.pairs {
+		if err := w.load(p); err != nil {
+			return err
+		}
+	}
+	return w.scanDir()
+}
+
+// Start reloads changed certificates periodically
+func (w *Watcher) Start() {
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(config.CertReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.reload()
+			}
+		}
+	}()
+}
+
+// Stop stops reloading
+func (w *Watcher) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *Watcher) reload() {
+	for _, p := range w.pairs {
+		if err := w.load(p); err != nil {
+			log.Printf("Failed to reload certificate %s, keeping the current one: %v", p.CertFile, err)
+		}
+	}
+	if err := w.scanDir(); err != nil {
+		log.Printf("Failed to scan certificate directory %s: %v", w.dir, err)
+	}
+}
+
+// load reads a pair into the store if its certificate file changed since the last load
+func (w *Watcher) load(p KeyPair) error {
+	info, err := os.Stat(p.CertFile)
+	if err != nil {
+		return err
+	}
+	if last, ok := w.loaded[p.CertFile]; ok && info.ModTime().Equal(last) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.CertFile, err)
+	}
+	if err := w.store.Set("file:"+p.CertFile, &cert); err != nil {
+		return err
+	}
+	if _, ok := w.loaded[p.CertFile]; ok {
+		log.Printf("Reloaded certificate %s for %s", p.CertFile, strings.Join(cert.Leaf.DNSNames, ", "))
+	}
+	w.loaded[p.CertFile] = info.ModTime()
+	return nil
+}
+
+// scanDir loads new and changed pairs from the directory and removes the
+// certificates of pairs that were deleted
+func (w *Watcher) scanDir() error {
+	if w.dir == "" {
+		return nil
+	}
+	matches, err := filepath.Glob(filepath.Join(w.dir, "*.crt"))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(w.dir); err != nil {
+		return err
+	}
+
+	present := make(map[string]bool, len(matches))
+	for _, certFile := range matches {
+		present[certFile] = true
+		pair := KeyPair{CertFile: certFile, KeyFile: strings.TrimSuffix(certFile, ".crt") + ".key"}
+		if err := w.load(pair); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Skipping certificate %s: %v", certFile, err)
+		}
+	}
+	for certFile := range w.loaded {
+		if filepath.Dir(certFile) == filepath.Clean(w.dir) && !present[certFile] {
+			w.store.Remove("file:" + certFile)
+			delete(w.loaded, certFile)
+			log.Printf("Removed certificate %s", certFile)
+		}
+	}
+	return nil
+}
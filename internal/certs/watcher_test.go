@@ -0,0 +1,88 @@
+package certs
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestPair(t *testing.T, dir, name string, modTime time.Time, names ...string) KeyPair {
+	t.Helper()
+	certPEM, keyPEM := newTestCert(t, time.Now().Add(90*24*time.Hour), names...)
+	pair := KeyPair{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	if err := os.WriteFile(pair.CertFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pair.KeyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(pair.CertFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func servedNames(t *testing.T, s *Store, serverName string) []string {
+	t.Helper()
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatalf("GetCertificate(%q) error = %v", serverName, err)
+	}
+	return cert.Leaf.DNSNames
+}
+
+func TestWatcher(t *testing.T) {
+	mainDir, dir := t.TempDir(), t.TempDir()
+	now := time.Now()
+	main := writeTestPair(t, mainDir, "fullchain", now, "tunnl.gg", "*.tunnl.gg")
+
+	s := NewStore()
+	w := NewWatcher(s, dir, main)
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if s.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", s.Len())
+	}
+
+	// A certificate dropped into the directory is served after a reload
+	writeTestPair(t, dir, "custom", now, "app.example.com")
+	w.reload()
+	if names := servedNames(t, s, "app.example.com"); names[0] != "app.example.com" {
+		t.Errorf("served %v for app.example.com, want the custom certificate", names)
+	}
+
+	// A renewed main certificate replaces the old one
+	writeTestPair(t, mainDir, "fullchain", now.Add(time.Minute), "tunnl.gg", "*.tunnl.gg", "*.tunnl.dev")
+	w.reload()
+	if names := servedNames(t, s, "myapp.tunnl.dev"); len(names) != 3 {
+		t.Errorf("served %v for myapp.tunnl.dev, want the renewed certificate", names)
+	}
+
+	// A certificate removed from the directory is no longer served
+	os.Remove(filepath.Join(dir, "custom.crt"))
+	w.reload()
+	if s.Len() != 1 {
+		t.Errorf("Len() = %d after removal, want 1", s.Len())
+	}
+
+	// A broken main certificate keeps the current one
+	os.WriteFile(main.CertFile, []byte("garbage"), 0o600)
+	os.Chtimes(main.CertFile, now.Add(2*time.Minute), now.Add(2*time.Minute))
+	w.reload()
+	if names := servedNames(t, s, "myapp.tunnl.gg"); len(names) != 3 {
+		t.Errorf("served %v after a failed reload, want the previous certificate", names)
+	}
+}
+
+func TestWatcher_LoadErrors(t *testing.T) {
+	missing := KeyPair{CertFile: filepath.Join(t.TempDir(), "none.crt"), KeyFile: filepath.Join(t.TempDir(), "none.key")}
+	if err := NewWatcher(NewStore(), "", missing).Load(); err == nil {
+		t.Error("Load() should fail for a missing certificate file")
+	}
+	if err := NewWatcher(NewStore(), filepath.Join(t.TempDir(), "absent")).Load(); err == nil {
+		t.Error("Load() should fail for a missing directory")
+	}
+}
@@ -1,315 +0,0 @@
-package server
-
-import (
-	"crypto/subtle"
-	"fmt"
-	"io"
-	"log"
-	"net"
-	"net/http"
-	"net/http/httputil"
-	"net/url"
-	"strings"
-	"time"
-
-	"tunnl.gg/internal/config"
-	"tunnl.gg/internal/subdomain"
-	"tunnl.gg/internal/tunnel"
-)
-
-// ServeHTTP implements http.Handler for HTTPS requests
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	setSecurityHeaders(w)
-
-	// Enforce request body size limit
-	if r.ContentLength > config.MaxRequestBodySize {
-		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
-		return
-	}
-	r.Body = http.MaxBytesReader(w, r.Body, config.MaxRequestBodySize)
-
-	host := stripPort(r.Host)
-
-	if !strings.HasSuffix(host, "."+s.domain) {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
-		return
-	}
-
-	sub := strings.TrimSuffix(host, "."+s.domain)
-
-	if !subdomain.IsValid(sub) {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
-		return
-	}
-
-	tun := s.GetTunnel(sub)
-	if tun == nil {
-		http.Error(w, "Not Found", http.StatusNotFound)
-		return
-	}
-
-	if !tun.AllowRequest() {
-		// Record violation and kill tunnel + block SSH client IP if too many violations
-		if tun.RecordRateLimitHit() {
-			log.Printf("Tunnel %s killed due to rate limit abuse, blocking SSH client %s", sub, tun.ClientIP)
-			s.BlockIP(tun.ClientIP)
-			tun.CloseSSH()
-		}
-		w.Header().Set("Retry-After", "1")
-		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-		return
-	}
-
-	tun.Touch()
-	s.IncrementRequests()
-
-	// Show interstitial warning for browser requests
-	if isBrowserRequest(r) &&
-		r.Header.Get("tunnl-skip-browser-warning") == "" &&
-		!hasWarningCookie(r, sub) {
-		s.redirectToWarningPage(w, r, sub)
-		return
-	}
-
-	if isWebSocketRequest(r) {
-		s.handleWebSocket(w, r, tun, sub)
-		return
-	}
-
-	requestStart := time.Now()
-	sw := &statusCaptureWriter{ResponseWriter: w}
-
-	proxy := &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			req.URL.Scheme = "http"
-			req.URL.Host = tun.Listener.Addr().String()
-			req.Host = r.Host
-		},
-		Transport: tun.Transport(),
-		ModifyResponse: func(resp *http.Response) error {
-			// Enforce response body size limit
-			if resp.ContentLength > config.MaxResponseBodySize {
-				return fmt.Errorf("response too large: %d bytes (max %d)", resp.ContentLength, config.MaxResponseBodySize)
-			}
-			// Wrap body with size limiter for chunked/unknown-length responses
-			resp.Body = &limitedReadCloser{
-				rc:    resp.Body,
-				limit: config.MaxResponseBodySize,
-			}
-			return nil
-		},
-		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-			log.Printf("Proxy error for %s: %v", sub, err)
-			if strings.Contains(err.Error(), "response too large") {
-				http.Error(w, "Response Too Large", http.StatusBadGateway)
-				return
-			}
-			http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		},
-	}
-
-	proxy.ServeHTTP(sw, r)
-
-	if logger := tun.Logger(); logger != nil {
-		logger.LogRequest(r.Method, r.URL.Path, sw.status, time.Since(requestStart))
-	}
-}
-
-func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel, sub string) {
-	backendConn, err := net.DialTimeout("tcp", tun.Listener.Addr().String(), 10*time.Second)
-	if err != nil {
-		log.Printf("WebSocket backend dial error for %s: %v", sub, err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return
-	}
-	defer backendConn.Close()
-
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		log.Printf("WebSocket hijack not supported for %s", sub)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	clientConn, _, err := hijacker.Hijack()
-	if err != nil {
-		// After Hijack() is called (even on failure), ResponseWriter may be invalid
-		// Just log the error and return - the connection will be closed
-		log.Printf("WebSocket hijack error for %s: %v", sub, err)
-		return
-	}
-	defer clientConn.Close()
-
-	if err := r.Write(backendConn); err != nil {
-		log.Printf("WebSocket request write error for %s: %v", sub, err)
-		return
-	}
-
-	logger := tun.Logger()
-	wsPath := r.URL.Path
-	wsStart := time.Now()
-	if logger != nil {
-		logger.LogWebSocketOpen(wsPath)
-	}
-
-	// Copy data bidirectionally with limits
-	var backendBytes, clientBytes int64
-	done := make(chan struct{})
-	go func() {
-		backendBytes, _ = copyWithLimits(backendConn, clientConn, config.MaxWebSocketTransfer, config.WebSocketIdleTimeout)
-		// Signal backend we're done sending
-		if tc, ok := backendConn.(*net.TCPConn); ok {
-			tc.CloseWrite()
-		}
-	}()
-	go func() {
-		defer close(done)
-		clientBytes, _ = copyWithLimits(clientConn, backendConn, config.MaxWebSocketTransfer, config.WebSocketIdleTimeout)
-	}()
-	<-done
-
-	if logger != nil {
-		logger.LogWebSocketClose(wsPath, time.Since(wsStart), backendBytes+clientBytes)
-	}
-}
-
-// copyWithLimits copies from src to dst with a byte transfer limit and idle timeout.
-// It resets the read deadline on src after each successful read.
-// Returns the number of bytes written and any error.
-func copyWithLimits(dst, src net.Conn, maxBytes int64, idleTimeout time.Duration) (int64, error) {
-	buf := make([]byte, 32*1024)
-	var written int64
-	for {
-		src.SetReadDeadline(time.Now().Add(idleTimeout))
-		n, readErr := src.Read(buf)
-		if n > 0 {
-			written += int64(n)
-			if written > maxBytes {
-				return written, fmt.Errorf("transfer limit exceeded")
-			}
-			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
-				return written, writeErr
-			}
-		}
-		if readErr != nil {
-			if readErr == io.EOF {
-				return written, nil
-			}
-			return written, readErr
-		}
-	}
-}
-
-func setSecurityHeaders(w http.ResponseWriter) {
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.Header().Set("X-Frame-Options", "DENY")
-	w.Header().Set("X-XSS-Protection", "1; mode=block")
-	w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
-}
-
-func isBrowserRequest(r *http.Request) bool {
-	ua := strings.ToLower(r.Header.Get("User-Agent"))
-	browserKeywords := []string{"mozilla", "chrome", "safari", "firefox", "edge", "opera"}
-	for _, kw := range browserKeywords {
-		if strings.Contains(ua, kw) {
-			return true
-		}
-	}
-	return false
-}
-
-func hasWarningCookie(r *http.Request, sub string) bool {
-	cookie, err := r.Cookie(config.WarningCookieName + "_" + sub)
-	if err != nil {
-		return false
-	}
-	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte("1")) == 1
-}
-
-func (s *Server) redirectToWarningPage(w http.ResponseWriter, r *http.Request, sub string) {
-	originalURL := "https://" + r.Host + r.URL.RequestURI()
-	fullSubdomain := sub + "." + s.domain
-	warningURL := fmt.Sprintf("https://%s/#/warning?redirect=%s&subdomain=%s",
-		s.domain,
-		url.QueryEscape(originalURL),
-		url.QueryEscape(fullSubdomain))
-	http.Redirect(w, r, warningURL, http.StatusTemporaryRedirect)
-}
-
-func isWebSocketRequest(r *http.Request) bool {
-	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
-		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
-}
-
-// stripPort removes the port from a host string (e.g., "example.com:443" -> "example.com")
-func stripPort(host string) string {
-	if idx := strings.LastIndex(host, ":"); idx != -1 {
-		return host[:idx]
-	}
-	return host
-}
-
-// limitedReadCloser wraps an io.ReadCloser and limits the number of bytes read
-type limitedReadCloser struct {
-	rc    io.ReadCloser
-	limit int64
-	read  int64
-}
-
-func (l *limitedReadCloser) Read(p []byte) (n int, err error) {
-	if l.read >= l.limit {
-		return 0, fmt.Errorf("response body too large (exceeded %d bytes)", l.limit)
-	}
-	remaining := l.limit - l.read
-	if int64(len(p)) > remaining {
-		p = p[:remaining]
-	}
-	n, err = l.rc.Read(p)
-	l.read += int64(n)
-	return n, err
-}
-
-func (l *limitedReadCloser) Close() error {
-	return l.rc.Close()
-}
-
-// statusCaptureWriter wraps http.ResponseWriter to capture the status code.
-type statusCaptureWriter struct {
-	http.ResponseWriter
-	status      int
-	wroteHeader bool
-}
-
-func (w *statusCaptureWriter) WriteHeader(code int) {
-	if !w.wroteHeader {
-		w.status = code
-		w.wroteHeader = true
-	}
-	w.ResponseWriter.WriteHeader(code)
-}
-
-func (w *statusCaptureWriter) Write(b []byte) (int, error) {
-	if !w.wroteHeader {
-		w.status = http.StatusOK
-		w.wroteHeader = true
-	}
-	return w.ResponseWriter.Write(b)
-}
-
-// Unwrap returns the underlying ResponseWriter for interface passthrough (e.g., http.Flusher).
-func (w *statusCaptureWriter) Unwrap() http.ResponseWriter {
-	return w.ResponseWriter
-}
-
-// HTTPRedirectHandler returns an http.Handler that redirects HTTP to HTTPS
-func (s *Server) HTTPRedirectHandler() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		host := stripPort(r.Host)
-		if !strings.HasSuffix(host, "."+s.domain) && host != s.domain {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
-			return
-		}
-		target := "https://" + r.Host + r.URL.RequestURI()
-		http.Redirect(w, r, target, http.StatusMovedPermanently)
-	})
-}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// redisKeyPrefix namespaces tunnl's keys in a shared Redis database
+const redisKeyPrefix = "tunnl:"
+
+// redis stores blobs as Redis strings, speaking RESP over one connection
+// that is re-established after errors
+type redis struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	db       int
+
+	mu   sync.Mutex // serializes commands on conn
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedis(u *url.URL) (*redis, error) {
+	r := &redis{addr: u.Host, tls: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+		r.db = n
+	}
+	return r, nil
+}
+
+func (r *redis) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := r.do(ctx, "GET", key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	return reply, nil
+}
+
+func (r *redis) Put(ctx context.Context, key string, data []byte) error {
+	_, err := r.do(ctx, "SET", key, string(data))
+	return err
+}
+
+func (r *redis) Delete(ctx context.Context, key string) error {
+	_, err := r.do(ctx, "DEL", key)
+	return err
+}
+
+// do runs a command on a key and returns the bulk string reply, nil for
+// a null reply or a reply of another type
+func (r *redis) do(ctx context.Context, cmd, key string, args ...string) ([]byte, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("invalid storage key %q", key)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		if err := r.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.roundTrip(ctx, append([]string{cmd, redisKeyPrefix + key}, args...)...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection is in an unknown state
+		r.conn.Close()
+		r.conn = nil
+	}
+	return reply, err
+}
+
+// connect dials the server, authenticates and selects the database
+func (r *redis) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: config.StorageTimeout}
+	var conn net.Conn
+	var err error
+	if r.tls {
+		host, _, _ := net.SplitHostPort(r.addr)
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", r.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return err
+	}
+	r.conn, r.rd = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	if r.password != "" && r.username != "" {
+		setup = append(setup, []string{"AUTH", r.username, r.password})
+	} else if r.password != "" {
+		setup = append(setup, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	for _, args := range setup {
+		if _, err := r.roundTrip(ctx, args...); err != nil {
+			conn.Close()
+			r.conn = nil
+			return fmt.Errorf("redis %s: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+// roundTrip writes a command as an array of bulk strings and reads its reply
+func (r *redis) roundTrip(ctx context.Context, args ...string) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(config.StorageTimeout)
+	}
+	r.conn.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(r.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(r.rd)
+}
+
+// redisError is an error reply from the server, after which the
+// connection remains usable
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readRedisReply reads one RESP reply, returning the payload of bulk
+// strings and nil for other types
+func readRedisReply(rd *bufio.Reader) ([]byte, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil, nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if n > config.MaxStorageObjectSize {
+			return nil, fmt.Errorf("redis: reply of %d bytes is too large", n)
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
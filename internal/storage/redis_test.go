@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeRedis serves GET, SET, DEL, AUTH and SELECT from a map
+func fakeRedis(t *testing.T, password string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	data := map[string]string{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				authed := password == ""
+				for {
+					args, err := readCommand(rd)
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(args[0])
+					switch {
+					case cmd == "AUTH":
+						authed = args[len(args)-1] == password
+						if !authed {
+							io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+							continue
+						}
+						io.WriteString(conn, "+OK\r\n")
+					case !authed:
+						io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+					case cmd == "SELECT":
+						io.WriteString(conn, "+OK\r\n")
+					case cmd == "GET":
+						v, ok := data[args[1]]
+						if !ok {
+							io.WriteString(conn, "$-1\r\n")
+							continue
+						}
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+					case cmd == "SET":
+						data[args[1]] = args[2]
+						io.WriteString(conn, "+OK\r\n")
+					case cmd == "DEL":
+						delete(data, args[1])
+						io.WriteString(conn, ":1\r\n")
+					default:
+						io.WriteString(conn, "-ERR unknown command\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func TestRedis(t *testing.T) {
+	addr := fakeRedis(t, "pw")
+	u, _ := url.Parse("redis://:pw@" + addr + "/1")
+	r, err := newRedis(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, r)
+
+	u, _ = url.Parse("redis://:wrong@" + addr)
+	bad, _ := newRedis(u)
+	if _, err := bad.Get(t.Context(), "x"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Get() with a wrong password error = %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"tunnl.gg/internal/awsv4"
+	"tunnl.gg/pkg/config"
+)
+
+// s3 stores blobs as objects of an S3 bucket, or of an S3-compatible service
+// (MinIO, R2, ...) when S3_ENDPOINT is set
+type s3 struct {
+	bucket       string
+	prefix       string // key prefix from the URL path, e.g. "tunnl/"
+	region       string
+	endpoint     string // "" = AWS, with virtual-hosted bucket URLs
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+	now          func() time.Time
+}
+
+func newS3(u *url.URL, getenv func(string) string) (*s3, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("s3 storage URL needs a bucket, e.g. s3://bucket/prefix")
+	}
+	s := &s3{
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       getenv("AWS_REGION"),
+		endpoint:     strings.TrimSuffix(getenv("S3_ENDPOINT"), "/"),
+		accessKey:    getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: config.StorageTimeout},
+		now:          time.Now,
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return s, nil
+}
+
+// objectURL returns the URL of a key's object
+func (s *s3) objectURL(key string) string {
+	parts := strings.Split(s.prefix+key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	path := strings.Join(parts, "/")
+	if s.endpoint != "" {
+		return s.endpoint + "/" + s.bucket + "/" + path
+	}
+	return "https://" + s.bucket + ".s3." + s.region + ".amazonaws.com/" + path
+}
+
+// do sends a signed request for a key's object
+func (s *s3) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("invalid storage key %q", key)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	awsv4.Sign(req, body, s.accessKey, s.secretKey, s.region, "s3", s.now())
+	return s.client.Do(req)
+}
+
+// s3Error describes a failed response by its S3 error code if it has one
+func s3Error(method, key string, resp *http.Response) error {
+	var apiErr struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+		return fmt.Errorf("s3 %s %s: %s: %s", method, key, apiErr.Code, apiErr.Message)
+	}
+	return fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+}
+
+func (s *s3) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(io.LimitReader(resp.Body, config.MaxStorageObjectSize))
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	}
+	return nil, s3Error("GET", key, resp)
+}
+
+func (s *s3) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("PUT", key, resp)
+	}
+	return nil
+}
+
+func (s *s3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("DELETE", key, resp)
+	}
+	return nil
+}
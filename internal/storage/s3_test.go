@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestS3(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/s3/aws4_request") || r.Header.Get("X-Amz-Content-Sha256") == "" ||
+			r.Header.Get("X-Amz-Security-Token") == "expired" {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<Error><Code>AccessDenied</Code><Message>unsigned</Message></Error>`)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/bucket/tunnl/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+				return
+			}
+			w.Write(data)
+		case http.MethodPut:
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	env := map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret", "S3_ENDPOINT": srv.URL}
+	u, _ := url.Parse("s3://bucket/tunnl/")
+	s, err := newS3(u, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("newS3() error = %v", err)
+	}
+	testStorage(t, s)
+
+	s.sessionToken = "expired"
+	if err := s.Put(t.Context(), "x", nil); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("rejected Put() error = %v, want AccessDenied", err)
+	}
+}
+
+func TestS3_ObjectURL(t *testing.T) {
+	u, _ := url.Parse("s3://my-bucket")
+	s, err := newS3(u, func(k string) string {
+		return map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_REGION": "eu-west-1"}[k]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.objectURL("acme/a b.crt"); got != "https://my-bucket.s3.eu-west-1.amazonaws.com/acme/a%20b.crt" {
+		t.Errorf("objectURL() = %q", got)
+	}
+}
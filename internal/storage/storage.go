@@ -0,0 +1,84 @@
+// Package storage keeps small blobs such as ACME certificates and subdomain
+// reservations in a local directory, an S3 bucket or Redis, so that the
+// servers of a cluster can share them.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrNotFound is returned by Get for keys that do not exist
+var ErrNotFound = errors.New("not found")
+
+// Storage is a key-value store for blobs. Keys are slash-separated paths
+// such as "acme/example.com.crt".
+type Storage interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, data []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Schemes lists the supported storage URL schemes
+var Schemes = []string{"file", "s3", "redis", "rediss"}
+
+// Open returns the storage described by rawURL: a directory
+// (file:///var/lib/tunnl or a plain path), an S3 bucket
+// (s3://bucket/prefix) or a Redis database (redis://:password@host:6379/0,
+// rediss:// for TLS). Credentials are read through getenv.
+func Open(rawURL string, getenv func(string) string) (Storage, error) {
+	if !strings.Contains(rawURL, "://") {
+		return NewDir(rawURL), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return NewDir(u.Path), nil
+	case "s3":
+		return newS3(u, getenv)
+	case "redis", "rediss":
+		return newRedis(u)
+	}
+	return nil, fmt.Errorf("unknown storage scheme %q (want one of %s)", u.Scheme, strings.Join(Schemes, ", "))
+}
+
+// WithPrefix returns a view of s whose keys are prefixed with prefix
+func WithPrefix(s Storage, prefix string) Storage {
+	return prefixed{s, prefix}
+}
+
+type prefixed struct {
+	s      Storage
+	prefix string
+}
+
+func (p prefixed) Get(ctx context.Context, key string) ([]byte, error) {
+	return p.s.Get(ctx, p.prefix+key)
+}
+
+func (p prefixed) Put(ctx context.Context, key string, data []byte) error {
+	return p.s.Put(ctx, p.prefix+key, data)
+}
+
+func (p prefixed) Delete(ctx context.Context, key string) error {
+	return p.s.Delete(ctx, p.prefix+key)
+}
+
+// validKey reports whether key is a relative path without empty, "." or ".." segments
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
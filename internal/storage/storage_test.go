@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+// testStorage checks the Storage contract on s
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := t.Context()
+	if _, err := s.Get(ctx, "acme/example.com.crt"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get() of a missing key error = %v, want ErrNotFound", err)
+	}
+	if err := s.Put(ctx, "acme/example.com.crt", []byte("one")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := s.Put(ctx, "acme/example.com.crt", []byte("two")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if got, err := s.Get(ctx, "acme/example.com.crt"); err != nil || string(got) != "two" {
+		t.Errorf("Get() = %q, %v, want two", got, err)
+	}
+	if err := s.Delete(ctx, "acme/example.com.crt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := s.Delete(ctx, "acme/example.com.crt"); err != nil {
+		t.Errorf("Delete() of a missing key error = %v", err)
+	}
+	if _, err := s.Get(ctx, "acme/example.com.crt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after Delete() error = %v, want ErrNotFound", err)
+	}
+	for _, key := range []string{"", "../etc/passwd", "acme//x", "/abs"} {
+		if err := s.Put(ctx, key, nil); err == nil {
+			t.Errorf("Put(%q) should be refused", key)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	testStorage(t, NewDir(t.TempDir()))
+}
+
+func TestWithPrefix(t *testing.T) {
+	dir := NewDir(t.TempDir())
+	p := WithPrefix(dir, "acme/")
+	if err := p.Put(t.Context(), "account.key", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := dir.Get(t.Context(), "acme/account.key"); err != nil || string(got) != "key" {
+		t.Errorf("underlying Get() = %q, %v, want the prefixed key", got, err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	env := map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret"}
+	getenv := func(k string) string { return env[k] }
+	for _, good := range []string{"/var/lib/tunnl", "file:///var/lib/tunnl", "s3://bucket/tunnl", "redis://:pw@localhost:6379/2", "rediss://cache.internal"} {
+		if _, err := Open(good, getenv); err != nil {
+			t.Errorf("Open(%q) error = %v", good, err)
+		}
+	}
+	for _, bad := range []string{"ftp://host/dir", "s3:///prefix", "redis://localhost/db"} {
+		if _, err := Open(bad, getenv); err == nil {
+			t.Errorf("Open(%q) should fail", bad)
+		}
+	}
+}
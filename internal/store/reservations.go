@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"tunnl.gg/internal/storage"
+	"tunnl.gg/pkg/config"
+)
+
+// Reservations keeps subdomain reservations. *Store keeps them in SQLite,
+// *SharedReservations in a storage shared by the servers of a cluster.
+type Reservations interface {
+	SaveReservation(r Reservation) error
+	Reservation(sub string, now time.Time) (Reservation, bool, error)
+	ExtendReservation(sub string, expiresAt time.Time) error
+}
+
+// SharedReservations keeps reservations as JSON objects in a storage, so a
+// client can resume its subdomain through any server of a cluster. Expired
+// reservations are deleted when they are next looked up.
+type SharedReservations struct {
+	storage storage.Storage
+}
+
+// NewSharedReservations keeps reservations below "reservations/" in s
+func NewSharedReservations(s storage.Storage) *SharedReservations {
+	return &SharedReservations{storage: storage.WithPrefix(s, "reservations/")}
+}
+
+// SaveReservation creates or replaces a subdomain reservation
+func (r *SharedReservations) SaveReservation(res Reservation) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.StorageTimeout)
+	defer cancel()
+	return r.storage.Put(ctx, res.Subdomain, data)
+}
+
+// Reservation returns the unexpired reservation of a subdomain
+func (r *SharedReservations) Reservation(sub string, now time.Time) (Reservation, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.StorageTimeout)
+	defer cancel()
+	data, err := r.storage.Get(ctx, sub)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Reservation{}, false, nil
+	}
+	if err != nil {
+		return Reservation{}, false, err
+	}
+	var res Reservation
+	if err := json.Unmarshal(data, &res); err != nil {
+		return Reservation{}, false, err
+	}
+	if !res.ExpiresAt.After(now) {
+		return Reservation{}, false, r.storage.Delete(ctx, sub)
+	}
+	return res, true, nil
+}
+
+// ExtendReservation moves a reservation's expiry
+func (r *SharedReservations) ExtendReservation(sub string, expiresAt time.Time) error {
+	res, ok, err := r.Reservation(sub, time.Time{})
+	if err != nil || !ok {
+		return err
+	}
+	res.ExpiresAt = expiresAt
+	return r.SaveReservation(res)
+}
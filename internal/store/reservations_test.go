@@ -0,0 +1,41 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"tunnl.gg/internal/storage"
+)
+
+func TestSharedReservations(t *testing.T) {
+	dir := storage.NewDir(t.TempDir())
+	r := NewSharedReservations(dir)
+	now := time.Now()
+
+	if _, ok, err := r.Reservation("happy-tiger-abcdef01", now); ok || err != nil {
+		t.Fatalf("Reservation() of a new subdomain = %v, %v", ok, err)
+	}
+	res := Reservation{Subdomain: "happy-tiger-abcdef01", Account: "alice", ResumeToken: "tok", ExpiresAt: now.Add(time.Hour)}
+	if err := r.SaveReservation(res); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another server sharing the storage sees it
+	got, ok, err := NewSharedReservations(dir).Reservation("happy-tiger-abcdef01", now)
+	if err != nil || !ok || got.Account != "alice" || got.ResumeToken != "tok" {
+		t.Errorf("Reservation() = %+v, %v, %v, want alice's", got, ok, err)
+	}
+
+	if err := r.ExtendReservation("happy-tiger-abcdef01", now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := r.Reservation("happy-tiger-abcdef01", now); ok {
+		t.Error("expired reservation should not be returned")
+	}
+	if _, err := dir.Get(t.Context(), "reservations/happy-tiger-abcdef01"); err == nil {
+		t.Error("expired reservation should be deleted once looked up")
+	}
+	if err := r.ExtendReservation("calm-eagle-12345678", now); err != nil {
+		t.Errorf("ExtendReservation() of no reservation error = %v", err)
+	}
+}
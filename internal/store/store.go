@@ -0,0 +1,286 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS users (
+	name        TEXT PRIMARY KEY,
+	first_seen  INTEGER NOT NULL,
+	last_seen   INTEGER NOT NULL,
+	connections INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS reservations (
+	subdomain    TEXT PRIMARY KEY,
+	account      TEXT NOT NULL,
+	resume_token TEXT NOT NULL,
+	expires_at   INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS usage (
+	kind  TEXT NOT NULL,
+	key   TEXT NOT NULL,
+	day   TEXT NOT NULL,
+	bytes INTEGER NOT NULL,
+	PRIMARY KEY (kind, key, day)
+);
+CREATE TABLE IF NOT EXISTS tunnel_usage (
+	day            TEXT NOT NULL,
+	account        TEXT NOT NULL,
+	subdomain      TEXT NOT NULL,
+	requests       INTEGER NOT NULL DEFAULT 0,
+	bytes          INTEGER NOT NULL DEFAULT 0,
+	tunnel_seconds INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (day, account, subdomain)
+);
+CREATE TABLE IF NOT EXISTS blocks (
+	ip         TEXT PRIMARY KEY,
+	expires_at INTEGER NOT NULL
+);
+`
+
+// Usage counter kinds
+const (
+	UsageIP      = "ip"
+	UsageAccount = "account"
+)
+
+// User is a persisted account record
+type User struct {
+	Name        string
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Connections int64
+}
+
+// Reservation holds a subdomain for its account after the last tunnel
+// disconnects, so the client can resume it with the token
+type Reservation struct {
+	Subdomain   string
+	Account     string
+	ResumeToken string
+	ExpiresAt   time.Time
+}
+
+// TunnelUsage is the traffic of one subdomain under one account on a UTC day
+type TunnelUsage struct {
+	Day           string
+	Account       string // empty for anonymous clients
+	Subdomain     string
+	Requests      int64
+	Bytes         int64
+	TunnelSeconds int64
+}
+
+// Store is a SQLite-backed state store. It is safe for concurrent use.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens (creating if needed) the database at path
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %s: %w", path, err)
+	}
+	// SQLite allows a single writer; serializing avoids SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize store %s: %w", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// TouchUser records a connection by the named account
+func (s *Store) TouchUser(name string, at time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO users (name, first_seen, last_seen, connections) VALUES (?, ?, ?, 1)
+		ON CONFLICT (name) DO UPDATE SET last_seen = excluded.last_seen, connections = connections + 1`,
+		name, at.Unix(), at.Unix())
+	return err
+}
+
+// User returns the record of the named account
+func (s *Store) User(name string) (User, bool, error) {
+	var u User
+	var first, last int64
+	err := s.db.QueryRow(`SELECT name, first_seen, last_seen, connections FROM users WHERE name = ?`, name).
+		Scan(&u.Name, &first, &last, &u.Connections)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, false, nil
+	}
+	if err != nil {
+		return User{}, false, err
+	}
+	u.FirstSeen, u.LastSeen = time.Unix(first, 0), time.Unix(last, 0)
+	return u, true, nil
+}
+
+// SaveReservation creates or replaces a subdomain reservation
+func (s *Store) SaveReservation(r Reservation) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO reservations (subdomain, account, resume_token, expires_at) VALUES (?, ?, ?, ?)`,
+		r.Subdomain, r.Account, r.ResumeToken, r.ExpiresAt.Unix())
+	return err
+}
+
+// Reservation returns the unexpired reservation of a subdomain
+func (s *Store) Reservation(sub string, now time.Time) (Reservation, bool, error) {
+	r := Reservation{Subdomain: sub}
+	var expires int64
+	err := s.db.QueryRow(`SELECT account, resume_token, expires_at FROM reservations WHERE subdomain = ? AND expires_at > ?`,
+		sub, now.Unix()).Scan(&r.Account, &r.ResumeToken, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Reservation{}, false, nil
+	}
+	if err != nil {
+		return Reservation{}, false, err
+	}
+	r.ExpiresAt = time.Unix(expires, 0)
+	return r, true, nil
+}
+
+// ExtendReservation moves a reservation's expiry
+func (s *Store) ExtendReservation(sub string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`UPDATE reservations SET expires_at = ? WHERE subdomain = ?`, expiresAt.Unix(), sub)
+	return err
+}
+
+// SaveUsage stores the bytes used by each key of a kind on a UTC day
+// (YYYY-MM-DD), replacing earlier values
+func (s *Store) SaveUsage(kind, day string, usage map[string]int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO usage (kind, key, day, bytes) VALUES (?, ?, ?, ?)
+		ON CONFLICT (kind, key, day) DO UPDATE SET bytes = excluded.bytes`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for key, n := range usage {
+		if _, err := stmt.Exec(kind, key, day, n); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Usage returns the bytes used by each key of a kind on a UTC day
+func (s *Store) Usage(kind, day string) (map[string]int64, error) {
+	rows, err := s.db.Query(`SELECT key, bytes FROM usage WHERE kind = ? AND day = ?`, kind, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usage := make(map[string]int64)
+	for rows.Next() {
+		var key string
+		var n int64
+		if err := rows.Scan(&key, &n); err != nil {
+			return nil, err
+		}
+		usage[key] = n
+	}
+	return usage, rows.Err()
+}
+
+// AddTunnelUsage adds the given counters to the stored daily totals
+func (s *Store) AddTunnelUsage(records []TunnelUsage) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO tunnel_usage (day, account, subdomain, requests, bytes, tunnel_seconds) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (day, account, subdomain) DO UPDATE SET
+			requests = requests + excluded.requests,
+			bytes = bytes + excluded.bytes,
+			tunnel_seconds = tunnel_seconds + excluded.tunnel_seconds`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range records {
+		if _, err := stmt.Exec(r.Day, r.Account, r.Subdomain, r.Requests, r.Bytes, r.TunnelSeconds); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// TunnelUsageBetween returns the daily totals from one UTC day to another, inclusive
+func (s *Store) TunnelUsageBetween(from, to string) ([]TunnelUsage, error) {
+	rows, err := s.db.Query(`SELECT day, account, subdomain, requests, bytes, tunnel_seconds FROM tunnel_usage
+		WHERE day >= ? AND day <= ? ORDER BY day, account, subdomain`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []TunnelUsage
+	for rows.Next() {
+		var r TunnelUsage
+		if err := rows.Scan(&r.Day, &r.Account, &r.Subdomain, &r.Requests, &r.Bytes, &r.TunnelSeconds); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// SaveBlocks replaces the stored IP blocks
+func (s *Store) SaveBlocks(blocks map[string]time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM blocks`); err != nil {
+		return err
+	}
+	for ip, expiry := range blocks {
+		if _, err := tx.Exec(`INSERT INTO blocks (ip, expires_at) VALUES (?, ?)`, ip, expiry.Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Blocks returns the stored IP blocks that have not expired
+func (s *Store) Blocks(now time.Time) (map[string]time.Time, error) {
+	rows, err := s.db.Query(`SELECT ip, expires_at FROM blocks WHERE expires_at > ?`, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blocks := make(map[string]time.Time)
+	for rows.Next() {
+		var ip string
+		var expires int64
+		if err := rows.Scan(&ip, &expires); err != nil {
+			return nil, err
+		}
+		blocks[ip] = time.Unix(expires, 0)
+	}
+	return blocks, rows.Err()
+}
+
+// Prune deletes expired reservations and blocks
+func (s *Store) Prune(now time.Time) error {
+	if _, err := s.db.Exec(`DELETE FROM reservations WHERE expires_at <= ?`, now.Unix()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM blocks WHERE expires_at <= ?`, now.Unix())
+	return err
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) (*Store, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tunnl.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, path
+}
+
+func TestUsers(t *testing.T) {
+	s, _ := openTestStore(t)
+	first := time.Unix(1700000000, 0)
+	if err := s.TouchUser("alice", first); err != nil {
+		t.Fatalf("TouchUser() error = %v", err)
+	}
+	if err := s.TouchUser("alice", first.Add(time.Hour)); err != nil {
+		t.Fatalf("TouchUser() error = %v", err)
+	}
+
+	u, ok, err := s.User("alice")
+	if err != nil || !ok {
+		t.Fatalf("User() = %v, %v, want a record", ok, err)
+	}
+	if !u.FirstSeen.Equal(first) || !u.LastSeen.Equal(first.Add(time.Hour)) || u.Connections != 2 {
+		t.Errorf("User() = %+v", u)
+	}
+	if _, ok, _ := s.User("bob"); ok {
+		t.Error("User() should not find unknown users")
+	}
+}
+
+func TestReservations(t *testing.T) {
+	s, _ := openTestStore(t)
+	now := time.Unix(1700000000, 0)
+	r := Reservation{Subdomain: "happy-tiger-abcdef01", Account: "alice", ResumeToken: "secret", ExpiresAt: now.Add(time.Hour)}
+	if err := s.SaveReservation(r); err != nil {
+		t.Fatalf("SaveReservation() error = %v", err)
+	}
+
+	got, ok, err := s.Reservation(r.Subdomain, now)
+	if err != nil || !ok {
+		t.Fatalf("Reservation() = %v, %v, want a reservation", ok, err)
+	}
+	if got.Account != "alice" || got.ResumeToken != "secret" || !got.ExpiresAt.Equal(r.ExpiresAt) {
+		t.Errorf("Reservation() = %+v, want %+v", got, r)
+	}
+	if _, ok, _ := s.Reservation(r.Subdomain, now.Add(2*time.Hour)); ok {
+		t.Error("expired reservations should not be returned")
+	}
+
+	if err := s.ExtendReservation(r.Subdomain, now.Add(3*time.Hour)); err != nil {
+		t.Fatalf("ExtendReservation() error = %v", err)
+	}
+	if _, ok, _ := s.Reservation(r.Subdomain, now.Add(2*time.Hour)); !ok {
+		t.Error("extended reservation should still be held")
+	}
+
+	if err := s.Prune(now.Add(4 * time.Hour)); err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if _, ok, _ := s.Reservation(r.Subdomain, now); ok {
+		t.Error("Prune() should delete expired reservations")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	s, _ := openTestStore(t)
+	if err := s.SaveUsage(UsageIP, "2025-01-01", map[string]int64{"1.2.3.4": 100, "5.6.7.8": 5}); err != nil {
+		t.Fatalf("SaveUsage() error = %v", err)
+	}
+	if err := s.SaveUsage(UsageIP, "2025-01-01", map[string]int64{"1.2.3.4": 250}); err != nil {
+		t.Fatalf("SaveUsage() error = %v", err)
+	}
+	if err := s.SaveUsage(UsageAccount, "2025-01-01", map[string]int64{"alice": 7}); err != nil {
+		t.Fatalf("SaveUsage() error = %v", err)
+	}
+
+	usage, err := s.Usage(UsageIP, "2025-01-01")
+	if err != nil {
+		t.Fatalf("Usage() error = %v", err)
+	}
+	if len(usage) != 2 || usage["1.2.3.4"] != 250 || usage["5.6.7.8"] != 5 {
+		t.Errorf("Usage() = %v", usage)
+	}
+	if usage, _ := s.Usage(UsageIP, "2025-01-02"); len(usage) != 0 {
+		t.Errorf("Usage() for another day = %v, want empty", usage)
+	}
+}
+
+func TestBlocks_Reopen(t *testing.T) {
+	s, path := openTestStore(t)
+	now := time.Unix(1700000000, 0)
+	err := s.SaveBlocks(map[string]time.Time{
+		"1.2.3.4": now.Add(time.Hour),
+		"5.6.7.8": now.Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("SaveBlocks() error = %v", err)
+	}
+	s.Close()
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer reopened.Close()
+
+	blocks, err := reopened.Blocks(now)
+	if err != nil {
+		t.Fatalf("Blocks() error = %v", err)
+	}
+	if len(blocks) != 1 || !blocks["1.2.3.4"].Equal(now.Add(time.Hour)) {
+		t.Errorf("Blocks() = %v, want only the unexpired block", blocks)
+	}
+}
+
+func TestTunnelUsage(t *testing.T) {
+	s, _ := openTestStore(t)
+	batch := []TunnelUsage{
+		{Day: "2025-01-01", Account: "alice", Subdomain: "happy-tiger-abcdef01", Requests: 10, Bytes: 100, TunnelSeconds: 60},
+		{Day: "2025-01-02", Account: "", Subdomain: "calm-eagle-abcdef02", Requests: 1},
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.AddTunnelUsage(batch); err != nil {
+			t.Fatalf("AddTunnelUsage() error = %v", err)
+		}
+	}
+
+	records, err := s.TunnelUsageBetween("2025-01-01", "2025-01-01")
+	if err != nil {
+		t.Fatalf("TunnelUsageBetween() error = %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	if r := records[0]; r.Requests != 20 || r.Bytes != 200 || r.TunnelSeconds != 120 {
+		t.Errorf("record = %+v, want counters added up", r)
+	}
+	if records, _ := s.TunnelUsageBetween("2025-01-01", "2025-01-31"); len(records) != 2 {
+		t.Errorf("got %d records for January, want 2", len(records))
+	}
+}
@@ -2,6 +2,7 @@ package subdomain
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"strings"
@@ -21,11 +22,35 @@ var nouns = []string{
 	"maple", "cedar", "pine", "oak", "willow", "birch", "aspen", "elm",
 }
 
-// Generate creates a random memorable subdomain in the format adjective-noun-hex
-func Generate() (string, error) {
+// Lengths of the hex suffix of generated subdomains
+const (
+	ShortSuffix   = 4  // 16 random bits: easy to read out, but guessable
+	DefaultSuffix = 8  // 32 random bits
+	LongSuffix    = 16 // 64 random bits, for tunnels that must not be found by scanning
+)
+
+// EntropyLevels maps the entropy levels clients can ask for to suffix lengths
+var EntropyLevels = map[string]int{
+	"low":     ShortSuffix,
+	"default": DefaultSuffix,
+	"high":    LongSuffix,
+}
+
+// SuffixLength returns the suffix length of an entropy level, the default
+// for an empty one
+func SuffixLength(level string) (int, bool) {
+	if level == "" {
+		return DefaultSuffix, true
+	}
+	n, ok := EntropyLevels[level]
+	return n, ok
+}
+
+// Generate creates a random memorable subdomain in the format adjective-noun-hex,
+// with suffixLen hex characters
+func Generate(suffixLen int) (string, error) {
 	adjIdx := make([]byte, 1)
 	nounIdx := make([]byte, 1)
-	hexBytes := make([]byte, 4) // 4 bytes = 8 hex characters for better entropy
 
 	if _, err := rand.Read(adjIdx); err != nil {
 		return "", fmt.Errorf("failed to generate random bytes: %w", err)
@@ -33,28 +58,58 @@ func Generate() (string, error) {
 	if _, err := rand.Read(nounIdx); err != nil {
 		return "", fmt.Errorf("failed to generate random bytes: %w", err)
 	}
-	if _, err := rand.Read(hexBytes); err != nil {
-		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	hexSuffix, err := randomHex(suffixLen)
+	if err != nil {
+		return "", err
 	}
 
 	adj := adjectives[int(adjIdx[0])%len(adjectives)]
 	noun := nouns[int(nounIdx[0])%len(nouns)]
-	hexSuffix := hex.EncodeToString(hexBytes)
 
 	return fmt.Sprintf("%s-%s-%s", adj, noun, hexSuffix), nil
 }
 
+// GenerateFor creates a subdomain whose adjective-noun prefix is derived from
+// key, so the same key (e.g. an account name) always gets the same prefix.
+// The hex suffix of suffixLen characters is still random. As the prefix
+// gives nothing away, the suffix is at least DefaultSuffix long: a short one
+// would let a key's subdomains be found by scanning 16 bits.
+func GenerateFor(key string, suffixLen int) (string, error) {
+	suffixLen = max(suffixLen, DefaultSuffix)
+	sum := sha256.Sum256([]byte(key))
+	hexSuffix, err := randomHex(suffixLen)
+	if err != nil {
+		return "", err
+	}
+
+	adj := adjectives[int(sum[0])%len(adjectives)]
+	noun := nouns[int(sum[1])%len(nouns)]
+
+	return fmt.Sprintf("%s-%s-%s", adj, noun, hexSuffix), nil
+}
+
+// randomHex returns n random lowercase hex characters
+func randomHex(n int) (string, error) {
+	b := make([]byte, (n+1)/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return hex.EncodeToString(b)[:n], nil
+}
+
 // IsValid checks if a subdomain matches the expected format (adjective-noun-hex)
 func IsValid(s string) bool {
-	parts := strings.Split(s, "-")
-	if len(parts) != 3 {
+	// Cut rather than Split: this runs on every proxied request
+	adj, rest, ok := strings.Cut(s, "-")
+	noun, suffix, ok2 := strings.Cut(rest, "-")
+	if !ok || !ok2 || strings.Contains(suffix, "-") {
 		return false
 	}
 
 	// Check adjective
 	adjValid := false
-	for _, adj := range adjectives {
-		if parts[0] == adj {
+	for _, a := range adjectives {
+		if adj == a {
 			adjValid = true
 			break
 		}
@@ -65,8 +120,8 @@ func IsValid(s string) bool {
 
 	// Check noun
 	nounValid := false
-	for _, noun := range nouns {
-		if parts[1] == noun {
+	for _, n := range nouns {
+		if noun == n {
 			nounValid = true
 			break
 		}
@@ -75,11 +130,11 @@ func IsValid(s string) bool {
 		return false
 	}
 
-	// Check hex suffix (8 characters)
-	if len(parts[2]) != 8 {
+	// Check hex suffix (one of the generated lengths)
+	if len(suffix) != ShortSuffix && len(suffix) != DefaultSuffix && len(suffix) != LongSuffix {
 		return false
 	}
-	for _, c := range parts[2] {
+	for _, c := range suffix {
 		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
 			return false
 		}
@@ -87,3 +142,48 @@ func IsValid(s string) bool {
 
 	return true
 }
+
+// IsValidName checks that s can be used as a custom (reserved) subdomain:
+// 3-63 lowercase letters, digits or hyphens, not starting or ending with a
+// hyphen. Punycode ("xn--") names are refused: they display as Unicode and
+// could pass for another site's name.
+func IsValidName(s string) bool {
+	if len(s) < 3 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' || strings.HasPrefix(s, "xn--") {
+		return false
+	}
+	for _, c := range s {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// ServiceSeparator joins a service name to the subdomain serving it, as in
+// api--happy-tiger-a1b2c3d4. Generated subdomains never contain it.
+const ServiceSeparator = "--"
+
+// SplitService splits a "<service>--<subdomain>" label. ok is false, and sub
+// the whole label, if it does not start with a valid service name followed
+// by exactly the separator, as in "api---x", which has no clear split.
+func SplitService(label string) (service, sub string, ok bool) {
+	service, sub, ok = strings.Cut(label, ServiceSeparator)
+	if !ok || sub == "" || sub[0] == '-' || !IsValidService(service) {
+		return "", label, false
+	}
+	return service, sub, true
+}
+
+// IsValidService checks that s can name a service: 1-20 lowercase letters,
+// digits or single hyphens, not starting or ending with a hyphen
+func IsValidService(s string) bool {
+	if len(s) < 1 || len(s) > 20 || s[0] == '-' || s[len(s)-1] == '-' || strings.Contains(s, ServiceSeparator) {
+		return false
+	}
+	for _, c := range s {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-') {
+			return false
+		}
+	}
+	return true
+}
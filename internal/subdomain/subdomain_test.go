@@ -1,24 +1,30 @@
 package subdomain
 
 import (
+	"strings"
 	"testing"
 )
 
 func TestGenerate(t *testing.T) {
 	t.Run("format", func(t *testing.T) {
-		sub, err := Generate()
-		if err != nil {
-			t.Fatalf("Generate() error: %v", err)
-		}
-		if !IsValid(sub) {
-			t.Errorf("Generate() produced invalid subdomain: %q", sub)
+		for _, n := range []int{ShortSuffix, DefaultSuffix, LongSuffix} {
+			sub, err := Generate(n)
+			if err != nil {
+				t.Fatalf("Generate(%d) error: %v", n, err)
+			}
+			if !IsValid(sub) {
+				t.Errorf("Generate(%d) produced invalid subdomain: %q", n, sub)
+			}
+			if suffix := sub[strings.LastIndex(sub, "-")+1:]; len(suffix) != n {
+				t.Errorf("Generate(%d) suffix = %q, want %d characters", n, suffix, n)
+			}
 		}
 	})
 
 	t.Run("uniqueness", func(t *testing.T) {
 		seen := make(map[string]struct{})
 		for i := 0; i < 100; i++ {
-			sub, err := Generate()
+			sub, err := Generate(DefaultSuffix)
 			if err != nil {
 				t.Fatalf("Generate() error on iteration %d: %v", i, err)
 			}
@@ -30,6 +36,50 @@ func TestGenerate(t *testing.T) {
 	})
 }
 
+func TestGenerateFor(t *testing.T) {
+	a, err := GenerateFor("alice", DefaultSuffix)
+	if err != nil {
+		t.Fatalf("GenerateFor() error: %v", err)
+	}
+	b, _ := GenerateFor("alice", LongSuffix)
+	if !IsValid(a) || !IsValid(b) {
+		t.Fatalf("GenerateFor() produced invalid subdomains: %q, %q", a, b)
+	}
+	if a == b {
+		t.Error("GenerateFor() should randomize the suffix")
+	}
+	if prefix(a) != prefix(b) {
+		t.Errorf("GenerateFor() prefixes differ for the same key: %q, %q", a, b)
+	}
+	if c, _ := GenerateFor("alice", ShortSuffix); len(c)-len(prefix(c)) != DefaultSuffix+1 {
+		t.Errorf("GenerateFor(ShortSuffix) = %q, want a suffix of at least %d characters", c, DefaultSuffix)
+	}
+}
+
+func TestSuffixLength(t *testing.T) {
+	tests := []struct {
+		level string
+		want  int
+		ok    bool
+	}{
+		{"", DefaultSuffix, true},
+		{"default", DefaultSuffix, true},
+		{"low", ShortSuffix, true},
+		{"high", LongSuffix, true},
+		{"max", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := SuffixLength(tt.level); got != tt.want || ok != tt.ok {
+			t.Errorf("SuffixLength(%q) = %d, %v, want %d, %v", tt.level, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// prefix returns the adjective-noun part of a subdomain
+func prefix(sub string) string {
+	return sub[:strings.LastIndex(sub, "-")]
+}
+
 func TestIsValid(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -44,8 +94,11 @@ func TestIsValid(t *testing.T) {
 		{"too many parts", "happy-tiger-abcd-ef01", false},
 		{"invalid adjective", "bogus-tiger-abcdef01", false},
 		{"invalid noun", "happy-bogus-abcdef01", false},
+		{"short hex", "happy-tiger-abcd", true},
+		{"long hex", "happy-tiger-0123456789abcdef", true},
 		{"hex too short", "happy-tiger-abcdef0", false},
 		{"hex too long", "happy-tiger-abcdef012", false},
+		{"hex between lengths", "happy-tiger-0123456789ab", false},
 		{"uppercase hex", "happy-tiger-ABCDEF01", false},
 		{"non-hex chars", "happy-tiger-ghijklmn", false},
 	}
@@ -58,3 +111,68 @@ func TestIsValid(t *testing.T) {
 		})
 	}
 }
+
+func TestIsValidName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"myapp", true},
+		{"my-app-2", true},
+		{"happy-tiger-abcdef01", true},
+		{"ab", false},
+		{"-myapp", false},
+		{"myapp-", false},
+		{"MyApp", false},
+		{"my_app", false},
+		{"xn--pple-43d", false},
+		{"xn-app", true},
+		{strings.Repeat("a", 64), false},
+	}
+	for _, tt := range tests {
+		if got := IsValidName(tt.name); got != tt.want {
+			t.Errorf("IsValidName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitService(t *testing.T) {
+	tests := []struct {
+		label, service, sub string
+		ok                  bool
+	}{
+		{"api--happy-tiger-abcdef01", "api", "happy-tiger-abcdef01", true},
+		{"web-2--myapp", "web-2", "myapp", true},
+		{"happy-tiger-abcdef01", "", "happy-tiger-abcdef01", false},
+		{"--happy-tiger-abcdef01", "", "--happy-tiger-abcdef01", false},
+		{"api--", "", "api--", false},
+		{"API--myapp", "", "API--myapp", false},
+		{strings.Repeat("a", 21) + "--myapp", "", strings.Repeat("a", 21) + "--myapp", false},
+		{"api---myapp", "", "api---myapp", false},
+		{"api--my--app", "api", "my--app", true},
+	}
+	for _, tt := range tests {
+		service, sub, ok := SplitService(tt.label)
+		if service != tt.service || sub != tt.sub || ok != tt.ok {
+			t.Errorf("SplitService(%q) = %q, %q, %v, want %q, %q, %v", tt.label, service, sub, ok, tt.service, tt.sub, tt.ok)
+		}
+	}
+}
+
+func FuzzSplitService(f *testing.F) {
+	for _, seed := range []string{"api--happy-tiger-abcdef01", "api---myapp", "--x", "a--", "web-2--myapp"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, label string) {
+		service, sub, ok := SplitService(label)
+		if !ok {
+			if service != "" || sub != label {
+				t.Errorf("SplitService(%q) = %q, %q on failure", label, service, sub)
+			}
+			return
+		}
+		if service+ServiceSeparator+sub != label || !IsValidService(service) || sub == "" || sub[0] == '-' {
+			t.Errorf("SplitService(%q) = %q, %q, not a clean split", label, service, sub)
+		}
+	})
+}
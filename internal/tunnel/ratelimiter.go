@@ -1,45 +0,0 @@
-package tunnel
-
-import (
-	"sync"
-	"time"
-)
-
-// RateLimiter implements a token bucket rate limiter
-type RateLimiter struct {
-	tokens     float64
-	maxTokens  float64
-	refillRate float64 // tokens per second
-	lastRefill time.Time
-	mu         sync.Mutex
-}
-
-// NewRateLimiter creates a new rate limiter with the given rate and burst size
-func NewRateLimiter(rate float64, burst int) *RateLimiter {
-	return &RateLimiter{
-		tokens:     float64(burst),
-		maxTokens:  float64(burst),
-		refillRate: rate,
-		lastRefill: time.Now(),
-	}
-}
-
-// Allow returns true if a request is allowed, false if rate limited
-func (r *RateLimiter) Allow() bool {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	now := time.Now()
-	elapsed := now.Sub(r.lastRefill).Seconds()
-	r.tokens += elapsed * r.refillRate
-	if r.tokens > r.maxTokens {
-		r.tokens = r.maxTokens
-	}
-	r.lastRefill = now
-
-	if r.tokens >= 1 {
-		r.tokens--
-		return true
-	}
-	return false
-}
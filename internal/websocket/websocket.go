@@ -0,0 +1,312 @@
+// Package websocket carries a byte stream in WebSocket binary messages
+// (RFC 6455), enough to tunnel SSH through proxies that only let HTTPS
+// through, without a WebSocket library.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acceptGUID is appended to the client's key to compute the server's answer
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	maxControlPayload = 125
+	maxFramePayload   = 32 << 10 // writes are split into frames of at most this
+	closeTimeout      = time.Second
+)
+
+// ErrBadHandshake is returned when either side does not open a WebSocket
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// Conn is a connection whose writes are sent as binary messages and whose
+// reads return the payload of the messages received. Pings are answered
+// while reading; a close message ends reads with io.EOF.
+type Conn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool // masks its frames and expects unmasked ones
+
+	rmu       sync.Mutex
+	remaining int64 // payload bytes left in the frame being read
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	readErr   error
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept value answering a Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IsUpgrade reports whether r asks to switch to the WebSocket protocol
+func IsUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// Upgrade answers a client's opening handshake and takes over its
+// connection. Requests that are not a WebSocket handshake get an error
+// response.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !IsUpgrade(r) || key == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Upgrade Required", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		// HTTP/2 connections cannot be taken over
+		http.Error(w, "HTTP Version Not Supported", http.StatusHTTPVersionNotSupported)
+		return nil, ErrBadHandshake
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// The HTTP server's timeouts no longer apply
+	conn.SetDeadline(time.Time{})
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{Conn: conn, br: rw.Reader}, nil
+}
+
+// Handshake opens a WebSocket to u over conn, which is already connected
+// (and for wss, TLS-secured) to u's host
+func Handshake(conn net.Conn, u *url.URL) (*Conn, error) {
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Opaque: u.RequestURI()},
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%w: %s", ErrBadHandshake, resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != AcceptKey(key) {
+		return nil, fmt.Errorf("%w: wrong Sec-WebSocket-Accept", ErrBadHandshake)
+	}
+	return &Conn{Conn: conn, br: br, client: true}, nil
+}
+
+// Read reads the payload of the messages received, whatever their frame
+// boundaries
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		for i := range n {
+			p[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remaining -= int64(n)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads a frame header. Data frames leave their payload to Read;
+// control frames are handled here.
+func (c *Conn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return err
+	}
+	fin, op := head[0]&0x80 != 0, head[0]&0x0f
+	masked := head[1]&0x80 != 0
+	if head[0]&0x70 != 0 {
+		return errors.New("websocket: reserved bits set")
+	}
+	// Clients mask every frame and servers none
+	if masked == c.client {
+		return errors.New("websocket: wrongly masked frame")
+	}
+
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(b[:]))
+		if length < 0 {
+			return errors.New("websocket: frame too long")
+		}
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case opContinuation, opText, opBinary:
+		c.remaining, c.masked, c.mask, c.maskPos = length, masked, mask, 0
+		return nil
+	case opClose, opPing, opPong:
+		if !fin || length > maxControlPayload {
+			return errors.New("websocket: invalid control frame")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		case opClose:
+			// Echo the status code, if any, and stop reading
+			c.writeFrame(opClose, payload[:min(len(payload), 2)])
+			return io.EOF
+		}
+		return nil
+	default:
+		return fmt.Errorf("websocket: unknown opcode %d", op)
+	}
+}
+
+// Write sends p as binary frames
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxFramePayload)]
+		if err := c.writeFrame(opBinary, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeFrame sends one final frame, masked if c is a client
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|op)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		for i := range payload {
+			buf[start+i] ^= mask[i%4]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// Close sends a normal closure message, unless one was exchanged already,
+// and closes the connection
+func (c *Conn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.writeFrame(opClose, []byte{0x03, 0xe8}) // 1000: normal closure
+	return c.Conn.Close()
+}
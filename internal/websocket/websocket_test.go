@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// dialEcho opens a WebSocket to a server echoing everything it reads
+func dialEcho(t *testing.T) *Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}))
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(strings.Replace(srv.URL, "http://", "ws://", 1) + "/ssh")
+	raw, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Handshake(raw, u)
+	if err != nil {
+		raw.Close()
+		t.Fatalf("Handshake: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestAcceptKey(t *testing.T) {
+	// The example of RFC 6455, section 1.3
+	if got, want := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("AcceptKey() = %q, want %q", got, want)
+	}
+}
+
+func TestConn_Echo(t *testing.T) {
+	conn := dialEcho(t)
+
+	// Long enough for several frames, and 16- and 64-bit lengths
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+	go conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading the echo: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("echo differs from what was sent")
+	}
+
+	// Pings are answered without disturbing the stream
+	if err := conn.writeFrame(opPing, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("after ping"))
+	got = make([]byte, len("after ping"))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "after ping" {
+		t.Errorf("read %q (%v) after a ping, want %q", got, err, "after ping")
+	}
+}
+
+func TestConn_CloseEndsReads(t *testing.T) {
+	conn := dialEcho(t)
+	if err := conn.writeFrame(opClose, []byte{0x03, 0xe8}); err != nil {
+		t.Fatal(err)
+	}
+	// The server echoes the close and stops
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() after close = %v, want io.EOF", err)
+	}
+}
+
+func TestUpgrade_RejectsPlainRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"no upgrade", http.Header{}, http.StatusBadRequest},
+		{"no key", http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}, "Sec-Websocket-Version": {"13"}}, http.StatusBadRequest},
+		{"old version", http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}, "Sec-Websocket-Key": {"a2V5"}, "Sec-Websocket-Version": {"8"}}, http.StatusUpgradeRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ssh", nil)
+			r.Header = tt.header
+			w := httptest.NewRecorder()
+			if _, err := Upgrade(w, r); !errors.Is(err, ErrBadHandshake) {
+				t.Errorf("Upgrade() = %v, want ErrBadHandshake", err)
+			}
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandshake_RejectedByServer(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/ssh")
+	raw, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	if _, err := Handshake(raw, u); !errors.Is(err, ErrBadHandshake) || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Handshake() = %v, want ErrBadHandshake with the status", err)
+	}
+}
@@ -0,0 +1,520 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultDomain     = "tunnl.gg"
+	InactivityTimeout = 2 * time.Hour
+	MaxTunnelsPerIP   = 3                // Reduced from 5
+	MaxTotalTunnels   = 1000
+
+	// SSH handshake timeout
+	SSHHandshakeTimeout = 30 * time.Second
+
+	// Failed accepts on the SSH listener are retried after a delay doubling
+	// from SSHAcceptBackoff up to MaxSSHAcceptBackoff. Temporary errors such
+	// as running out of file descriptors are retried until they clear; others
+	// stop the listener after MaxSSHAcceptFailures in a row.
+	SSHAcceptBackoff     = 5 * time.Millisecond
+	MaxSSHAcceptBackoff  = 1 * time.Second
+	MaxSSHAcceptFailures = 10
+
+	// HTTP rate limiting per tunnel
+	RequestsPerSecond = 10 // requests per second per tunnel
+	BurstSize         = 20 // max burst size
+
+	// HTTP rate limiting per visitor IP per tunnel (applied before the tunnel limit)
+	VisitorRequestsPerSecond = 5               // requests per second per visitor per tunnel
+	VisitorBurstSize         = 10              // max burst size per visitor
+	VisitorIdleTimeout       = 5 * time.Minute // forget visitors idle for this long
+
+	// HTTP rate limiting per visitor fingerprint per tunnel: visitors in the
+	// same network (IPv4 /24, IPv6 /48) with the same user agent and TLS
+	// fingerprint share a budget, looser than a single visitor's
+	FingerprintRequestsPerSecond = 20 // requests per second per fingerprint per tunnel
+	FingerprintBurstSize         = 40 // max burst size per fingerprint
+	FingerprintIPv4Prefix        = 24
+	FingerprintIPv6Prefix        = 48
+
+	// Tarpit for visitors that repeatedly hit rate limits
+	TarpitViolationThreshold = 20               // violations within the window before tarpitting
+	TarpitWindow             = 10 * time.Minute // violations older than this are forgotten
+	TarpitDelay              = 10 * time.Second // how long to stall each tarpitted response
+	MaxTarpitConnections     = 256              // max connections held in the tarpit at once
+
+	// Requests over the rate limit wait in a small per-tunnel queue before being rejected
+	RequestQueueSize       = 10               // max requests waiting per tunnel
+	RequestQueueTimeout    = 2 * time.Second  // default max time a request waits for a token
+	MaxRequestQueueTimeout = 20 * time.Second // most a client may raise it to (queue=<seconds>), within HTTPSWriteTimeout
+
+	// Request size limits
+	MaxRequestBodySize = 128 * 1024 * 1024 // 128MB
+
+	// Connection rate limiting (new connections per IP)
+	MaxConnectionsPerMinute = 10              // max new connections per IP per minute
+	ConnectionRateWindow    = 1 * time.Minute // sliding window for connection rate
+
+	// IP blocking, with separate thresholds per class of violation
+	BlockDuration               = 1 * time.Hour    // how long to block abusive IPs
+	ViolationWindow             = 10 * time.Minute // violations older than this are forgotten
+	ConnectionRateViolationsMax = 10               // SSH connections over the rate limit before auto-block
+	HTTPAbuseViolationsMax      = 10               // requests rejected by a client's tunnel rate limits before auto-block
+
+	// External blocklists
+	BlocklistRefreshInterval = 6 * time.Hour
+	BlocklistFetchTimeout    = 30 * time.Second
+	MaxBlocklistSize         = 16 * 1024 * 1024 // 16MB per source
+
+	// TLS fingerprint tracking of HTTPS visitors
+	MaxTrackedFingerprints     = 10000         // distinct fingerprints kept in memory
+	MaxFingerprintIPs          = 1000          // distinct visitor IPs counted per fingerprint
+	FingerprintIdleTimeout     = 1 * time.Hour // unseen fingerprints are evicted when full
+	DefaultFingerprintListSize = 100           // fingerprints listed by the admin API
+
+	// Tunnel lifetime
+	MaxTunnelLifetime = 24 * time.Hour // max tunnel duration regardless of activity
+
+	// Backend circuit breaker per tunnel
+	BreakerFailureThreshold = 5                // consecutive backend failures before tripping
+	BreakerCooldown         = 30 * time.Second // how long to fast-fail before probing again
+	BackendDownRetry        = 5 * time.Second  // reload delay of the page shown when a backend does not answer
+
+	// Active backend health probing through each tunnel
+	HealthProbeInterval = 30 * time.Second // how often to probe the local backend
+	HealthProbeTimeout  = 5 * time.Second  // max time to wait for a probe channel
+
+	// Concurrent backend connections (forwarded-tcpip channels) per tunnel;
+	// excess connections wait up to BackendConnWait for a slot, then are dropped
+	MaxBackendConns = 32
+	BackendConnWait = 10 * time.Second
+
+	// forwarded-tcpip channel opens awaiting the client's answer at once over
+	// one SSH connection; further opens queue up to ChannelOpenWait
+	MaxChannelOpens = 4
+	ChannelOpenWait = 10 * time.Second
+
+	// Longest wait for the first bytes of a connection to a tunnel listener,
+	// checked to be HTTP; longer than the proxy keeps idle connections
+	SniffTimeout = 2 * time.Minute
+
+	// Longest wait for the first bytes of a connection to the HTTPS port when
+	// SSH is multiplexed on it; clients that stay silent are taken for SSH
+	// clients waiting for the server's banner
+	MuxSniffTimeout = 2 * time.Second
+
+	// ALPN protocol native agents negotiate on the HTTPS port; version 1 is
+	// an SSH connection inside the TLS session
+	AgentProtocol = "tunnl/1"
+
+	// Channels the client refused because nothing listened on its local port,
+	// as while a dev server restarts, are retried with jittered backoff
+	BackendDialRetries     = 2
+	BackendDialBackoff     = 250 * time.Millisecond // first wait, doubling after each retry
+	BackendDialRetryWindow = 2 * time.Second        // retries never wait past this
+
+	// A tunnel is torn down once its client refused at least
+	// ChannelFailureBudget channels in a row, over at least ChannelFailureWindow
+	ChannelFailureBudget = 50
+	ChannelFailureWindow = 5 * time.Minute
+
+	// Response size limits
+	MaxResponseBodySize = 128 * 1024 * 1024 // 128MB
+
+	// Edge compression (tunnel option "compress"): responses of known length
+	// below this are sent as-is
+	CompressMinSize = 1024
+
+	// Bandwidth quota (bytes per SSH client IP per UTC day, 0 disables)
+	DefaultDailyBandwidthQuota = 10 * 1024 * 1024 * 1024 // 10GB
+
+	// Global load shedding (max in-flight proxied requests server-wide, 0 disables)
+	DefaultMaxConcurrentRequests = 2000
+	LoadShedRetryAfter           = 5 // seconds suggested to shed clients via Retry-After
+
+	// Emergency throttling: while server-wide load is over any of the
+	// thresholds, per-tunnel and per-visitor rate limits are cut to
+	// EmergencyThrottlePercent, until load stays under them for OverloadCalmPeriod
+	DefaultOverloadAcceptsPerSecond = 500 // new connections per second, all listeners
+	DefaultOverloadInFlightRequests = 1500
+	DefaultOverloadCPUPercent       = 90 // of all CPUs
+	OverloadCheckInterval           = 5 * time.Second
+	OverloadCalmPeriod              = 30 * time.Second
+	EmergencyThrottlePercent        = 25
+
+	// HTTP server timeouts
+	HTTPReadTimeout    = 10 * time.Second
+	HTTPWriteTimeout   = 10 * time.Second
+	HTTPIdleTimeout    = 30 * time.Second
+	HTTPSReadTimeout   = 30 * time.Second
+	HTTPSWriteTimeout  = 30 * time.Second
+	HTTPSIdleTimeout   = 120 * time.Second
+	StatsReadTimeout   = 5 * time.Second
+	StatsWriteTimeout  = 5 * time.Second
+	ShutdownTimeout    = 10 * time.Second
+
+	// On shutdown, how long to wait for proxied requests and WebSocket
+	// connections to finish before tunnels are closed, and how often to check
+	DrainTimeout       = 30 * time.Second
+	DrainCheckInterval = 100 * time.Millisecond
+
+	// Wait before reopening a listener that failed, when restarts are enabled
+	ListenerRestartBackoff = 1 * time.Second
+
+	// Migration hints sent to clients when a clustered server shuts down:
+	// clients are told to reconnect after a random delay up to the spread,
+	// and their sessions end with the exit status (EX_TEMPFAIL)
+	MigrationReconnectSpread = 10 * time.Second
+	MigrationHintTimeout     = 2 * time.Second // max time to deliver the hints
+	MigrationExitStatus      = 75
+
+	// Max time for a backend to start responding (0 disables); below
+	// HTTPSWriteTimeout so the 504 page can still be written
+	DefaultUpstreamResponseTimeout = 25 * time.Second
+
+	// Wildcard certificates via ACME DNS-01 (enabled with DNS_PROVIDER)
+	CertRenewBefore        = 30 * 24 * time.Hour // renew when fewer than 30 days remain
+	CertCheckInterval      = 12 * time.Hour      // how often expiry is checked
+	CertObtainTimeout      = 10 * time.Minute    // max time for one ACME order
+	DNSProviderTimeout     = 30 * time.Second    // per DNS provider API call
+	DNSPropagationTimeout  = 2 * time.Minute     // max wait for TXT records to become visible
+	DNSPropagationInterval = 5 * time.Second
+	DNSRecordTTL           = 120                 // seconds, for challenge TXT records
+
+	// Certificate files (TLS_CERT/TLS_KEY and CERTS_DIR) are checked for changes this often
+	CertReloadInterval = 1 * time.Minute
+
+	// Shared storage of ACME data and reservations (enabled with STORAGE_URL)
+	StorageTimeout       = 30 * time.Second // per storage operation
+	MaxStorageObjectSize = 1 << 20          // bytes read back per object
+
+	// Request and response bodies captured for tunnels with the inspect option
+	DefaultCaptureBodyLimit = 64 * 1024       // bytes of each body kept in memory
+	CaptureMemoryBudget     = 64 << 20        // bytes of bodies kept in memory across all captures
+	CaptureSpillBudget      = 128 << 20       // bytes buffered for spilling at any one time
+	CaptureTTL              = 1 * time.Hour   // captures and spilled bodies are deleted after this
+	CaptureSweepInterval    = 1 * time.Minute // how often expired captures are deleted
+	MaxCaptures             = 10000           // captures kept across all tunnels
+
+	// Memory shared by captured bodies, queued session log lines and the
+	// per-IP abuse tracking maps (MEMORY_BUDGET, 0 = unlimited); map entries
+	// are counted at an estimated size each
+	DefaultMemoryBudget = 256 << 20
+	AbuseEntryMemory    = 256
+
+	// Busiest subdomains and visitor IPs, from per-minute counters
+	TopTalkersWindow         = 60    // minutes of counters kept
+	MaxTopTalkerKeys         = 10000 // subdomains and visitor IPs counted per minute
+	DefaultTopTalkersMinutes = 5
+	DefaultTopTalkersLimit   = 10
+	MaxTopTalkersLimit       = 100
+
+	// Key material from a secret manager (enabled with SECRETS_PROVIDER)
+	SecretsProviderTimeout = 30 * time.Second // per secret manager API call
+	SecretRefreshInterval  = 10 * time.Minute // how often secrets are checked for rotation
+	MaxSecretSize          = 1 << 20          // bytes read from a secret manager response
+
+	// WebSocket limits
+	WebSocketIdleTimeout = 2 * time.Hour
+	MaxWebSocketTransfer = 1024 * 1024 * 1024 // 1GB
+
+	// Tunnel labels (set by clients via ssh -o SetEnv=TUNNL_LABEL_<key>=<value>)
+	LabelEnvPrefix     = "TUNNL_LABEL_"
+	MaxLabelsPerTunnel = 16
+	MaxLabelLength     = 64 // max length of a label key or value
+
+	// Passphrase protection (enabled by clients via ssh -o SetEnv=TUNNL_PASSPHRASE=1)
+	PassphraseEnv        = "TUNNL_PASSPHRASE"
+	PassphraseCookieName = "tunnl_auth"
+	PassphraseHeader     = "tunnl-passphrase"
+	UnlockPath           = "/__tunnl/unlock"
+
+	// How long to wait for the client's shell request before printing the banner
+	BannerWaitTimeout = 1 * time.Second
+
+	// How long a resized terminal must keep its size before the banner is redrawn
+	ResizeRedrawDelay = 500 * time.Millisecond
+
+	// Request logging; clients turn colors off with ssh -o SetEnv=NO_COLOR=1
+	NoColorEnv            = "NO_COLOR"
+	LogBufferSize         = 128 // buffered channel size for SSH terminal request logs
+	MaxLogExcludePatterns = 16  // path globs a client may hide from its request log
+	RequestHistorySize    = 100 // recent requests kept per tunnel for the API and "h" key
+	HistoryReplaySize     = 20  // requests replayed in the terminal by the "h" key
+
+	// Further ports a client may forward next to its first, and path
+	// prefixes it may route to them (route=/api:8080)
+	MaxForwards = 8
+	MaxRoutes   = 8
+	MaxServices = 8 // named services reachable at <name>--<subdomain> (service=api:8080)
+
+	// Header rules a tunnel may declare (request-header=, response-header=)
+	// and the longest value one may set
+	MaxHeaderRules       = 16
+	MaxHeaderValueLength = 1024
+
+	// Longest announcement an operator may broadcast to every session
+	MaxBroadcastLength = 500
+
+	// Path on every tunnel URL where owners download the request history
+	AccessLogPath = "/__tunnl/access-log"
+
+	// Path on the domain itself where clients behind proxies that only let
+	// HTTPS through open SSH connections inside a WebSocket
+	SSHWebSocketPath = "/__tunnl/ssh"
+
+	// Live request tail (SSE) on the stats server
+	MaxTailSubscribers = 10               // concurrent tails per subdomain
+	RequestFeedBuffer  = 64               // records buffered per tail before dropping
+	TailPingInterval   = 15 * time.Second // keepalive comment for idle streams
+
+	// Stats snapshots pushed over SSE on the stats server
+	DefaultStatsStreamInterval = 5   // seconds between snapshots
+	MaxStatsStreamInterval     = 300 // seconds
+	MaxStatsStreams            = 20  // concurrent streams
+
+	// SSH usernames act as lightweight, unauthenticated account identifiers
+	MaxTunnelsPerAccount = 5  // max concurrent tunnels per account (key, or username and IP)
+	MaxAccountNameLength = 32 // longer usernames are treated as anonymous
+
+	// Per-account request rate shared by all of an account's tunnels (0 disables)
+	DefaultAccountRequestsPerSecond = 25
+
+	// IPv6 clients are limited and blocked by their /64, which a single
+	// subscriber can rotate through freely
+	DefaultIPv6Prefix = 64
+
+	// Persistent store: how often state is saved, and how long a subdomain is
+	// held for its client to resume after the last backend disconnects
+	StoreFlushInterval = 1 * time.Minute
+	ResumeWindow       = 1 * time.Hour
+
+	// Usage counters are kept this long in memory when no store is configured
+	UsageRetention = 31 * 24 * time.Hour
+
+	// Authorized keys file granting per-key privileges
+	AuthorizedKeysReloadInterval = 10 * time.Second
+
+	// Interstitial warning cookie
+	WarningCookieName          = "tunnl_warned"
+	DefaultWarningCookieMaxAge = 24 * time.Hour
+	WarningPath                = "/__tunnl/continue"
+
+	// Warning cookie scopes: remember the acknowledgement per subdomain, or once
+	// per visitor for every subdomain of the domain
+	WarningScopeSubdomain = "subdomain"
+	WarningScopeVisitor   = "visitor"
+
+	// Warning bypass token for automated browsers (enabled via ssh -o SetEnv=TUNNL_BYPASS_TOKEN=1)
+	BypassEnv        = "TUNNL_BYPASS_TOKEN"
+	BypassHeader     = "tunnl-bypass-token"
+	BypassQueryParam = "tunnl_bypass"
+
+	// Sticky session cookie pinning visitors to one backend of a multi-client subdomain
+	StickyCookieName = "tunnl_backend"
+
+	// X-Robots-Tag sent on tunnel responses unless the tunnel allows indexing
+	RobotsTag = "noindex, nofollow"
+
+	// Cookie set by the JavaScript challenge of the "block-bots=challenge" tunnel option
+	BotChallengeCookieName   = "tunnl_human"
+	BotChallengeCookieMaxAge = 24 * time.Hour
+
+	// Shown to clients refused while maintenance mode pauses new tunnels
+	DefaultMaintenanceMessage = "This server is undergoing maintenance and is not accepting new tunnels. Please try again in a few minutes."
+
+	// Status page served to visitors of unknown subdomains during maintenance
+	// or while the subdomain registry cannot be reached
+	StatusPageRetryAfter = 5 * time.Minute
+)
+
+// Config holds runtime configuration loaded from environment
+type Config struct {
+	SSHAddr     string
+	HTTPAddr    string
+	HTTPSAddr   string
+	StatsAddr   string
+	HostKeyPath string
+	TLSCert     string
+	TLSKey      string
+	Domain      string
+
+	// Further domains served alongside Domain; tunnels pick one with domain=<name>
+	ExtraDomains []string
+
+	// Accept SSH clients on HTTPSAddr too, told apart from HTTPS visitors by
+	// their first bytes, for networks that block SSHAddr's port
+	SSHOnHTTPSPort bool
+
+	// Accept native agents on HTTPSAddr: TLS clients offering AgentProtocol
+	// by ALPN instead of h2 or http/1.1
+	AgentALPN bool
+
+	DailyBandwidthQuota   int64
+	MaxConcurrentRequests int
+	StickySessions        bool
+
+	// Server-wide load that turns on emergency throttling (0 disables each)
+	OverloadAcceptsPerSecond int
+	OverloadInFlightRequests int
+	OverloadCPUPercent       int
+
+	// Per-account quotas, applied across all IPs an account connects from (0 disables)
+	AccountDailyBandwidthQuota int64
+	AccountRequestsPerSecond   int
+
+	// Request rate shared fairly by all tunnels of a client IP (0 = per-tunnel limits only)
+	IPRequestsPerSecond int
+
+	// Prefix length IPv6 clients are counted and blocked by (128 = per address)
+	IPv6Prefix int
+
+	// Largest response size authorized keys and tiers may raise a tunnel's limit to
+	MaxResponseSizeCeiling int64
+
+	// Max time for a backend to produce response headers before a 504 (0 disables)
+	UpstreamResponseTimeout time.Duration
+
+	// nftables sets ("<family> <table> <set>") that mirror blocked IPs; empty disables
+	NFTSet  string
+	NFTSet6 string
+
+	// Blocklist sources (URLs or file paths) refreshed periodically
+	Blocklists []string
+
+	// IPs and CIDR ranges (own offices, monitoring probes) exempt from the
+	// connection rate limit and blocklists, and never auto-blocked
+	TrustedIPs []string
+
+	// Auto-block policies of the two classes of violations: how many within
+	// ViolationWindow block the client IP (0 = never) and for how long.
+	// Connection rate violations are SSH connections over
+	// MaxConnectionsPerMinute; HTTP abuse is requests rejected by the rate
+	// limits of a client's tunnels.
+	ConnectionRateBlockAfter    int
+	ConnectionRateBlockDuration time.Duration
+	HTTPAbuseBlockAfter         int
+	HTTPAbuseBlockDuration      time.Duration
+
+	// CSV database of IP ranges and country codes for the request log's
+	// visitor columns (empty = no countries)
+	GeoIPPath string
+
+	// TLS fingerprints (JA3 hashes or JA4 strings) refused at the handshake
+	TLSFingerprintBlocklist []string
+
+	// Directory of <lang>.json files overriding the warning page translations
+	WarningLocalesDir string
+
+	// Warning cookie policy (0 max age = session cookie)
+	WarningCookieMaxAge   time.Duration
+	WarningCookieSameSite string // lax, strict or none
+	WarningCookieScope    string // WarningScopeSubdomain or WarningScopeVisitor
+
+	// OpenSSH-style authorized keys file with per-key options (empty = disabled)
+	AuthorizedKeysPath string
+	// Reject clients whose key is not in the authorized keys file
+	RequireAuthorizedKey bool
+
+	// JSON file defining named tiers for authorized keys (empty = built-in limits)
+	TiersPath string
+
+	// SQLite database persisting users, reservations, usage and blocks (empty = in-memory only)
+	StorePath string
+
+	// Storage shared by the servers of a cluster for ACME data and subdomain
+	// reservations: a directory, s3://bucket/prefix or redis://host:port/db
+	// (empty = ACMECacheDir and StorePath)
+	StorageURL string
+
+	// SSH addresses (host or host:port) of other servers of the cluster that
+	// clients are pointed to when this one shuts down
+	MigrationNodes []string
+
+	// Bytes of each request and response body captured in memory for
+	// inspected tunnels, and storage that larger bodies are spilled to, up
+	// to MaxStorageObjectSize (empty = truncate at the limit)
+	CaptureBodyLimit int
+	CaptureSpillURL  string
+
+	// Bytes shared by captures, session log buffers and abuse maps; the
+	// oldest captures and arbitrary tracking entries are evicted and log
+	// lines dropped once it is used up (0 = unlimited)
+	MemoryBudget int64
+
+	// Times a failed listener is reopened on its address before the failure
+	// stops the server (0 = stop at the first failure)
+	ListenerRestarts int
+
+	// Secret manager holding the TLS certificate and key and the SSH host key
+	// (empty = read them from TLSCert/TLSKey and HostKeyPath). Secret names
+	// are provider paths with an optional "#field".
+	SecretsProvider string
+	TLSCertSecret   string
+	TLSKeySecret    string
+	HostKeySecret   string
+
+	// DNS provider for ACME DNS-01 wildcard certificates (empty = use TLSCert/TLSKey)
+	DNSProvider   string
+	ACMEEmail     string
+	ACMEDirectory string
+	ACMECacheDir  string // account key and issued certificate
+
+	// TLS policy of the HTTPS server: minimum version ("1.2" or "1.3"),
+	// TLS 1.2 cipher suites and curves (empty = Go defaults), ALPN protocols
+	TLSMinVersion   string
+	TLSCipherSuites []string
+	TLSCurves       []string
+	TLSALPN         []string
+
+	// Directory of <name>.crt/<name>.key pairs served by SNI alongside the
+	// main certificate, picked up without a restart (empty = none)
+	CertsDir string
+}
+
+// Default returns configuration with default values
+func Default() *Config {
+	return &Config{
+		SSHAddr:     ":22",
+		HTTPAddr:    ":80",
+		HTTPSAddr:   ":443",
+		StatsAddr:   "127.0.0.1:9090",
+		HostKeyPath: "host_key",
+		TLSCert:     fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", DefaultDomain),
+		TLSKey:      fmt.Sprintf("/etc/letsencrypt/live/%s/privkey.pem", DefaultDomain),
+		Domain:      DefaultDomain,
+
+		DailyBandwidthQuota:   DefaultDailyBandwidthQuota,
+		MaxConcurrentRequests: DefaultMaxConcurrentRequests,
+
+		OverloadAcceptsPerSecond: DefaultOverloadAcceptsPerSecond,
+		OverloadInFlightRequests: DefaultOverloadInFlightRequests,
+		OverloadCPUPercent:       DefaultOverloadCPUPercent,
+
+		AccountDailyBandwidthQuota: DefaultDailyBandwidthQuota,
+		AccountRequestsPerSecond:   DefaultAccountRequestsPerSecond,
+		IPv6Prefix:                 DefaultIPv6Prefix,
+
+		ConnectionRateBlockAfter:    ConnectionRateViolationsMax,
+		ConnectionRateBlockDuration: BlockDuration,
+		HTTPAbuseBlockAfter:         HTTPAbuseViolationsMax,
+		HTTPAbuseBlockDuration:      BlockDuration,
+
+		MaxResponseSizeCeiling:  MaxResponseBodySize,
+		UpstreamResponseTimeout: DefaultUpstreamResponseTimeout,
+		CaptureBodyLimit:        DefaultCaptureBodyLimit,
+		MemoryBudget:            DefaultMemoryBudget,
+
+		WarningCookieMaxAge:   DefaultWarningCookieMaxAge,
+		WarningCookieSameSite: "lax",
+		WarningCookieScope:    WarningScopeSubdomain,
+
+		TLSMinVersion: "1.2",
+		TLSALPN:       []string{"h2", "http/1.1"},
+
+		ACMEDirectory: "https://acme-v02.api.letsencrypt.org/directory",
+		ACMECacheDir:  "acme",
+	}
+}
@@ -0,0 +1,548 @@
+package server
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// BlockCallback is called when an IP is blocked
+type BlockCallback func(ip string)
+
+// ViolationClass is a kind of abuse the tracker counts separately, with its
+// own threshold and block policy
+type ViolationClass int
+
+const (
+	// ViolationConnectionRate is an SSH connection over MaxConnectionsPerMinute
+	ViolationConnectionRate ViolationClass = iota
+	// ViolationHTTPRateLimit is a request to one of a client's tunnels
+	// rejected by the tunnel's rate limit
+	ViolationHTTPRateLimit
+
+	numViolationClasses
+)
+
+var violationClassNames = [numViolationClasses]string{"connection_rate", "http_rate_limit"}
+
+// String returns the class's name as used in stats
+func (c ViolationClass) String() string {
+	return violationClassNames[c]
+}
+
+// ViolationPolicy decides when violations of a class get an IP blocked
+type ViolationPolicy struct {
+	Threshold int           // violations within Window that block the IP (0 = never block)
+	Window    time.Duration // violations older than this are forgotten
+	BlockFor  time.Duration // how long the IP stays blocked
+}
+
+// violationRecord counts an IP's recent violations of one class
+type violationRecord struct {
+	count int
+	since time.Time // first violation counted
+}
+
+// AbuseTracker tracks connection patterns and blocks abusive IPs
+type AbuseTracker struct {
+	mu sync.RWMutex
+
+	// Connection timestamps per IP for rate limiting
+	connectionTimes map[string][]time.Time
+
+	// Blocked IPs with expiration time
+	blockedIPs map[string]time.Time
+
+	// Recent violations per class and IP, and the policy of each class
+	violations [numViolationClasses]map[string]*violationRecord
+	policies   [numViolationClasses]ViolationPolicy
+
+	// Callback when IP is blocked
+	onBlock BlockCallback
+
+	// Optional external enforcement (e.g. nftables) for blocked IPs
+	enforcer BlockEnforcer
+
+	// Ranges from external blocklists (replaced wholesale on each refresh)
+	blocklist []netip.Prefix
+
+	// Operator ranges exempt from connection rate limits, blocklists and auto-blocks
+	trusted []netip.Prefix
+
+	// Optional budget counting connection and violation entries (blocks are not counted)
+	memory *MemoryBudget
+
+	// IPv6 clients are tracked by their prefix of this many bits (see ipKey)
+	ipv6Prefix int
+
+	// Stats (use atomic operations for thread safety)
+	totalBlocked     atomic.Uint64
+	totalRateLimited atomic.Uint64
+	blocklistMatches atomic.Uint64
+	violationTotals  [numViolationClasses]atomic.Uint64
+	violationBlocks  [numViolationClasses]atomic.Uint64
+
+	// Lifecycle management for cleanup goroutine
+	stopCleanup chan struct{}
+	cleanupDone chan struct{}
+}
+
+// NewAbuseTracker creates a new abuse tracker
+func NewAbuseTracker() *AbuseTracker {
+	at := &AbuseTracker{
+		connectionTimes: make(map[string][]time.Time),
+		blockedIPs:      make(map[string]time.Time),
+		ipv6Prefix:      config.DefaultIPv6Prefix,
+		stopCleanup:     make(chan struct{}),
+		cleanupDone:     make(chan struct{}),
+	}
+	for c := range at.violations {
+		at.violations[c] = make(map[string]*violationRecord)
+	}
+	at.policies[ViolationConnectionRate] = ViolationPolicy{
+		Threshold: config.ConnectionRateViolationsMax,
+		Window:    config.ViolationWindow,
+		BlockFor:  config.BlockDuration,
+	}
+	at.policies[ViolationHTTPRateLimit] = ViolationPolicy{
+		Threshold: config.HTTPAbuseViolationsMax,
+		Window:    config.ViolationWindow,
+		BlockFor:  config.BlockDuration,
+	}
+
+	// Start cleanup goroutine
+	go at.cleanup()
+
+	return at
+}
+
+// Stop gracefully stops the cleanup goroutine
+func (at *AbuseTracker) Stop() {
+	close(at.stopCleanup)
+	<-at.cleanupDone
+}
+
+// SetOnBlockCallback sets the callback to be called when an IP is blocked
+func (at *AbuseTracker) SetOnBlockCallback(cb BlockCallback) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.onBlock = cb
+}
+
+// SetPolicy replaces the block policy of a violation class
+func (at *AbuseTracker) SetPolicy(class ViolationClass, policy ViolationPolicy) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.policies[class] = policy
+}
+
+// SetMemoryBudget makes connection and violation entries count against b
+func (at *AbuseTracker) SetMemoryBudget(b *MemoryBudget) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.memory = b
+}
+
+// reserveEntry takes budget for a new connection or violation entry,
+// evicting arbitrary entries while over budget. It returns false if there
+// is nothing left to evict; the new entry is then not tracked. Must be
+// called with lock held.
+func (at *AbuseTracker) reserveEntry() bool {
+	for !at.memory.Reserve(memoryAbuse, config.AbuseEntryMemory) {
+		if !at.evictEntry() {
+			at.memory.Evicted(memoryAbuse)
+			return false
+		}
+	}
+	return true
+}
+
+// evictEntry forgets an arbitrary connection or violation entry (must be
+// called with lock held)
+func (at *AbuseTracker) evictEntry() bool {
+	for ip := range at.connectionTimes {
+		at.deleteConnectionTimes(ip)
+		at.memory.Evicted(memoryAbuse)
+		return true
+	}
+	for c := range at.violations {
+		for ip := range at.violations[c] {
+			at.deleteViolations(ViolationClass(c), ip)
+			at.memory.Evicted(memoryAbuse)
+			return true
+		}
+	}
+	return false
+}
+
+// deleteConnectionTimes forgets an IP's connections (must be called with lock held)
+func (at *AbuseTracker) deleteConnectionTimes(ip string) {
+	delete(at.connectionTimes, ip)
+	at.memory.Release(memoryAbuse, config.AbuseEntryMemory)
+}
+
+// deleteViolations forgets an IP's violations of a class (must be called with lock held)
+func (at *AbuseTracker) deleteViolations(class ViolationClass, ip string) {
+	delete(at.violations[class], ip)
+	at.memory.Release(memoryAbuse, config.AbuseEntryMemory)
+}
+
+// SetIPv6Prefix sets the prefix length IPv6 clients are tracked and blocked by
+func (at *AbuseTracker) SetIPv6Prefix(bits int) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.ipv6Prefix = bits
+}
+
+// SetEnforcer sets an external enforcer that mirrors IP blocks
+func (at *AbuseTracker) SetEnforcer(e BlockEnforcer) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.enforcer = e
+}
+
+// enforce mirrors a block or unblock to the external enforcer, if set
+// (must be called without lock held)
+func (at *AbuseTracker) enforce(ip string, block bool, duration time.Duration) {
+	at.mu.RLock()
+	e := at.enforcer
+	at.mu.RUnlock()
+
+	if e == nil {
+		return
+	}
+	// Run outside the caller's path since enforcers may shell out
+	go func() {
+		var err error
+		if block {
+			err = e.Block(ip, duration)
+		} else {
+			err = e.Unblock(ip)
+		}
+		if err != nil {
+			log.Printf("Failed to update block enforcement for IP %s: %v", ip, err)
+		}
+	}()
+}
+
+// callOnBlock calls the onBlock callback if set (must be called without lock held)
+func (at *AbuseTracker) callOnBlock(ip string) {
+	at.mu.RLock()
+	cb := at.onBlock
+	at.mu.RUnlock()
+
+	if cb != nil {
+		// Call callback without holding lock to avoid deadlock
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Panic in onBlock callback for IP %s: %v", ip, r)
+				}
+			}()
+			cb(ip)
+		}()
+	}
+}
+
+// GetBlockExpiry returns the expiry time for a blocked IP, or zero time if not blocked
+func (at *AbuseTracker) GetBlockExpiry(ip string) time.Time {
+	at.mu.RLock()
+	defer at.mu.RUnlock()
+
+	expiry, blocked := at.blockedIPs[ipKey(ip, at.ipv6Prefix)]
+	if !blocked || time.Now().After(expiry) {
+		return time.Time{}
+	}
+	return expiry
+}
+
+// SetBlocklist replaces the set of externally listed IP ranges
+func (at *AbuseTracker) SetBlocklist(prefixes []netip.Prefix) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.blocklist = prefixes
+}
+
+// SetTrusted replaces the set of trusted IP ranges
+func (at *AbuseTracker) SetTrusted(prefixes []netip.Prefix) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.trusted = prefixes
+}
+
+// IsTrusted returns true if the IP falls in a trusted range
+func (at *AbuseTracker) IsTrusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	at.mu.RLock()
+	defer at.mu.RUnlock()
+	for _, prefix := range at.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsListed returns true if the IP falls in a range from an external blocklist
+func (at *AbuseTracker) IsListed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	at.mu.RLock()
+	defer at.mu.RUnlock()
+	for _, prefix := range at.blocklist {
+		if prefix.Contains(addr) {
+			at.blocklistMatches.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+// GetBlocklistStats returns the number of listed ranges and how many connections matched them
+func (at *AbuseTracker) GetBlocklistStats() (entries int, matches uint64) {
+	at.mu.RLock()
+	defer at.mu.RUnlock()
+	return len(at.blocklist), at.blocklistMatches.Load()
+}
+
+// BlockIP blocks an IP, or its IPv6 prefix, for the configured duration
+func (at *AbuseTracker) BlockIP(ip string) {
+	at.mu.Lock()
+	ip = ipKey(ip, at.ipv6Prefix)
+	at.blockedIPs[ip] = time.Now().Add(config.BlockDuration)
+	at.mu.Unlock()
+
+	at.totalBlocked.Add(1)
+	at.enforce(ip, true, config.BlockDuration)
+	at.callOnBlock(ip)
+}
+
+// RecordViolation counts a violation of a class by an IP and blocks the IP
+// per the class's policy. It returns true if the IP was blocked. Trusted IPs
+// are never blocked.
+func (at *AbuseTracker) RecordViolation(class ViolationClass, ip string) bool {
+	if at.IsTrusted(ip) {
+		at.violationTotals[class].Add(1)
+		return false
+	}
+	at.mu.Lock()
+	ip = ipKey(ip, at.ipv6Prefix)
+	blockFor, blocked := at.recordViolation(class, ip, time.Now())
+	at.mu.Unlock()
+
+	at.violationTotals[class].Add(1)
+	if blocked {
+		at.violationBlocks[class].Add(1)
+		at.totalBlocked.Add(1)
+		at.enforce(ip, true, blockFor)
+		at.callOnBlock(ip)
+	}
+	return blocked
+}
+
+// recordViolation counts a violation and blocks the IP once the class's
+// threshold is reached within its window (must be called with lock held)
+func (at *AbuseTracker) recordViolation(class ViolationClass, ip string, now time.Time) (time.Duration, bool) {
+	policy := at.policies[class]
+	rec := at.violations[class][ip]
+	if rec == nil && !at.reserveEntry() {
+		return 0, false
+	}
+	if rec == nil || now.Sub(rec.since) > policy.Window {
+		rec = &violationRecord{since: now}
+		at.violations[class][ip] = rec
+	}
+	rec.count++
+	if policy.Threshold == 0 || rec.count < policy.Threshold {
+		return 0, false
+	}
+	at.deleteViolations(class, ip)
+	at.blockedIPs[ip] = now.Add(policy.BlockFor)
+	return policy.BlockFor, true
+}
+
+// ViolationStats returns the violations counted and the blocks they caused, per class name
+func (at *AbuseTracker) ViolationStats() map[string]ViolationStats {
+	stats := make(map[string]ViolationStats, numViolationClasses)
+	for c := range numViolationClasses {
+		stats[c.String()] = ViolationStats{
+			Violations: at.violationTotals[c].Load(),
+			Blocks:     at.violationBlocks[c].Load(),
+		}
+	}
+	return stats
+}
+
+// ViolationStats counts the violations of one class
+type ViolationStats struct {
+	Violations uint64 `json:"violations"`
+	Blocks     uint64 `json:"blocks"`
+}
+
+// CheckConnectionRate checks if a new connection from IP should be allowed
+// Returns true if allowed, false if rate limited
+// Auto-blocks IP after repeated violations
+func (at *AbuseTracker) CheckConnectionRate(ip string) bool {
+	if at.IsTrusted(ip) {
+		return true
+	}
+	at.mu.Lock()
+	key := ipKey(ip, at.ipv6Prefix)
+
+	now := time.Now()
+	windowStart := now.Add(-config.ConnectionRateWindow)
+
+	// Get existing timestamps and filter to current window
+	times, tracked := at.connectionTimes[key]
+	validTimes := make([]time.Time, 0, len(times))
+	for _, t := range times {
+		if t.After(windowStart) {
+			validTimes = append(validTimes, t)
+		}
+	}
+
+	// Check if over limit
+	if len(validTimes) >= config.MaxConnectionsPerMinute {
+		at.mu.Unlock()
+
+		at.totalRateLimited.Add(1)
+		// Auto-block after too many violations
+		at.RecordViolation(ViolationConnectionRate, ip)
+		return false
+	}
+
+	// Record this connection, unless the IP is new and the memory budget
+	// leaves no room to track it
+	if tracked || at.reserveEntry() {
+		validTimes = append(validTimes, now)
+		at.connectionTimes[key] = validTimes
+	}
+
+	at.mu.Unlock()
+	return true
+}
+
+
+// Blocks returns a copy of the active IP blocks and their expiry times
+func (at *AbuseTracker) Blocks() map[string]time.Time {
+	at.mu.RLock()
+	defer at.mu.RUnlock()
+
+	now := time.Now()
+	blocks := make(map[string]time.Time, len(at.blockedIPs))
+	for ip, expiry := range at.blockedIPs {
+		if expiry.After(now) {
+			blocks[ip] = expiry
+		}
+	}
+	return blocks
+}
+
+// RestoreBlocks reinstates IP blocks saved by a previous run
+func (at *AbuseTracker) RestoreBlocks(blocks map[string]time.Time) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	for ip, expiry := range blocks {
+		ip = ipKey(ip, at.ipv6Prefix)
+		if expiry.After(at.blockedIPs[ip]) {
+			at.blockedIPs[ip] = expiry
+		}
+	}
+}
+
+// GetStats returns abuse tracking statistics
+func (at *AbuseTracker) GetStats() (blockedIPs int, totalBlocked uint64, totalRateLimited uint64) {
+	at.mu.RLock()
+	defer at.mu.RUnlock()
+
+	// Count currently active blocks
+	now := time.Now()
+	activeBlocks := 0
+	for _, expiry := range at.blockedIPs {
+		if expiry.After(now) {
+			activeBlocks++
+		}
+	}
+
+	return activeBlocks, at.totalBlocked.Load(), at.totalRateLimited.Load()
+}
+
+// cleanup periodically removes expired entries
+func (at *AbuseTracker) cleanup() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	defer close(at.cleanupDone)
+
+	for {
+		select {
+		case <-at.stopCleanup:
+			return
+		case <-ticker.C:
+			at.mu.Lock()
+
+			now := time.Now()
+			windowStart := now.Add(-config.ConnectionRateWindow)
+			// Use 2x window for stale data cleanup
+			staleThreshold := now.Add(-2 * config.ConnectionRateWindow)
+
+			// Clean up connection times
+			for ip, times := range at.connectionTimes {
+				validTimes := make([]time.Time, 0, len(times))
+				for _, t := range times {
+					if t.After(windowStart) {
+						validTimes = append(validTimes, t)
+					}
+				}
+				if len(validTimes) == 0 {
+					at.deleteConnectionTimes(ip)
+				} else {
+					// Also clean up if most recent connection is too old
+					mostRecent := validTimes[len(validTimes)-1]
+					if mostRecent.Before(staleThreshold) {
+						at.deleteConnectionTimes(ip)
+					} else {
+						at.connectionTimes[ip] = validTimes
+					}
+				}
+			}
+
+			// Clean up expired blocks
+			var unblocked []string
+			for ip, expiry := range at.blockedIPs {
+				if expiry.Before(now) {
+					delete(at.blockedIPs, ip)
+					unblocked = append(unblocked, ip)
+				}
+			}
+
+			// Clean up violations past their class's window
+			for c, records := range at.violations {
+				for ip, rec := range records {
+					if now.Sub(rec.since) > at.policies[c].Window {
+						at.deleteViolations(ViolationClass(c), ip)
+					}
+				}
+			}
+
+			at.mu.Unlock()
+
+			for _, ip := range unblocked {
+				at.enforce(ip, false, 0)
+			}
+		}
+	}
+}
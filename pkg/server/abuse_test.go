@@ -1,6 +1,7 @@
 package server
 
 import (
+	"net/netip"
 	"sync"
 	"testing"
 	"time"
@@ -172,3 +173,107 @@ func TestAbuseTracker_DifferentIPs(t *testing.T) {
 		t.Error("rate limiting one IP should not affect another")
 	}
 }
+
+type fakeEnforcer struct {
+	blocked chan string
+}
+
+func (f *fakeEnforcer) Block(ip string, _ time.Duration) error {
+	f.blocked <- ip
+	return nil
+}
+
+func (f *fakeEnforcer) Unblock(string) error { return nil }
+
+func TestAbuseTracker_Enforcer(t *testing.T) {
+	at := newTestTracker(t)
+	fe := &fakeEnforcer{blocked: make(chan string, 1)}
+	at.SetEnforcer(fe)
+
+	at.BlockIP("1.2.3.4")
+
+	select {
+	case ip := <-fe.blocked:
+		if ip != "1.2.3.4" {
+			t.Errorf("enforcer got %q, want 1.2.3.4", ip)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("enforcer was not called on block")
+	}
+}
+
+func TestAbuseTracker_ViolationClasses(t *testing.T) {
+	at := newTestTracker(t)
+	at.SetPolicy(ViolationHTTPRateLimit, ViolationPolicy{Threshold: 3, Window: time.Minute, BlockFor: 5 * time.Minute})
+	at.SetPolicy(ViolationConnectionRate, ViolationPolicy{Threshold: 0, Window: time.Minute, BlockFor: time.Hour})
+
+	// Connection rate violations never block with a zero threshold, and do
+	// not count towards the HTTP class
+	for i := 0; i < 30; i++ {
+		at.CheckConnectionRate("1.2.3.4")
+	}
+	if !at.GetBlockExpiry("1.2.3.4").IsZero() {
+		t.Fatal("connection rate violations should not block with a zero threshold")
+	}
+	if at.RecordViolation(ViolationHTTPRateLimit, "1.2.3.4") || at.RecordViolation(ViolationHTTPRateLimit, "1.2.3.4") {
+		t.Fatal("HTTP violations below the threshold should not block")
+	}
+	if !at.RecordViolation(ViolationHTTPRateLimit, "1.2.3.4") {
+		t.Fatal("third HTTP violation should block")
+	}
+	if expiry := at.GetBlockExpiry("1.2.3.4"); time.Until(expiry) > 5*time.Minute {
+		t.Errorf("block expires in %v, want the HTTP class's 5m", time.Until(expiry))
+	}
+
+	stats := at.ViolationStats()
+	if got := stats["connection_rate"]; got.Violations != 20 || got.Blocks != 0 {
+		t.Errorf("connection_rate = %+v, want 20 violations and no blocks", got)
+	}
+	if got := stats["http_rate_limit"]; got.Violations != 3 || got.Blocks != 1 {
+		t.Errorf("http_rate_limit = %+v, want 3 violations and 1 block", got)
+	}
+}
+
+func TestAbuseTracker_ViolationWindow(t *testing.T) {
+	at := newTestTracker(t)
+	at.SetPolicy(ViolationHTTPRateLimit, ViolationPolicy{Threshold: 2, Window: time.Minute, BlockFor: time.Hour})
+
+	start := time.Now()
+	at.mu.Lock()
+	at.recordViolation(ViolationHTTPRateLimit, "1.2.3.4", start)
+	_, blocked := at.recordViolation(ViolationHTTPRateLimit, "1.2.3.4", start.Add(2*time.Minute))
+	at.mu.Unlock()
+	if blocked {
+		t.Error("a violation outside the window should start a new count")
+	}
+}
+
+func TestAbuseTracker_Trusted(t *testing.T) {
+	at := newTestTracker(t)
+	prefix, _ := parsePrefix("10.0.0.0/8")
+	single, _ := parsePrefix("2001:db8::1")
+	at.SetTrusted([]netip.Prefix{prefix, single})
+
+	for _, ip := range []string{"10.1.2.3", "::ffff:10.1.2.3", "2001:db8::1"} {
+		if !at.IsTrusted(ip) {
+			t.Errorf("IsTrusted(%q) = false, want true", ip)
+		}
+	}
+	if at.IsTrusted("11.0.0.1") || at.IsTrusted("2001:db8::2") {
+		t.Error("IPs outside the trusted ranges should not be trusted")
+	}
+
+	for i := 0; i < 50; i++ {
+		if !at.CheckConnectionRate("10.1.2.3") {
+			t.Fatalf("trusted IP rate limited on connection %d", i+1)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if at.RecordViolation(ViolationHTTPRateLimit, "10.1.2.3") {
+			t.Fatal("trusted IP should never be auto-blocked")
+		}
+	}
+	if !at.GetBlockExpiry("10.1.2.3").IsZero() {
+		t.Error("trusted IP should not be blocked")
+	}
+}
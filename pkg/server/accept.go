@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// ServeSSH accepts SSH connections on ln and handles each in its own
+// goroutine until ln is closed, when it returns nil. Failed accepts are
+// retried with backoff; it returns an error only once the listener has
+// failed MaxSSHAcceptFailures times in a row with errors that are not
+// temporary.
+func (s *Server) ServeSSH(ln net.Listener) error {
+	var delay time.Duration
+	failures := 0
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			s.accepts[listenerSSH].RecordError()
+			failures++
+			temporary := isTemporaryAcceptError(err)
+			if !temporary && failures >= config.MaxSSHAcceptFailures {
+				return fmt.Errorf("SSH listener failed %d times in a row: %w", failures, err)
+			}
+
+			if delay == 0 {
+				delay = s.acceptBackoff
+			} else {
+				delay = min(2*delay, config.MaxSSHAcceptBackoff)
+			}
+			// A persistent error is logged on its 1st, 2nd, 4th, 8th... occurrence
+			if failures&(failures-1) == 0 {
+				log.Printf("Failed to accept SSH connection (%d in a row, temporary: %v), retrying in %v: %v", failures, temporary, delay, err)
+			}
+			time.Sleep(delay)
+			continue
+		}
+
+		if failures > 0 {
+			log.Printf("SSH listener accepting again after %d failed accepts", failures)
+			failures, delay = 0, 0
+		}
+		go s.HandleSSHConnection(conn)
+	}
+}
+
+// isTemporaryAcceptError reports whether an accept failed for a reason that
+// clears by itself, such as running out of file descriptors or a client
+// aborting its connection before it was accepted
+func isTemporaryAcceptError(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+			syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN:
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
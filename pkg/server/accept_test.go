@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// scriptedListener returns the given accept results in order, then reports
+// being closed
+type scriptedListener struct {
+	net.Listener
+	results  []error // nil accepts a connection
+	accepted int
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	if len(l.results) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.results[0]
+	l.results = l.results[1:]
+	if err != nil {
+		return nil, err
+	}
+	l.accepted++
+	client, server := net.Pipe()
+	client.Close()
+	return server, nil
+}
+
+func (l *scriptedListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestServeSSH_RetriesTemporaryErrors(t *testing.T) {
+	s := newTestServer(t)
+	s.acceptBackoff = time.Microsecond
+
+	// Running out of file descriptors clears by itself, however long it lasts
+	results := []error{nil}
+	for range config.MaxSSHAcceptFailures + 2 {
+		results = append(results, &net.OpError{Op: "accept", Err: syscall.EMFILE})
+	}
+	ln := &scriptedListener{results: append(results, nil)}
+
+	if err := s.ServeSSH(ln); err != nil {
+		t.Fatalf("ServeSSH() = %v, want nil once the listener is closed", err)
+	}
+	if ln.accepted != 2 {
+		t.Errorf("accepted %d connections, want 2", ln.accepted)
+	}
+	if errs := s.accepts[listenerSSH].Stats().Errors; errs != uint64(config.MaxSSHAcceptFailures+2) {
+		t.Errorf("%d accept errors counted, want %d", errs, config.MaxSSHAcceptFailures+2)
+	}
+}
+
+func TestServeSSH_GivesUpOnPersistentErrors(t *testing.T) {
+	s := newTestServer(t)
+	s.acceptBackoff = time.Microsecond
+
+	broken := errors.New("listener broken")
+	var results []error
+	for range config.MaxSSHAcceptFailures + 5 {
+		results = append(results, broken)
+	}
+	ln := &scriptedListener{results: results}
+
+	err := s.ServeSSH(ln)
+	if !errors.Is(err, broken) || !strings.Contains(err.Error(), "in a row") {
+		t.Fatalf("ServeSSH() = %v, want the listener's error", err)
+	}
+	if left := len(ln.results); left != 5 {
+		t.Errorf("%d accepts left, want ServeSSH to stop after %d failures", left, config.MaxSSHAcceptFailures)
+	}
+}
+
+func TestServeSSH_SuccessResetsFailures(t *testing.T) {
+	s := newTestServer(t)
+	s.acceptBackoff = time.Microsecond
+
+	// Failures short of the limit, separated by accepted connections, never add up
+	broken := errors.New("listener broken")
+	var results []error
+	for range 3 {
+		for range config.MaxSSHAcceptFailures - 1 {
+			results = append(results, broken)
+		}
+		results = append(results, nil)
+	}
+	ln := &scriptedListener{results: results}
+
+	if err := s.ServeSSH(ln); err != nil {
+		t.Fatalf("ServeSSH() = %v, want nil", err)
+	}
+	if ln.accepted != 3 {
+		t.Errorf("accepted %d connections, want 3", ln.accepted)
+	}
+}
+
+func TestIsTemporaryAcceptError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "accept", Err: syscall.EMFILE}, true},
+		{&net.OpError{Op: "accept", Err: syscall.ENFILE}, true},
+		{&net.OpError{Op: "accept", Err: syscall.ECONNABORTED}, true},
+		{&net.OpError{Op: "accept", Err: syscall.EINVAL}, false},
+		{errors.New("listener broken"), false},
+	}
+	for _, tt := range tests {
+		if got := isTemporaryAcceptError(tt.err); got != tt.want {
+			t.Errorf("isTemporaryAcceptError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnl.gg/internal/subdomain"
+	"tunnl.gg/pkg/config"
+)
+
+// genericUsernames are default or shared SSH usernames that do not identify
+// anyone, so clients using them stay anonymous
+var genericUsernames = map[string]bool{
+	"root": true, "admin": true, "user": true, "guest": true, "test": true,
+	"ubuntu": true, "debian": true, "centos": true, "ec2-user": true, "pi": true,
+	"git": true, "tunnel": true, "tunnl": true,
+}
+
+// accountName returns the account key for an SSH username, or "" if the
+// username is generic or not a valid account name. Account names are not
+// authenticated; they namespace limits and subdomain prefixes.
+func accountName(user string) string {
+	user, _ = splitEntropy(user)
+	name := strings.ToLower(user)
+	if name == "" || len(name) > config.MaxAccountNameLength || genericUsernames[name] {
+		return ""
+	}
+	for _, c := range name {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' || c == '.' || c == '-') {
+			return ""
+		}
+	}
+	return name
+}
+
+// entropySuffix ends usernames that choose the entropy level of the
+// subdomain generated for the connection, as in alice+entropy=high
+const entropySuffix = "+entropy="
+
+// splitEntropy splits the entropy level, if any, off an SSH username
+func splitEntropy(user string) (name, level string) {
+	if i := strings.LastIndex(user, entropySuffix); i >= 0 {
+		return user[:i], strings.ToLower(user[i+len(entropySuffix):])
+	}
+	return user, ""
+}
+
+// permKeyFingerprint is the ssh.Permissions extension carrying the fingerprint of a client's authorized key
+const permKeyFingerprint = "tunnl-key-fingerprint"
+
+// tunnelLimits returns the per-IP and per-account tunnel limits for a client.
+// An authorized key's max-tunnels, or else its tier's, replaces both defaults.
+func tunnelLimits(tier *Tier, key *AuthorizedKey) (perIP, perAccount int) {
+	if key != nil && key.MaxTunnels > 0 {
+		return key.MaxTunnels, key.MaxTunnels
+	}
+	if tier.MaxTunnels > 0 {
+		return tier.MaxTunnels, tier.MaxTunnels
+	}
+	return config.MaxTunnelsPerIP, config.MaxTunnelsPerAccount
+}
+
+// accountRate returns the request rate a client's account may use: its key's
+// rate, or else its tier's (0 = the server default)
+func accountRate(tier *Tier, key *AuthorizedKey) int {
+	if key != nil && key.Rate > 0 {
+		return key.Rate
+	}
+	return tier.RequestsPerSecond
+}
+
+// responseLimit returns the largest response a client's tunnels may serve:
+// its key's max-response-size, or else its tier's, capped at the operator
+// ceiling (default config.MaxResponseBodySize)
+func (s *Server) responseLimit(tier *Tier, key *AuthorizedKey) int64 {
+	n := tier.MaxResponseSize
+	if key != nil && key.MaxResponseSize > 0 {
+		n = key.MaxResponseSize
+	}
+	if n <= 0 {
+		return config.MaxResponseBodySize
+	}
+	return min(n, s.maxResponseCeiling)
+}
+
+// quotaAccount returns the name a client's account quotas are kept under.
+// Usernames are not authenticated, so the quotas of a client with an
+// authorized key follow the key, and those of other named clients are scoped
+// to their IP (or IPv6 prefix): claiming someone's name does not use up their
+// quotas. Clients without a key or name are not limited per account.
+func (s *Server) quotaAccount(account string, key *AuthorizedKey, clientIP string) string {
+	if key != nil {
+		return "key:" + key.Fingerprint
+	}
+	if account == "" {
+		return ""
+	}
+	return account + "@" + s.ipKey(clientIP)
+}
+
+// checkIPTunnelLimit returns an error if the IP holds more than limit
+// connections. The caller's own connection is already counted.
+func (s *Server) checkIPTunnelLimit(clientIP string, limit int) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.ipConnections[s.ipKey(clientIP)] > limit {
+		return fmt.Errorf("rate limit exceeded: max %d tunnels per IP. Close an existing tunnel and try again", limit)
+	}
+	return nil
+}
+
+// admit applies the tunnel limits to an authenticating client. Refused clients
+// are told why in an auth banner.
+func (s *Server) admit(conn ssh.ConnMetadata, key *AuthorizedKey) error {
+	account := accountName(conn.User())
+	clientIP := addrIP(conn.RemoteAddr())
+	perIP, perAccount := tunnelLimits(s.tiers.For(key), key)
+	err := s.checkIPTunnelLimit(clientIP, perIP)
+	if _, level := splitEntropy(conn.User()); err == nil {
+		if _, ok := subdomain.SuffixLength(level); !ok {
+			err = fmt.Errorf("unknown subdomain entropy %q: use low, default or high, as in alice+entropy=high", level)
+		}
+	}
+	if err == nil {
+		err = s.quotas.Check(s.quotaAccount(account, key, clientIP), perAccount)
+	}
+	if err != nil {
+		if bc, ok := conn.(ssh.ServerPreAuthConn); ok {
+			bc.SendAuthBanner(rejectionBanner(err))
+		}
+	}
+	return err
+}
+
+// authNone admits clients when no authorized keys file is configured
+func (s *Server) authNone(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+	return nil, s.admit(conn, nil)
+}
+
+// authKeyboardInteractive admits clients without an authorized key. It asks
+// no questions; it only exists because "none" is refused so that clients
+// offer their keys first.
+func (s *Server) authKeyboardInteractive(conn ssh.ConnMetadata, _ ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return nil, s.admit(conn, nil)
+}
+
+// authPublicKey admits clients presenting a key from the authorized keys file
+func (s *Server) authPublicKey(conn ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+	key := s.authorizedKeys.Lookup(pub)
+	if key == nil {
+		return nil, errors.New("key not authorized")
+	}
+	if err := s.admit(conn, key); err != nil {
+		return nil, err
+	}
+	return &ssh.Permissions{Extensions: map[string]string{permKeyFingerprint: key.Fingerprint}}, nil
+}
+
+// clientKey returns the authorized key a connection authenticated with, or nil
+func (s *Server) clientKey(sshConn *ssh.ServerConn) *AuthorizedKey {
+	if s.authorizedKeys == nil || sshConn.Permissions == nil {
+		return nil
+	}
+	fingerprint, ok := sshConn.Permissions.Extensions[permKeyFingerprint]
+	if !ok {
+		return nil
+	}
+	return s.authorizedKeys.Get(fingerprint)
+}
+
+// isReservedSubdomain reports whether an authorized key reserves the subdomain
+func (s *Server) isReservedSubdomain(sub string) bool {
+	return s.authorizedKeys != nil && s.authorizedKeys.IsReserved(sub)
+}
+
+// isValidSubdomain reports whether sub is a generated or reserved subdomain
+func (s *Server) isValidSubdomain(sub string) bool {
+	return subdomain.IsValid(sub) || s.isReservedSubdomain(sub)
+}
+
+// addrIP returns the IP of a TCP address, or "unknown"
+func addrIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return "unknown"
+}
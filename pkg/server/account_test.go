@@ -0,0 +1,82 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestAccountName(t *testing.T) {
+	tests := []struct {
+		user string
+		want string
+	}{
+		{"alice", "alice"},
+		{"Alice", "alice"},
+		{"dev.team-1", "dev.team-1"},
+		{"", ""},
+		{"root", ""},
+		{"ubuntu", ""},
+		{"happy-tiger-abcdef01+0123456789abcdef", ""},
+		{"alice+entropy=high", "alice"},
+		{"root+entropy=low", ""},
+		{"bad name", ""},
+		{strings.Repeat("a", config.MaxAccountNameLength+1), ""},
+	}
+	for _, tt := range tests {
+		if got := accountName(tt.user); got != tt.want {
+			t.Errorf("accountName(%q) = %q, want %q", tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestSplitEntropy(t *testing.T) {
+	tests := []struct {
+		user, name, level string
+	}{
+		{"alice", "alice", ""},
+		{"alice+entropy=high", "alice", "high"},
+		{"+entropy=LOW", "", "low"},
+		{"alice+entropy=", "alice", ""},
+		{"happy-tiger-abcdef01+0123456789abcdef", "happy-tiger-abcdef01+0123456789abcdef", ""},
+	}
+	for _, tt := range tests {
+		if name, level := splitEntropy(tt.user); name != tt.name || level != tt.level {
+			t.Errorf("splitEntropy(%q) = %q, %q, want %q, %q", tt.user, name, level, tt.name, tt.level)
+		}
+	}
+}
+
+func TestQuotaAccount_SameNameOtherIP(t *testing.T) {
+	s := newTestServer(t)
+	limit := config.MaxTunnelsPerAccount
+
+	owner := s.quotaAccount("alice", nil, "1.2.3.4")
+	for i := 0; i < limit; i++ {
+		if err := s.quotas.Reserve(owner, limit, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.quotas.Check(owner, limit); err == nil {
+		t.Fatal("alice should be at her tunnel limit")
+	}
+
+	// Someone else connecting as alice has quotas of their own
+	other := s.quotaAccount("alice", nil, "5.6.7.8")
+	if other == owner {
+		t.Fatalf("quotaAccount() = %q for both IPs", owner)
+	}
+	if err := s.quotas.Check(other, limit); err != nil {
+		t.Errorf("another IP using the same username should not share quota: %v", err)
+	}
+
+	// Authorized keys keep their quotas wherever they connect from
+	key := &AuthorizedKey{Fingerprint: "SHA256:abc"}
+	if a, b := s.quotaAccount("alice", key, "1.2.3.4"), s.quotaAccount("bob", key, "5.6.7.8"); a != b || a == owner {
+		t.Errorf("quotaAccount() with a key = %q, %q, want the key's own account", a, b)
+	}
+	if got := s.quotaAccount("", nil, "1.2.3.4"); got != "" {
+		t.Errorf("quotaAccount() = %q for an anonymous client, want none", got)
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+// agentTunnel mirrors the tunnel object returned by the ngrok agent API
+// (GET /api/tunnels), so existing tooling can poll tunnl the same way.
+type agentTunnel struct {
+	Name      string             `json:"name"`
+	URI       string             `json:"uri"`
+	PublicURL string             `json:"public_url"`
+	Proto     string             `json:"proto"`
+	Config    agentTunnelConfig  `json:"config"`
+	Metrics   agentTunnelMetrics `json:"metrics"`
+}
+
+type agentTunnelConfig struct {
+	Addr    string `json:"addr"`
+	Inspect bool   `json:"inspect"`
+}
+
+type agentTunnelMetrics struct {
+	Conns agentCounter `json:"conns"`
+	HTTP  agentCounter `json:"http"`
+}
+
+type agentCounter struct {
+	Count uint64 `json:"count"`
+	Gauge int    `json:"gauge"`
+}
+
+type agentTunnelList struct {
+	Tunnels []agentTunnel `json:"tunnels"`
+	URI     string        `json:"uri"`
+}
+
+// agentTunnels builds an ngrok-style record for each active subdomain
+func (s *Server) agentTunnels() []agentTunnel {
+	s.mu.RLock()
+	pools := make([]*tunnel.Pool, 0, len(s.pools))
+	for _, pool := range s.pools {
+		pools = append(pools, pool)
+	}
+	s.mu.RUnlock()
+
+	out := make([]agentTunnel, 0, len(pools))
+	for _, pool := range pools {
+		if at, ok := s.agentTunnelFor(pool); ok {
+			out = append(out, at)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// agentTunnelFor converts a pool into an ngrok-style tunnel record
+func (s *Server) agentTunnelFor(pool *tunnel.Pool) (agentTunnel, bool) {
+	tunnels := pool.Tunnels()
+	if len(tunnels) == 0 {
+		return agentTunnel{}, false
+	}
+
+	var requests uint64
+	for _, t := range tunnels {
+		requests += t.RequestCount()
+	}
+
+	// The server never learns the client's local address, so report the
+	// forward the client requested (e.g. "localhost:80") instead
+	first := tunnels[0]
+	bindAddr := first.BindAddr
+	if bindAddr == "" {
+		bindAddr = "localhost"
+	}
+
+	return agentTunnel{
+		Name:      pool.Subdomain,
+		URI:       "/api/tunnels/" + pool.Subdomain,
+		PublicURL: s.publicURL(pool),
+		Proto:     "https",
+		Config: agentTunnelConfig{
+			Addr:    net.JoinHostPort(bindAddr, strconv.FormatUint(uint64(first.BindPort), 10)),
+			Inspect: pool.Inspect(),
+		},
+		Metrics: agentTunnelMetrics{
+			Conns: agentCounter{Count: uint64(len(tunnels)), Gauge: len(tunnels)},
+			HTTP:  agentCounter{Count: requests},
+		},
+	}, true
+}
+
+// agentTunnelsHandler serves GET /api/tunnels
+func (s *Server) agentTunnelsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, agentTunnelList{Tunnels: s.agentTunnels(), URI: "/api/tunnels"})
+	})
+}
+
+// agentTunnelHandler serves GET /api/tunnels/{name}
+func (s *Server) agentTunnelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.ToLower(r.PathValue("name"))
+		pool := s.GetPool(name)
+		if pool == nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		at, ok := s.agentTunnelFor(pool)
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, at)
+	})
+}
+
+// tunnelRequestsHandler serves GET /api/tunnels/{name}/requests: the most
+// recent requests across the subdomain's backends, oldest first
+func (s *Server) tunnelRequestsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pool := s.GetPool(strings.ToLower(r.PathValue("name")))
+		if pool == nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		limit := config.RequestHistorySize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		records := poolHistory(pool, limit)
+		if r.URL.Query().Get("format") == tunnel.AccessLogText {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			tunnel.WriteAccessLog(w, records, tunnel.AccessLogText)
+			return
+		}
+		writeJSON(w, struct {
+			Requests []tunnel.RequestRecord `json:"requests"`
+		}{records})
+	})
+}
+
+// poolHistory merges the recent requests of a subdomain's backends and
+// returns the last limit of them (all of them if limit is 0), oldest first
+func poolHistory(pool *tunnel.Pool, limit int) []tunnel.RequestRecord {
+	records := []tunnel.RequestRecord{}
+	for _, t := range pool.Tunnels() {
+		records = append(records, t.History().Recent(limit)...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records
+}
+
+// serveAccessLog answers AccessLogPath on a tunnel's own URL with its request
+// history as a file download, for requests carrying the access log token
+func serveAccessLog(w http.ResponseWriter, r *http.Request, pool *tunnel.Pool) {
+	format, ext, contentType := tunnel.AccessLogText, "log", "text/plain; charset=utf-8"
+	if r.URL.Query().Get("format") == tunnel.AccessLogJSON {
+		format, ext, contentType = tunnel.AccessLogJSON, "json", "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-access.%s"`, pool.Subdomain, ext))
+	if err := tunnel.WriteAccessLog(w, poolHistory(pool, 0), format); err != nil {
+		log.Printf("Failed to write access log for %s: %v", pool.Subdomain, err)
+	}
+}
+
+// accessLogURL is the download link of a subdomain's access log
+func (s *Server) accessLogURL(pool *tunnel.Pool) string {
+	return s.publicURL(pool) + config.AccessLogPath + "?token=" + pool.AccessLogToken()
+}
+
+// captureHandler serves GET /api/captures/{id}: a captured request and
+// response of an inspected tunnel, without the bodies
+func (s *Server) captureHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := s.captures.Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, c)
+	})
+}
+
+// captureBodyHandler serves GET /api/captures/{id}/request and
+// /api/captures/{id}/response: a captured body as it was sent, marked with
+// X-Capture-Truncated when only its beginning was kept
+func (s *Server) captureBodyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, part := r.PathValue("id"), r.PathValue("part")
+		c, ok := s.captures.Get(id)
+		if !ok || (part != "request" && part != "response") {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		data, complete, err := s.captures.Body(r.Context(), id, part)
+		if err != nil {
+			log.Printf("Failed to read captured %s body %s: %v", part, id, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		header := c.RequestHeader
+		if part == "response" {
+			header = c.ResponseHeader
+		}
+		contentType := header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		if encoding := header.Get("Content-Encoding"); encoding != "" {
+			w.Header().Set("X-Capture-Content-Encoding", encoding)
+		}
+		if !complete {
+			w.Header().Set("X-Capture-Truncated", "true")
+		}
+		w.Write(data)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode JSON response: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/tunnel"
+)
+
+func TestAgentAPI_ListTunnels(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	tun := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	tun.IncrementRequests()
+
+	r := httptest.NewRequest("GET", "/api/tunnels", nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	w := httptest.NewRecorder()
+	s.StatsHandler().ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var list agentTunnelList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(list.Tunnels) != 1 {
+		t.Fatalf("got %d tunnels, want 1", len(list.Tunnels))
+	}
+	got := list.Tunnels[0]
+	if got.Name != sub {
+		t.Errorf("name = %q, want %q", got.Name, sub)
+	}
+	if got.PublicURL != "https://"+sub+".tunnl.gg" {
+		t.Errorf("public_url = %q", got.PublicURL)
+	}
+	if got.Config.Addr != "localhost:80" {
+		t.Errorf("config.addr = %q, want localhost:80", got.Config.Addr)
+	}
+	if got.Metrics.HTTP.Count != 1 {
+		t.Errorf("metrics.http.count = %d, want 1", got.Metrics.HTTP.Count)
+	}
+}
+
+func TestAgentAPI_TunnelDetails(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+
+	tests := []struct {
+		name     string
+		path     string
+		remote   string
+		wantCode int
+	}{
+		{"existing tunnel", "/api/tunnels/" + sub, "127.0.0.1:1", http.StatusOK},
+		{"unknown tunnel", "/api/tunnels/calm-eagle-12345678", "127.0.0.1:1", http.StatusNotFound},
+		{"non-loopback client", "/api/tunnels/" + sub, "203.0.113.5:1", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			s.StatsHandler().ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAgentAPI_TunnelRequests(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	first := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	second := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.5")
+
+	start := time.Now()
+	for i, path := range []string{"/a", "/b", "/c", "/d"} {
+		tun := first
+		if i%2 == 1 {
+			tun = second
+		}
+		tun.History().Add(tunnel.RequestRecord{Time: start.Add(time.Duration(i) * time.Second), Method: "GET", Path: path, Status: 200})
+	}
+
+	get := func(path string) (int, []tunnel.RequestRecord) {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "127.0.0.1:1"
+		w := httptest.NewRecorder()
+		s.StatsHandler().ServeHTTP(w, r)
+		var resp struct {
+			Requests []tunnel.RequestRecord `json:"requests"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Requests
+	}
+
+	code, records := get("/api/tunnels/" + sub + "/requests?limit=3")
+	if code != http.StatusOK || len(records) != 3 {
+		t.Fatalf("status %d, %d records, want 200 and 3", code, len(records))
+	}
+	if records[0].Path != "/b" || records[2].Path != "/d" {
+		t.Errorf("records = %+v, want /b to /d across both backends", records)
+	}
+	if code, _ := get("/api/tunnels/calm-eagle-12345678/requests"); code != http.StatusNotFound {
+		t.Errorf("unknown tunnel: status %d, want 404", code)
+	}
+	if code, _ := get("/api/tunnels/" + sub + "/requests?limit=0"); code != http.StatusBadRequest {
+		t.Errorf("limit=0: status %d, want 400", code)
+	}
+
+	r := httptest.NewRequest("GET", "/api/tunnels/"+sub+"/requests?format=text", nil)
+	r.RemoteAddr = "127.0.0.1:1"
+	w := httptest.NewRecorder()
+	s.StatsHandler().ServeHTTP(w, r)
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 4 || !strings.Contains(w.Body.String(), `"GET /d" 200`) {
+		t.Errorf("format=text = %q, want 4 log lines", w.Body.String())
+	}
+}
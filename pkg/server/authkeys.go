@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnl.gg/internal/subdomain"
+	"tunnl.gg/pkg/config"
+)
+
+// AuthorizedKey is an entry of the authorized keys file and the privileges its options grant
+type AuthorizedKey struct {
+	Name        string   // Key comment, used in logs
+	Fingerprint string   // SHA256 fingerprint of the public key
+	Subdomains  []string // Reserved subdomains only this key may claim (subdomain="...")
+	MaxTunnels  int      // Tunnel limit replacing the per-IP and per-user defaults (max-tunnels=N, 0 = default)
+	Rate        int      // Requests per second per tunnel (rate=N, 0 = default)
+	NoWarning   bool     // Skip the browser warning page (no-warning)
+	Tier        string   // Tier from the tiers file (tier="...", "" = the default tier)
+	Domain      string   // Serving domain for this key's tunnels (domain="...", "" = default domain)
+
+	WebSocketIdleTimeout time.Duration // Idle timeout of WebSocket connections (ws-idle-timeout=2h, 0 = default)
+	MaxWebSocketTransfer int64         // Bytes per WebSocket and direction (ws-max-transfer=N, 0 = default)
+	MaxResponseSize      int64         // Bytes per response, up to the operator ceiling (max-response-size=N, 0 = default)
+}
+
+// Reserves reports whether the key reserves the given subdomain
+func (k *AuthorizedKey) Reserves(sub string) bool {
+	return slices.Contains(k.Subdomains, sub)
+}
+
+// AuthorizedKeys is an OpenSSH-style authorized keys file whose options grant
+// per-key privileges. The file is reloaded when it changes; if a reload fails,
+// the previous keys stay in effect.
+type AuthorizedKeys struct {
+	path    string
+	mu      sync.RWMutex
+	keys    map[string]*AuthorizedKey // by fingerprint
+	modTime time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// LoadAuthorizedKeys reads the authorized keys file at path
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	ak := &AuthorizedKeys{
+		path: path,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := ak.reload(); err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+// Start watches the file for changes until Stop is called
+func (ak *AuthorizedKeys) Start() {
+	go func() {
+		defer close(ak.done)
+		ticker := time.NewTicker(config.AuthorizedKeysReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ak.stop:
+				return
+			case <-ticker.C:
+				if err := ak.reload(); err != nil {
+					log.Printf("Failed to reload authorized keys: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops watching the file
+func (ak *AuthorizedKeys) Stop() {
+	close(ak.stop)
+	<-ak.done
+}
+
+// reload re-reads the file if its modification time changed
+func (ak *AuthorizedKeys) reload() error {
+	info, err := os.Stat(ak.path)
+	if err != nil {
+		return err
+	}
+
+	ak.mu.RLock()
+	unchanged := info.ModTime().Equal(ak.modTime)
+	ak.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(ak.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseAuthorizedKeys(data)
+	if err != nil {
+		return err
+	}
+
+	ak.mu.Lock()
+	ak.keys = keys
+	ak.modTime = info.ModTime()
+	ak.mu.Unlock()
+	log.Printf("Loaded %d authorized keys from %s", len(keys), ak.path)
+	return nil
+}
+
+// Lookup returns the entry for a public key, or nil if it is not authorized
+func (ak *AuthorizedKeys) Lookup(key ssh.PublicKey) *AuthorizedKey {
+	return ak.Get(ssh.FingerprintSHA256(key))
+}
+
+// Get returns the entry for a key fingerprint, or nil if it is not authorized
+func (ak *AuthorizedKeys) Get(fingerprint string) *AuthorizedKey {
+	ak.mu.RLock()
+	defer ak.mu.RUnlock()
+	return ak.keys[fingerprint]
+}
+
+// IsReserved reports whether any key reserves the given subdomain
+func (ak *AuthorizedKeys) IsReserved(sub string) bool {
+	ak.mu.RLock()
+	defer ak.mu.RUnlock()
+	for _, k := range ak.keys {
+		if k.Reserves(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthorizedKeys parses an authorized keys file. Any invalid line or
+// option fails the whole file, so a typo cannot silently drop privileges.
+func parseAuthorizedKeys(data []byte) (map[string]*AuthorizedKey, error) {
+	keys := make(map[string]*AuthorizedKey)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		pub, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		entry := &AuthorizedKey{
+			Name:        comment,
+			Fingerprint: ssh.FingerprintSHA256(pub),
+		}
+		for _, opt := range options {
+			if err := entry.setOption(opt); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+		}
+		keys[entry.Fingerprint] = entry
+	}
+	return keys, nil
+}
+
+// setOption applies a single authorized_keys option to the entry
+func (k *AuthorizedKey) setOption(opt string) error {
+	name, value, _ := strings.Cut(opt, "=")
+	value = strings.Trim(value, `"`)
+
+	switch strings.ToLower(name) {
+	case "subdomain":
+		value = strings.ToLower(value)
+		if !subdomain.IsValidName(value) {
+			return fmt.Errorf("invalid subdomain %q", value)
+		}
+		k.Subdomains = append(k.Subdomains, value)
+	case "max-tunnels":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid max-tunnels %q", value)
+		}
+		k.MaxTunnels = n
+	case "rate":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid rate %q", value)
+		}
+		k.Rate = n
+	case "no-warning":
+		k.NoWarning = true
+	case "tier":
+		if value == "" {
+			return fmt.Errorf("empty tier")
+		}
+		k.Tier = value
+	case "domain":
+		value = strings.TrimSuffix(strings.ToLower(value), ".")
+		if !strings.Contains(value, ".") || strings.ContainsAny(value, " /:") {
+			return fmt.Errorf("invalid domain %q", value)
+		}
+		k.Domain = value
+	case "ws-idle-timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid ws-idle-timeout %q", value)
+		}
+		k.WebSocketIdleTimeout = d
+	case "ws-max-transfer":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid ws-max-transfer %q", value)
+		}
+		k.MaxWebSocketTransfer = n
+	case "max-response-size":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid max-response-size %q", value)
+		}
+		k.MaxResponseSize = n
+	default:
+		return fmt.Errorf("unknown option %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnl.gg/pkg/config"
+)
+
+// newTestKey returns a signer and its authorized_keys line with the given options
+func newTestKey(t *testing.T, options, comment string) (ssh.Signer, string) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " " + comment
+	if options != "" {
+		line = options + " " + line
+	}
+	return signer, line
+}
+
+func writeKeysFile(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	alice, aliceLine := newTestKey(t, `subdomain="myapp",subdomain="api",max-tunnels=10,rate=50,no-warning,tier="pro",domain="tunnl.dev",ws-idle-timeout=8h,ws-max-transfer=4096,max-response-size=1073741824`, "alice@laptop")
+	bob, bobLine := newTestKey(t, "", "bob@desktop")
+
+	keys, err := parseAuthorizedKeys([]byte("# team keys\n\n" + aliceLine + "\n" + bobLine + "\n"))
+	if err != nil {
+		t.Fatalf("parseAuthorizedKeys() error = %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+
+	a := keys[ssh.FingerprintSHA256(alice.PublicKey())]
+	if a == nil {
+		t.Fatal("alice's key missing")
+	}
+	if a.Name != "alice@laptop" || !a.Reserves("myapp") || !a.Reserves("api") ||
+		a.MaxTunnels != 10 || a.Rate != 50 || !a.NoWarning || a.Tier != "pro" || a.Domain != "tunnl.dev" ||
+		a.WebSocketIdleTimeout != 8*time.Hour || a.MaxWebSocketTransfer != 4096 || a.MaxResponseSize != 1<<30 {
+		t.Errorf("alice = %+v, options not applied", a)
+	}
+
+	b := keys[ssh.FingerprintSHA256(bob.PublicKey())]
+	if b == nil || len(b.Subdomains) != 0 || b.MaxTunnels != 0 || b.NoWarning {
+		t.Errorf("bob = %+v, want no privileges", b)
+	}
+}
+
+func TestParseAuthorizedKeys_Errors(t *testing.T) {
+	for _, options := range []string{`subdomain="Bad_Name"`, "max-tunnels=0", "rate=fast", `tier=""`, `domain="localhost"`, "ws-idle-timeout=forever", "ws-max-transfer=0", "max-response-size=1GB", "no-pty"} {
+		_, line := newTestKey(t, options, "key")
+		if _, err := parseAuthorizedKeys([]byte(line)); err == nil {
+			t.Errorf("options %q: expected error", options)
+		}
+	}
+	if _, err := parseAuthorizedKeys([]byte("ssh-ed25519 not-base64")); err == nil {
+		t.Error("expected error for malformed key")
+	}
+}
+
+func TestAuthorizedKeys_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	alice, aliceLine := newTestKey(t, `subdomain="myapp"`, "alice")
+	bob, bobLine := newTestKey(t, "", "bob")
+	writeKeysFile(t, path, aliceLine)
+
+	ak, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("LoadAuthorizedKeys() error = %v", err)
+	}
+	if ak.Lookup(alice.PublicKey()) == nil || !ak.IsReserved("myapp") {
+		t.Fatal("alice's key should be loaded")
+	}
+	if ak.Lookup(bob.PublicKey()) != nil {
+		t.Fatal("bob's key should not be authorized yet")
+	}
+
+	writeKeysFile(t, path, bobLine)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := ak.reload(); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	if ak.Lookup(alice.PublicKey()) != nil || ak.IsReserved("myapp") {
+		t.Error("removed key should no longer be authorized")
+	}
+	if ak.Lookup(bob.PublicKey()) == nil {
+		t.Error("added key should be authorized")
+	}
+
+	// A broken file keeps the previous keys
+	writeKeysFile(t, path, bobLine, "no-such-option "+aliceLine)
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := ak.reload(); err == nil {
+		t.Error("reload() should fail for an invalid file")
+	}
+	if ak.Lookup(bob.PublicKey()) == nil {
+		t.Error("keys should be kept when a reload fails")
+	}
+}
+
+func newKeyedTestServer(t *testing.T, require bool, lines ...string) *Server {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	writeKeysFile(t, path, lines...)
+
+	cfg := config.Default()
+	cfg.HostKeyPath = t.TempDir() + "/host_key"
+	cfg.AuthorizedKeysPath = path
+	cfg.RequireAuthorizedKey = require
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create test server: %v", err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// dialTestServer serves a single SSH connection and dials it with the given auth methods
+func dialTestServer(t *testing.T, s *Server, user string, auth ...ssh.AuthMethod) error {
+	t.Helper()
+	ln := newTestListener(t)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.HandleSSHConnection(conn)
+	}()
+
+	client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	client.Close()
+	return nil
+}
+
+func TestAuthorizedKeys_Auth(t *testing.T) {
+	alice, aliceLine := newTestKey(t, "", "alice")
+	stranger, _ := newTestKey(t, "", "stranger")
+	noQuestions := ssh.KeyboardInteractive(func(string, string, []string, []bool) ([]string, error) {
+		return nil, nil
+	})
+
+	t.Run("optional", func(t *testing.T) {
+		s := newKeyedTestServer(t, false, aliceLine)
+		if err := dialTestServer(t, s, "alice", ssh.PublicKeys(alice)); err != nil {
+			t.Errorf("authorized key should be accepted: %v", err)
+		}
+		if err := dialTestServer(t, s, "guest", ssh.PublicKeys(stranger), noQuestions); err != nil {
+			t.Errorf("clients without an authorized key should fall back to anonymous access: %v", err)
+		}
+	})
+
+	t.Run("required", func(t *testing.T) {
+		s := newKeyedTestServer(t, true, aliceLine)
+		if err := dialTestServer(t, s, "alice", ssh.PublicKeys(alice)); err != nil {
+			t.Errorf("authorized key should be accepted: %v", err)
+		}
+		if err := dialTestServer(t, s, "guest", ssh.PublicKeys(stranger), noQuestions); err == nil {
+			t.Error("clients without an authorized key should be rejected")
+		}
+	})
+}
+
+func TestTunnelLimits(t *testing.T) {
+	perIP, perAccount := tunnelLimits(builtinTier, nil)
+	if perIP != config.MaxTunnelsPerIP || perAccount != config.MaxTunnelsPerAccount {
+		t.Errorf("tunnelLimits(nil) = %d, %d, want defaults", perIP, perAccount)
+	}
+	perIP, perAccount = tunnelLimits(&Tier{MaxTunnels: 10}, nil)
+	if perIP != 10 || perAccount != 10 {
+		t.Errorf("tunnelLimits(tier max_tunnels=10) = %d, %d, want 10, 10", perIP, perAccount)
+	}
+	perIP, perAccount = tunnelLimits(&Tier{MaxTunnels: 10}, &AuthorizedKey{MaxTunnels: 20})
+	if perIP != 20 || perAccount != 20 {
+		t.Errorf("tunnelLimits(max-tunnels=20) = %d, %d, want 20, 20", perIP, perAccount)
+	}
+}
+
+func TestResponseLimit(t *testing.T) {
+	s := newTestServer(t)
+	s.maxResponseCeiling = 1 << 30
+
+	tests := []struct {
+		name string
+		tier *Tier
+		key  *AuthorizedKey
+		want int64
+	}{
+		{"default", builtinTier, nil, config.MaxResponseBodySize},
+		{"tier", &Tier{MaxResponseSize: 512 << 20}, nil, 512 << 20},
+		{"key over tier", &Tier{MaxResponseSize: 512 << 20}, &AuthorizedKey{MaxResponseSize: 768 << 20}, 768 << 20},
+		{"capped at ceiling", builtinTier, &AuthorizedKey{MaxResponseSize: 10 << 30}, 1 << 30},
+	}
+	for _, tt := range tests {
+		if got := s.responseLimit(tt.tier, tt.key); got != tt.want {
+			t.Errorf("%s: responseLimit() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsValidSubdomain_Reserved(t *testing.T) {
+	_, line := newTestKey(t, `subdomain="myapp"`, "alice")
+	s := newKeyedTestServer(t, false, line)
+
+	if !s.isValidSubdomain("myapp") {
+		t.Error("reserved subdomain should be valid")
+	}
+	if s.isValidSubdomain("otherapp") {
+		t.Error("unreserved custom subdomain should be invalid")
+	}
+	if !s.isValidSubdomain("happy-tiger-abcdef01") {
+		t.Error("generated subdomains should stay valid")
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// BandwidthTracker accounts bytes transferred per SSH client IP (or IPv6
+// prefix, as keyed by the caller) and enforces a daily quota. Usage resets at midnight UTC.
+type BandwidthTracker struct {
+	mu    sync.Mutex
+	quota int64            // bytes per IP per day, 0 disables enforcement
+	day   string           // current UTC day (YYYY-MM-DD)
+	days  dayCache         // formats the current day without allocating
+	usage map[string]int64 // bytes transferred today per IP
+
+	now func() time.Time // overridable for tests
+}
+
+// NewBandwidthTracker creates a tracker enforcing the given daily quota in bytes
+func NewBandwidthTracker(quota int64) *BandwidthTracker {
+	return &BandwidthTracker{
+		quota: quota,
+		usage: make(map[string]int64),
+		now:   time.Now,
+	}
+}
+
+// rollover resets usage when the UTC day changes (must be called with lock held)
+func (bt *BandwidthTracker) rollover() {
+	day := bt.days.format(bt.now())
+	if day != bt.day {
+		bt.day = day
+		bt.usage = make(map[string]int64)
+	}
+}
+
+// Add records n bytes transferred by the given IP
+func (bt *BandwidthTracker) Add(ip string, n int64) {
+	if n <= 0 {
+		return
+	}
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.rollover()
+	bt.usage[ip] += n
+}
+
+// Usage returns the bytes transferred today by the given IP
+func (bt *BandwidthTracker) Usage(ip string) int64 {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.rollover()
+	return bt.usage[ip]
+}
+
+// Exceeded returns true if the IP has used up its daily quota
+func (bt *BandwidthTracker) Exceeded(ip string) bool {
+	if bt.quota <= 0 {
+		return false
+	}
+	return bt.Usage(ip) >= bt.quota
+}
+
+// Quota returns the configured daily quota in bytes
+func (bt *BandwidthTracker) Quota() int64 {
+	return bt.quota
+}
+
+// Snapshot returns the current UTC day and a copy of its usage per key
+func (bt *BandwidthTracker) Snapshot() (day string, usage map[string]int64) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.rollover()
+	usage = make(map[string]int64, len(bt.usage))
+	for k, n := range bt.usage {
+		usage[k] = n
+	}
+	return bt.day, usage
+}
+
+// Restore adds usage saved earlier on the given UTC day. Usage from other
+// days is ignored.
+func (bt *BandwidthTracker) Restore(day string, usage map[string]int64) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.rollover()
+	if day != bt.day {
+		return
+	}
+	for k, n := range usage {
+		bt.usage[k] += n
+	}
+}
+
+// GetStats returns the total bytes transferred today and the number of IPs over quota
+func (bt *BandwidthTracker) GetStats() (totalBytes int64, exceededIPs int) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.rollover()
+	for _, n := range bt.usage {
+		totalBytes += n
+		if bt.quota > 0 && n >= bt.quota {
+			exceededIPs++
+		}
+	}
+	return totalBytes, exceededIPs
+}
+
+// meteredWriter wraps an io.Writer and records written bytes against an IP's quota
+type meteredWriter struct {
+	w  io.Writer
+	bt *BandwidthTracker
+	ip string
+}
+
+// meterIP wraps w so bytes written through it count against the daily
+// bandwidth of the client IP, or of its IPv6 prefix
+func (s *Server) meterIP(w io.Writer, clientIP string) io.Writer {
+	return &meteredWriter{w: w, bt: s.bandwidth, ip: s.ipKey(clientIP)}
+}
+
+func (m *meteredWriter) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+	m.bt.Add(m.ip, int64(n))
+	return n, err
+}
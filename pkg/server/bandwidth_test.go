@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBandwidthTracker_AddAndUsage(t *testing.T) {
+	bt := NewBandwidthTracker(1000)
+
+	bt.Add("1.2.3.4", 300)
+	bt.Add("1.2.3.4", 200)
+	bt.Add("5.6.7.8", 50)
+
+	if got := bt.Usage("1.2.3.4"); got != 500 {
+		t.Errorf("Usage(1.2.3.4) = %d, want 500", got)
+	}
+	if got := bt.Usage("5.6.7.8"); got != 50 {
+		t.Errorf("Usage(5.6.7.8) = %d, want 50", got)
+	}
+}
+
+func TestBandwidthTracker_Exceeded(t *testing.T) {
+	bt := NewBandwidthTracker(1000)
+
+	bt.Add("1.2.3.4", 999)
+	if bt.Exceeded("1.2.3.4") {
+		t.Error("IP under quota should not be exceeded")
+	}
+
+	bt.Add("1.2.3.4", 1)
+	if !bt.Exceeded("1.2.3.4") {
+		t.Error("IP at quota should be exceeded")
+	}
+}
+
+func TestBandwidthTracker_Disabled(t *testing.T) {
+	bt := NewBandwidthTracker(0)
+
+	bt.Add("1.2.3.4", 1<<40)
+	if bt.Exceeded("1.2.3.4") {
+		t.Error("zero quota should disable enforcement")
+	}
+}
+
+func TestBandwidthTracker_DailyReset(t *testing.T) {
+	bt := NewBandwidthTracker(1000)
+	now := time.Date(2025, 1, 1, 23, 59, 0, 0, time.UTC)
+	bt.now = func() time.Time { return now }
+
+	bt.Add("1.2.3.4", 1000)
+	if !bt.Exceeded("1.2.3.4") {
+		t.Fatal("IP should be over quota before midnight")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if bt.Exceeded("1.2.3.4") {
+		t.Error("quota should reset after midnight UTC")
+	}
+}
+
+func TestBandwidthTracker_Restore(t *testing.T) {
+	bt := NewBandwidthTracker(0)
+	bt.now = func() time.Time { return time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC) }
+	bt.Add("1.2.3.4", 10)
+
+	bt.Restore("2025-01-01", map[string]int64{"1.2.3.4": 500})
+	bt.Restore("2025-01-02", map[string]int64{"1.2.3.4": 100})
+
+	if got := bt.Usage("1.2.3.4"); got != 110 {
+		t.Errorf("Usage() = %d, want 110 (only today's saved usage restored)", got)
+	}
+	day, usage := bt.Snapshot()
+	if day != "2025-01-02" || usage["1.2.3.4"] != 110 {
+		t.Errorf("Snapshot() = %q, %v", day, usage)
+	}
+}
+
+func TestBandwidthTracker_GetStats(t *testing.T) {
+	bt := NewBandwidthTracker(100)
+
+	bt.Add("1.2.3.4", 150)
+	bt.Add("5.6.7.8", 50)
+
+	total, exceeded := bt.GetStats()
+	if total != 200 {
+		t.Errorf("total = %d, want 200", total)
+	}
+	if exceeded != 1 {
+		t.Errorf("exceeded = %d, want 1", exceeded)
+	}
+}
+
+func TestMeteredWriter(t *testing.T) {
+	bt := NewBandwidthTracker(0)
+	var buf bytes.Buffer
+	mw := &meteredWriter{w: &buf, bt: bt, ip: "1.2.3.4"}
+
+	mw.Write([]byte("hello"))
+	mw.Write([]byte(" world"))
+
+	if got := bt.Usage("1.2.3.4"); got != 11 {
+		t.Errorf("Usage() = %d, want 11", got)
+	}
+	if buf.String() != "hello world" {
+		t.Errorf("underlying writer got %q, want %q", buf.String(), "hello world")
+	}
+}
+
+func TestBandwidthQuota_IPv6(t *testing.T) {
+	s := newTestServer(t)
+	s.bandwidth = NewBandwidthTracker(1000)
+
+	w := s.meterIP(io.Discard, "2001:db8:0:1::a")
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckAndReserveConnection("2001:db8:0:1::b"); err == nil {
+		t.Error("another address in the /64 should share the exhausted quota")
+	}
+	if err := s.CheckAndReserveConnection("2001:db8:0:2::1"); err != nil {
+		t.Errorf("another /64 should have its own quota: %v", err)
+	}
+
+	sub := "happy-tiger-abcdef01"
+	s.RegisterTunnel(sub, "", 0, newTestListener(t), "", 80, "2001:db8:0:1::c")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d for a tunnel whose /64 is over quota", rec.Code, http.StatusTooManyRequests)
+	}
+}
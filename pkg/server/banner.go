@@ -0,0 +1,114 @@
+package server
+
+import (
+	"strings"
+)
+
+// Colors of the session banner
+const (
+	reset     = "\033[0m"
+	gray      = "\033[38;5;245m"
+	boldGreen = "\033[1;32m"
+	purple    = "\033[38;5;141m"
+)
+
+// bannerLabelWidth is the column at which banner values start
+const bannerLabelWidth = 12
+
+// bannerRow is one line of the session banner, such as "Public URL: <url>".
+// Values are URLs or commands that must stay copyable and are never broken,
+// unless sep is set, in which case they wrap at its occurrences.
+type bannerRow struct {
+	label string // may be empty, e.g. for continuation or heading rows
+	value string
+	color string // of the value; gray if empty
+	note  string // dimmed remark after the value, wrapped at spaces
+	sep   string
+}
+
+// renderBanner lays the banner out for a terminal width columns wide,
+// or on unbroken lines if the width is unknown (0)
+func renderBanner(rows []bannerRow, width int) string {
+	var b strings.Builder
+	b.WriteString("\r\n")
+	for _, row := range rows {
+		for _, line := range row.lines(width) {
+			b.WriteString(line + reset + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// lines renders a row as one or more terminal lines
+func (row bannerRow) lines(width int) []string {
+	label := row.label
+	if label != "" {
+		label += strings.Repeat(" ", max(bannerLabelWidth-len(label), 1))
+	}
+	color := row.color
+	if color == "" {
+		color = gray
+	}
+	note := ""
+	if row.note != "" {
+		note = " " + row.note
+	}
+	if width <= 0 || len(label)+len(row.value)+len(note) <= width {
+		return []string{gray + label + color + row.value + gray + note}
+	}
+
+	indent := bannerLabelWidth
+	if label == "" || width < 2*bannerLabelWidth {
+		indent = 0
+	}
+	pad := strings.Repeat(" ", indent)
+
+	var lines []string
+	switch {
+	case row.sep != "":
+		for i, part := range wrapText(row.value, row.sep, width-indent) {
+			if i == 0 && indent > 0 {
+				lines = append(lines, gray+label+color+part)
+			} else if i == 0 {
+				lines = append(lines, gray+label, color+part)
+			} else {
+				lines = append(lines, pad+color+part)
+			}
+		}
+	case len(label)+len(row.value) <= width:
+		lines = append(lines, gray+label+color+row.value)
+	case label != "":
+		// Too long for the line: the value goes unindented on its own line,
+		// so that the terminal wraps it and copying it stays intact
+		lines = append(lines, gray+strings.TrimRight(label, " "), color+row.value)
+	default:
+		lines = append(lines, color+row.value)
+	}
+	if row.note != "" {
+		for _, part := range wrapText(row.note, " ", width-indent) {
+			lines = append(lines, pad+gray+part)
+		}
+	}
+	return lines
+}
+
+// wrapText packs the sep-separated parts of text into lines of at most width
+// characters, keeping the separator at the end of each wrapped line. A part
+// longer than width is placed on a line of its own.
+func wrapText(text, sep string, width int) []string {
+	parts := strings.SplitAfter(text, sep)
+	var lines []string
+	var line string
+	for _, part := range parts {
+		if line != "" && len(strings.TrimRight(line+part, " ")) > width {
+			lines = append(lines, strings.TrimRight(line, " "))
+			line = ""
+		}
+		line += part
+	}
+	if line != "" {
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	return lines
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*m")
+
+func TestRenderBanner(t *testing.T) {
+	url := "https://happy-tiger-abcdef01.tunnl.gg"
+	rows := []bannerRow{
+		{label: "Public URL:", value: url, color: purple},
+		{label: "Passphrase:", value: "open-sesame", color: purple, note: "(visitors must enter it once)"},
+		{label: "Keys:", value: "l logging on/off, v verbose, p pause, Ctrl+C quit", sep: ", "},
+	}
+	render := func(width int) []string {
+		text := ansiEscape.ReplaceAllString(renderBanner(rows, width), "")
+		return strings.Split(strings.Trim(text, "\r\n"), "\r\n")
+	}
+
+	wide := render(0)
+	if len(wide) != 3 || wide[0] != "Public URL: "+url || wide[1] != "Passphrase: open-sesame (visitors must enter it once)" {
+		t.Errorf("unknown width: %q", wide)
+	}
+
+	narrow := render(40)
+	want := []string{
+		"Public URL:",
+		url,
+		"Passphrase: open-sesame",
+		"            (visitors must enter it",
+		"            once)",
+		"Keys:       l logging on/off, v verbose,",
+		"            p pause, Ctrl+C quit",
+	}
+	if strings.Join(narrow, "\n") != strings.Join(want, "\n") {
+		t.Errorf("width 40:\n%s\nwant:\n%s", strings.Join(narrow, "\n"), strings.Join(want, "\n"))
+	}
+	for _, line := range narrow {
+		if len(line) > 40 && line != url {
+			t.Errorf("line %q is wider than the terminal", line)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// BlocklistFetcher periodically loads operator-configured IP blocklists
+// (e.g. Spamhaus DROP, AbuseIPDB exports) into the abuse tracker. Sources are
+// http(s) URLs or local file paths. If a refresh of one source fails, its
+// previous entries are kept.
+type BlocklistFetcher struct {
+	sources []string
+	tracker *AbuseTracker
+	client  *http.Client
+
+	mu       sync.Mutex
+	prefixes map[string][]netip.Prefix // last successful load per source
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBlocklistFetcher creates a fetcher for the given sources
+func NewBlocklistFetcher(sources []string, tracker *AbuseTracker) *BlocklistFetcher {
+	return &BlocklistFetcher{
+		sources:  sources,
+		tracker:  tracker,
+		client:   &http.Client{Timeout: config.BlocklistFetchTimeout},
+		prefixes: make(map[string][]netip.Prefix),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start loads all sources immediately and then refreshes them periodically
+func (bf *BlocklistFetcher) Start() {
+	go func() {
+		defer close(bf.done)
+		bf.refresh()
+
+		ticker := time.NewTicker(config.BlocklistRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-bf.stop:
+				return
+			case <-ticker.C:
+				bf.refresh()
+			}
+		}
+	}()
+}
+
+// Stop stops the refresh goroutine
+func (bf *BlocklistFetcher) Stop() {
+	close(bf.stop)
+	<-bf.done
+}
+
+// refresh reloads every source and pushes the merged list to the tracker
+func (bf *BlocklistFetcher) refresh() {
+	for _, src := range bf.sources {
+		prefixes, err := bf.load(src)
+		if err != nil {
+			log.Printf("Failed to load blocklist %s: %v", src, err)
+			continue
+		}
+		bf.mu.Lock()
+		bf.prefixes[src] = prefixes
+		bf.mu.Unlock()
+		log.Printf("Loaded %d entries from blocklist %s", len(prefixes), src)
+	}
+
+	bf.mu.Lock()
+	var merged []netip.Prefix
+	for _, prefixes := range bf.prefixes {
+		merged = append(merged, prefixes...)
+	}
+	bf.mu.Unlock()
+
+	bf.tracker.SetBlocklist(merged)
+}
+
+// load reads a single source
+func (bf *BlocklistFetcher) load(src string) ([]netip.Prefix, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		resp, err := bf.client.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	return parseBlocklist(io.LimitReader(r, config.MaxBlocklistSize))
+}
+
+// parseBlocklist extracts IPs and CIDR ranges from a blocklist. The first
+// field of each line is used, so both plain lists and CSV exports work;
+// comments (";" or "#") and unparseable lines such as CSV headers are skipped.
+func parseBlocklist(r io.Reader) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, ";#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.FieldsFunc(line, func(c rune) bool {
+			return c == ',' || c == ' ' || c == '\t'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		if prefix, ok := parsePrefix(strings.Trim(fields[0], `"`)); ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, scanner.Err()
+}
+
+// parsePrefix parses a CIDR range or a single IP address as a prefix
+func parsePrefix(entry string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		return prefix.Masked(), true
+	}
+	if addr, err := netip.ParseAddr(entry); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	input := `; Spamhaus DROP List
+; Last-Modified: Thu, 01 Jan 2025 00:00:00 GMT
+1.10.16.0/20 ; SBL256894
+2.56.192.0/22 ; SBL459831
+# plain IP list
+203.0.113.7
+2001:db8::/32
+ipAddress,countryCode,abuseConfidenceScore
+"198.51.100.9",US,100
+not-an-ip
+`
+	prefixes, err := parseBlocklist(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseBlocklist() error = %v", err)
+	}
+
+	want := []string{"1.10.16.0/20", "2.56.192.0/22", "203.0.113.7/32", "2001:db8::/32", "198.51.100.9/32"}
+	if len(prefixes) != len(want) {
+		t.Fatalf("parseBlocklist() returned %d entries, want %d: %v", len(prefixes), len(want), prefixes)
+	}
+	for i, w := range want {
+		if prefixes[i].String() != w {
+			t.Errorf("entry %d = %s, want %s", i, prefixes[i], w)
+		}
+	}
+}
+
+func TestAbuseTracker_IsListed(t *testing.T) {
+	at := newTestTracker(t)
+	at.SetBlocklist([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	})
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"2001:db8::1", true},
+		{"11.0.0.1", false},
+		{"invalid", false},
+	}
+	for _, tt := range tests {
+		if got := at.IsListed(tt.ip); got != tt.want {
+			t.Errorf("IsListed(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	entries, matches := at.GetBlocklistStats()
+	if entries != 2 {
+		t.Errorf("entries = %d, want 2", entries)
+	}
+	if matches != 3 {
+		t.Errorf("matches = %d, want 3", matches)
+	}
+}
+
+func TestBlocklistFetcher_Refresh(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "192.0.2.0/24 ; SBL1")
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte("198.51.100.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	at := newTestTracker(t)
+	bf := NewBlocklistFetcher([]string{srv.URL, path, filepath.Join(t.TempDir(), "missing")}, at)
+	bf.refresh()
+
+	if !at.IsListed("192.0.2.55") {
+		t.Error("IP from URL source should be listed")
+	}
+	if !at.IsListed("198.51.100.1") {
+		t.Error("IP from file source should be listed")
+	}
+	if entries, _ := at.GetBlocklistStats(); entries != 2 {
+		t.Errorf("entries = %d, want 2", entries)
+	}
+}
+
+func TestBlocklistFetcher_KeepsPreviousOnFailure(t *testing.T) {
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "192.0.2.0/24")
+	}))
+	defer srv.Close()
+
+	at := newTestTracker(t)
+	bf := NewBlocklistFetcher([]string{srv.URL}, at)
+	bf.refresh()
+
+	fail.Store(true)
+	bf.refresh()
+
+	if !at.IsListed("192.0.2.1") {
+		t.Error("entries should be kept when a refresh fails")
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+// botKeywords identify crawlers and vulnerability scanners by user agent (lowercase)
+var botKeywords = []string{
+	// Scanners
+	"zgrab", "masscan", "nmap", "nikto", "sqlmap", "nuclei", "gobuster", "dirbuster", "ffuf",
+	"wpscan", "censysinspect", "expanse", "l9explore", "l9tcpid", "odin.io", "internet-measurement",
+	"httpx", "fuzz faster", "modatscanner", "netsystemsresearch",
+	// Crawlers
+	"googlebot", "bingbot", "yandexbot", "baiduspider", "ahrefsbot", "semrushbot", "mj12bot",
+	"dotbot", "petalbot", "bytespider", "gptbot", "ccbot", "claudebot", "amazonbot", "dataforseobot",
+	"facebookexternalhit", "applebot", "duckduckbot",
+}
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Checking your browser</title></head>
+<body>
+<h1>Checking your browser</h1>
+<noscript><p>Enable JavaScript to continue to this site.</p></noscript>
+<script>
+document.cookie = "{{.Name}}={{.Value}}; path=/; max-age={{.MaxAge}}; secure; samesite=lax";
+location.reload();
+</script>
+</body>
+</html>
+`))
+
+// isBot reports whether a user agent is empty or belongs to a known crawler or scanner
+func isBot(userAgent string) bool {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+	if ua == "" {
+		return true
+	}
+	for _, kw := range botKeywords {
+		if strings.Contains(ua, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// botChallengeValue signs the subdomain, so a passed challenge only counts for it
+func (s *Server) botChallengeValue(sub string) string {
+	mac := hmac.New(sha256.New, s.cookieKey)
+	mac.Write([]byte("bot\x00" + sub))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkBots applies the pool's block-bots action. It returns true if the
+// request may proceed; otherwise it has already written a response.
+func (s *Server) checkBots(w http.ResponseWriter, r *http.Request, sub string, pool *tunnel.Pool) bool {
+	action := pool.BlockBots()
+	if action == "" || !isBot(r.Header.Get("User-Agent")) {
+		return true
+	}
+
+	switch action {
+	case tunnel.BotActionChallenge:
+		expected := s.botChallengeValue(sub)
+		if cookie, err := r.Cookie(config.BotChallengeCookieName); err == nil &&
+			hmac.Equal([]byte(cookie.Value), []byte(expected)) {
+			return true
+		}
+		s.botsBlocked.Add(1)
+		serveChallengePage(w, expected)
+	case tunnel.BotAction403:
+		s.botsBlocked.Add(1)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		s.botsBlocked.Add(1)
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}
+	return false
+}
+
+func serveChallengePage(w http.ResponseWriter, value string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	data := struct {
+		Name   string
+		Value  string
+		MaxAge int
+	}{config.BotChallengeCookieName, value, int(config.BotChallengeCookieMaxAge.Seconds())}
+	if err := challengePage.Execute(w, data); err != nil {
+		log.Printf("Failed to render challenge page: %v", err)
+	}
+}
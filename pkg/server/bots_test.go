@@ -0,0 +1,90 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+func TestIsBot(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want bool
+	}{
+		{"", true},
+		{"   ", true},
+		{"Mozilla/5.0 zgrab/0.x", true},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"Mozilla/5.0 (compatible; Nmap Scripting Engine; https://nmap.org/book/nse.html)", true},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36", false},
+		{"curl/8.5.0", false},
+	}
+	for _, tt := range tests {
+		if got := isBot(tt.ua); got != tt.want {
+			t.Errorf("isBot(%q) = %v, want %v", tt.ua, got, tt.want)
+		}
+	}
+}
+
+func TestServeHTTP_BlockBots(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	pool := s.GetPool(sub)
+	pool.SetNoWarning(true)
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	serve := func(ua string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil)
+		r.Header.Set("User-Agent", ua)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// Without the option bots reach the backend
+	if w := serve("", nil); w.Body.String() != "backend" {
+		t.Fatalf("bot without block-bots: status %d, body %q", w.Code, w.Body)
+	}
+
+	for action, want := range map[string]int{tunnel.BotAction404: http.StatusNotFound, tunnel.BotAction403: http.StatusForbidden} {
+		pool.SetBlockBots(action)
+		if w := serve("masscan/1.3", nil); w.Code != want {
+			t.Errorf("block-bots=%s: status = %d, want %d", action, w.Code, want)
+		}
+		if w := serve("curl/8.5.0", nil); w.Body.String() != "backend" {
+			t.Errorf("block-bots=%s: regular client got status %d", action, w.Code)
+		}
+	}
+
+	pool.SetBlockBots(tunnel.BotActionChallenge)
+	w := serve("", nil)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), config.BotChallengeCookieName+"=") {
+		t.Fatalf("challenge: status %d, body %q", w.Code, w.Body)
+	}
+	if w := serve("", &http.Cookie{Name: config.BotChallengeCookieName, Value: "forged"}); w.Code != http.StatusForbidden {
+		t.Errorf("forged challenge cookie: status = %d, want 403", w.Code)
+	}
+	passed := &http.Cookie{Name: config.BotChallengeCookieName, Value: s.botChallengeValue(sub)}
+	if w := serve("", passed); w.Body.String() != "backend" {
+		t.Errorf("passed challenge: status %d, body %q", w.Code, w.Body)
+	}
+
+	if got := s.GetStats(false, false).BotsBlocked; got != 4 {
+		t.Errorf("BotsBlocked = %d, want 4", got)
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+// Broadcast writes an announcement to the terminal of every connected SSH
+// session and returns how many sessions it was sent to
+func (s *Server) Broadcast(message string) int {
+	s.mu.RLock()
+	pools := make([]*tunnel.Pool, 0, len(s.pools))
+	for _, pool := range s.pools {
+		pools = append(pools, pool)
+	}
+	s.mu.RUnlock()
+
+	sent := 0
+	for _, pool := range pools {
+		for _, t := range pool.Tunnels() {
+			if logger := t.Logger(); logger != nil {
+				logger.LogAnnouncement(message)
+				sent++
+			}
+		}
+	}
+	return sent
+}
+
+// broadcastHandler serves POST /api/broadcast. A body of
+// {"message": "server restart in 5 minutes"} is shown in every session.
+func (s *Server) broadcastHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Message string `json:"message"`
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validAnnouncement(req.Message); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sessions := s.Broadcast(req.Message)
+		log.Printf("Broadcast to %d sessions: %s", sessions, req.Message)
+		writeJSON(w, struct {
+			Sessions int `json:"sessions"`
+		}{sessions})
+	})
+}
+
+// validAnnouncement checks that a message fits on one line and holds no
+// control characters that could mangle the clients' terminals
+func validAnnouncement(message string) error {
+	if strings.TrimSpace(message) == "" {
+		return fmt.Errorf("message must not be empty")
+	}
+	if len(message) > config.MaxBroadcastLength {
+		return fmt.Errorf("message must be at most %d bytes", config.MaxBroadcastLength)
+	}
+	if strings.IndexFunc(message, unicode.IsControl) >= 0 {
+		return fmt.Errorf("message must not contain control characters")
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tunnl.gg/pkg/tunnel"
+)
+
+func TestBroadcastAPI(t *testing.T) {
+	s := newTestServer(t)
+	var outputs [2]bytes.Buffer
+	var loggers []*tunnel.RequestLogger
+	for i, sub := range []string{"happy-tiger-abcdef01", "brave-lion-abcdef02"} {
+		tun := s.RegisterTunnel(sub, "", 0, newTestListener(t), "", 80, "1.2.3.4")
+		l := tunnel.NewRequestLogger(&outputs[i], 16)
+		tun.SetLogger(l)
+		loggers = append(loggers, l)
+	}
+	// A tunnel without a session terminal is skipped
+	s.RegisterTunnel("quiet-owl-abcdef03", "", 0, newTestListener(t), "", 80, "1.2.3.5")
+
+	do := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/broadcast", strings.NewReader(body))
+		r.RemoteAddr = "127.0.0.1:1"
+		w := httptest.NewRecorder()
+		s.StatsHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(`{"message": "server restart in 5 minutes"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"sessions":2`) {
+		t.Fatalf("broadcast = %d %q", w.Code, w.Body)
+	}
+	for i, l := range loggers {
+		l.Close()
+		if !strings.Contains(outputs[i].String(), "server restart in 5 minutes") {
+			t.Errorf("session %d output = %q", i, outputs[i].String())
+		}
+	}
+
+	for _, body := range []string{`{"message": ""}`, `{"message": "line\u001b[2J"}`, `{"message": "` + strings.Repeat("x", 501) + `"}`} {
+		if w := do(body); w.Code != http.StatusBadRequest {
+			t.Errorf("broadcast %.40s = %d, want 400", body, w.Code)
+		}
+	}
+}
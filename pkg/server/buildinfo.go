@@ -0,0 +1,54 @@
+package server
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// BuildInfo describes the running binary and the hot path benchmarks it
+// was tuned against
+type BuildInfo struct {
+	GoVersion  string            `json:"go_version"`
+	Revision   string            `json:"revision,omitempty"` // VCS revision, if stamped
+	Modified   bool              `json:"modified,omitempty"` // built from a dirty tree
+	Benchmarks []BenchmarkResult `json:"benchmarks"`
+}
+
+// BenchmarkResult compares a benchmark before and after an optimization
+type BenchmarkResult struct {
+	Name   string           `json:"name"`
+	Before BenchmarkNumbers `json:"before"`
+	After  BenchmarkNumbers `json:"after"`
+}
+
+// BenchmarkNumbers are the per-operation figures of go test -benchmem
+type BenchmarkNumbers struct {
+	NsPerOp     int64 `json:"ns_per_op"`
+	BytesPerOp  int64 `json:"bytes_per_op"`
+	AllocsPerOp int64 `json:"allocs_per_op"`
+}
+
+// hotPathBenchmarks are the numbers of `make bench` around the last round
+// of allocation work on the proxy paths; update them with the next one
+var hotPathBenchmarks = []BenchmarkResult{
+	{"ServeHTTP", BenchmarkNumbers{42421, 47953, 127}, BenchmarkNumbers{41572, 47713, 114}},
+	{"CopyWithLimits", BenchmarkNumbers{84645, 36867, 46}, BenchmarkNumbers{69570, 4110, 45}},
+	{"ForwardToSSH", BenchmarkNumbers{184507, 178258, 112}, BenchmarkNumbers{165366, 112654, 105}},
+}
+
+// buildInfo reads the binary's build information once
+var buildInfo = sync.OnceValue(func() BuildInfo {
+	info := BuildInfo{GoVersion: runtime.Version(), Benchmarks: hotPathBenchmarks}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Revision = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+})
@@ -0,0 +1,19 @@
+package server
+
+import "testing"
+
+func TestBuildInfo(t *testing.T) {
+	s := newTestServer(t)
+	build := s.GetStats(false, false).Build
+	if build.GoVersion == "" {
+		t.Error("Go version missing")
+	}
+	for _, b := range build.Benchmarks {
+		if b.Before.NsPerOp <= 0 || b.After.NsPerOp <= 0 {
+			t.Errorf("benchmark %s has no numbers: %+v", b.Name, b)
+		}
+	}
+	if len(build.Benchmarks) == 0 {
+		t.Error("benchmarks missing")
+	}
+}
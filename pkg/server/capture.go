@@ -0,0 +1,405 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tunnl.gg/internal/storage"
+	"tunnl.gg/pkg/config"
+)
+
+// Capture is a request to an inspected tunnel with its headers and bodies
+type Capture struct {
+	ID             string       `json:"id"`
+	Subdomain      string       `json:"subdomain"`
+	Time           time.Time    `json:"time"`
+	Method         string       `json:"method"`
+	URL            string       `json:"url"` // path and query
+	Status         int          `json:"status"`
+	RequestHeader  http.Header  `json:"request_headers"`
+	ResponseHeader http.Header  `json:"response_headers,omitempty"`
+	Request        CapturedBody `json:"request_body"`
+	Response       CapturedBody `json:"response_body"`
+}
+
+// CapturedBody describes a captured body. The first CaptureBodyLimit bytes
+// are kept in memory; larger bodies are spilled to storage when it is set.
+type CapturedBody struct {
+	Size      int64 `json:"size"`      // bytes that passed through the proxy
+	Truncated bool  `json:"truncated"` // fewer than Size bytes are stored
+	Spilled   bool  `json:"spilled"`   // stored in the spill storage rather than in memory
+
+	preview []byte
+}
+
+// CaptureStore keeps the captures of inspected tunnels for CaptureTTL.
+// Bodies held in memory are bounded by CaptureMemoryBudget and the shared
+// memory budget, and bodies buffered for spilling by CaptureSpillBudget;
+// the oldest captures are dropped first.
+type CaptureStore struct {
+	limit  int             // bytes of each body kept in memory
+	spill  storage.Storage // nil = bodies are truncated at limit
+	budget *MemoryBudget   // nil = only CaptureMemoryBudget applies
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu       sync.Mutex
+	captures map[string]*Capture
+	order    []string // capture IDs, oldest first
+	memory   int64    // bytes of bodies held by captures
+
+	spilling atomic.Int64   // bytes of the spill budget in use
+	spills   sync.WaitGroup // pending spill writes and deletes
+
+	stopCleanup chan struct{}
+	cleanupDone chan struct{}
+}
+
+// NewCaptureStore creates a capture store keeping limit bytes of each body
+// in memory and spilling larger bodies to spill, if not nil
+func NewCaptureStore(limit int, spill storage.Storage) *CaptureStore {
+	cs := &CaptureStore{
+		limit:       limit,
+		spill:       spill,
+		ttl:         config.CaptureTTL,
+		now:         time.Now,
+		captures:    make(map[string]*Capture),
+		stopCleanup: make(chan struct{}),
+		cleanupDone: make(chan struct{}),
+	}
+	go cs.cleanup()
+	return cs
+}
+
+// Stop stops the cleanup goroutine and waits for pending spill writes
+func (cs *CaptureStore) Stop() {
+	close(cs.stopCleanup)
+	<-cs.cleanupDone
+	cs.spills.Wait()
+}
+
+// SetMemoryBudget makes bodies held in memory count against b. It must be
+// called before the store is used.
+func (cs *CaptureStore) SetMemoryBudget(b *MemoryBudget) {
+	cs.budget = b
+}
+
+// Start begins capturing a request to sub, teeing its body into the capture
+func (cs *CaptureStore) Start(sub string, r *http.Request) *captureRecorder {
+	c := &captureRecorder{
+		store: cs,
+		capture: Capture{
+			ID:            newCaptureID(),
+			Subdomain:     sub,
+			Time:          cs.now(),
+			Method:        r.Method,
+			URL:           r.URL.RequestURI(),
+			RequestHeader: r.Header.Clone(),
+		},
+	}
+	c.request.store, c.response.store = cs, cs
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &teeReadCloser{r.Body, &c.request}
+	}
+	return c
+}
+
+// Get returns a copy of a capture
+func (cs *CaptureStore) Get(id string) (Capture, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.captures[id]
+	if !ok {
+		return Capture{}, false
+	}
+	return *c, true
+}
+
+// Body returns the stored bytes of a capture's request or response body,
+// reading spilled bodies back from storage, and whether they are the
+// whole body
+func (cs *CaptureStore) Body(ctx context.Context, id, part string) ([]byte, bool, error) {
+	c, ok := cs.Get(id)
+	if !ok {
+		return nil, false, storage.ErrNotFound
+	}
+	body := c.Request
+	if part == "response" {
+		body = c.Response
+	}
+	if body.Spilled {
+		data, err := cs.spill.Get(ctx, spillKey(id, part))
+		if err == nil {
+			return data, !body.Truncated, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return nil, false, err
+		}
+		// Not written yet: fall back to the part held in memory
+	}
+	return body.preview, int64(len(body.preview)) == body.Size, nil
+}
+
+// add stores a finished capture, spilling bodies past the memory limit
+func (cs *CaptureStore) add(c *Capture, request, response *bodyRecorder) {
+	c.Request = request.finish()
+	c.Response = response.finish()
+
+	size := int64(len(c.Request.preview) + len(c.Response.preview))
+	cs.mu.Lock()
+	var evicted []*Capture
+	for !cs.budget.Reserve(memoryCaptures, size) {
+		cs.budget.Evicted(memoryCaptures)
+		if len(cs.order) == 0 {
+			// Nothing left to evict: keep the capture without its bodies
+			c.Request.dropPreview()
+			c.Response.dropPreview()
+			size = 0
+			break
+		}
+		evicted = append(evicted, cs.removeOldest())
+	}
+	cs.captures[c.ID] = c
+	cs.order = append(cs.order, c.ID)
+	cs.memory += size
+	for len(cs.order) > config.MaxCaptures || cs.memory > config.CaptureMemoryBudget {
+		evicted = append(evicted, cs.removeOldest())
+	}
+	cs.mu.Unlock()
+
+	if c.Request.Spilled {
+		cs.spillBody(c.ID, "request", request)
+	}
+	if c.Response.Spilled {
+		cs.spillBody(c.ID, "response", response)
+	}
+	cs.deleteSpilled(evicted)
+}
+
+// spillBody writes a body to the spill storage in the background and
+// releases its share of the spill budget once written
+func (cs *CaptureStore) spillBody(id, part string, b *bodyRecorder) {
+	cs.spills.Add(1)
+	go func() {
+		defer cs.spills.Done()
+		defer cs.spilling.Add(-b.reserved)
+		ctx, cancel := context.WithTimeout(context.Background(), config.StorageTimeout)
+		defer cancel()
+		err := cs.spill.Put(ctx, spillKey(id, part), b.buf)
+		if err != nil {
+			log.Printf("Failed to spill captured %s body %s: %v", part, id, err)
+		}
+		cs.mu.Lock()
+		c, kept := cs.captures[id]
+		if kept && err != nil {
+			body := &c.Request
+			if part == "response" {
+				body = &c.Response
+			}
+			body.Spilled = false
+			body.Truncated = int64(len(body.preview)) < body.Size
+		}
+		cs.mu.Unlock()
+		if !kept && err == nil {
+			// Dropped while being written
+			cs.spill.Delete(ctx, spillKey(id, part))
+		}
+	}()
+}
+
+// deleteSpilled removes the spilled bodies of dropped captures in the background
+func (cs *CaptureStore) deleteSpilled(captures []*Capture) {
+	var keys []string
+	for _, c := range captures {
+		if c.Request.Spilled {
+			keys = append(keys, spillKey(c.ID, "request"))
+		}
+		if c.Response.Spilled {
+			keys = append(keys, spillKey(c.ID, "response"))
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	cs.spills.Add(1)
+	go func() {
+		defer cs.spills.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), config.StorageTimeout)
+		defer cancel()
+		for _, key := range keys {
+			if err := cs.spill.Delete(ctx, key); err != nil {
+				log.Printf("Failed to delete spilled capture %s: %v", key, err)
+			}
+		}
+	}()
+}
+
+// removeOldest drops the oldest capture. cs.mu must be held.
+func (cs *CaptureStore) removeOldest() *Capture {
+	c := cs.captures[cs.order[0]]
+	delete(cs.captures, cs.order[0])
+	cs.order = cs.order[1:]
+	size := int64(len(c.Request.preview) + len(c.Response.preview))
+	cs.memory -= size
+	cs.budget.Release(memoryCaptures, size)
+	return c
+}
+
+// cleanup periodically deletes expired captures
+func (cs *CaptureStore) cleanup() {
+	ticker := time.NewTicker(config.CaptureSweepInterval)
+	defer ticker.Stop()
+	defer close(cs.cleanupDone)
+
+	for {
+		select {
+		case <-cs.stopCleanup:
+			return
+		case <-ticker.C:
+			cs.removeExpired()
+		}
+	}
+}
+
+// removeExpired deletes captures older than the TTL with their spilled bodies
+func (cs *CaptureStore) removeExpired() {
+	cutoff := cs.now().Add(-cs.ttl)
+	var expired []*Capture
+	cs.mu.Lock()
+	for len(cs.order) > 0 && cs.captures[cs.order[0]].Time.Before(cutoff) {
+		expired = append(expired, cs.removeOldest())
+	}
+	cs.mu.Unlock()
+	cs.deleteSpilled(expired)
+}
+
+// captureRecorder collects a request and its response while they are proxied
+type captureRecorder struct {
+	store    *CaptureStore
+	capture  Capture
+	request  bodyRecorder
+	response bodyRecorder
+}
+
+// RecordResponse captures the backend's response headers and tees its body
+func (c *captureRecorder) RecordResponse(resp *http.Response) {
+	c.capture.ResponseHeader = resp.Header.Clone()
+	resp.Body = &teeReadCloser{resp.Body, &c.response}
+}
+
+// Finish stores the capture with the status sent to the visitor and returns its ID
+func (c *captureRecorder) Finish(status int) string {
+	c.capture.Status = status
+	capture := c.capture
+	c.store.add(&capture, &c.request, &c.response)
+	return capture.ID
+}
+
+// bodyRecorder keeps a copy of a body as it streams through the proxy: the
+// first limit bytes and, when spilling is enabled, up to MaxStorageObjectSize
+// bytes while the spill budget lasts
+type bodyRecorder struct {
+	store    *CaptureStore
+	mu       sync.Mutex
+	buf      []byte
+	size     int64
+	reserved int64 // bytes of buf past the limit, taken from the spill budget
+	full     bool  // no more bytes are kept
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	b.size += int64(n)
+	if b.full {
+		return n, nil
+	}
+	if room := b.store.limit - len(b.buf); room > 0 {
+		k := min(room, len(p))
+		b.buf = append(b.buf, p[:k]...)
+		p = p[k:]
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	if b.store.spill == nil {
+		b.full = true
+		return n, nil
+	}
+	k := min(len(p), config.MaxStorageObjectSize-len(b.buf))
+	if k <= 0 {
+		b.full = true
+		return n, nil
+	}
+	if b.store.spilling.Add(int64(k)) > config.CaptureSpillBudget {
+		// Out of spill budget: keep only the part held in memory
+		b.store.spilling.Add(-int64(k) - b.reserved)
+		b.reserved = 0
+		b.buf = b.buf[:b.store.limit]
+		b.full = true
+		return n, nil
+	}
+	b.reserved += int64(k)
+	b.buf = append(b.buf, p[:k]...)
+	if k < len(p) {
+		b.full = true
+	}
+	return n, nil
+}
+
+// finish describes the recorded body and stops recording. Bytes past the
+// limit stay in buf for spillBody; the memory part is copied so buf can be
+// dropped once spilled.
+func (b *bodyRecorder) finish() CapturedBody {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.full = true
+	return CapturedBody{
+		Size:      b.size,
+		Truncated: int64(len(b.buf)) < b.size,
+		Spilled:   len(b.buf) > b.store.limit,
+		preview:   bytes.Clone(b.buf[:min(len(b.buf), b.store.limit)]),
+	}
+}
+
+// dropPreview forgets the part of a body held in memory
+func (b *CapturedBody) dropPreview() {
+	b.preview = nil
+	b.Truncated = !b.Spilled && b.Size > 0
+}
+
+// teeReadCloser copies what is read from a body into a recorder
+type teeReadCloser struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.w.Write(p[:n])
+	}
+	return n, err
+}
+
+// spillKey is the storage key of a spilled body
+func spillKey(id, part string) string {
+	return id + "/" + part
+}
+
+// newCaptureID returns a random identifier for a capture
+func newCaptureID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnl.gg/internal/storage"
+)
+
+// recordBody feeds body through a recorder of cs in small writes and finishes it
+func recordBody(cs *CaptureStore, body string) (*bodyRecorder, CapturedBody) {
+	b := &bodyRecorder{store: cs}
+	for chunk := range strings.SplitSeq(body, "") {
+		b.Write([]byte(chunk))
+	}
+	return b, b.finish()
+}
+
+func TestBodyRecorder(t *testing.T) {
+	cs := NewCaptureStore(4, nil)
+	defer cs.Stop()
+
+	if _, body := recordBody(cs, "abc"); body.Truncated || body.Spilled || string(body.preview) != "abc" {
+		t.Errorf("small body = %+v, preview %q", body, body.preview)
+	}
+	if _, body := recordBody(cs, "abcdefgh"); !body.Truncated || body.Spilled || body.Size != 8 || string(body.preview) != "abcd" {
+		t.Errorf("large body without spill = %+v, preview %q", body, body.preview)
+	}
+
+	spilling := NewCaptureStore(4, storage.NewDir(t.TempDir()))
+	defer spilling.Stop()
+	b, body := recordBody(spilling, "abcdefgh")
+	if body.Truncated || !body.Spilled || string(body.preview) != "abcd" || string(b.buf) != "abcdefgh" {
+		t.Errorf("large body with spill = %+v, buf %q", body, b.buf)
+	}
+	if got := spilling.spilling.Load(); got != 4 {
+		t.Errorf("spill budget in use = %d, want 4", got)
+	}
+}
+
+func TestCaptureStore_Spill(t *testing.T) {
+	dir := storage.NewDir(t.TempDir())
+	cs := NewCaptureStore(4, dir)
+	defer cs.Stop()
+
+	r := httptest.NewRequest("POST", "/upload?x=1", strings.NewReader("request body"))
+	c := cs.Start("happy-tiger-abcdef01", r)
+	io.ReadAll(r.Body)
+	resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(strings.NewReader("ok"))}
+	c.RecordResponse(resp)
+	io.ReadAll(resp.Body)
+	id := c.Finish(http.StatusCreated)
+	cs.spills.Wait()
+
+	got, ok := cs.Get(id)
+	if !ok || got.URL != "/upload?x=1" || got.Status != http.StatusCreated || !got.Request.Spilled || got.Response.Spilled {
+		t.Fatalf("capture = %+v, %v", got, ok)
+	}
+	ctx := context.Background()
+	if data, complete, err := cs.Body(ctx, id, "request"); err != nil || !complete || string(data) != "request body" {
+		t.Errorf("request body = %q, %v, %v", data, complete, err)
+	}
+	if data, complete, err := cs.Body(ctx, id, "response"); err != nil || !complete || string(data) != "ok" {
+		t.Errorf("response body = %q, %v, %v", data, complete, err)
+	}
+	if cs.spilling.Load() != 0 {
+		t.Errorf("spill budget in use = %d after writing", cs.spilling.Load())
+	}
+
+	// Expired captures are deleted with their spilled bodies
+	cs.now = func() time.Time { return time.Now().Add(2 * cs.ttl) }
+	cs.removeExpired()
+	cs.spills.Wait()
+	if _, ok := cs.Get(id); ok {
+		t.Error("expired capture should be removed")
+	}
+	if _, err := dir.Get(ctx, spillKey(id, "request")); err != storage.ErrNotFound {
+		t.Errorf("spilled body of an expired capture: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestServeHTTP_Inspect(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	s.GetPool(sub).SetInspect(true)
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "pong")
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	r := httptest.NewRequest("POST", "https://"+sub+"."+s.domain+"/ping", strings.NewReader("ping"))
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	records := tun.History().Recent(1)
+	if len(records) != 1 || records[0].CaptureID == "" {
+		t.Fatalf("history = %+v, want a capture ID", records)
+	}
+	id := records[0].CaptureID
+
+	handler := s.StatsHandler()
+	req := httptest.NewRequest("GET", "/api/captures/"+id+"/response", nil)
+	req.RemoteAddr = "127.0.0.1:1"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "pong" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("response body = %d %q (%s)", w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+	}
+
+	req = httptest.NewRequest("GET", "/api/captures/"+id, nil)
+	req.RemoteAddr = "127.0.0.1:1"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `"method":"POST"`) || !strings.Contains(w.Body.String(), `"size":4`) {
+		t.Errorf("capture = %s", w.Body.String())
+	}
+}
+
+func TestServeHTTP_InspectAborted(t *testing.T) {
+	s := newTestServer(t)
+	s.captures.Stop()
+	s.captures = NewCaptureStore(4, storage.NewDir(t.TempDir()))
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	s.GetPool(sub).SetInspect(true)
+
+	// The backend drops the connection partway through its body
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		io.WriteString(w, strings.Repeat("x", 100))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}), ErrorLog: log.New(io.Discard, "", 0)}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	// A real server, under which the proxy aborts cut-off responses with a panic
+	front := httptest.NewServer(s)
+	defer front.Close()
+	front.Config.ErrorLog = log.New(io.Discard, "", 0)
+	req, _ := http.NewRequest("GET", front.URL+"/download", nil)
+	req.Host = sub + "." + s.domain
+	if resp, err := front.Client().Do(req); err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Error("the cut-off response should end with an error")
+		}
+	}
+
+	records := tun.History().Recent(1)
+	if len(records) != 1 || records[0].CaptureID == "" {
+		t.Fatalf("history = %+v, want the aborted request with a capture ID", records)
+	}
+	s.captures.spills.Wait()
+	if got := s.captures.spilling.Load(); got != 0 {
+		t.Errorf("spill budget in use = %d after an aborted request", got)
+	}
+}
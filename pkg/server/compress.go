@@ -0,0 +1,144 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+
+	"tunnl.gg/pkg/config"
+)
+
+// compressibleTypes are the media types worth compressing; other types
+// (images, video, archives) are usually compressed already
+var compressibleTypes = map[string]bool{
+	"application/javascript":    true,
+	"application/json":          true,
+	"application/manifest+json": true,
+	"application/wasm":          true,
+	"application/xml":           true,
+	"image/svg+xml":             true,
+}
+
+// isCompressibleType reports whether a Content-Type is worth compressing
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediaType == "text/event-stream" {
+		// Buffering in the compressor would hold back events
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// negotiateEncoding picks brotli or gzip from a request's Accept-Encoding,
+// preferring brotli when both are acceptable. Returns "" for neither.
+func negotiateEncoding(acceptEncoding string) string {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[strings.ToLower(strings.TrimSpace(coding))] = weight
+	}
+	star, hasStar := q["*"]
+	accepts := func(coding string) bool {
+		if w, ok := q[coding]; ok {
+			return w > 0
+		}
+		return hasStar && star > 0
+	}
+	switch {
+	case accepts("br"):
+		return "br"
+	case accepts("gzip"):
+		return "gzip"
+	}
+	return ""
+}
+
+// compressResponse compresses a backend response on the fly when the visitor
+// accepts it and the backend did not compress it already. Eligible responses
+// get Vary: Accept-Encoding whether or not this visitor's is compressed, so
+// caches keep the two variants apart.
+func compressResponse(resp *http.Response) {
+	req := resp.Request
+	if req == nil || req.Method == http.MethodHead ||
+		resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Content-Encoding") != "" ||
+		resp.Header.Get("Content-Range") != "" ||
+		strings.Contains(resp.Header.Get("Cache-Control"), "no-transform") ||
+		!isCompressibleType(resp.Header.Get("Content-Type")) ||
+		(resp.ContentLength >= 0 && resp.ContentLength < config.CompressMinSize) {
+		return
+	}
+	if !varies(resp.Header, "Accept-Encoding") {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+	encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return
+	}
+
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	// The compressed body differs from the one a strong validator names
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+
+	src := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		var zw io.WriteCloser
+		if encoding == "br" {
+			zw = brotli.NewWriterLevel(pw, 4)
+		} else {
+			zw, _ = gzip.NewWriterLevel(pw, gzip.DefaultCompression)
+		}
+		_, err := io.Copy(zw, src)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		src.Close()
+		pw.CloseWithError(err)
+	}()
+	resp.Body = &pipeBody{PipeReader: pr, src: src}
+}
+
+// pipeBody is a compressed response body; closing it also closes the
+// backend body, stopping the compressor if the visitor went away
+type pipeBody struct {
+	*io.PipeReader
+	src io.Closer
+}
+
+func (b *pipeBody) Close() error {
+	b.src.Close()
+	return b.PipeReader.Close()
+}
+
+// varies reports whether a response's Vary header lists the given request header
+func varies(h http.Header, name string) bool {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
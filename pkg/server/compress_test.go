@@ -0,0 +1,177 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0, gzip", "gzip"},
+		{"GZIP;q=0.5", "gzip"},
+		{"identity", ""},
+		{"*", "br"},
+		{"*, br;q=0", "gzip"},
+		{"gzip;q=0", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestIsCompressibleType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"application/json", true},
+		{"application/ld+json", true},
+		{"image/svg+xml", true},
+		{"image/png", false},
+		{"application/zip", false},
+		{"text/event-stream", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isCompressibleType(tt.contentType); got != tt.want {
+			t.Errorf("isCompressibleType(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+// newCompressTestResponse returns a backend response to a request with the given Accept-Encoding
+func newCompressTestResponse(acceptEncoding, contentType, body string) *http.Response {
+	req := httptest.NewRequest("GET", "/", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {contentType}, "Etag": {`"v1"`}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	resp.Header.Set("Content-Length", "1")
+	return resp
+}
+
+func TestCompressResponse(t *testing.T) {
+	body := strings.Repeat("hello tunnl ", 500)
+
+	for encoding, decode := range map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	} {
+		t.Run(encoding, func(t *testing.T) {
+			resp := newCompressTestResponse(encoding, "text/html", body)
+			compressResponse(resp)
+
+			if got := resp.Header.Get("Content-Encoding"); got != encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, encoding)
+			}
+			if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+				t.Error("Content-Length should be dropped")
+			}
+			if resp.Header.Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", resp.Header.Get("Vary"))
+			}
+			if resp.Header.Get("ETag") != `W/"v1"` {
+				t.Errorf("ETag = %q, want it weakened", resp.Header.Get("ETag"))
+			}
+
+			compressed, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compressed) >= len(body) {
+				t.Errorf("compressed %d bytes to %d", len(body), len(compressed))
+			}
+			r, err := decode(strings.NewReader(string(compressed)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := io.ReadAll(r); string(got) != body {
+				t.Error("decompressed body differs from the original")
+			}
+		})
+	}
+
+	t.Run("not accepted", func(t *testing.T) {
+		resp := newCompressTestResponse("", "text/html", body)
+		compressResponse(resp)
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Error("response should not be compressed")
+		}
+		if resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Error("eligible responses should vary on Accept-Encoding even when sent as-is")
+		}
+	})
+
+	skipped := map[string]func(*http.Response){
+		"already encoded":  func(r *http.Response) { r.Header.Set("Content-Encoding", "gzip") },
+		"not compressible": func(r *http.Response) { r.Header.Set("Content-Type", "image/png") },
+		"small":            func(r *http.Response) { r.ContentLength = 100 },
+		"partial":          func(r *http.Response) { r.StatusCode = http.StatusPartialContent },
+		"no-transform":     func(r *http.Response) { r.Header.Set("Cache-Control", "public, no-transform") },
+		"head":             func(r *http.Response) { r.Request.Method = http.MethodHead },
+	}
+	for name, modify := range skipped {
+		t.Run(name, func(t *testing.T) {
+			resp := newCompressTestResponse("gzip", "text/html", body)
+			modify(resp)
+			before := resp.Header.Get("Content-Encoding")
+			compressResponse(resp)
+			if resp.Header.Get("Content-Encoding") != before || resp.Header.Get("Vary") != "" {
+				t.Errorf("response should be left alone, headers = %v", resp.Header)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_Compress(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	s.GetPool(sub).SetCompress(true)
+
+	body := strings.Repeat("hello tunnl ", 500)
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != body {
+		t.Error("decompressed body differs from the backend's")
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"slices"
+	"strings"
+
+	"tunnl.gg/internal/subdomain"
+	"tunnl.gg/pkg/tunnel"
+)
+
+// splitHost returns the subdomain of a request host and the serving domain
+// it belongs to. The longest matching domain wins, so a domain may be nested
+// in another (e.g. eu.tunnl.gg alongside tunnl.gg). The subdomain is a single
+// label, and a serving domain is never taken for a subdomain of another, so
+// eu.tunnl.gg cannot reach a tunnel named eu.
+func (s *Server) splitHost(host string) (sub, domain string, ok bool) {
+	if s.servesDomain(host) {
+		return "", "", false
+	}
+	for _, d := range s.domains {
+		if strings.HasSuffix(host, "."+d) && len(d) > len(domain) {
+			sub, domain, ok = strings.TrimSuffix(host, "."+d), d, true
+		}
+	}
+	if !ok || sub == "" || strings.Contains(sub, ".") {
+		return "", "", false
+	}
+	return sub, domain, ok
+}
+
+// servesDomain reports whether domain is one of the server's domains
+func (s *Server) servesDomain(domain string) bool {
+	return slices.Contains(s.domains, domain)
+}
+
+// Domains returns the serving domains, the default domain first
+func (s *Server) Domains() []string {
+	return slices.Clone(s.domains)
+}
+
+// domainOf returns the domain a subdomain is served on
+func (s *Server) domainOf(pool *tunnel.Pool) string {
+	if d := pool.Domain(); d != "" {
+		return d
+	}
+	return s.domain
+}
+
+// domainFor returns the domain a subdomain is served on, or the default
+// domain if it has no tunnels
+func (s *Server) domainFor(sub string) string {
+	if pool := s.GetPool(sub); pool != nil {
+		return s.domainOf(pool)
+	}
+	return s.domain
+}
+
+// publicURL returns the public URL of a subdomain
+func (s *Server) publicURL(pool *tunnel.Pool) string {
+	return "https://" + pool.Subdomain + "." + s.domainOf(pool)
+}
+
+// serviceURL returns the public URL of a named service of a subdomain
+func (s *Server) serviceURL(pool *tunnel.Pool, service string) string {
+	return "https://" + service + subdomain.ServiceSeparator + pool.Subdomain + "." + s.domainOf(pool)
+}
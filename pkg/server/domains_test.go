@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tunnl.gg/pkg/tunnel"
+)
+
+func newMultiDomainTestServer(t testing.TB) *Server {
+	t.Helper()
+	s := newTestServer(t)
+	s.domains = []string{s.domain, "tunnl.dev", "eu.tunnl.gg"}
+	return s
+}
+
+func TestSplitHost(t *testing.T) {
+	s := newMultiDomainTestServer(t)
+
+	tests := []struct {
+		host       string
+		wantSub    string
+		wantDomain string
+		wantOK     bool
+	}{
+		{"myapp.tunnl.gg", "myapp", "tunnl.gg", true},
+		{"myapp.tunnl.dev", "myapp", "tunnl.dev", true},
+		{"myapp.eu.tunnl.gg", "myapp", "eu.tunnl.gg", true},
+		{"tunnl.dev", "", "", false},
+		{"myapp.evil.com", "", "", false},
+		{"eu.tunnl.gg", "", "", false},
+		{"a.myapp.tunnl.gg", "", "", false},
+		{".tunnl.gg", "", "", false},
+		{"myapp.tunnl.gg.evil.com", "", "", false},
+	}
+	for _, tt := range tests {
+		sub, domain, ok := s.splitHost(tt.host)
+		if sub != tt.wantSub || domain != tt.wantDomain || ok != tt.wantOK {
+			t.Errorf("splitHost(%q) = %q, %q, %v, want %q, %q, %v", tt.host, sub, domain, ok, tt.wantSub, tt.wantDomain, tt.wantOK)
+		}
+	}
+}
+
+func FuzzSplitHost(f *testing.F) {
+	s := newMultiDomainTestServer(f)
+	for _, seed := range []string{"myapp.tunnl.gg", "myapp.eu.tunnl.gg", "eu.tunnl.gg", "a.b.tunnl.dev", "tunnl.gg", ".tunnl.gg"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, host string) {
+		sub, domain, ok := s.splitHost(host)
+		if !ok {
+			if sub != "" || domain != "" {
+				t.Errorf("splitHost(%q) = %q, %q on failure", host, sub, domain)
+			}
+			return
+		}
+		if sub+"."+domain != host || sub == "" || strings.Contains(sub, ".") || !s.servesDomain(domain) {
+			t.Errorf("splitHost(%q) = %q, %q, want one label of a served domain", host, sub, domain)
+		}
+		if s.servesDomain(host) {
+			t.Errorf("splitHost(%q) split a served domain", host)
+		}
+	})
+}
+
+func TestServeHTTP_TunnelDomain(t *testing.T) {
+	s := newMultiDomainTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	s.RegisterTunnel(sub, "", 0, newTestListener(t), "", 80, "1.2.3.4")
+	pool := s.GetPool(sub)
+	pool.SetDomain("tunnl.dev")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status on the default domain = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if got, want := s.publicURL(pool), "https://"+sub+".tunnl.dev"; got != want {
+		t.Errorf("publicURL() = %q, want %q", got, want)
+	}
+}
+
+func TestApplyOptions_Domain(t *testing.T) {
+	s := newMultiDomainTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	tun := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	pool := s.GetPool(sub)
+
+	opts, _ := tunnel.ParseOptions("domain=tunnl.io")
+	if err := s.applyOptions(pool, tun, nil, opts); err == nil {
+		t.Error("a domain the server does not serve should be refused")
+	}
+
+	opts, _ = tunnel.ParseOptions("domain=tunnl.dev")
+	if err := s.applyOptions(pool, tun, nil, opts); err != nil {
+		t.Fatalf("applyOptions() error = %v", err)
+	}
+	if s.domainOf(pool) != "tunnl.dev" {
+		t.Errorf("domainOf() = %q, want tunnl.dev", s.domainOf(pool))
+	}
+
+	// A second backend cannot move the subdomain
+	second := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	opts, _ = tunnel.ParseOptions("domain=" + s.domain)
+	if err := s.applyOptions(pool, second, nil, opts); err == nil {
+		t.Error("a joined backend should not change the domain")
+	}
+	opts, _ = tunnel.ParseOptions("domain=tunnl.dev")
+	if err := s.applyOptions(pool, second, nil, opts); err != nil {
+		t.Errorf("repeating the current domain should be accepted: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// BlockEnforcer pushes IP blocks into an external enforcement layer (e.g. the
+// kernel firewall) so blocked clients are dropped before accept and handshake.
+type BlockEnforcer interface {
+	Block(ip string, duration time.Duration) error
+	Unblock(ip string) error
+}
+
+// NFTEnforcer adds blocked IPs to nftables sets via the nft command.
+// Sets are given as "<family> <table> <set>", e.g. "inet filter tunnl_blocked".
+// Elements are added with a timeout so the kernel expires them even if the
+// server exits before removing them.
+type NFTEnforcer struct {
+	set4 string // set for IPv4 addresses
+	set6 string // set for IPv6 addresses (empty skips IPv6)
+
+	run func(args ...string) error // overridable for tests
+}
+
+// NewNFTEnforcer creates an enforcer for the given IPv4 and (optional) IPv6 sets
+func NewNFTEnforcer(set4, set6 string) (*NFTEnforcer, error) {
+	for _, set := range []string{set4, set6} {
+		if set != "" && len(strings.Fields(set)) != 3 {
+			return nil, fmt.Errorf("invalid nftables set %q: want \"<family> <table> <set>\"", set)
+		}
+	}
+	return &NFTEnforcer{set4: set4, set6: set6, run: runNFT}, nil
+}
+
+// Block adds the IP to the matching set for the given duration
+func (e *NFTEnforcer) Block(ip string, duration time.Duration) error {
+	set := e.setFor(ip)
+	if set == "" {
+		return nil
+	}
+	element := fmt.Sprintf("{ %s timeout %ds }", ip, int(duration.Seconds()))
+	return e.run(append(append([]string{"add", "element"}, strings.Fields(set)...), element)...)
+}
+
+// Unblock removes the IP from the matching set
+func (e *NFTEnforcer) Unblock(ip string) error {
+	set := e.setFor(ip)
+	if set == "" {
+		return nil
+	}
+	element := fmt.Sprintf("{ %s }", ip)
+	return e.run(append(append([]string{"delete", "element"}, strings.Fields(set)...), element)...)
+}
+
+func (e *NFTEnforcer) setFor(ip string) string {
+	if strings.Contains(ip, ":") {
+		return e.set6
+	}
+	return e.set4
+}
+
+func runNFT(args ...string) error {
+	out, err := exec.Command("nft", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewNFTEnforcer_InvalidSet(t *testing.T) {
+	if _, err := NewNFTEnforcer("tunnl_blocked", ""); err == nil {
+		t.Error("expected error for set without family and table")
+	}
+	if _, err := NewNFTEnforcer("inet filter tunnl_blocked", "inet filter"); err == nil {
+		t.Error("expected error for malformed IPv6 set")
+	}
+}
+
+func TestNFTEnforcer_Commands(t *testing.T) {
+	e, err := NewNFTEnforcer("inet filter blocked4", "inet filter blocked6")
+	if err != nil {
+		t.Fatalf("NewNFTEnforcer() error: %v", err)
+	}
+	var calls []string
+	e.run = func(args ...string) error {
+		calls = append(calls, strings.Join(args, " "))
+		return nil
+	}
+
+	e.Block("1.2.3.4", time.Hour)
+	e.Block("2001:db8::1", time.Minute)
+	e.Unblock("1.2.3.4")
+
+	want := []string{
+		"add element inet filter blocked4 { 1.2.3.4 timeout 3600s }",
+		"add element inet filter blocked6 { 2001:db8::1 timeout 60s }",
+		"delete element inet filter blocked4 { 1.2.3.4 }",
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("got %d nft calls, want %d: %v", len(calls), len(want), calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("call %d = %q, want %q", i, calls[i], want[i])
+		}
+	}
+}
+
+func TestNFTEnforcer_SkipsUnconfiguredFamily(t *testing.T) {
+	e, _ := NewNFTEnforcer("inet filter blocked4", "")
+	called := false
+	e.run = func(args ...string) error {
+		called = true
+		return nil
+	}
+
+	e.Block("2001:db8::1", time.Hour)
+	if called {
+		t.Error("IPv6 block should be skipped without an IPv6 set")
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"slices"
+
+	"tunnl.gg/pkg/tunnel"
+)
+
+// trackIPTunnel adds a tunnel to its client IP's fair share (must be called with s.mu held)
+func (s *Server) trackIPTunnel(t *tunnel.Tunnel) {
+	key := s.ipKey(t.ClientIP)
+	s.ipTunnels[key] = append(s.ipTunnels[key], t)
+	s.rebalanceIP(key)
+}
+
+// untrackIPTunnel removes a tunnel from its client IP's fair share (must be called with s.mu held)
+func (s *Server) untrackIPTunnel(t *tunnel.Tunnel) {
+	key := s.ipKey(t.ClientIP)
+	tunnels := slices.DeleteFunc(s.ipTunnels[key], func(other *tunnel.Tunnel) bool { return other == t })
+	if len(tunnels) == 0 {
+		delete(s.ipTunnels, key)
+		return
+	}
+	s.ipTunnels[key] = tunnels
+	s.rebalanceIP(key)
+}
+
+// rebalanceIP splits a client IP's request budget evenly across its tunnels,
+// so opening more tunnels does not multiply the client's budget. Each tunnel
+// keeps its own limit when that is lower than its share. Must be called with
+// s.mu held.
+func (s *Server) rebalanceIP(ip string) {
+	if s.ipRequestsPerSecond <= 0 {
+		return
+	}
+	tunnels := s.ipTunnels[ip]
+	share := max(1, s.ipRequestsPerSecond/len(tunnels))
+	for _, t := range tunnels {
+		t.SetShare(share)
+	}
+}
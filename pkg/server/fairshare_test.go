@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestFairShare(t *testing.T) {
+	s := newTestServer(t)
+	s.ipRequestsPerSecond = 20
+
+	a := s.RegisterTunnel("happy-tiger-abcdef01", "", 0, newTestListener(t), "", 80, "1.2.3.4")
+	if a.Share() != 20 {
+		t.Errorf("single tunnel Share() = %d, want the whole budget", a.Share())
+	}
+
+	b := s.RegisterTunnel("happy-tiger-abcdef02", "", 0, newTestListener(t), "", 80, "1.2.3.4")
+	other := s.RegisterTunnel("happy-tiger-abcdef03", "", 0, newTestListener(t), "", 80, "5.6.7.8")
+	if a.Share() != 10 || b.Share() != 10 {
+		t.Errorf("Share() = %d, %d, want the budget split across the IP's tunnels", a.Share(), b.Share())
+	}
+	if other.Share() != 20 {
+		t.Errorf("other IP Share() = %d, want its own budget", other.Share())
+	}
+
+	// The share caps the tunnel's limiter, burst included
+	burst := config.BurstSize * 10 / config.RequestsPerSecond
+	for i := 0; i < burst; i++ {
+		if !a.AllowRequest() {
+			t.Fatalf("request %d within the fair share burst was refused", i+1)
+		}
+	}
+	if a.AllowRequest() {
+		t.Error("request past the fair share burst should be refused")
+	}
+	if a.RateLimit() != config.RequestsPerSecond {
+		t.Errorf("RateLimit() = %d, the configured limit should be unchanged", a.RateLimit())
+	}
+
+	s.RemoveTunnel("happy-tiger-abcdef02", b)
+	if a.Share() != 20 {
+		t.Errorf("Share() after close = %d, want the whole budget back", a.Share())
+	}
+	s.RemoveTunnel("happy-tiger-abcdef01", a)
+	if len(s.ipTunnels["1.2.3.4"]) != 0 {
+		t.Error("closed tunnels should no longer be tracked")
+	}
+}
+
+func TestFairShare_Disabled(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		tun := s.RegisterTunnel(fmt.Sprintf("happy-tiger-abcdef0%d", i), "", 0, newTestListener(t), "", 80, "1.2.3.4")
+		if tun.Share() != 0 {
+			t.Errorf("Share() = %d without IP_REQUESTS_PER_SECOND, want 0", tun.Share())
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// TLSFingerprint identifies the TLS stack of a visitor. Scanners rotate IPs
+// but tend to reuse the same client library, so the fingerprint survives
+// where IP-based tracking does not.
+type TLSFingerprint struct {
+	JA3     string `json:"ja3"`      // JA3 hash (MD5 of the JA3 string)
+	JA3Full string `json:"ja3_full"` // JA3 string
+	JA4     string `json:"ja4"`
+}
+
+// Matches reports whether pattern is the fingerprint's JA3 hash or JA4
+func (fp *TLSFingerprint) Matches(pattern string) bool {
+	return fp != nil && (pattern == fp.JA3 || pattern == fp.JA4)
+}
+
+// Extension IDs with special meaning in fingerprints
+const (
+	extServerName        = 0x0000
+	extALPN              = 0x0010
+	extSupportedVersions = 0x002b
+)
+
+// isGREASE reports whether v is a GREASE value (RFC 8701), which clients
+// randomize and fingerprints ignore
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE[T ~uint16](values []T) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(uint16(v)) {
+			out = append(out, uint16(v))
+		}
+	}
+	return out
+}
+
+// fingerprintHello computes the JA3 and JA4 fingerprints of a ClientHello
+func fingerprintHello(hello *tls.ClientHelloInfo) *TLSFingerprint {
+	ciphers := withoutGREASE(hello.CipherSuites)
+	extensions := withoutGREASE(hello.Extensions)
+	curves := withoutGREASE(hello.SupportedCurves)
+	versions := withoutGREASE(hello.SupportedVersions)
+	sigAlgs := withoutGREASE(hello.SignatureSchemes)
+
+	// Without the supported_versions extension Go derives the list from the
+	// legacy version field; with it, that field is TLS 1.2 by convention
+	maxVersion := uint16(0)
+	if len(versions) > 0 {
+		maxVersion = slices.Max(versions)
+	}
+	legacyVersion := maxVersion
+	if slices.Contains(extensions, extSupportedVersions) {
+		legacyVersion = tls.VersionTLS12
+	}
+
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(legacyVersion)),
+		joinDecimal(ciphers), joinDecimal(extensions), joinDecimal(curves), joinDecimal(points),
+	}, ",")
+	ja3Sum := md5.Sum([]byte(ja3))
+
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(hello.SupportedProtos) > 0 && hello.SupportedProtos[0] != "" {
+		alpn = alpnChars(hello.SupportedProtos[0])
+	}
+	ja4a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(maxVersion), sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	sortedCiphers := slices.Sorted(slices.Values(ciphers))
+	var sortedExts []uint16
+	for _, e := range extensions {
+		if e != extServerName && e != extALPN {
+			sortedExts = append(sortedExts, e)
+		}
+	}
+	slices.Sort(sortedExts)
+	ja4c := joinHex(sortedExts)
+	if len(sigAlgs) > 0 {
+		ja4c += "_" + joinHex(sigAlgs)
+	}
+
+	return &TLSFingerprint{
+		JA3:     hex.EncodeToString(ja3Sum[:]),
+		JA3Full: ja3,
+		JA4:     ja4a + "_" + truncatedHash(joinHex(sortedCiphers)) + "_" + truncatedHash(ja4c),
+	}
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// alpnChars returns the first and last character of an ALPN value, or the
+// first and last hex digit when either is not alphanumeric
+func alpnChars(proto string) string {
+	first, last := proto[0], proto[len(proto)-1]
+	isAlnum := func(c byte) bool { return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte(proto))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+// truncatedHash is the first 12 hex digits of the SHA-256 of s, or zeros for an empty list
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// fingerprintSlot receives a connection's fingerprint once its handshake
+// has been seen
+type fingerprintSlot struct {
+	fp atomic.Pointer[TLSFingerprint]
+}
+
+type fingerprintKey struct{}
+
+// TLSConnContext prepares an HTTPS connection's context to carry the
+// visitor's TLS fingerprint; use it as http.Server.ConnContext
+func (s *Server) TLSConnContext(ctx context.Context, c net.Conn) context.Context {
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+	slot := &fingerprintSlot{}
+	s.fingerprintSlots.Store(tlsConn.NetConn(), slot)
+	return context.WithValue(ctx, fingerprintKey{}, slot)
+}
+
+// TLSConnState counts accepted HTTPS connections and forgets those that
+// never completed a handshake; use it as http.Server.ConnState
+func (s *Server) TLSConnState(c net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		s.accepts[listenerHTTPS].Record()
+	}
+	if tlsConn, ok := c.(*tls.Conn); ok && (state == http.StateClosed || state == http.StateHijacked) {
+		s.fingerprintSlots.Delete(tlsConn.NetConn())
+	}
+}
+
+// InspectClientHello fingerprints each handshake and refuses those whose
+// fingerprint is blocked; use it as tls.Config.GetConfigForClient
+func (s *Server) InspectClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	fp := fingerprintHello(hello)
+	if v, ok := s.fingerprintSlots.LoadAndDelete(hello.Conn); ok {
+		v.(*fingerprintSlot).fp.Store(fp)
+	}
+	if s.fingerprints.IsBlocked(fp) {
+		s.fingerprints.RecordBlocked(fp)
+		return nil, fmt.Errorf("TLS fingerprint %s is blocked", fp.JA4)
+	}
+	return nil, nil
+}
+
+// requestFingerprint returns the TLS fingerprint of the connection a request arrived on, if known
+func requestFingerprint(r *http.Request) *TLSFingerprint {
+	if slot, ok := r.Context().Value(fingerprintKey{}).(*fingerprintSlot); ok {
+		return slot.fp.Load()
+	}
+	return nil
+}
+
+// FingerprintStats is the traffic seen from one TLS fingerprint
+type FingerprintStats struct {
+	TLSFingerprint
+	Requests    uint64    `json:"requests"`
+	RateLimited uint64    `json:"rate_limited"`
+	Handshakes  uint64    `json:"blocked_handshakes"`
+	IPs         int       `json:"visitor_ips"` // distinct IPs, capped at MaxFingerprintIPs
+	LastSeen    time.Time `json:"last_seen"`
+	Blocked     bool      `json:"blocked"`
+
+	ips map[string]struct{}
+}
+
+// FingerprintTracker counts requests and rate limit hits per TLS fingerprint
+// and holds the operator's fingerprint blocklist (JA3 hashes or JA4 strings)
+type FingerprintTracker struct {
+	mu           sync.Mutex
+	seen         map[string]*FingerprintStats // by JA4 + JA3
+	blocked      map[string]bool
+	totalBlocked atomic.Uint64
+}
+
+// NewFingerprintTracker creates a tracker blocking the given fingerprints
+func NewFingerprintTracker(blocked []string) *FingerprintTracker {
+	ft := &FingerprintTracker{
+		seen:    make(map[string]*FingerprintStats),
+		blocked: make(map[string]bool),
+	}
+	for _, b := range blocked {
+		ft.blocked[b] = true
+	}
+	return ft
+}
+
+// entry returns the stats of fp, creating them if there is room
+func (ft *FingerprintTracker) entry(fp *TLSFingerprint, now time.Time) *FingerprintStats {
+	key := fp.JA4 + "|" + fp.JA3
+	e := ft.seen[key]
+	if e == nil {
+		if len(ft.seen) >= config.MaxTrackedFingerprints {
+			ft.evict(now)
+			if len(ft.seen) >= config.MaxTrackedFingerprints {
+				return nil
+			}
+		}
+		e = &FingerprintStats{TLSFingerprint: *fp, ips: make(map[string]struct{})}
+		ft.seen[key] = e
+	}
+	e.LastSeen = now
+	return e
+}
+
+// evict drops fingerprints not seen within FingerprintIdleTimeout
+func (ft *FingerprintTracker) evict(now time.Time) {
+	for key, e := range ft.seen {
+		if now.Sub(e.LastSeen) > config.FingerprintIdleTimeout {
+			delete(ft.seen, key)
+		}
+	}
+}
+
+// RecordRequest counts a request from visitor with fingerprint fp
+func (ft *FingerprintTracker) RecordRequest(fp *TLSFingerprint, visitor string) {
+	if fp == nil {
+		return
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if e := ft.entry(fp, time.Now()); e != nil {
+		e.Requests++
+		if len(e.ips) < config.MaxFingerprintIPs {
+			e.ips[visitor] = struct{}{}
+		}
+	}
+}
+
+// RecordRateLimited counts a rate limited request from fingerprint fp
+func (ft *FingerprintTracker) RecordRateLimited(fp *TLSFingerprint) {
+	if fp == nil {
+		return
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if e := ft.entry(fp, time.Now()); e != nil {
+		e.RateLimited++
+	}
+}
+
+// RecordBlocked counts a handshake refused because fp is blocked
+func (ft *FingerprintTracker) RecordBlocked(fp *TLSFingerprint) {
+	ft.totalBlocked.Add(1)
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if e := ft.entry(fp, time.Now()); e != nil {
+		e.Handshakes++
+	}
+}
+
+// IsBlocked reports whether fp's JA3 hash or JA4 is on the blocklist
+func (ft *FingerprintTracker) IsBlocked(fp *TLSFingerprint) bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.blocked[fp.JA3] || ft.blocked[fp.JA4]
+}
+
+// TotalBlocked returns the number of handshakes refused for a blocked fingerprint
+func (ft *FingerprintTracker) TotalBlocked() uint64 {
+	return ft.totalBlocked.Load()
+}
+
+// Block adds a JA3 hash or JA4 to the blocklist
+func (ft *FingerprintTracker) Block(fingerprint string) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.blocked[fingerprint] = true
+}
+
+// Unblock removes a JA3 hash or JA4 from the blocklist and reports whether it was there
+func (ft *FingerprintTracker) Unblock(fingerprint string) bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	was := ft.blocked[fingerprint]
+	delete(ft.blocked, fingerprint)
+	return was
+}
+
+// Blocklist returns the blocked fingerprints, sorted
+func (ft *FingerprintTracker) Blocklist() []string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	list := make([]string, 0, len(ft.blocked))
+	for fp := range ft.blocked {
+		list = append(list, fp)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Top returns up to n fingerprints, most rate limited first, then by requests
+func (ft *FingerprintTracker) Top(n int) []FingerprintStats {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	out := make([]FingerprintStats, 0, len(ft.seen))
+	for _, e := range ft.seen {
+		stats := *e
+		stats.IPs = len(e.ips)
+		stats.Blocked = ft.blocked[e.JA3] || ft.blocked[e.JA4]
+		stats.ips = nil
+		out = append(out, stats)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].RateLimited != out[j].RateLimited {
+			return out[i].RateLimited > out[j].RateLimited
+		}
+		return out[i].Requests > out[j].Requests
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+var (
+	ja3HashPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	ja4Pattern     = regexp.MustCompile(`^[tqd](s3|1[0-3]|00)[di]\d{4}[0-9a-zA-Z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+)
+
+// isValidFingerprint reports whether s is a JA3 hash or a JA4 fingerprint
+func isValidFingerprint(s string) bool {
+	return ja3HashPattern.MatchString(s) || ja4Pattern.MatchString(s)
+}
+
+func (s *Server) fingerprintsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := config.DefaultFingerprintListSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, struct {
+			Blocked      []string           `json:"blocked"`
+			Fingerprints []FingerprintStats `json:"fingerprints"`
+		}{s.fingerprints.Blocklist(), s.fingerprints.Top(limit)})
+	})
+}
+
+func (s *Server) fingerprintBlockHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fingerprint := r.PathValue("fingerprint")
+		if !isValidFingerprint(fingerprint) {
+			http.Error(w, "not a JA3 hash or JA4 fingerprint", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if !s.fingerprints.Unblock(fingerprint) {
+				http.Error(w, "Not Found", http.StatusNotFound)
+				return
+			}
+			log.Printf("TLS fingerprint %s unblocked", fingerprint)
+		} else {
+			s.fingerprints.Block(fingerprint)
+			log.Printf("TLS fingerprint %s blocked", fingerprint)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
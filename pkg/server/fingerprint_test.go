@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// chromeHello is a ClientHello as sent by Chrome, GREASE values included
+func chromeHello() *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		CipherSuites: []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		Extensions: []uint16{0x2a2a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005, 0x000d, 0x0012, 0x0033, 0x002d,
+			0x002b, 0x001b, 0x4469, 0x0015, 0x3a3a},
+		SupportedCurves:   []tls.CurveID{0x4a4a, tls.X25519, tls.CurveP256, tls.CurveP384},
+		SupportedPoints:   []uint8{0},
+		SupportedVersions: []uint16{0x6a6a, tls.VersionTLS13, tls.VersionTLS12},
+		SignatureSchemes:  []tls.SignatureScheme{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		SupportedProtos:   []string{"h2", "http/1.1"},
+		ServerName:        "myapp.tunnl.gg",
+	}
+}
+
+func TestFingerprintHello(t *testing.T) {
+	fp := fingerprintHello(chromeHello())
+	if want := "t13d1516h2_8daaf6152771_e5627efa2ab1"; fp.JA4 != want {
+		t.Errorf("JA4 = %q, want %q", fp.JA4, want)
+	}
+	wantJA3 := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	if fp.JA3Full != wantJA3 {
+		t.Errorf("JA3 string = %q, want %q", fp.JA3Full, wantJA3)
+	}
+	if len(fp.JA3) != 32 || !isValidFingerprint(fp.JA3) || !isValidFingerprint(fp.JA4) {
+		t.Errorf("fingerprint %+v does not validate", fp)
+	}
+
+	// GREASE values are random per connection and must not change the result
+	hello := chromeHello()
+	hello.CipherSuites[0], hello.Extensions[0] = 0xdada, 0xfafa
+	if other := fingerprintHello(hello); *other != *fp {
+		t.Errorf("fingerprint changed with GREASE values: %+v, want %+v", other, fp)
+	}
+
+	// No SNI, no ALPN, TLS 1.2 only
+	hello = &tls.ClientHelloInfo{
+		CipherSuites:      []uint16{0xc02f},
+		Extensions:        []uint16{0x000a},
+		SupportedVersions: []uint16{tls.VersionTLS12, tls.VersionTLS11},
+	}
+	if fp := fingerprintHello(hello); !strings.HasPrefix(fp.JA4, "t12i010100_") || !strings.HasPrefix(fp.JA3Full, "771,49199,10,,") {
+		t.Errorf("fingerprintHello(bare) = %+v", fp)
+	}
+}
+
+func TestIsValidFingerprint(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"t13d1516h2_8daaf6152771_e5627efa2ab1", true},
+		{"e7d705a3286e19ea42f587b344ee6865", true},
+		{"t13d1516h2_8daaf6152771", false},
+		{"E7D705A3286E19EA42F587B344EE6865", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isValidFingerprint(tt.in); got != tt.want {
+			t.Errorf("isValidFingerprint(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintTracker(t *testing.T) {
+	ft := NewFingerprintTracker([]string{"e7d705a3286e19ea42f587b344ee6865"})
+	fp := fingerprintHello(chromeHello())
+	scanner := &TLSFingerprint{JA3: "e7d705a3286e19ea42f587b344ee6865", JA4: "t12i010100_000000000000_000000000000"}
+
+	if ft.IsBlocked(fp) || !ft.IsBlocked(scanner) {
+		t.Fatal("only the configured JA3 hash should be blocked")
+	}
+
+	ft.RecordRequest(fp, "1.1.1.1")
+	ft.RecordRequest(fp, "1.1.1.1")
+	ft.RecordRequest(scanner, "2.2.2.2")
+	ft.RecordRequest(scanner, "3.3.3.3")
+	ft.RecordRateLimited(scanner)
+	ft.RecordRequest(nil, "4.4.4.4")
+
+	top := ft.Top(10)
+	if len(top) != 2 {
+		t.Fatalf("Top() returned %d fingerprints, want 2", len(top))
+	}
+	if top[0].JA4 != scanner.JA4 || top[0].RateLimited != 1 || top[0].IPs != 2 || !top[0].Blocked {
+		t.Errorf("Top()[0] = %+v, want the rate limited scanner first", top[0])
+	}
+	if top[1].Requests != 2 || top[1].IPs != 1 || top[1].Blocked {
+		t.Errorf("Top()[1] = %+v, want 2 requests from 1 IP", top[1])
+	}
+
+	ft.Block(fp.JA4)
+	if !ft.IsBlocked(fp) {
+		t.Error("Block() should block by JA4")
+	}
+	if !ft.Unblock(fp.JA4) || ft.Unblock(fp.JA4) || ft.IsBlocked(fp) {
+		t.Error("Unblock() should remove the fingerprint once")
+	}
+}
+
+func TestInspectClientHello(t *testing.T) {
+	s := newTestServer(t)
+	fp := fingerprintHello(chromeHello())
+	if _, err := s.InspectClientHello(chromeHello()); err != nil {
+		t.Fatalf("InspectClientHello() error = %v", err)
+	}
+	s.fingerprints.Block(fp.JA4)
+	if _, err := s.InspectClientHello(chromeHello()); err == nil {
+		t.Error("InspectClientHello() should refuse a blocked fingerprint")
+	}
+	if got := s.GetStats(false, false).FingerprintsBlocked; got != 1 {
+		t.Errorf("FingerprintsBlocked = %d, want 1", got)
+	}
+}
+
+func TestRequestFingerprint(t *testing.T) {
+	s := newTestServer(t)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fp := requestFingerprint(r); fp != nil {
+			io.WriteString(w, fp.JA4)
+		}
+	}))
+	ts.Config.ConnContext = s.TLSConnContext
+	ts.Config.ConnState = s.TLSConnState
+	ts.TLS = &tls.Config{GetConfigForClient: s.InspectClientHello}
+	ts.StartTLS()
+	defer ts.Close()
+
+	for range 2 {
+		resp, err := ts.Client().Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.HasPrefix(string(body), "t13i") {
+			t.Errorf("request fingerprint = %q, want a TLS 1.3 JA4 without SNI", body)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// geoRange maps an inclusive range of addresses to a country code
+type geoRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// GeoIP resolves visitor IPs to ISO country codes from an operator-supplied
+// CSV database such as DB-IP's free "IP to Country Lite" export
+type GeoIP struct {
+	ranges []geoRange // sorted by start, non-overlapping
+}
+
+// LoadGeoIP reads a GeoIP CSV file
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseGeoIP(f)
+}
+
+// parseGeoIP reads "start,end,country" or "cidr,country" rows. Comments and
+// unparseable lines such as CSV headers are skipped.
+func parseGeoIP(r io.Reader) (*GeoIP, error) {
+	g := &GeoIP{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.Trim(strings.TrimSpace(fields[i]), `"`)
+		}
+
+		var rng geoRange
+		switch len(fields) {
+		case 2:
+			prefix, err := netip.ParsePrefix(fields[0])
+			if err != nil {
+				continue
+			}
+			prefix = prefix.Masked()
+			rng = geoRange{start: prefix.Addr(), end: lastAddr(prefix), country: fields[1]}
+		case 3:
+			start, err1 := netip.ParseAddr(fields[0])
+			end, err2 := netip.ParseAddr(fields[1])
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			rng = geoRange{start: start.Unmap(), end: end.Unmap(), country: fields[2]}
+		default:
+			continue
+		}
+		if len(rng.country) != 2 || rng.start.BitLen() != rng.end.BitLen() || rng.end.Less(rng.start) {
+			continue
+		}
+		rng.country = strings.ToUpper(rng.country)
+		g.ranges = append(g.ranges, rng)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(g.ranges) == 0 {
+		return nil, fmt.Errorf("no ranges found")
+	}
+	sort.Slice(g.ranges, func(i, j int) bool { return g.ranges[i].start.Less(g.ranges[j].start) })
+	return g, nil
+}
+
+// lastAddr returns the last address of a prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// Len returns the number of ranges loaded
+func (g *GeoIP) Len() int {
+	if g == nil {
+		return 0
+	}
+	return len(g.ranges)
+}
+
+// Country returns the country code of ip, or "" if unknown
+func (g *GeoIP) Country(ip string) string {
+	if g == nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	// Last range starting at or before addr
+	i := sort.Search(len(g.ranges), func(i int) bool { return addr.Less(g.ranges[i].start) }) - 1
+	if i < 0 || g.ranges[i].end.Less(addr) || g.ranges[i].start.BitLen() != addr.BitLen() {
+		return ""
+	}
+	return g.ranges[i].country
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeoIP_Country(t *testing.T) {
+	csv := `# DB-IP style ranges and CIDR rows may be mixed
+start,end,country
+"1.0.0.0","1.0.0.255","AU"
+2.16.0.0,2.16.255.255,de
+198.51.100.0/24,NL
+2001:db8::,2001:db8::ffff,FR
+not,an,entry
+`
+	g, err := parseGeoIP(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("parseGeoIP() error = %v", err)
+	}
+	if g.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", g.Len())
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.0.0.1", "AU"},
+		{"1.0.1.0", ""},
+		{"2.16.200.1", "DE"},
+		{"198.51.100.255", "NL"},
+		{"::ffff:198.51.100.1", "NL"},
+		{"2001:db8::42", "FR"},
+		{"2001:db8::1:0", ""},
+		{"0.0.0.1", ""},
+		{"garbage", ""},
+	}
+	for _, tt := range tests {
+		if got := g.Country(tt.ip); got != tt.want {
+			t.Errorf("Country(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+
+	var none *GeoIP
+	if none.Country("1.0.0.1") != "" {
+		t.Error("nil GeoIP should know no countries")
+	}
+	if _, err := parseGeoIP(strings.NewReader("header only\n")); err == nil {
+		t.Error("parseGeoIP() should fail without ranges")
+	}
+}
@@ -0,0 +1,957 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnl.gg/internal/subdomain"
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+// ServeHTTP implements http.Handler for HTTPS requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	setSecurityHeaders(w)
+
+	// Enforce request body size limit
+	if r.ContentLength > config.MaxRequestBodySize {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxRequestBodySize)
+
+	host, ok := canonicalHost(r.Host)
+	if !ok {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Path == config.SSHWebSocketPath && s.servesDomain(host) {
+		s.serveSSHWebSocket(w, r)
+		return
+	}
+
+	sub, domain, ok := s.splitHost(host)
+	// api--happy-tiger-a1b2c3d4 reaches the api service of happy-tiger-a1b2c3d4,
+	// unless a reserved subdomain has that very name
+	service, rest, isService := subdomain.SplitService(sub)
+	if isService && s.GetPool(sub) == nil {
+		sub = rest
+	} else {
+		service = ""
+	}
+	if !ok || !s.isValidSubdomain(sub) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	// Subdomains are unique across domains but only answer on their own
+	if pool := s.GetPool(sub); pool != nil && s.domainOf(pool) != domain {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	tun := s.pickTunnel(w, r, sub)
+	if tun == nil {
+		// The tunnel may be gone because of the outage, not for good
+		if !s.serveStatusPage(w, host, domain) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+		return
+	}
+	if service != "" {
+		if _, ok := tun.ServiceAddr(service); !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+	}
+
+	// Per-visitor limit first: a single visitor hitting it does not count
+	// against the tunnel owner
+	visitor := visitorIP(r.RemoteAddr)
+	fp := requestFingerprint(r)
+	s.fingerprints.RecordRequest(fp, visitor)
+	if !s.visitorLimiter.Allow(visitor, sub) {
+		s.rejectRateLimited(w, r, visitor, s.visitorLimiter.Delay(visitor, sub))
+		return
+	}
+	if vfp := visitorFingerprint(visitor, r.UserAgent(), fp); !s.visitorLimiter.AllowFingerprint(vfp, visitor, sub) {
+		s.rejectRateLimited(w, r, visitor, s.visitorLimiter.Delay(vfp, sub))
+		return
+	}
+
+	if !tun.WaitRequest(r.Context()) {
+		s.visitorLimiter.RecordViolation(visitor)
+		tun.RecordRateLimitHit()
+		// Kill the tunnel once its client has had too many requests rejected;
+		// the abuse tracker has then blocked the client's IP
+		if s.abuseTracker.RecordViolation(ViolationHTTPRateLimit, tun.ClientIP) {
+			if fp != nil {
+				log.Printf("Tunnel %s killed due to rate limit abuse, blocking SSH client %s (last visitor %s, TLS fingerprint %s)", sub, tun.ClientIP, visitor, fp.JA4)
+			} else {
+				log.Printf("Tunnel %s killed due to rate limit abuse, blocking SSH client %s", sub, tun.ClientIP)
+			}
+			tun.CloseSSH()
+		}
+		s.rejectRateLimited(w, r, visitor, tun.RetryDelay())
+		return
+	}
+
+	// Account limits are shared by every tunnel of the account, so hitting
+	// them is not a violation of this tunnel's limit
+	if !s.quotas.Allow(tun.QuotaAccount()) {
+		w.Header().Set("Retry-After", retryAfter(s.quotas.Delay(tun.QuotaAccount())))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	if s.bandwidth.Exceeded(s.ipKey(tun.ClientIP)) || s.quotas.BandwidthExceeded(tun.QuotaAccount()) {
+		http.Error(w, "Bandwidth Quota Exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	tun.Touch()
+	s.IncrementRequests()
+	tun.IncrementRequests()
+	s.usage.AddRequest(tun.Account(), sub)
+
+	pool := s.GetPool(sub)
+	if pool == nil {
+		if !s.serveStatusPage(w, host, domain) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+		return
+	}
+
+	// Keep ephemeral tunnel URLs out of search indexes unless the owner opts
+	// in; robots.txt is answered here without reaching the backend
+	noIndex := !pool.Indexing()
+	if noIndex {
+		w.Header()["X-Robots-Tag"] = robotsTag
+		if r.URL.Path == "/robots.txt" {
+			serveRobotsTxt(w, r)
+			return
+		}
+	}
+
+	// Owners download the access log from the tunnel URL with its token; other
+	// requests to the path reach the backend like any other
+	if r.URL.Path == config.AccessLogPath && pool.CheckAccessLogToken(r.URL.Query().Get("token")) {
+		serveAccessLog(w, r, pool)
+		return
+	}
+
+	// Bots and scanners are turned away before any other check, if the owner asked
+	if !s.checkBots(w, r, sub, pool) {
+		return
+	}
+
+	// Passphrase-protected subdomains require the visitor to unlock them first,
+	// and tunnels with the auth option require basic auth credentials
+	if !s.checkPassphrase(w, r, sub, pool) || !checkBasicAuth(w, r, sub, pool) {
+		return
+	}
+
+	// Show interstitial warning for browser requests
+	if isBrowserRequest(r) &&
+		!pool.NoWarning() &&
+		r.Header.Get("tunnl-skip-browser-warning") == "" &&
+		!s.hasWarningCookie(r, sub) &&
+		!s.checkBypassToken(w, r, sub) {
+		s.handleWarning(w, r, sub)
+		return
+	}
+
+	if isWebSocketRequest(r) {
+		s.handleWebSocket(w, r, tun, sub, service)
+		return
+	}
+
+	// Shed load when too many requests are in flight server-wide
+	if !s.acquireRequestSlot() {
+		w.Header().Set("Retry-After", strconv.Itoa(config.LoadShedRetryAfter))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.releaseRequestSlot()
+
+	// Fast-fail while the local backend appears to be down
+	breaker := tun.Breaker()
+	allowed, probe := breaker.AllowProbe()
+	if !allowed {
+		serveBackendDownPage(w, r, config.BreakerCooldown)
+		return
+	}
+
+	requestStart := time.Now()
+	sw := &statusCaptureWriter{ResponseWriter: w}
+	maxResponse := tun.MaxResponseSize()
+
+	// The backend must start responding within upstreamTimeout of receiving
+	// the whole request; the deadline is lifted once headers arrive, so long
+	// uploads and downloads are unaffected
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	var deadline *upstreamDeadline
+	if s.upstreamTimeout > 0 {
+		deadline = &upstreamDeadline{timeout: s.upstreamTimeout, cancel: cancel}
+		defer deadline.stop()
+	}
+	r = r.WithContext(ctx)
+
+	var capture *captureRecorder
+	if pool.Inspect() {
+		capture = s.captures.Start(sub, r)
+	}
+	var requestBody *countingReadCloser
+	if r.Body != nil && r.Body != http.NoBody {
+		requestBody = &countingReadCloser{ReadCloser: r.Body}
+		r.Body = requestBody
+	}
+	// The proxy does not send empty bodies, so there is nothing to wait for
+	if r.ContentLength == 0 {
+		deadline.start()
+	} else {
+		r.Body = &deadlineBody{ReadCloser: r.Body, deadline: deadline}
+	}
+
+	// Deferred, as the proxy panics with http.ErrAbortHandler when a response
+	// is cut off mid-stream: failed requests must still be counted and
+	// recorded, and the capture finished to release its share of the spill
+	// budget
+	defer func() {
+		latency := time.Since(requestStart)
+		info := s.visitorInfo(r)
+		s.proxyMetrics.ObserveHTTP(requestBody.bytesRead(), sw.bytes)
+		tun.AddBytes(requestBody.bytesRead() + sw.bytes)
+		s.topTalkers.Record(sub, info.IP, requestBody.bytesRead()+sw.bytes)
+		var captureID string
+		if capture != nil {
+			captureID = capture.Finish(sw.status)
+		}
+		s.recordRequest(tun, tunnel.RequestRecord{
+			Time: requestStart, BackendID: tun.BackendID(), Method: r.Method, Path: r.URL.Path,
+			Status: sw.status, Bytes: sw.bytes, LatencyMS: latency.Milliseconds(),
+			VisitorIP: info.IP, Country: info.Country, UserAgent: info.UserAgent,
+			CaptureID: captureID,
+		})
+		if logger := tun.Logger(); logger != nil {
+			logger.LogRequest(r.Method, r.URL.Path, sw.status, sw.bytes, latency, info)
+		}
+	}()
+
+	requestHeaders, responseHeaders := tun.HeaderRules()
+	private := tun.Private()
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = routeRequest(tun, req, service)
+			req.Host = r.Host
+			identifyRequest(req, tun, sub, visitor)
+			tunnel.ApplyHeaderRules(req.Header, requestHeaders)
+			capRange(req.Header, maxResponse)
+		},
+		Transport: tun.Transport(),
+		ModifyResponse: func(resp *http.Response) error {
+			if !deadline.stop() {
+				return errUpstreamTimeout
+			}
+			breaker.RecordSuccess()
+			// Responses declared too large are refused before any byte is
+			// sent, unless the backend supports ranges: the visitor then gets
+			// the first maxResponse bytes and, knowing the full length,
+			// can resume the rest with range requests
+			if resp.ContentLength > maxResponse && !acceptsRanges(resp) {
+				s.responseTooLarge(tun, sub, fmt.Sprintf("%d bytes, not delivered", resp.ContentLength))
+				return errResponseTooLarge
+			}
+			// Chunked or unknown-length responses are counted as they stream
+			resp.Body = &limitedReadCloser{
+				rc:    resp.Body,
+				limit: maxResponse,
+				onExceed: func() {
+					s.responseTooLarge(tun, sub, "streamed response, connection aborted")
+				},
+			}
+			if capture != nil {
+				// Captured as the backend sent it, before compression
+				capture.RecordResponse(resp)
+			}
+			if private {
+				tunnel.StripTunnlHeaders(resp.Header)
+			}
+			tunnel.ApplyHeaderRules(resp.Header, responseHeaders)
+			if noIndex {
+				// Already set on the response; the backend cannot opt back in
+				resp.Header.Del("X-Robots-Tag")
+			}
+			if pool.Compress() {
+				compressResponse(resp)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, errResponseTooLarge) {
+				http.Error(w, "Response Too Large", http.StatusBadGateway)
+				return
+			}
+			if errors.Is(err, errUpstreamTimeout) || errors.Is(context.Cause(r.Context()), errUpstreamTimeout) {
+				// A slow handler is not a down backend, so the breaker is left
+				// alone, apart from making way for the next probe
+				if probe {
+					breaker.Release()
+				}
+				s.upstreamTimeouts.Add(1)
+				if logger := tun.Logger(); logger != nil {
+					logger.LogNotice(fmt.Sprintf("Local server did not respond within %v", s.upstreamTimeout))
+				}
+				serveGatewayTimeoutPage(w, s.upstreamTimeout)
+				return
+			}
+			log.Printf("Proxy error for %s: %v", sub, err)
+			if errors.Is(err, context.Canceled) {
+				// Visitor went away; not the backend's fault, but a probe
+				// must make way for the next request
+				if probe {
+					breaker.Release()
+				}
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			retry := config.BackendDownRetry
+			if breaker.RecordFailure() {
+				log.Printf("Circuit breaker tripped for %s after repeated backend failures", sub)
+				if logger := tun.Logger(); logger != nil {
+					logger.LogNotice(fmt.Sprintf("Local server appears down; pausing requests for %v", config.BreakerCooldown))
+				}
+				retry = config.BreakerCooldown
+			}
+			serveBackendDownPage(w, r, retry)
+		},
+	}
+
+	proxy.ServeHTTP(sw, r)
+}
+
+// routeRequest returns the local address serving a request, removing the
+// prefix of the route it matched from its path. The backend learns the
+// prefix from X-Forwarded-Prefix, to build links that include it. Requests
+// to a named service go to its port whole; routes only apply to the tunnel's
+// own hostname.
+func routeRequest(tun *tunnel.Tunnel, req *http.Request, service string) string {
+	if service != "" {
+		addr, _ := tun.ServiceAddr(service)
+		return addr
+	}
+	addr, prefix := tun.Route(req.URL.Path)
+	if prefix == "" {
+		return addr
+	}
+	req.URL.Path = tunnel.StripPrefix(req.URL.Path, prefix)
+	if raw := req.URL.RawPath; strings.HasPrefix(raw, prefix) {
+		req.URL.RawPath = tunnel.StripPrefix(raw, prefix)
+	} else {
+		// An escaped prefix: the path is escaped again from Path
+		req.URL.RawPath = ""
+	}
+	req.Header.Set("X-Forwarded-Prefix", prefix)
+	return addr
+}
+
+// identifyRequest replaces any X-Tunnl-* headers a visitor sent with the
+// subdomain, visitor IP and scheme, unless the tunnel opted out of them. Private
+// tunnels get neither these nor the visitor's forwarding headers and user agent.
+func identifyRequest(req *http.Request, tun *tunnel.Tunnel, sub, visitor string) {
+	if tun.Private() {
+		tunnel.StripVisitorHeaders(req.Header)
+		return
+	}
+	req.Header.Del(tunnel.HeaderSubdomain)
+	req.Header.Del(tunnel.HeaderVisitorIP)
+	req.Header.Del(tunnel.HeaderProto)
+	if !tun.Identify() {
+		return
+	}
+	proto := "https"
+	if req.TLS == nil {
+		proto = "http"
+	}
+	req.Header[tunnel.HeaderSubdomain] = []string{sub}
+	req.Header[tunnel.HeaderVisitorIP] = []string{visitor}
+	req.Header[tunnel.HeaderProto] = []string{proto}
+}
+
+// recordRequest adds a request to its tunnel's history and its subdomain's live feed
+func (s *Server) recordRequest(tun *tunnel.Tunnel, rec tunnel.RequestRecord) {
+	tun.History().Add(rec)
+	if pool := s.GetPool(tun.Subdomain); pool != nil {
+		pool.Feed().Publish(rec)
+	}
+}
+
+// visitorInfo describes the visitor of a request for the request log
+func (s *Server) visitorInfo(r *http.Request) tunnel.Visitor {
+	ip := visitorIP(r.RemoteAddr)
+	return tunnel.Visitor{IP: ip, Country: s.geoIP.Country(ip), UserAgent: r.UserAgent()}
+}
+
+// responseTooLarge records a response over the tunnel's size limit
+func (s *Server) responseTooLarge(tun *tunnel.Tunnel, sub, detail string) {
+	s.totalTooLarge.Add(1)
+	log.Printf("Response too large for %s (%s, max %d bytes)", sub, detail, tun.MaxResponseSize())
+	if logger := tun.Logger(); logger != nil {
+		logger.LogNotice(fmt.Sprintf("Response exceeded the %d MB limit (%s)", tun.MaxResponseSize()/(1024*1024), detail))
+	}
+}
+
+// rejectRateLimited answers a rate limited request. Repeat offenders are
+// tarpitted: their response is stalled before a minimal 429, raising the
+// cost of scraping or brute forcing through tunnels. Others are told to
+// retry after retry, when the limiter they hit has a token for them.
+func (s *Server) rejectRateLimited(w http.ResponseWriter, r *http.Request, visitor string, retry time.Duration) {
+	s.fingerprints.RecordRateLimited(requestFingerprint(r))
+	if s.visitorLimiter.IsRepeatOffender(visitor) {
+		select {
+		case s.tarpitSlots <- struct{}{}:
+			defer func() { <-s.tarpitSlots }()
+			s.totalTarpitted.Add(1)
+			timer := time.NewTimer(config.TarpitDelay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		default:
+			// Tarpit full: fall back to a fast rejection
+		}
+	}
+	w.Header().Set("Retry-After", retryAfter(retry))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// retryAfter formats d as a Retry-After value: whole seconds, rounded up so
+// clients do not come back before a token is there, and at least 1
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(max(1, int((d+time.Second-1)/time.Second)))
+}
+
+// pickTunnel selects the backend for a request. With sticky sessions enabled,
+// visitors of a multi-client subdomain are pinned to one backend via a cookie.
+func (s *Server) pickTunnel(w http.ResponseWriter, r *http.Request, sub string) *tunnel.Tunnel {
+	pool := s.GetPool(sub)
+	if pool == nil {
+		return nil
+	}
+	if !s.stickySessions || pool.Len() < 2 {
+		return pool.Next()
+	}
+
+	if cookie, err := r.Cookie(config.StickyCookieName); err == nil {
+		if tun := pool.Get(cookie.Value); tun != nil {
+			return tun
+		}
+	}
+
+	tun := pool.Next()
+	if tun != nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     config.StickyCookieName,
+			Value:    tun.BackendID(),
+			Path:     "/",
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return tun
+}
+
+// acquireRequestSlot reserves a slot for an in-flight proxied request.
+// Returns false if the server-wide ceiling has been reached.
+func (s *Server) acquireRequestSlot() bool {
+	n := s.inFlightRequests.Add(1)
+	if s.maxConcurrentRequests > 0 && n > s.maxConcurrentRequests {
+		s.inFlightRequests.Add(-1)
+		s.totalShed.Add(1)
+		return false
+	}
+	return true
+}
+
+// releaseRequestSlot releases a slot reserved by acquireRequestSlot
+func (s *Server) releaseRequestSlot() {
+	s.inFlightRequests.Add(-1)
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel, sub, service string) {
+	wsPath := r.URL.Path
+	backendAddr := routeRequest(tun, r, service)
+	requestHeaders, _ := tun.HeaderRules()
+	identifyRequest(r, tun, sub, visitorIP(r.RemoteAddr))
+	tunnel.ApplyHeaderRules(r.Header, requestHeaders)
+	backendConn, err := net.DialTimeout("tcp", backendAddr, 10*time.Second)
+	if err != nil {
+		log.Printf("WebSocket backend dial error for %s: %v", sub, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer backendConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		log.Printf("WebSocket hijack not supported for %s", sub)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		// After Hijack() is called (even on failure), ResponseWriter may be invalid
+		// Just log the error and return - the connection will be closed
+		log.Printf("WebSocket hijack error for %s: %v", sub, err)
+		return
+	}
+	defer clientConn.Close()
+
+	// Hijacked connections are not tracked by the HTTP server, so shutdown
+	// waits for them through this count
+	s.activeWebSockets.Add(1)
+	defer s.activeWebSockets.Add(-1)
+
+	if err := r.Write(backendConn); err != nil {
+		log.Printf("WebSocket request write error for %s: %v", sub, err)
+		return
+	}
+
+	logger := tun.Logger()
+	wsStart := time.Now()
+	if logger != nil {
+		logger.LogWebSocketOpen(wsPath, s.visitorInfo(r))
+	}
+
+	// Copy data bidirectionally with the tunnel's limits
+	idleTimeout, maxTransfer := tun.WebSocketLimits()
+	var backendBytes, clientBytes int64
+	done := make(chan struct{})
+	go func() {
+		backendBytes, _ = copyWithLimits(backendConn, clientConn, maxTransfer, idleTimeout)
+		// Signal backend we're done sending
+		if tc, ok := backendConn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	go func() {
+		defer close(done)
+		clientBytes, _ = copyWithLimits(clientConn, backendConn, maxTransfer, idleTimeout)
+	}()
+	<-done
+	s.proxyMetrics.ObserveWebSocket(backendBytes, clientBytes)
+	tun.AddBytes(backendBytes + clientBytes)
+
+	visitor := s.visitorInfo(r)
+	s.topTalkers.Record(sub, visitor.IP, backendBytes+clientBytes)
+	s.recordRequest(tun, tunnel.RequestRecord{
+		Time: wsStart, BackendID: tun.BackendID(), Method: "WS", Path: wsPath,
+		Status: http.StatusSwitchingProtocols, Bytes: backendBytes + clientBytes, LatencyMS: time.Since(wsStart).Milliseconds(),
+		VisitorIP: visitor.IP, Country: visitor.Country, UserAgent: visitor.UserAgent,
+	})
+	if logger != nil {
+		logger.LogWebSocketClose(wsPath, time.Since(wsStart), backendBytes+clientBytes)
+	}
+}
+
+// copyBuffers recycles the buffers of long-lived relays, which would
+// otherwise allocate 32KB per connection and direction
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, 32*1024)
+	return &buf
+}}
+
+// copyWithLimits copies from src to dst with a byte transfer limit and idle timeout.
+// It resets the read deadline on src after each successful read.
+// Returns the number of bytes written and any error.
+func copyWithLimits(dst, src net.Conn, maxBytes int64, idleTimeout time.Duration) (int64, error) {
+	bufp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bufp)
+	buf := *bufp
+	var written int64
+	for {
+		src.SetReadDeadline(time.Now().Add(idleTimeout))
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			written += int64(n)
+			if written > maxBytes {
+				return written, fmt.Errorf("transfer limit exceeded")
+			}
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				return written, writeErr
+			}
+		}
+		if readErr != nil {
+			if readErr == io.EOF {
+				return written, nil
+			}
+			return written, readErr
+		}
+	}
+}
+
+var backendDownPage = template.Must(template.New("backend-down").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Local server unavailable</title></head>
+<body>
+<h1>Local server is not answering</h1>
+<p>This tunnel exists and is connected, but the application behind it is not
+responding. It may be starting up or restarting.</p>
+{{if .Reload}}<p>Trying again in <span id="countdown">{{.Retry}}</span> seconds.</p>
+<noscript><p>Reload this page to try again.</p></noscript>
+<script>
+(function () {
+  var left = {{.Retry}};
+  var countdown = document.getElementById("countdown");
+  var timer = setInterval(function () {
+    left--;
+    countdown.textContent = left;
+    if (left <= 0) {
+      clearInterval(timer);
+      location.reload();
+    }
+  }, 1000);
+})();
+</script>
+{{else}}<p>Please try again in a moment.</p>
+{{end}}</body>
+</html>
+`))
+
+// serveBackendDownPage responds with a friendly page when a tunnel's local
+// server is not answering. Pages of GET requests reload themselves after
+// retry; other requests are not repeated without the visitor.
+func serveBackendDownPage(w http.ResponseWriter, r *http.Request, retry time.Duration) {
+	seconds := int(retry.Seconds())
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusBadGateway)
+	data := struct {
+		Reload bool
+		Retry  int
+	}{r.Method == http.MethodGet, seconds}
+	if err := backendDownPage.Execute(w, data); err != nil {
+		log.Printf("Failed to render backend down page: %v", err)
+	}
+}
+
+const gatewayTimeoutPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Local server timed out</title></head>
+<body>
+<h1>Local server took too long to respond</h1>
+<p>This tunnel is connected, but the application behind it did not start
+responding within %v. If this request does slow work, consider answering
+right away and finishing it in the background.</p>
+</body>
+</html>
+`
+
+// errUpstreamTimeout reports a backend that did not produce response headers in time
+var errUpstreamTimeout = errors.New("upstream response timeout")
+
+// upstreamDeadline cancels a proxied request with errUpstreamTimeout if the
+// backend has not responded within timeout of being sent the request. A nil
+// deadline never expires.
+type upstreamDeadline struct {
+	timeout time.Duration
+	cancel  context.CancelCauseFunc
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	done    bool // lifted or expired
+	expired bool
+}
+
+// start starts the deadline once the request has been sent; later calls do nothing
+func (d *upstreamDeadline) start() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.done || d.timer != nil {
+		return
+	}
+	d.timer = time.AfterFunc(d.timeout, d.expire)
+}
+
+func (d *upstreamDeadline) expire() {
+	d.mu.Lock()
+	if d.done {
+		d.mu.Unlock()
+		return
+	}
+	d.done, d.expired = true, true
+	d.mu.Unlock()
+	d.cancel(errUpstreamTimeout)
+}
+
+// stop lifts the deadline, returning false if it had already expired
+func (d *upstreamDeadline) stop() bool {
+	if d == nil {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.done = true
+	return !d.expired
+}
+
+// deadlineBody starts an upstream deadline once the request body has been
+// read to the end or closed
+type deadlineBody struct {
+	io.ReadCloser
+	deadline *upstreamDeadline
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.deadline.start()
+	}
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	b.deadline.start()
+	return b.ReadCloser.Close()
+}
+
+// serveGatewayTimeoutPage responds with a friendly page when a backend is too slow to respond
+func serveGatewayTimeoutPage(w http.ResponseWriter, timeout time.Duration) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusGatewayTimeout)
+	fmt.Fprintf(w, gatewayTimeoutPage, timeout)
+}
+
+// serveRobotsTxt answers robots.txt at the edge with a deny-all policy
+func serveRobotsTxt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	io.WriteString(w, "User-agent: *\nDisallow: /\n")
+}
+
+// securityHeaders are set on every response. The value slices are shared
+// rather than allocated per request; their capacity equals their length, so
+// a later Add copies instead of writing into them.
+var securityHeaders = http.Header{
+	"X-Content-Type-Options": {"nosniff"},
+	"X-Frame-Options":        {"DENY"},
+	"X-Xss-Protection":       {"1; mode=block"},
+	"Referrer-Policy":        {"strict-origin-when-cross-origin"},
+}
+
+// robotsTag is the shared X-Robots-Tag value of tunnels that opt out of indexing
+var robotsTag = []string{config.RobotsTag}
+
+func setSecurityHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range securityHeaders {
+		h[k] = v
+	}
+}
+
+func isBrowserRequest(r *http.Request) bool {
+	ua := strings.ToLower(r.Header.Get("User-Agent"))
+	browserKeywords := []string{"mozilla", "chrome", "safari", "firefox", "edge", "opera"}
+	for _, kw := range browserKeywords {
+		if strings.Contains(ua, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) hasWarningCookie(r *http.Request, sub string) bool {
+	cookie, err := r.Cookie(s.warningCookieName(sub))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte("1")) == 1
+}
+
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// stripPort removes the port from a host string (e.g., "example.com:443" -> "example.com"),
+// and the brackets of IPv6 literals ("[::1]:443" -> "::1")
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	// No port: only IPv6 literals need their brackets removed
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// canonicalHost returns a Host header's name without port or trailing dot,
+// lowercased, for matching against subdomains and domains. Names served here
+// are ASCII, so hosts with other bytes (Unicode lookalikes, fullwidth dots) or
+// characters outside letters, digits, hyphens and dots are refused rather
+// than mapped, and cannot reach a tunnel by a second spelling. So are names
+// breaking DNS label rules (empty labels, labels over 63 characters or
+// starting or ending with a hyphen) and ports that are not a number.
+func canonicalHost(hostport string) (string, bool) {
+	if _, port, err := net.SplitHostPort(hostport); err == nil && !isPort(port) {
+		return "", false
+	}
+	host := strings.TrimSuffix(stripPort(hostport), ".")
+	if host == "" || len(host) > maxHostLength {
+		return "", false
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '.') {
+			return "", false
+		}
+	}
+	for label := range strings.SplitSeq(host, ".") {
+		if label == "" || len(label) > maxLabelLength || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", false
+		}
+	}
+	return strings.ToLower(host), true
+}
+
+// Limits of DNS names (RFC 1035)
+const (
+	maxHostLength  = 253
+	maxLabelLength = 63
+)
+
+// isPort reports whether a Host header's port is empty, which RFC 3986
+// allows, or a decimal number up to 65535
+func isPort(port string) bool {
+	if len(port) > 5 {
+		return false
+	}
+	n := 0
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return false
+		}
+		n = n*10 + int(port[i]-'0')
+	}
+	return n <= 65535
+}
+
+// errResponseTooLarge reports a backend response over the tunnel's size limit
+var errResponseTooLarge = errors.New("response too large")
+
+// limitedReadCloser wraps an io.ReadCloser and counts the bytes read. A body
+// of exactly limit bytes reads normally; once a byte past the limit arrives,
+// onExceed is called and the read fails with errResponseTooLarge without
+// returning the excess. The reverse proxy then aborts the visitor's
+// connection, so the truncated response cannot pass for a complete one.
+type limitedReadCloser struct {
+	rc       io.ReadCloser
+	limit    int64
+	read     int64
+	onExceed func() // called once when the limit is exceeded (optional)
+}
+
+func (l *limitedReadCloser) Read(p []byte) (n int, err error) {
+	if l.read > l.limit {
+		return 0, errResponseTooLarge
+	}
+	// Read up to one byte past the limit to tell a body that ends exactly at
+	// the limit from one that exceeds it
+	if remaining := l.limit - l.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err = l.rc.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		if l.onExceed != nil {
+			l.onExceed()
+		}
+		return n - int(l.read-l.limit), errResponseTooLarge
+	}
+	return n, err
+}
+
+func (l *limitedReadCloser) Close() error {
+	return l.rc.Close()
+}
+
+// statusCaptureWriter wraps http.ResponseWriter to capture the status code.
+type statusCaptureWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64 // body bytes written
+	wroteHeader bool
+}
+
+func (w *statusCaptureWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusCaptureWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.status = http.StatusOK
+		w.wroteHeader = true
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter for interface passthrough (e.g., http.Flusher).
+func (w *statusCaptureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// HTTPRedirectHandler returns an http.Handler that redirects HTTP to HTTPS
+func (s *Server) HTTPRedirectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, ok := canonicalHost(r.Host)
+		if !ok {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if _, _, ok := s.splitHost(host); !ok && !s.servesDomain(host) {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		target := "https://" + r.Host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,1413 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+func TestStripPort(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"with port", "example.com:443", "example.com"},
+		{"without port", "example.com", "example.com"},
+		{"ipv4 with port", "127.0.0.1:8080", "127.0.0.1"},
+		{"ipv6 with port", "[2001:db8::1]:443", "2001:db8::1"},
+		{"ipv6 without port", "[2001:db8::1]", "2001:db8::1"},
+		{"bare ipv6", "2001:db8::1", "2001:db8::1"},
+		{"empty port", "example.com:", "example.com"},
+		{"empty string", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripPort(tt.input); got != tt.want {
+				t.Errorf("stripPort(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_HostForms(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	s.GetPool(sub).SetNoWarning(true)
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	tests := []struct {
+		host string
+		want int
+	}{
+		{sub + "." + s.domain, http.StatusOK},
+		{sub + "." + s.domain + ":443", http.StatusOK},
+		{"[2001:db8::1]:443", http.StatusBadRequest},
+		{"[2001:db8::1]", http.StatusBadRequest},
+		{"HAPPY-Tiger-ABCDEF01." + s.domain + ".", http.StatusOK},
+		{"happy-tiger-abcdef01.tunn\u04cf.gg", http.StatusBadRequest},
+		{"happy-tiger-abcdef01\uff0e" + s.domain, http.StatusBadRequest},
+		{"happy-tiger-abcdef01." + s.domain + "..", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil)
+		r.Host = tt.host
+		r.RemoteAddr = "[2001:db8::2]:51000"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("Host %q: status = %d, want %d", tt.host, w.Code, tt.want)
+		}
+	}
+}
+
+// FuzzServeHTTP_Host checks that no spelling of a Host header other than
+// the tunnel's own hostname and its services' reaches the tunnel
+func FuzzServeHTTP_Host(f *testing.F) {
+	s := newTestServer(f)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(f)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	tun.SetServices([]tunnel.Service{{Name: "api", Port: 80}})
+	s.GetPool(sub).SetNoWarning(true)
+	tun.SetRateBurst(1e9, 1<<30)
+	var visitors atomic.Uint32 // each request from its own network, under the visitor limits
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go backend.Serve(ln)
+	f.Cleanup(func() { backend.Close() })
+
+	host := sub + "." + s.domain
+	for _, seed := range []string{
+		host, host + ":443", host + ".", "HAPPY-tiger-ABCDEF01." + s.domain, "api--" + host,
+		"x." + host, host + ".evil.com", "happy-tiger-abcdef01\uff0e" + s.domain, host + ":0x1bb", "[" + host + "]",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, hostHeader string) {
+		r := httptest.NewRequest("GET", "https://"+host+"/", nil)
+		r.Host = hostHeader
+		n := visitors.Add(1)
+		r.RemoteAddr = fmt.Sprintf("10.%d.%d.1:51000", byte(n>>8), byte(n))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			return
+		}
+		got, ok := canonicalHost(hostHeader)
+		if !ok || (got != host && got != "api--"+host) {
+			t.Errorf("Host %q reached the tunnel %s", hostHeader, host)
+		}
+	})
+}
+
+func TestCanonicalHost(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   string
+		wantOK bool
+	}{
+		{"Happy-Tiger-ABCDEF01.Tunnl.GG:443", "happy-tiger-abcdef01.tunnl.gg", true},
+		{"tunnl.gg.", "tunnl.gg", true},
+		{"xn--tunnl-3ve.gg", "xn--tunnl-3ve.gg", true},
+		{"t\u00fcnnl.gg", "", false},
+		{"tunnl\u3002gg", "", false},
+		{"tunnl.gg%00", "", false},
+		{"[::1]:443", "", false},
+		{"", "", false},
+		{".", "", false},
+		{"tunnl.gg..", "", false},
+		{"a..tunnl.gg", "", false},
+		{".tunnl.gg", "", false},
+		{"-a.tunnl.gg", "", false},
+		{"a-.tunnl.gg", "", false},
+		{strings.Repeat("a", 64) + ".tunnl.gg", "", false},
+		{strings.Repeat("a", 63) + ".tunnl.gg", strings.Repeat("a", 63) + ".tunnl.gg", true},
+		{"tunnl.gg:", "tunnl.gg", true},
+		{"tunnl.gg:65535", "tunnl.gg", true},
+		{"tunnl.gg:65536", "", false},
+		{"tunnl.gg:0x1bb", "", false},
+		{"tunnl.gg:443:443", "", false},
+		{"tunnl.gg.:443", "tunnl.gg", true},
+	}
+	for _, tt := range tests {
+		got, ok := canonicalHost(tt.input)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("canonicalHost(%q) = %q, %v, want %q, %v", tt.input, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func FuzzCanonicalHost(f *testing.F) {
+	for _, seed := range []string{
+		"happy-tiger-abcdef01.tunnl.gg", "HAPPY-Tiger-ABCDEF01.Tunnl.GG.:443", "api--happy-tiger-abcdef01.tunnl.gg",
+		"[::1]:443", "tunnl.gg:", "tunnl.gg..", "a..b", "xn--tunnl-3ve.gg", "t\u00fcnnl.gg", "tunnl.gg:0x1bb",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, hostport string) {
+		host, ok := canonicalHost(hostport)
+		if !ok {
+			if host != "" {
+				t.Errorf("canonicalHost(%q) = %q on failure", hostport, host)
+			}
+			return
+		}
+		if host != strings.ToLower(host) || strings.ContainsAny(host, ":[]") || strings.HasSuffix(host, ".") {
+			t.Errorf("canonicalHost(%q) = %q, not a bare lowercase name", hostport, host)
+		}
+		// Canonical names are their own canonical form, with or without a port
+		for _, again := range []string{host, host + ".", host + ":443", strings.ToUpper(host)} {
+			if got, ok := canonicalHost(again); !ok || got != host {
+				t.Errorf("canonicalHost(%q) = %q, %v, want %q from %q", again, got, ok, host, hostport)
+			}
+		}
+	})
+}
+
+func TestIsBrowserRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		want      bool
+	}{
+		{"chrome", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/91.0", true},
+		{"firefox", "Mozilla/5.0 (X11; Linux x86_64; rv:89.0) Gecko/20100101 Firefox/89.0", true},
+		{"curl", "curl/7.68.0", false},
+		{"go http", "Go-http-client/1.1", false},
+		{"empty", "", false},
+		{"safari", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) Safari/605.1.15", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{Header: http.Header{}}
+			r.Header.Set("User-Agent", tt.userAgent)
+			if got := isBrowserRequest(r); got != tt.want {
+				t.Errorf("isBrowserRequest(%q) = %v, want %v", tt.userAgent, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsWebSocketRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		upgrade    string
+		connection string
+		want       bool
+	}{
+		{"valid websocket", "websocket", "Upgrade", true},
+		{"case insensitive", "WebSocket", "upgrade", true},
+		{"missing upgrade header", "", "Upgrade", false},
+		{"missing connection header", "websocket", "", false},
+		{"wrong upgrade value", "http/2", "Upgrade", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{Header: http.Header{}}
+			if tt.upgrade != "" {
+				r.Header.Set("Upgrade", tt.upgrade)
+			}
+			if tt.connection != "" {
+				r.Header.Set("Connection", tt.connection)
+			}
+			if got := isWebSocketRequest(r); got != tt.want {
+				t.Errorf("isWebSocketRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasWarningCookie(t *testing.T) {
+	s := newTestServer(t)
+	sub := "test-sub-12345678"
+	cookieName := config.WarningCookieName + "_" + sub
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		want   bool
+	}{
+		{"no cookie", nil, false},
+		{"valid cookie", &http.Cookie{Name: cookieName, Value: "1"}, true},
+		{"wrong value", &http.Cookie{Name: cookieName, Value: "0"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{Header: http.Header{}}
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			if got := s.hasWarningCookie(r, sub); got != tt.want {
+				t.Errorf("hasWarningCookie() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetSecurityHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	setSecurityHeaders(w)
+
+	expected := map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":       "DENY",
+		"X-Xss-Protection":      "1; mode=block",
+		"Referrer-Policy":       "strict-origin-when-cross-origin",
+	}
+
+	for header, want := range expected {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("header %q = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		name string
+		d    time.Duration
+		want string
+	}{
+		{"2 hours", 2 * time.Hour, "2h"},
+		{"1 hour", 1 * time.Hour, "1h"},
+		{"90 minutes", 90 * time.Minute, "1h"},
+		{"45 minutes", 45 * time.Minute, "45m"},
+		{"10 minutes", 10 * time.Minute, "10m"},
+		{"3 hours", 3 * time.Hour, "3h"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatDuration(tt.d); got != tt.want {
+				t.Errorf("formatDuration(%v) = %q, want %q", tt.d, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitedReadCloser(t *testing.T) {
+	t.Run("within limit", func(t *testing.T) {
+		data := "hello world"
+		rc := io.NopCloser(strings.NewReader(data))
+		lrc := &limitedReadCloser{rc: rc, limit: 100}
+
+		buf, err := io.ReadAll(lrc)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != data {
+			t.Errorf("got %q, want %q", string(buf), data)
+		}
+	})
+
+	t.Run("exactly at limit", func(t *testing.T) {
+		rc := io.NopCloser(strings.NewReader("hello"))
+		lrc := &limitedReadCloser{rc: rc, limit: 5, onExceed: func() { t.Error("onExceed called for a body at the limit") }}
+
+		buf, err := io.ReadAll(lrc)
+		if err != nil || string(buf) != "hello" {
+			t.Errorf("ReadAll() = %q, %v, want the whole body", buf, err)
+		}
+	})
+
+	t.Run("exceeds limit", func(t *testing.T) {
+		data := "hello world" // 11 bytes
+		rc := io.NopCloser(strings.NewReader(data))
+		exceeded := 0
+		lrc := &limitedReadCloser{rc: rc, limit: 5, onExceed: func() { exceeded++ }}
+
+		buf, err := io.ReadAll(lrc)
+		if !errors.Is(err, errResponseTooLarge) {
+			t.Fatalf("ReadAll() error = %v, want errResponseTooLarge", err)
+		}
+		if string(buf) != "hello" {
+			t.Errorf("got %q, want only the bytes within the limit", buf)
+		}
+		if _, err := lrc.Read(make([]byte, 10)); !errors.Is(err, errResponseTooLarge) {
+			t.Errorf("Read() after overflow error = %v, want errResponseTooLarge", err)
+		}
+		if exceeded != 1 {
+			t.Errorf("onExceed called %d times, want 1", exceeded)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		rc := io.NopCloser(strings.NewReader("test"))
+		lrc := &limitedReadCloser{rc: rc, limit: 100}
+		if err := lrc.Close(); err != nil {
+			t.Errorf("Close() error: %v", err)
+		}
+	})
+}
+
+func TestServeHTTP_ResponseTooLarge(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+
+	// Backend declares a body over the limit
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", config.MaxResponseBodySize+1)
+	}()
+
+	r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/big", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if got := s.GetStats(false, false).ResponsesTooLarge; got != 1 {
+		t.Errorf("ResponsesTooLarge = %d, want 1", got)
+	}
+}
+
+func TestServeHTTP_TunnelResponseLimit(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	tun.SetMaxResponseSize(config.MaxResponseBodySize * 2)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", config.MaxResponseBodySize+1)
+	}()
+
+	r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/artifact.zip", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want the tunnel's raised limit to allow the response", w.Code)
+	}
+}
+
+func TestCopyWithLimits(t *testing.T) {
+	t.Run("normal copy", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		data := []byte("hello world")
+		go func() {
+			server.Write(data)
+			server.Close()
+		}()
+
+		dst, dstWriter := net.Pipe()
+		defer dst.Close()
+		defer dstWriter.Close()
+
+		received := make(chan []byte, 1)
+		go func() {
+			buf, _ := io.ReadAll(dst)
+			received <- buf
+		}()
+
+		n, err := copyWithLimits(dstWriter, client, 1024, 5*time.Second)
+		dstWriter.Close()
+
+		if err != nil {
+			t.Fatalf("copyWithLimits error: %v", err)
+		}
+		if n != int64(len(data)) {
+			t.Errorf("copyWithLimits returned %d bytes, want %d", n, len(data))
+		}
+
+		got := <-received
+		if string(got) != string(data) {
+			t.Errorf("got %q, want %q", string(got), string(data))
+		}
+	})
+
+	t.Run("transfer limit exceeded", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		// Write more than limit
+		go func() {
+			buf := make([]byte, 100)
+			for i := 0; i < 100; i++ {
+				server.Write(buf)
+			}
+			server.Close()
+		}()
+
+		dst, dstWriter := net.Pipe()
+		defer dst.Close()
+		defer dstWriter.Close()
+
+		// Drain dst to avoid blocking
+		go io.Copy(io.Discard, dst)
+
+		_, err := copyWithLimits(dstWriter, client, 500, 5*time.Second)
+		if err == nil || !strings.Contains(err.Error(), "transfer limit exceeded") {
+			t.Errorf("expected transfer limit exceeded error, got: %v", err)
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		dst, dstWriter := net.Pipe()
+		defer dst.Close()
+		defer dstWriter.Close()
+
+		go io.Copy(io.Discard, dst)
+
+		// Don't write anything — should timeout
+		_, err := copyWithLimits(dstWriter, client, 1024, 50*time.Millisecond)
+		if err == nil {
+			t.Error("expected timeout error, got nil")
+		}
+	})
+}
+
+func newTestServer(t testing.TB) *Server {
+	t.Helper()
+	cfg := config.Default()
+	cfg.HostKeyPath = t.TempDir() + "/host_key"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create test server: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func TestHTTPRedirectHandler(t *testing.T) {
+	s := newTestServer(t)
+	handler := s.HTTPRedirectHandler()
+
+	tests := []struct {
+		name       string
+		host       string
+		path       string
+		wantCode   int
+		wantTarget string
+	}{
+		{
+			"subdomain redirect",
+			"test-sub-12345678.tunnl.gg",
+			"/foo",
+			http.StatusMovedPermanently,
+			"https://test-sub-12345678.tunnl.gg/foo",
+		},
+		{
+			"bare domain redirect",
+			"tunnl.gg",
+			"/",
+			http.StatusMovedPermanently,
+			"https://tunnl.gg/",
+		},
+		{
+			"bad domain rejected",
+			"evil.com",
+			"/",
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"ipv6 literal rejected",
+			"[2001:db8::1]:80",
+			"/",
+			http.StatusBadRequest,
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://"+tt.host+tt.path, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantTarget != "" {
+				loc := w.Header().Get("Location")
+				if loc != tt.wantTarget {
+					t.Errorf("Location = %q, want %q", loc, tt.wantTarget)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusCaptureWriter(t *testing.T) {
+	t.Run("captures explicit status", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		sw := &statusCaptureWriter{ResponseWriter: rec}
+		sw.WriteHeader(http.StatusNotFound)
+
+		if sw.status != http.StatusNotFound {
+			t.Errorf("status = %d, want %d", sw.status, http.StatusNotFound)
+		}
+	})
+
+	t.Run("defaults to 200 on Write", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		sw := &statusCaptureWriter{ResponseWriter: rec}
+		sw.Write([]byte("hello"))
+
+		if sw.status != http.StatusOK {
+			t.Errorf("status = %d, want %d", sw.status, http.StatusOK)
+		}
+	})
+
+	t.Run("counts body bytes", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		sw := &statusCaptureWriter{ResponseWriter: rec}
+		sw.Write([]byte("hello"))
+		sw.Write([]byte(", world"))
+
+		if sw.bytes != 12 {
+			t.Errorf("bytes = %d, want 12", sw.bytes)
+		}
+	})
+
+	t.Run("first WriteHeader wins", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		sw := &statusCaptureWriter{ResponseWriter: rec}
+		sw.WriteHeader(http.StatusCreated)
+		sw.WriteHeader(http.StatusNotFound)
+
+		if sw.status != http.StatusCreated {
+			t.Errorf("status = %d, want %d (first call should win)", sw.status, http.StatusCreated)
+		}
+	})
+
+	t.Run("Unwrap returns inner writer", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		sw := &statusCaptureWriter{ResponseWriter: rec}
+
+		if sw.Unwrap() != rec {
+			t.Error("Unwrap() should return the underlying ResponseWriter")
+		}
+	})
+}
+
+func TestRequestSlots(t *testing.T) {
+	s := newTestServer(t)
+	s.maxConcurrentRequests = 2
+
+	if !s.acquireRequestSlot() || !s.acquireRequestSlot() {
+		t.Fatal("acquireRequestSlot() should succeed below the ceiling")
+	}
+	if s.acquireRequestSlot() {
+		t.Error("acquireRequestSlot() should fail at the ceiling")
+	}
+	if got := s.totalShed.Load(); got != 1 {
+		t.Errorf("totalShed = %d, want 1", got)
+	}
+
+	s.releaseRequestSlot()
+	if !s.acquireRequestSlot() {
+		t.Error("acquireRequestSlot() should succeed after a release")
+	}
+	if got := s.inFlightRequests.Load(); got != 2 {
+		t.Errorf("inFlightRequests = %d, want 2", got)
+	}
+}
+
+func TestPickTunnel_Sticky(t *testing.T) {
+	s := newTestServer(t)
+	s.stickySessions = true
+	sub := "happy-tiger-abcdef01"
+	s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+
+	w := httptest.NewRecorder()
+	first := s.pickTunnel(w, httptest.NewRequest("GET", "/", nil), sub)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != config.StickyCookieName {
+		t.Fatalf("expected a %s cookie, got %v", config.StickyCookieName, cookies)
+	}
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookies[0])
+		if got := s.pickTunnel(httptest.NewRecorder(), r, sub); got != first {
+			t.Fatalf("request %d with affinity cookie went to a different backend", i+1)
+		}
+	}
+}
+
+func TestPickTunnel_NotStickyByDefault(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+
+	w := httptest.NewRecorder()
+	s.pickTunnel(w, httptest.NewRequest("GET", "/", nil), sub)
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("no affinity cookie should be set when sticky sessions are disabled")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "1"},
+		{100 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{time.Second + time.Millisecond, "2"},
+		{9500 * time.Millisecond, "10"},
+	}
+	for _, tt := range tests {
+		if got := retryAfter(tt.d); got != tt.want {
+			t.Errorf("retryAfter(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestServeHTTP_FingerprintRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	tun.SetRateBurst(1000, 1000)
+	s.GetPool(sub).SetNoWarning(true)
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go backend.Serve(ln)
+	t.Cleanup(func() { backend.Close() })
+
+	get := func(ip, ua string) int {
+		r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/login", nil)
+		r.RemoteAddr = ip + ":51000"
+		r.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// A client rotating through its network, one request per address, runs
+	// into the limit its addresses share
+	for i := range config.FingerprintBurstSize {
+		if code := get(fmt.Sprintf("198.51.100.%d", i+1), "stuffer/1.0"); code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200 within the fingerprint's burst", i+1, code)
+		}
+	}
+	if code := get("198.51.100.250", "stuffer/1.0"); code != http.StatusTooManyRequests {
+		t.Errorf("request past the burst: status %d, want 429", code)
+	}
+	if code := get("198.51.100.250", "Mozilla/5.0"); code != http.StatusOK {
+		t.Errorf("other software in the network: status %d, want 200", code)
+	}
+	if got := s.GetStats(false, false).FingerprintLimited; got != 1 {
+		t.Errorf("FingerprintLimited = %d, want 1", got)
+	}
+}
+
+func TestRejectRateLimited(t *testing.T) {
+	s := newTestServer(t)
+
+	t.Run("fast rejection", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.rejectRateLimited(w, httptest.NewRequest("GET", "/", nil), "1.2.3.4", 2500*time.Millisecond)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+		}
+		if got := w.Header().Get("Retry-After"); got != "3" {
+			t.Errorf("Retry-After = %q, want the delay rounded up to %q", got, "3")
+		}
+	})
+
+	t.Run("tarpit honors client disconnect", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			s.visitorLimiter.RecordViolation("5.6.7.8")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+
+		start := time.Now()
+		s.rejectRateLimited(httptest.NewRecorder(), r, "5.6.7.8", time.Second)
+		if time.Since(start) > time.Second {
+			t.Error("tarpit should stop stalling once the client goes away")
+		}
+		if got := s.totalTarpitted.Load(); got != 1 {
+			t.Errorf("totalTarpitted = %d, want 1", got)
+		}
+	})
+}
+
+func TestHandleWebSocket_TunnelLimits(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	tun.SetWebSocketLimits(100*time.Millisecond, 1<<20)
+
+	// Backend accepts the upgrade, then stays silent
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		time.Sleep(5 * time.Second)
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handleWebSocket(w, r, tun, sub, "")
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: "+sub+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	io.Copy(io.Discard, conn)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("idle WebSocket closed after %v, want the tunnel's 100ms idle timeout", elapsed)
+	}
+}
+
+func TestServeHTTP_UpstreamTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.upstreamTimeout = 100 * time.Millisecond
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.URL.Path == "/hang" {
+					<-release
+					return
+				}
+				if req.URL.Path == "/upload" {
+					// Answers as soon as the whole body is in
+					io.Copy(io.Discard, req.Body)
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+					return
+				}
+				// Headers arrive in time; the body is slower than the deadline
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\n")
+				time.Sleep(200 * time.Millisecond)
+				io.WriteString(conn, "done")
+			}()
+		}
+	}()
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/hang", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v, want it cut off at the upstream timeout", elapsed)
+	}
+	if got := s.GetStats(false, false).UpstreamTimeouts; got != 1 {
+		t.Errorf("UpstreamTimeouts = %d, want 1", got)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/slow-body", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "done" {
+		t.Errorf("slow body: status = %d, body %q, want the full response", w.Code, w.Body)
+	}
+
+	// The deadline starts once the request body is sent, so slow uploads are unaffected
+	body, upload := io.Pipe()
+	go func() {
+		for range 3 {
+			time.Sleep(100 * time.Millisecond)
+			io.WriteString(upload, "chunk")
+		}
+		upload.Close()
+	}()
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "https://"+sub+"."+s.domain+"/upload", body))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("slow upload: status = %d, body %q, want the response", w.Code, w.Body)
+	}
+}
+
+// hangingBackend answers requests on ln with 200, except those to /hang,
+// which get no answer until the test ends
+func hangingBackend(t *testing.T, ln net.Listener) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.URL.Path == "/hang" {
+					<-release
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}()
+		}
+	}()
+}
+
+// openBreaker gives tun a breaker with a short cooldown, trips it and waits
+// for the cooldown to end, so that the next request is the half-open probe
+func openBreaker(tun *tunnel.Tunnel) {
+	tun.SetBreaker(tunnel.NewCircuitBreaker(1, 20*time.Millisecond))
+	tun.Breaker().RecordFailure()
+	time.Sleep(30 * time.Millisecond)
+}
+
+func TestServeHTTP_CanceledProbe(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	hangingBackend(t, ln)
+	openBreaker(tun)
+
+	// The visitor behind the probe goes away before the backend answers
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/hang", nil).WithContext(ctx)
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status after a canceled probe = %d, want %d", w.Code, http.StatusOK)
+	}
+	if tun.Breaker().IsOpen() {
+		t.Error("the next probe should have closed the breaker")
+	}
+}
+
+func TestServeHTTP_TimedOutProbe(t *testing.T) {
+	s := newTestServer(t)
+	s.upstreamTimeout = 50 * time.Millisecond
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	hangingBackend(t, ln)
+	openBreaker(tun)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/hang", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("probe status = %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status after a timed-out probe = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestServeHTTP_RobotsTag(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	pool := s.GetPool(sub)
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "all")
+		io.WriteString(w, "ok")
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	serve := func() []string {
+		r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Header().Values("X-Robots-Tag")
+	}
+
+	if got := serve(); len(got) != 1 || got[0] != config.RobotsTag {
+		t.Errorf("X-Robots-Tag = %q, want only %q", got, config.RobotsTag)
+	}
+	pool.SetIndexing(true)
+	if got := serve(); len(got) != 1 || got[0] != "all" {
+		t.Errorf("X-Robots-Tag with allow-indexing = %q, want the backend's", got)
+	}
+}
+
+func TestServeHTTP_RobotsTxt(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "User-agent: *\nAllow: /\n")
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	serve := func() string {
+		r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/robots.txt", nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	if got := serve(); got != "User-agent: *\nDisallow: /\n" {
+		t.Errorf("robots.txt = %q, want the edge's deny-all policy", got)
+	}
+	s.GetPool(sub).SetIndexing(true)
+	if got := serve(); got != "User-agent: *\nAllow: /\n" {
+		t.Errorf("robots.txt with allow-indexing = %q, want the backend's", got)
+	}
+}
+
+func TestServeHTTP_AccessLog(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "secret", 0, ln, "", 80, "1.2.3.4")
+	tun.History().Add(tunnel.RequestRecord{Time: time.Now(), Method: "GET", Path: "/a", Status: 200, Bytes: 12, VisitorIP: "5.6.7.8"})
+	token := s.GetPool(sub).AccessLogToken()
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "app")
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	serve := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+config.AccessLogPath+query, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// Without the token, including with the join token, the path is the app's
+	for _, query := range []string{"", "?token=wrong", "?token=secret"} {
+		if w := serve(query); w.Code != http.StatusOK || w.Body.String() != "app" {
+			t.Errorf("%q: status %d, body %q, want the app's response", query, w.Code, w.Body.String())
+		}
+	}
+	w := serve("?token=" + token)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), `5.6.7.8 - - [`) || !strings.Contains(w.Body.String(), `"GET /a" 200 12`) {
+		t.Errorf("text log: status %d, body %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="`+sub+`-access.log"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	w = serve("?token=" + token + "&format=json")
+	if !strings.Contains(w.Body.String(), `"path": "/a"`) || !strings.HasSuffix(w.Header().Get("Content-Disposition"), `.json"`) {
+		t.Errorf("json log: body %q, Content-Disposition %q", w.Body.String(), w.Header().Get("Content-Disposition"))
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	s := newTestServer(b)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(b)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	tun.SetRateBurst(1<<30, 1<<30)
+	// The visitor's own limits would otherwise throttle the benchmark
+	s.visitorLimiter.visitors[visitorKey{"192.0.2.1", sub}] = &visitorEntry{limiter: tunnel.NewRateLimiter(1<<30, 1<<30)}
+	s.visitorLimiter.visitors[visitorKey{visitorFingerprint("192.0.2.1", "bench/1.0", nil), sub}] = &visitorEntry{limiter: tunnel.NewRateLimiter(1<<30, 1<<30)}
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "pong")
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/ping?x=1", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("User-Agent", "bench/1.0")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("status = %d", w.Code)
+		}
+	}
+}
+
+func BenchmarkCopyWithLimits(b *testing.B) {
+	payload := make([]byte, 256<<10)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for b.Loop() {
+		src, srcPeer := net.Pipe()
+		dst, dstPeer := net.Pipe()
+		go func() {
+			srcPeer.Write(payload)
+			srcPeer.Close()
+		}()
+		go io.Copy(io.Discard, dstPeer)
+		if _, err := copyWithLimits(dst, src, 1<<30, time.Minute); err != nil {
+			b.Fatal(err)
+		}
+		src.Close()
+		dst.Close()
+		dstPeer.Close()
+	}
+}
+
+func TestServeHTTP_Routes(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	s.GetPool(sub).SetNoWarning(true)
+
+	// Each backend answers with its name, the path and prefix it received
+	serve := func(name string, ln net.Listener) {
+		backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s %s", name, r.URL.EscapedPath(), r.Header.Get("X-Forwarded-Prefix"))
+		})}
+		go backend.Serve(ln)
+		t.Cleanup(func() { backend.Close() })
+	}
+	serve("web", ln)
+	api := newTestListener(t)
+	serve("api", api)
+	if !tun.AddForward(8080, api) {
+		t.Fatal("AddForward failed")
+	}
+
+	opts, _ := tunnel.ParseOptions("route=/api:9090")
+	if err := s.applyOptions(s.GetPool(sub), tun, nil, opts); err == nil {
+		t.Error("a route to a port that is not forwarded should be refused")
+	}
+	opts, _ = tunnel.ParseOptions("route=/api:8080")
+	if err := s.applyOptions(s.GetPool(sub), tun, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/", "web / "},
+		{"/apiary", "web /apiary "},
+		{"/api", "api / /api"},
+		{"/api/users?id=1", "api /users /api"},
+		{"/api/a%2Fb", "api /a%2Fb /api"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "https://"+sub+"."+s.domain+tt.path, nil))
+		if w.Body.String() != tt.want {
+			t.Errorf("GET %s = %d %q, want %q", tt.path, w.Code, w.Body.String(), tt.want)
+		}
+	}
+	if records := tun.History().Recent(1); len(records) != 1 || records[0].Path != "/api/a/b" {
+		t.Errorf("history = %+v, want the path the visitor requested", records)
+	}
+}
+
+func TestServeHTTP_HeaderRules(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	s.GetPool(sub).SetNoWarning(true)
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.2.3")
+		w.Header().Set("Cache-Control", "public")
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("X-Api-Key"), r.Header.Get("Cookie"), r.Header.Values("Accept"))
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	opts, err := tunnel.ParseOptions("request-header=X-Api-Key:s3cret request-header=-Cookie request-header=+Accept:text/plain " +
+		"response-header=-Server response-header=Cache-Control:no-store response-header=+X-Served-By:tunnl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.applyOptions(s.GetPool(sub), tun, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil)
+	req.Header.Set("X-Api-Key", "visitor-supplied")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+
+	if want := "s3cret||[text/html text/plain]"; w.Body.String() != want {
+		t.Errorf("backend saw %q, want %q", w.Body.String(), want)
+	}
+	if got := w.Header().Get("Server"); got != "" {
+		t.Errorf("Server = %q, want it removed", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+	if got := w.Header().Get("X-Served-By"); got != "tunnl" {
+		t.Errorf("X-Served-By = %q, want tunnl", got)
+	}
+}
+
+func TestServeHTTP_TunnlHeaders(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	s.GetPool(sub).SetNoWarning(true)
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("X-Tunnl-Subdomain"), r.Header.Get("X-Tunnl-Visitor-IP"), r.Header.Get("X-Tunnl-Proto"))
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	get := func() string {
+		req := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil)
+		req.Header.Set("X-Tunnl-Visitor-IP", "10.0.0.1") // forged
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	if got, want := get(), sub+"|192.0.2.1|https"; got != want {
+		t.Errorf("backend saw %q, want %q", got, want)
+	}
+
+	opts, _ := tunnel.ParseOptions("no-tunnl-headers")
+	if err := s.applyOptions(s.GetPool(sub), tun, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); got != "||" {
+		t.Errorf("backend saw %q with no-tunnl-headers, want none, not even forged ones", got)
+	}
+}
+
+func TestServeHTTP_Privacy(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	s.GetPool(sub).SetNoWarning(true)
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Tunnl-Debug", "backend-1")
+		for _, name := range []string{"User-Agent", "X-Forwarded-For", "X-Real-Ip", "Forwarded", "X-Tunnl-Subdomain", "X-Tunnl-Anything"} {
+			if v, ok := r.Header[name]; ok {
+				fmt.Fprintf(w, "%s=%v ", name, v)
+			}
+		}
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	opts, _ := tunnel.ParseOptions("privacy")
+	if err := s.applyOptions(s.GetPool(sub), tun, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("X-Real-IP", "10.0.0.1")
+	req.Header.Set("Forwarded", "for=10.0.0.1")
+	req.Header.Set("X-Tunnl-Anything", "1")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != "" {
+		t.Errorf("backend saw %d %q, want no visitor or tunnel headers", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Tunnl-Debug"); got != "" {
+		t.Errorf("X-Tunnl-Debug = %q, want it kept from the visitor", got)
+	}
+}
+
+func TestServeHTTP_BackendDownPage(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	s.GetPool(sub).SetNoWarning(true)
+
+	// The client's local server refuses: the forwarded connection closes at once
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	for _, method := range []string{"GET", "POST"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, "https://"+sub+"."+s.domain+"/", nil))
+		if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "Local server is not answering") {
+			t.Errorf("%s: got %d %q, want the backend down page", method, w.Code, w.Body.String())
+		}
+		if got, want := w.Header().Get("Retry-After"), strconv.Itoa(int(config.BackendDownRetry.Seconds())); got != want {
+			t.Errorf("%s: Retry-After = %q, want %q", method, got, want)
+		}
+		if reloads := strings.Contains(w.Body.String(), "location.reload()"); reloads != (method == "GET") {
+			t.Errorf("%s: page reloads itself = %v", method, reloads)
+		}
+	}
+}
+
+func TestServeHTTP_Services(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+	s.GetPool(sub).SetNoWarning(true)
+
+	serve := func(name string, ln net.Listener) {
+		backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		})}
+		go backend.Serve(ln)
+		t.Cleanup(func() { backend.Close() })
+	}
+	serve("web", ln)
+	api := newTestListener(t)
+	serve("api", api)
+	tun.AddForward(8080, api)
+
+	opts, _ := tunnel.ParseOptions("service=api:8080 route=/api:8080")
+	if err := s.applyOptions(s.GetPool(sub), tun, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, path string
+		code       int
+		want       string
+	}{
+		{sub, "/users", http.StatusOK, "web /users"},
+		{"api--" + sub, "/users", http.StatusOK, "api /users"},
+		{"api--" + sub, "/api/users", http.StatusOK, "api /api/users"}, // routes are for the subdomain only
+		{"admin--" + sub, "/", http.StatusNotFound, ""},
+		{"api--happy-tiger-00000000", "/", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "https://"+tt.host+"."+s.domain+tt.path, nil))
+		if w.Code != tt.code || (tt.want != "" && w.Body.String() != tt.want) {
+			t.Errorf("GET %s%s = %d %q, want %d %q", tt.host, tt.path, w.Code, w.Body.String(), tt.code, tt.want)
+		}
+	}
+}
+
+func TestServeHTTP_AbortedResponseRecorded(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	tun := s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+
+	// The backend drops the connection partway through its body
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		io.WriteString(w, strings.Repeat("x", 100))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}), ErrorLog: log.New(io.Discard, "", 0)}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	// A real server, under which the proxy aborts cut-off responses with a panic
+	front := httptest.NewServer(s)
+	defer front.Close()
+	front.Config.ErrorLog = log.New(io.Discard, "", 0)
+	req, _ := http.NewRequest("GET", front.URL+"/download", nil)
+	req.Host = sub + "." + s.domain
+	if resp, err := front.Client().Do(req); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if records := tun.History().Recent(1); len(records) != 1 || records[0].Path != "/download" || records[0].Bytes != 100 {
+		t.Errorf("history = %+v, want the aborted request", records)
+	}
+	if got := tun.BytesRelayed(); got != 100 {
+		t.Errorf("BytesRelayed() = %d, want 100", got)
+	}
+	if tunnels, _ := s.topTalkers.Top(1, 10, true); len(tunnels) != 1 || tunnels[0].Name != sub || tunnels[0].Bytes != 100 {
+		t.Errorf("top talkers = %+v, want the aborted request", tunnels)
+	}
+}
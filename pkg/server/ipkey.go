@@ -0,0 +1,25 @@
+package server
+
+import "net/netip"
+
+// ipKey returns the key a client IP is tracked under by the per-IP
+// connection limits, the SSH connection registry and the abuse tracker, so
+// the same client cannot pass for another by formatting its address
+// differently or rotating through its IPv6 range. IPv4 and IPv4-mapped IPv6
+// addresses map to their canonical IPv4 form; other IPv6 addresses to their
+// enclosing prefix of prefixBits, or their canonical form if prefixBits is
+// 0 or 128. Keys are returned unchanged, as is anything that is not an IP.
+func ipKey(ip string, prefixBits int) string {
+	if prefix, err := netip.ParsePrefix(ip); err == nil {
+		return prefix.Masked().String()
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+	if addr.Is6() && prefixBits > 0 && prefixBits < 128 {
+		return netip.PrefixFrom(addr, prefixBits).Masked().String()
+	}
+	return addr.String()
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestIPKey(t *testing.T) {
+	tests := []struct {
+		ip     string
+		prefix int
+		want   string
+	}{
+		{"1.2.3.4", 64, "1.2.3.4"},
+		{"::ffff:1.2.3.4", 64, "1.2.3.4"},
+		{"2001:0DB8:0000::0001", 128, "2001:db8::1"},
+		{"2001:db8::1", 0, "2001:db8::1"},
+		{"2001:db8:0:1:aaaa::1", 64, "2001:db8:0:1::/64"},
+		{"2001:db8:0:1:bbbb::2", 64, "2001:db8:0:1::/64"},
+		{"2001:db8:0:1:bbbb::2", 48, "2001:db8::/48"},
+		{"fe80::1%eth0", 128, "fe80::1"},
+		{"2001:db8:0:1::/64", 64, "2001:db8:0:1::/64"},
+		{"unknown", 64, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := ipKey(tt.ip, tt.prefix); got != tt.want {
+			t.Errorf("ipKey(%q, %d) = %q, want %q", tt.ip, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestIPv6PrefixAggregation(t *testing.T) {
+	s := newTestServer(t)
+
+	// Addresses of one /64 share the connection count
+	if err := s.CheckAndReserveConnection("2001:db8:0:1::a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckAndReserveConnection("2001:db8:0:1::b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkIPTunnelLimit("2001:0db8:0000:0001::c", 1); err == nil {
+		t.Error("tunnel limit should count connections across the /64")
+	}
+	s.DecrementIPConnection("2001:db8:0:1::a")
+	s.DecrementIPConnection("2001:db8:0:1::b")
+	if len(s.ipConnections) != 0 {
+		t.Errorf("ipConnections = %v after releasing both", s.ipConnections)
+	}
+
+	// A block covers the prefix, not just the address that earned it
+	s.BlockIP("2001:db8:0:2::1")
+	if err := s.CheckAndReserveConnection("2001:db8:0:2::ffff"); err == nil {
+		t.Error("a neighbour of a blocked address should be blocked")
+	}
+	if err := s.CheckAndReserveConnection("2001:db8:0:3::1"); err != nil {
+		t.Errorf("another /64 should not be blocked: %v", err)
+	}
+	s.DecrementIPConnection("2001:db8:0:3::1")
+
+	// So does the daily bandwidth quota
+	s.bandwidth = NewBandwidthTracker(100)
+	if _, err := s.meterIP(io.Discard, "2001:db8:0:4::1").Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckAndReserveConnection("2001:db8:0:4::2"); err == nil {
+		t.Error("a neighbour of an address over its bandwidth quota should be refused")
+	}
+	if got := s.bandwidth.Usage("2001:db8:0:4::/64"); got != 100 {
+		t.Errorf("Usage(2001:db8:0:4::/64) = %d, want 100", got)
+	}
+}
+
+func TestAbuseTracker_IPv6Rotation(t *testing.T) {
+	at := newTestTracker(t)
+	for i := range config.MaxConnectionsPerMinute {
+		if !at.CheckConnectionRate(fmt.Sprintf("2001:db8:0:1::%x", i+1)) {
+			t.Fatalf("connection %d refused", i+1)
+		}
+	}
+	if at.CheckConnectionRate("2001:db8:0:1::ffff") {
+		t.Error("rotating addresses within the /64 should not reset the rate limit")
+	}
+	if !at.CheckConnectionRate("2001:db8:0:2::1") {
+		t.Error("another /64 should have its own rate limit")
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"tunnl.gg/pkg/tunnel"
+)
+
+// BackendRateLimit is the rate limit currently applied to one backend of a subdomain
+type BackendRateLimit struct {
+	BackendID         string `json:"backend_id"`
+	RequestsPerSecond int    `json:"requests_per_second"`
+	Burst             int    `json:"burst"`
+	FairShare         int    `json:"fair_share,omitempty"` // cap from the client IP's shared budget
+}
+
+// RateLimits are the rate limits of a subdomain's backends
+type RateLimits struct {
+	Subdomain string             `json:"subdomain"`
+	Override  bool               `json:"override"` // set by an operator for every backend
+	Backends  []BackendRateLimit `json:"backends"`
+}
+
+// rateLimitsFor reports the limits of every backend in a pool
+func rateLimitsFor(pool *tunnel.Pool) RateLimits {
+	_, _, override := pool.RateLimits()
+	rl := RateLimits{Subdomain: pool.Subdomain, Override: override, Backends: []BackendRateLimit{}}
+	for _, t := range pool.Tunnels() {
+		rl.Backends = append(rl.Backends, BackendRateLimit{
+			BackendID:         t.BackendID(),
+			RequestsPerSecond: t.RateLimit(),
+			Burst:             t.Burst(),
+			FairShare:         t.Share(),
+		})
+	}
+	return rl
+}
+
+// rateLimitsHandler serves GET and PUT /api/tunnels/{name}/limits. A PUT with
+// {"requests_per_second": N, "burst": M} changes the limits of every backend of
+// the subdomain immediately, without reconnecting; burst defaults to one in
+// proportion to the rate. The limits also apply to backends that join later,
+// until the subdomain's last backend disconnects.
+func (s *Server) rateLimitsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pool := s.GetPool(strings.ToLower(r.PathValue("name")))
+		if pool == nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			var req struct {
+				RequestsPerSecond int `json:"requests_per_second"`
+				Burst             int `json:"burst"`
+			}
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.RequestsPerSecond < 1 || req.Burst < 0 {
+				http.Error(w, "requests_per_second must be at least 1 and burst must not be negative", http.StatusBadRequest)
+				return
+			}
+			if req.Burst == 0 {
+				req.Burst = tunnel.BurstFor(req.RequestsPerSecond)
+			}
+			pool.SetRateLimits(req.RequestsPerSecond, req.Burst)
+			log.Printf("Rate limit of %s set to %d/s (burst %d)", pool.Subdomain, req.RequestsPerSecond, req.Burst)
+		}
+
+		writeJSON(w, rateLimitsFor(pool))
+	})
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+func TestRateLimitsAPI(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	first := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	second := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.5")
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.RemoteAddr = "127.0.0.1:12345"
+		w := httptest.NewRecorder()
+		s.StatsHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("GET", "/api/tunnels/"+sub+"/limits", "")
+	var rl RateLimits
+	if err := json.NewDecoder(w.Body).Decode(&rl); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if rl.Override || len(rl.Backends) != 2 || rl.Backends[0].RequestsPerSecond != config.RequestsPerSecond {
+		t.Errorf("GET limits = %+v, want 2 backends at the default rate", rl)
+	}
+
+	w = do("PUT", "/api/tunnels/"+sub+"/limits", `{"requests_per_second": 2, "burst": 3}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT limits status = %d, body %q", w.Code, w.Body)
+	}
+	for _, tun := range []*tunnel.Tunnel{first, second} {
+		if tun.RateLimit() != 2 || tun.Burst() != 3 {
+			t.Errorf("backend %s limits = %d/%d, want 2/3", tun.BackendID(), tun.RateLimit(), tun.Burst())
+		}
+	}
+
+	// Lowered limits apply to the very next requests
+	for i := 0; i < 3; i++ {
+		if !first.AllowRequest() {
+			t.Fatalf("request %d within the new burst was refused", i+1)
+		}
+	}
+	if first.AllowRequest() {
+		t.Error("request past the new burst should be refused")
+	}
+
+	// Backends that join later get the same limits
+	if rps, burst, ok := s.GetPool(sub).RateLimits(); !ok || rps != 2 || burst != 3 {
+		t.Errorf("pool RateLimits() = %d, %d, %v, want 2, 3, true", rps, burst, ok)
+	}
+
+	w = do("PUT", "/api/tunnels/"+sub+"/limits", `{"requests_per_second": 40}`)
+	json.NewDecoder(w.Body).Decode(&rl)
+	if !rl.Override || rl.Backends[0].Burst != tunnel.BurstFor(40) {
+		t.Errorf("PUT without burst = %+v, want a proportional burst", rl)
+	}
+
+	for _, body := range []string{`{"requests_per_second": 0}`, `{"requests_per_second": 5, "burst": -1}`, `{"rps": 5}`, `nope`} {
+		if w := do("PUT", "/api/tunnels/"+sub+"/limits", body); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s status = %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if w := do("GET", "/api/tunnels/nobody/limits", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown subdomain status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
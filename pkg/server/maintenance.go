@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"tunnl.gg/pkg/config"
+)
+
+// maintenanceMode pauses the creation of new tunnels while existing ones keep
+// running, so operators can drain a server before an upgrade
+type maintenanceMode struct {
+	mu      sync.RWMutex
+	enabled bool
+	message string
+}
+
+// maintenanceError is the reason given to clients refused during maintenance
+type maintenanceError struct {
+	message string
+}
+
+func (e *maintenanceError) Error() string { return e.message }
+
+// SetMaintenance turns maintenance mode on or off. An empty message shows
+// the default one.
+func (s *Server) SetMaintenance(enabled bool, message string) {
+	if message == "" {
+		message = config.DefaultMaintenanceMessage
+	}
+	s.maintenance.mu.Lock()
+	s.maintenance.enabled = enabled
+	s.maintenance.message = message
+	s.maintenance.mu.Unlock()
+}
+
+// Maintenance reports whether maintenance mode is on, and the message shown
+// to refused clients
+func (s *Server) Maintenance() (bool, string) {
+	s.maintenance.mu.RLock()
+	defer s.maintenance.mu.RUnlock()
+	if s.maintenance.message == "" {
+		return s.maintenance.enabled, config.DefaultMaintenanceMessage
+	}
+	return s.maintenance.enabled, s.maintenance.message
+}
+
+// checkMaintenance returns a maintenanceError while new tunnels are paused
+func (s *Server) checkMaintenance() error {
+	if enabled, message := s.Maintenance(); enabled {
+		return &maintenanceError{message}
+	}
+	return nil
+}
+
+// maintenanceStatus is the body of the maintenance API
+type maintenanceStatus struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+}
+
+// maintenanceHandler serves GET and PUT /api/maintenance. A PUT with
+// {"enabled": true, "message": "..."} refuses new SSH connections with the
+// message as their banner until maintenance is turned off again; tunnels
+// already open are not affected.
+func (s *Server) maintenanceHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var req maintenanceStatus
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.SetMaintenance(req.Enabled, req.Message)
+			if req.Enabled {
+				log.Printf("Maintenance mode on: new tunnels are refused")
+			} else {
+				log.Printf("Maintenance mode off")
+			}
+		}
+
+		enabled, message := s.Maintenance()
+		writeJSON(w, maintenanceStatus{enabled, message})
+	})
+}
+
+// isMaintenance reports whether err refused a client for maintenance
+func isMaintenance(err error) bool {
+	var m *maintenanceError
+	return errors.As(err, &m)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestMaintenanceAPI(t *testing.T) {
+	s := newTestServer(t)
+	tun := s.RegisterTunnel("happy-tiger-abcdef01", "", 0, newTestListener(t), "", 80, "1.2.3.4")
+
+	do := func(method, body string) maintenanceStatus {
+		t.Helper()
+		r := httptest.NewRequest(method, "/api/maintenance", strings.NewReader(body))
+		r.RemoteAddr = "127.0.0.1:1"
+		w := httptest.NewRecorder()
+		s.StatsHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s status = %d, body %q", method, w.Code, w.Body)
+		}
+		var status maintenanceStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return status
+	}
+
+	if status := do("GET", ""); status.Enabled || status.Message != config.DefaultMaintenanceMessage {
+		t.Errorf("initial status = %+v", status)
+	}
+	if status := do("PUT", `{"enabled": true, "message": "Upgrading, back at 14:00 UTC"}`); !status.Enabled || status.Message != "Upgrading, back at 14:00 UTC" {
+		t.Errorf("status after enabling = %+v", status)
+	}
+
+	// New connections are refused with the message as their banner
+	err := s.CheckAndReserveConnection("198.51.100.1")
+	if err == nil {
+		t.Fatal("connection accepted during maintenance")
+	}
+	if banner := rejectionBanner(err); !strings.Contains(banner, "MAINTENANCE: Upgrading, back at 14:00 UTC") {
+		t.Errorf("banner = %q", banner)
+	}
+	if !s.GetStats(false, false).Maintenance {
+		t.Error("stats should report maintenance")
+	}
+
+	// Existing tunnels keep running
+	if s.GetPool("happy-tiger-abcdef01") == nil || tun.IsExpired() {
+		t.Error("existing tunnel should be kept during maintenance")
+	}
+
+	do("PUT", `{"enabled": false}`)
+	if err := s.CheckAndReserveConnection("198.51.100.1"); err != nil {
+		t.Errorf("connection refused after maintenance: %v", err)
+	}
+	s.DecrementIPConnection("198.51.100.1")
+}
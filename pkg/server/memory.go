@@ -0,0 +1,125 @@
+package server
+
+import (
+	"sync/atomic"
+)
+
+// memoryComponent is an optional subsystem whose memory counts against the
+// shared budget
+type memoryComponent int
+
+const (
+	memoryCaptures memoryComponent = iota // captured bodies held in memory
+	memoryLogs                            // lines queued for session terminals
+	memoryAbuse                           // per-IP connection, violation and visitor entries
+
+	numMemoryComponents
+)
+
+var memoryComponentNames = [numMemoryComponents]string{"captures", "logs", "abuse"}
+
+// MemoryBudget bounds the memory of the capture store, session log buffers
+// and abuse tracking maps together, so optional observability cannot run a
+// small server out of memory. Components reserve bytes before holding them;
+// a refused reservation makes the component evict its oldest or arbitrary
+// entries, or drop what it was about to keep. A nil budget is unlimited.
+type MemoryBudget struct {
+	limit     int64 // 0 = unlimited
+	used      atomic.Int64
+	usage     [numMemoryComponents]atomic.Int64
+	evictions [numMemoryComponents]atomic.Uint64 // entries evicted or dropped for the budget
+}
+
+// NewMemoryBudget creates a budget of limit bytes (0 = unlimited)
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// Reserve takes n bytes for a component, returning false if they would
+// exceed the budget
+func (b *MemoryBudget) Reserve(c memoryComponent, n int64) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		used := b.used.Load()
+		if b.limit > 0 && used+n > b.limit {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			b.usage[c].Add(n)
+			return true
+		}
+	}
+}
+
+// Release returns n bytes reserved by a component
+func (b *MemoryBudget) Release(c memoryComponent, n int64) {
+	if b == nil {
+		return
+	}
+	b.used.Add(-n)
+	b.usage[c].Add(-n)
+}
+
+// Evicted counts an entry a component evicted or dropped to stay in budget
+func (b *MemoryBudget) Evicted(c memoryComponent) {
+	if b != nil {
+		b.evictions[c].Add(1)
+	}
+}
+
+// For returns the budget of one component, as used by session loggers
+func (b *MemoryBudget) For(c memoryComponent) *ComponentBudget {
+	return &ComponentBudget{b, c}
+}
+
+// MemoryStats reports the budget and each component's share of it
+type MemoryStats struct {
+	Budget     int64                      `json:"budget_bytes"` // 0 = unlimited
+	Used       int64                      `json:"used_bytes"`
+	Components map[string]ComponentMemory `json:"components"`
+}
+
+// ComponentMemory is one component's use of the memory budget
+type ComponentMemory struct {
+	Used      int64  `json:"used_bytes"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// Stats returns the current usage
+func (b *MemoryBudget) Stats() MemoryStats {
+	stats := MemoryStats{
+		Budget:     b.limit,
+		Used:       b.used.Load(),
+		Components: make(map[string]ComponentMemory, numMemoryComponents),
+	}
+	for c := range numMemoryComponents {
+		stats.Components[memoryComponentNames[c]] = ComponentMemory{
+			Used:      b.usage[c].Load(),
+			Evictions: b.evictions[c].Load(),
+		}
+	}
+	return stats
+}
+
+// ComponentBudget is a component's view of a MemoryBudget
+type ComponentBudget struct {
+	budget    *MemoryBudget
+	component memoryComponent
+}
+
+// Reserve takes n bytes, returning false if they would exceed the budget
+// (the caller then drops what it was about to keep)
+func (cb *ComponentBudget) Reserve(n int64) bool {
+	if cb.budget.Reserve(cb.component, n) {
+		return true
+	}
+	cb.budget.Evicted(cb.component)
+	return false
+}
+
+// Release returns n reserved bytes
+func (cb *ComponentBudget) Release(n int64) {
+	cb.budget.Release(cb.component, n)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(100)
+	if !b.Reserve(memoryCaptures, 60) || !b.Reserve(memoryLogs, 40) {
+		t.Fatal("reservations within the budget were refused")
+	}
+	if b.Reserve(memoryAbuse, 1) {
+		t.Error("reservation over the budget was accepted")
+	}
+	b.Release(memoryCaptures, 60)
+	if !b.Reserve(memoryAbuse, 50) {
+		t.Error("reservation after a release was refused")
+	}
+	stats := b.Stats()
+	if stats.Used != 90 || stats.Components["logs"].Used != 40 || stats.Components["abuse"].Used != 50 || stats.Components["captures"].Used != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+
+	var unlimited *MemoryBudget
+	if !unlimited.Reserve(memoryCaptures, 1<<40) {
+		t.Error("nil budget should be unlimited")
+	}
+}
+
+func TestCaptureStore_MemoryBudget(t *testing.T) {
+	cs := NewCaptureStore(64, nil)
+	defer cs.Stop()
+	budget := NewMemoryBudget(10)
+	cs.SetMemoryBudget(budget)
+
+	capture := func(body string) string {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		c := cs.Start("happy-tiger-abcdef01", r)
+		r.Body.Read(make([]byte, 64))
+		return c.Finish(http.StatusOK)
+	}
+
+	first := capture("abcdef")
+	second := capture("ghijkl")
+	if _, ok := cs.Get(first); ok {
+		t.Error("oldest capture should be evicted to stay in budget")
+	}
+	if c, ok := cs.Get(second); !ok || string(c.Request.preview) != "ghijkl" {
+		t.Errorf("newest capture = %+v, %v", c, ok)
+	}
+
+	// A body larger than the whole budget is kept without its bytes
+	large := capture("0123456789abc")
+	if c, ok := cs.Get(large); !ok || c.Request.preview != nil || !c.Request.Truncated {
+		t.Errorf("capture over the budget = %+v, %v", c, ok)
+	}
+	if stats := budget.Stats(); stats.Used != 0 || stats.Components["captures"].Evictions < 2 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestAbuseTracker_MemoryBudget(t *testing.T) {
+	at := NewAbuseTracker()
+	defer at.Stop()
+	budget := NewMemoryBudget(2 * config.AbuseEntryMemory)
+	at.SetMemoryBudget(budget)
+
+	for i := range 5 {
+		at.CheckConnectionRate(fmt.Sprintf("192.0.2.%d", i))
+	}
+	at.mu.RLock()
+	tracked := len(at.connectionTimes)
+	at.mu.RUnlock()
+	if tracked != 2 {
+		t.Errorf("tracking %d IPs, want 2 within the budget", tracked)
+	}
+	if stats := budget.Stats(); stats.Used != 2*config.AbuseEntryMemory || stats.Components["abuse"].Evictions != 3 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestVisitorLimiter_MemoryBudget(t *testing.T) {
+	vl := NewVisitorLimiter()
+	defer vl.Stop()
+	vl.SetMemoryBudget(NewMemoryBudget(config.AbuseEntryMemory))
+
+	vl.Allow("198.51.100.1", "happy-tiger-abcdef01")
+	vl.Allow("198.51.100.2", "happy-tiger-abcdef01")
+	vl.mu.Lock()
+	_, first := vl.visitors[visitorKey{"198.51.100.1", "happy-tiger-abcdef01"}]
+	_, second := vl.visitors[visitorKey{"198.51.100.2", "happy-tiger-abcdef01"}]
+	vl.mu.Unlock()
+	if first || !second {
+		t.Errorf("visitors tracked: first %v, second %v; want only the second", first, second)
+	}
+}
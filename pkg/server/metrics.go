@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Directions of relayed traffic in the proxy metrics
+const (
+	directionIn  = 0 // from visitors to the local server
+	directionOut = 1 // from the local server to visitors
+)
+
+var directionNames = [2]string{"in", "out"}
+
+// sizeBuckets are the upper bounds of the size histograms, in bytes
+var sizeBuckets = [...]int64{
+	256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10,
+	1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30,
+}
+
+// sizeHistogram counts observed sizes per bucket of sizeBuckets; the
+// extra last bucket holds sizes beyond them
+type sizeHistogram struct {
+	buckets [len(sizeBuckets) + 1]atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Uint64
+}
+
+func (h *sizeHistogram) observe(n int64) {
+	i := 0
+	for i < len(sizeBuckets) && n > sizeBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(uint64(n))
+}
+
+// trafficMetrics are the byte counters and size histograms of one protocol,
+// indexed by direction
+type trafficMetrics struct {
+	bytes [2]atomic.Uint64
+	sizes [2]sizeHistogram
+}
+
+func (t *trafficMetrics) observe(in, out int64) {
+	t.bytes[directionIn].Add(uint64(in))
+	t.bytes[directionOut].Add(uint64(out))
+	t.sizes[directionIn].observe(in)
+	t.sizes[directionOut].observe(out)
+}
+
+// ProxyMetrics counts the bytes relayed by the HTTP proxy and the WebSocket
+// relay. HTTP sizes are per request and response body, WebSocket sizes per
+// connection and direction.
+type ProxyMetrics struct {
+	http      trafficMetrics
+	websocket trafficMetrics
+}
+
+// ObserveHTTP records a proxied request's body and response body sizes
+func (m *ProxyMetrics) ObserveHTTP(in, out int64) {
+	m.http.observe(in, out)
+}
+
+// ObserveWebSocket records the bytes a WebSocket connection relayed each way
+func (m *ProxyMetrics) ObserveWebSocket(in, out int64) {
+	m.websocket.observe(in, out)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func (m *ProxyMetrics) WritePrometheus(w io.Writer) {
+	protocols := []struct {
+		name string
+		t    *trafficMetrics
+	}{{"http", &m.http}, {"websocket", &m.websocket}}
+
+	fmt.Fprintln(w, "# HELP tunnl_proxy_bytes_total Bytes relayed between visitors and local servers.")
+	fmt.Fprintln(w, "# TYPE tunnl_proxy_bytes_total counter")
+	for _, p := range protocols {
+		for dir, name := range directionNames {
+			fmt.Fprintf(w, "tunnl_proxy_bytes_total{protocol=%q,direction=%q} %d\n", p.name, name, p.t.bytes[dir].Load())
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP tunnl_proxy_transfer_size_bytes Size of HTTP bodies and of WebSocket connections' traffic.")
+	fmt.Fprintln(w, "# TYPE tunnl_proxy_transfer_size_bytes histogram")
+	for _, p := range protocols {
+		for dir, name := range directionNames {
+			h := &p.t.sizes[dir]
+			labels := fmt.Sprintf("protocol=%q,direction=%q", p.name, name)
+			var cumulative uint64
+			for i, le := range sizeBuckets {
+				cumulative += h.buckets[i].Load()
+				fmt.Fprintf(w, "tunnl_proxy_transfer_size_bytes_bucket{%s,le=\"%d\"} %d\n", labels, le, cumulative)
+			}
+			// Observations racing with this read may leave count behind
+			// the buckets; the +Inf bucket must not be below the others
+			count := max(h.count.Load(), cumulative)
+			fmt.Fprintf(w, "tunnl_proxy_transfer_size_bytes_bucket{%s,le=\"+Inf\"} %d\n", labels, count)
+			fmt.Fprintf(w, "tunnl_proxy_transfer_size_bytes_sum{%s} %d\n", labels, h.sum.Load())
+			fmt.Fprintf(w, "tunnl_proxy_transfer_size_bytes_count{%s} %d\n", labels, count)
+		}
+	}
+}
+
+// metricsHandler serves GET /metrics for Prometheus
+func (s *Server) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.proxyMetrics.WritePrometheus(w)
+	})
+}
+
+// countingReadCloser counts the bytes read from a body
+type countingReadCloser struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// bytesRead returns how many bytes were read so far
+func (c *countingReadCloser) bytesRead() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.n.Load()
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyMetrics_WritePrometheus(t *testing.T) {
+	var m ProxyMetrics
+	m.ObserveHTTP(0, 100)
+	m.ObserveHTTP(2000, 5000)
+	m.ObserveWebSocket(300, 2<<30)
+
+	var b strings.Builder
+	m.WritePrometheus(&b)
+	out := b.String()
+	for _, want := range []string{
+		`tunnl_proxy_bytes_total{protocol="http",direction="in"} 2000`,
+		`tunnl_proxy_bytes_total{protocol="http",direction="out"} 5100`,
+		`tunnl_proxy_transfer_size_bytes_bucket{protocol="http",direction="out",le="256"} 1`,
+		`tunnl_proxy_transfer_size_bytes_bucket{protocol="http",direction="out",le="4096"} 1`,
+		`tunnl_proxy_transfer_size_bytes_bucket{protocol="http",direction="out",le="16384"} 2`,
+		`tunnl_proxy_transfer_size_bytes_count{protocol="http",direction="out"} 2`,
+		`tunnl_proxy_transfer_size_bytes_bucket{protocol="websocket",direction="out",le="1073741824"} 0`,
+		`tunnl_proxy_transfer_size_bytes_bucket{protocol="websocket",direction="out",le="+Inf"} 1`,
+		`tunnl_proxy_transfer_size_bytes_sum{protocol="websocket",direction="in"} 300`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestServeHTTP_ProxyMetrics(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "hello")
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	r := httptest.NewRequest("POST", "https://"+sub+"."+s.domain+"/", strings.NewReader("abc"))
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.RemoteAddr = "127.0.0.1:1"
+	w := httptest.NewRecorder()
+	s.StatsHandler().ServeHTTP(w, req)
+	for _, want := range []string{
+		`tunnl_proxy_bytes_total{protocol="http",direction="in"} 3`,
+		`tunnl_proxy_bytes_total{protocol="http",direction="out"} 5`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("/metrics missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+// MigrationHint tells a client of a clustered server that is shutting down
+// where and when to reconnect. It is written to the session as one JSON line
+// before the session ends with MigrationExitStatus.
+type MigrationHint struct {
+	Event          string `json:"event"` // always "shutdown"
+	Subdomain      string `json:"subdomain"`
+	Node           string `json:"node,omitempty"` // SSH address of another server of the cluster
+	ReconnectAfter int    `json:"reconnect_after"`
+	Resume         string `json:"resume,omitempty"` // username that resumes the subdomain
+}
+
+// migrationSession delivers a hint to one connected session and ends it
+type migrationSession func(hint MigrationHint)
+
+// registerMigration tracks a session that is sent a hint on shutdown, and
+// returns the function removing it again
+func (s *Server) registerMigration(tun *tunnel.Tunnel, send migrationSession) func() {
+	s.migrationMu.Lock()
+	s.migrationSessions[tun] = send
+	s.migrationMu.Unlock()
+	return func() {
+		s.migrationMu.Lock()
+		delete(s.migrationSessions, tun)
+		s.migrationMu.Unlock()
+	}
+}
+
+// SendMigrationHints tells every client of a clustered server where and when
+// to reconnect and ends their sessions, waiting up to MigrationHintTimeout
+// for the hints to be written. Clients resume their subdomains through the
+// shared reservations; reconnects are spread over MigrationReconnectSpread
+// so the other servers are not hit all at once. Servers without
+// STORAGE_URL send no hints.
+func (s *Server) SendMigrationHints() {
+	if !s.clustered {
+		return
+	}
+	s.migrationMu.Lock()
+	sessions := make(map[*tunnel.Tunnel]migrationSession, len(s.migrationSessions))
+	for tun, send := range s.migrationSessions {
+		sessions[tun] = send
+	}
+	s.migrationMu.Unlock()
+	if len(sessions) == 0 {
+		return
+	}
+
+	log.Printf("Sending migration hints to %d sessions", len(sessions))
+	var wg sync.WaitGroup
+	i := 0
+	for tun, send := range sessions {
+		hint := MigrationHint{
+			Event:          "shutdown",
+			Subdomain:      tun.Subdomain,
+			ReconnectAfter: 1 + rand.IntN(int(config.MigrationReconnectSpread.Seconds())),
+		}
+		if len(s.migrationNodes) > 0 {
+			hint.Node = s.migrationNodes[i%len(s.migrationNodes)]
+		}
+		i++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(hint)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(config.MigrationHintTimeout):
+		log.Printf("Timed out sending migration hints")
+	}
+}
+
+// writeMigrationHint writes a hint to a session as a notice for people and a
+// JSON line for automated clients, then ends the session with
+// MigrationExitStatus
+func writeMigrationHint(ch ssh.Channel, logger *tunnel.RequestLogger, hint MigrationHint) {
+	notice := fmt.Sprintf("Server shutting down; reconnect in %ds", hint.ReconnectAfter)
+	if hint.Node != "" {
+		notice += " to " + hint.Node
+	}
+	logger.LogNotice(notice)
+	logger.Close() // flush queued lines before the JSON line
+
+	data, err := json.Marshal(hint)
+	if err == nil {
+		ch.Write(append(data, '\r', '\n'))
+	}
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{config.MigrationExitStatus}))
+	ch.Close()
+}
+
+// normalizeNode adds the default SSH port to a migration node without one
+func normalizeNode(node string) string {
+	if _, _, err := net.SplitHostPort(node); err == nil {
+		return node
+	}
+	return net.JoinHostPort(node, "22")
+}
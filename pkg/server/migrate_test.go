@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+// recordingChannel is an ssh.Channel that records what is written and sent
+type recordingChannel struct {
+	bytes.Buffer
+	requests []string
+	closed   bool
+}
+
+func (c *recordingChannel) Read([]byte) (int, error) { return 0, io.EOF }
+func (c *recordingChannel) Close() error             { c.closed = true; return nil }
+func (c *recordingChannel) CloseWrite() error        { return nil }
+func (c *recordingChannel) Stderr() io.ReadWriter    { return &c.Buffer }
+func (c *recordingChannel) SendRequest(name string, _ bool, _ []byte) (bool, error) {
+	c.requests = append(c.requests, name)
+	return true, nil
+}
+
+func TestSendMigrationHints(t *testing.T) {
+	s := newTestServer(t)
+	var mu sync.Mutex
+	var hints []MigrationHint
+	for _, sub := range []string{"happy-tiger-abcdef01", "brave-lion-abcdef02"} {
+		tun := s.RegisterTunnel(sub, "", 0, newTestListener(t), "", 80, "1.2.3.4")
+		s.registerMigration(tun, func(hint MigrationHint) {
+			mu.Lock()
+			hints = append(hints, hint)
+			mu.Unlock()
+		})
+	}
+
+	// Only clustered servers send hints
+	s.SendMigrationHints()
+	if len(hints) != 0 {
+		t.Fatalf("standalone server sent hints: %+v", hints)
+	}
+
+	s.clustered = true
+	s.migrationNodes = []string{normalizeNode("node2.example.com"), normalizeNode("[2001:db8::2]:2222")}
+	s.SendMigrationHints()
+	if len(hints) != 2 {
+		t.Fatalf("sent %d hints, want 2", len(hints))
+	}
+	nodes := map[string]bool{}
+	for _, hint := range hints {
+		nodes[hint.Node] = true
+		if hint.Event != "shutdown" || hint.ReconnectAfter < 1 || hint.ReconnectAfter > int(config.MigrationReconnectSpread.Seconds()) {
+			t.Errorf("hint = %+v", hint)
+		}
+	}
+	if !nodes["node2.example.com:22"] || !nodes["[2001:db8::2]:2222"] {
+		t.Errorf("hints should be spread over the nodes, got %v", nodes)
+	}
+}
+
+func TestWriteMigrationHint(t *testing.T) {
+	ch := &recordingChannel{}
+	logger := tunnel.NewRequestLogger(ch, 16)
+	writeMigrationHint(ch, logger, MigrationHint{
+		Event: "shutdown", Subdomain: "happy-tiger-abcdef01", Node: "node2.example.com:22",
+		ReconnectAfter: 3, Resume: "happy-tiger-abcdef01+token",
+	})
+
+	lines := strings.Split(strings.TrimSpace(ch.String()), "\r\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "reconnect in 3s to node2.example.com:22") {
+		t.Fatalf("output = %q", ch.String())
+	}
+	var hint MigrationHint
+	if err := json.Unmarshal([]byte(lines[1]), &hint); err != nil || hint.Resume != "happy-tiger-abcdef01+token" {
+		t.Errorf("JSON line %q = %+v, %v", lines[1], hint, err)
+	}
+	if len(ch.requests) != 1 || ch.requests[0] != "exit-status" || !ch.closed {
+		t.Errorf("requests = %v, closed %v", ch.requests, ch.closed)
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// sshPrefix starts the version banner every SSH client sends first (RFC 4253)
+var sshPrefix = []byte("SSH-")
+
+// recordTypeHandshake is the first byte of a TLS ClientHello
+const recordTypeHandshake = 0x16
+
+// errHelloRead stops the handshake peekClientHello runs to read a ClientHello
+var errHelloRead = errors.New("ClientHello read")
+
+// MuxOptions are the protocols an HTTPS listener wrapped by Mux serves
+// besides HTTPS
+type MuxOptions struct {
+	SSH bool // SSH clients, told apart by their banner
+
+	// ALPN maps protocols TLS clients may offer instead of HTTP to handlers
+	// that get the connection once TLSConfig, the HTTPS server's, has
+	// completed its handshake
+	ALPN      map[string]func(*tls.Conn)
+	TLSConfig *tls.Config
+}
+
+// muxListener is an HTTPS listener that serves other protocols on the same
+// port. It hands connections that start with an SSH banner to the SSH
+// server and TLS handshakes offering one of its ALPN protocols to that
+// protocol's handler, and returns the others from Accept.
+type muxListener struct {
+	net.Listener
+	handleSSH func(net.Conn) // nil unless SSH is multiplexed
+	alpn      map[string]func(*tls.Conn)
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Mux wraps an HTTPS listener so that SSH clients and TLS clients of other
+// protocols can connect to it too. Each connection's first bytes are read
+// in its own goroutine, so a slow client holds up no others.
+func (s *Server) Mux(ln net.Listener, opts MuxOptions) net.Listener {
+	var handleSSH func(net.Conn)
+	if opts.SSH {
+		handleSSH = s.HandleSSHConnection
+	}
+	return newMuxListener(ln, handleSSH, opts.ALPN, opts.TLSConfig, config.MuxSniffTimeout)
+}
+
+// HandleAgentConnection serves a native agent that negotiated
+// config.AgentProtocol on the HTTPS port, with the same checks as an SSH
+// client: the protocol's first version is SSH inside the TLS session
+func (s *Server) HandleAgentConnection(conn *tls.Conn) {
+	s.HandleSSHConnection(conn)
+}
+
+// newMuxListener starts accepting on ln, waiting up to timeout for a
+// connection's first bytes
+func newMuxListener(ln net.Listener, handleSSH func(net.Conn), alpn map[string]func(*tls.Conn), tlsConfig *tls.Config, timeout time.Duration) *muxListener {
+	m := &muxListener{
+		Listener:  ln,
+		handleSSH: handleSSH,
+		alpn:      alpn,
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan struct{}),
+	}
+	go m.acceptLoop()
+	return m
+}
+
+// acceptLoop accepts connections on the wrapped listener until it is closed
+func (m *muxListener) acceptLoop() {
+	for {
+		conn, err := m.Listener.Accept()
+		if err != nil {
+			// The HTTPS server backs off from temporary errors itself
+			select {
+			case m.errs <- err:
+			case <-m.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go m.route(conn)
+	}
+}
+
+// route sends conn to the SSH server, an ALPN protocol's handler or the
+// HTTPS server, by its first bytes
+func (m *muxListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(m.timeout))
+	r := bufio.NewReaderSize(conn, sniffLen)
+	head, err := r.Peek(len(sshPrefix))
+	var replay net.Conn = &sniffedConn{Conn: conn, r: r}
+
+	var netErr net.Error
+	silent := errors.As(err, &netErr) && netErr.Timeout()
+	switch {
+	case m.handleSSH != nil && (bytes.Equal(head, sshPrefix) || silent && bytes.HasPrefix(sshPrefix, head)):
+		// Clients that stay silent wait for the SSH server's banner
+		conn.SetReadDeadline(time.Time{})
+		m.handleSSH(replay)
+		return
+	case len(head) == 0 && !silent:
+		conn.Close() // closed before sending anything
+		return
+	}
+
+	if len(m.alpn) > 0 && len(head) > 0 && head[0] == recordTypeHandshake {
+		var protos []string
+		protos, replay = peekClientHello(replay)
+		for _, proto := range protos {
+			if handle, ok := m.alpn[proto]; ok {
+				m.serveALPN(replay, proto, handle)
+				return
+			}
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	select {
+	case m.conns <- replay:
+	case <-m.done:
+		conn.Close()
+	}
+}
+
+// serveALPN completes the TLS handshake of a client that offered proto and
+// hands the connection to proto's handler
+func (m *muxListener) serveALPN(conn net.Conn, proto string, handle func(*tls.Conn)) {
+	cfg := m.tlsConfig.Clone()
+	cfg.NextProtos = []string{proto}
+	tlsConn := tls.Server(conn, cfg)
+	conn.SetDeadline(time.Now().Add(config.SSHHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("TLS handshake for %s from %s failed: %v", proto, addrIP(conn.RemoteAddr()), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	handle(tlsConn)
+}
+
+// peekClientHello reads the ALPN protocols a TLS client offers, in its
+// order of preference. The returned connection replays what was read.
+func peekClientHello(conn net.Conn) ([]string, net.Conn) {
+	var read bytes.Buffer
+	var protos []string
+	// crypto/tls parses the ClientHello; its answer is discarded
+	probe := tls.Server(&probeConn{Conn: conn, r: io.TeeReader(conn, &read)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			protos = hello.SupportedProtos
+			return nil, errHelloRead
+		},
+	})
+	probe.Handshake()
+	return protos, &sniffedConn{Conn: conn, r: io.MultiReader(&read, conn)}
+}
+
+// probeConn reads a connection through r and drops what is written to it
+type probeConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *probeConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *probeConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (m *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *muxListener) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+	return m.Listener.Close()
+}
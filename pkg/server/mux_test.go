@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestMux returns a mux listener on a free local port whose SSH
+// connections, if ssh is set, arrive on the returned channel
+func newTestMux(t *testing.T, ssh bool, alpn map[string]func(*tls.Conn), timeout time.Duration) (*muxListener, chan net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 1)
+	var handleSSH func(net.Conn)
+	if ssh {
+		handleSSH = func(conn net.Conn) { conns <- conn }
+	}
+	m := newMuxListener(ln, handleSSH, alpn, testTLSConfig(t), timeout)
+	t.Cleanup(func() { m.Close() })
+	return m, conns
+}
+
+// testTLSConfig returns a server configuration with a self-signed certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+}
+
+// readPrefix reads len(want) bytes from conn and fails the test unless they are want
+func readPrefix(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != want {
+		t.Errorf("read %q (%v), want %q replayed", got, err, want)
+	}
+}
+
+func TestMux_RoutesSSHByFirstBytes(t *testing.T) {
+	m, ssh := newTestMux(t, true, nil, 5*time.Second)
+
+	sshClient, err := net.Dial("tcp", m.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshClient.Close()
+	io.WriteString(sshClient, "SSH-2.0-OpenSSH_9.6\r\n")
+
+	tlsClient, err := net.Dial("tcp", m.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsClient.Close()
+	tlsClient.Write([]byte{0x16, 0x03, 0x01, 0x02, 0x00})
+
+	select {
+	case conn := <-ssh:
+		readPrefix(t, conn, "SSH-2.0-OpenSSH_9.6\r\n")
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("SSH client not handed to the SSH server")
+	}
+
+	conn, err := m.Accept()
+	if err != nil {
+		t.Fatalf("Accept() = %v, want the TLS client", err)
+	}
+	readPrefix(t, conn, "\x16\x03\x01\x02\x00")
+	conn.Close()
+}
+
+func TestMux_SilentClientIsSSH(t *testing.T) {
+	m, ssh := newTestMux(t, true, nil, 50*time.Millisecond)
+
+	client, err := net.Dial("tcp", m.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	select {
+	case conn := <-ssh:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent client not handed to the SSH server")
+	}
+}
+
+func TestMux_RoutesByALPN(t *testing.T) {
+	agents := make(chan *tls.Conn, 1)
+	m, _ := newTestMux(t, false, map[string]func(*tls.Conn){
+		"tunnl/1": func(conn *tls.Conn) { agents <- conn },
+	}, 5*time.Second)
+	dial := func(protos ...string) *tls.Conn {
+		conn, err := tls.Dial("tcp", m.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+		if err != nil {
+			t.Fatalf("dial with ALPN %v: %v", protos, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	// The HTTPS server completes the handshake of the others, from the
+	// replayed ClientHello
+	go func() {
+		conn, err := m.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := tls.Server(conn, m.tlsConfig)
+		if tlsConn.Handshake() == nil {
+			io.WriteString(tlsConn, "https")
+		}
+	}()
+	https := dial("h2", "http/1.1")
+	if proto := https.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Errorf("HTTPS client negotiated %q, want h2", proto)
+	}
+	readPrefix(t, https, "https")
+
+	agent := dial("h2", "tunnl/1")
+	if proto := agent.ConnectionState().NegotiatedProtocol; proto != "tunnl/1" {
+		t.Errorf("agent negotiated %q, want tunnl/1", proto)
+	}
+	select {
+	case conn := <-agents:
+		io.WriteString(agent, "agent")
+		readPrefix(t, conn, "agent")
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent not handed to its protocol's handler")
+	}
+}
+
+func TestMux_SSHNotMultiplexed(t *testing.T) {
+	m, _ := newTestMux(t, false, map[string]func(*tls.Conn){"tunnl/1": func(*tls.Conn) {}}, time.Second)
+
+	client, err := net.Dial("tcp", m.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	io.WriteString(client, "SSH-2.0-OpenSSH_9.6\r\n")
+
+	conn, err := m.Accept()
+	if err != nil {
+		t.Fatalf("Accept() = %v, want the SSH client for the HTTPS server", err)
+	}
+	readPrefix(t, conn, "SSH-2.0")
+	conn.Close()
+}
+
+func TestMux_Close(t *testing.T) {
+	m, _ := newTestMux(t, true, nil, time.Second)
+	m.Close()
+	if _, err := m.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() after Close = %v, want net.ErrClosed", err)
+	}
+}
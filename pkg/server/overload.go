@@ -0,0 +1,261 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// clockTicks is the unit of the CPU times in /proc/<pid>/stat (USER_HZ)
+const clockTicks = 100
+
+// LoadSample is the server-wide load measured over one check interval
+type LoadSample struct {
+	AcceptsPerSecond float64 `json:"accepts_per_second"` // all listeners
+	InFlightRequests int64   `json:"in_flight_requests"`
+	CPUPercent       float64 `json:"cpu_percent"` // of all CPUs, -1 if unknown
+}
+
+// OverloadStats is the state of emergency throttling
+type OverloadStats struct {
+	Throttled       bool       `json:"throttled"`
+	Since           time.Time  `json:"since,omitzero"`    // when the current throttling began
+	Reasons         []string   `json:"reasons,omitempty"` // thresholds the load is over
+	ThrottlePercent int        `json:"throttle_percent"`  // of the rate limits left (100 = not throttled)
+	Activations     uint64     `json:"activations"`
+	Load            LoadSample `json:"load"`
+}
+
+// OverloadDetector decides from load samples when the server is overloaded.
+// Throttling starts as soon as a sample is over any threshold and ends once
+// samples have stayed under all of them for the calm period, so limits do
+// not flap with load hovering at a threshold.
+type OverloadDetector struct {
+	acceptsPerSecond float64 // 0 = not checked
+	inFlightRequests int64   // 0 = not checked
+	cpuPercent       float64 // 0 = not checked
+	calmPeriod       time.Duration
+
+	mu          sync.Mutex
+	active      bool
+	since       time.Time
+	calmSince   time.Time // first calm sample while active (zero = none yet)
+	reasons     []string
+	load        LoadSample
+	activations uint64
+}
+
+// NewOverloadDetector creates a detector with the given thresholds (0
+// disables each)
+func NewOverloadDetector(acceptsPerSecond, inFlightRequests, cpuPercent int) *OverloadDetector {
+	return &OverloadDetector{
+		acceptsPerSecond: float64(acceptsPerSecond),
+		inFlightRequests: int64(inFlightRequests),
+		cpuPercent:       float64(cpuPercent),
+		calmPeriod:       config.OverloadCalmPeriod,
+		load:             LoadSample{CPUPercent: -1},
+	}
+}
+
+// Enabled reports whether any threshold is set
+func (d *OverloadDetector) Enabled() bool {
+	return d.acceptsPerSecond > 0 || d.inFlightRequests > 0 || d.cpuPercent > 0
+}
+
+// Update records a sample taken at now, returning true if the server became
+// overloaded or calm again
+func (d *OverloadDetector) Update(sample LoadSample, now time.Time) bool {
+	var reasons []string
+	if d.acceptsPerSecond > 0 && sample.AcceptsPerSecond >= d.acceptsPerSecond {
+		reasons = append(reasons, fmt.Sprintf("accepts %.0f/s >= %.0f/s", sample.AcceptsPerSecond, d.acceptsPerSecond))
+	}
+	if d.inFlightRequests > 0 && sample.InFlightRequests >= d.inFlightRequests {
+		reasons = append(reasons, fmt.Sprintf("in-flight requests %d >= %d", sample.InFlightRequests, d.inFlightRequests))
+	}
+	if d.cpuPercent > 0 && sample.CPUPercent >= d.cpuPercent {
+		reasons = append(reasons, fmt.Sprintf("CPU %.0f%% >= %.0f%%", sample.CPUPercent, d.cpuPercent))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.load = sample
+	if len(reasons) > 0 {
+		d.reasons = reasons
+		d.calmSince = time.Time{}
+		if !d.active {
+			d.active, d.since = true, now
+			d.activations++
+			return true
+		}
+		return false
+	}
+	if !d.active {
+		return false
+	}
+	if d.calmSince.IsZero() {
+		d.calmSince = now
+	}
+	if now.Sub(d.calmSince) < d.calmPeriod {
+		return false
+	}
+	d.active, d.since, d.calmSince, d.reasons = false, time.Time{}, time.Time{}, nil
+	return true
+}
+
+// Active reports whether the server is overloaded
+func (d *OverloadDetector) Active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+// Reasons returns the thresholds the last overloaded sample was over
+func (d *OverloadDetector) Reasons() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reasons
+}
+
+// Stats returns the throttling state and the last load sample
+func (d *OverloadDetector) Stats() OverloadStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := OverloadStats{
+		Throttled:       d.active,
+		Since:           d.since,
+		Reasons:         d.reasons,
+		ThrottlePercent: 100,
+		Activations:     d.activations,
+		Load:            d.load,
+	}
+	if d.active {
+		stats.ThrottlePercent = config.EmergencyThrottlePercent
+	}
+	return stats
+}
+
+// loadSampler turns the server's cumulative counters into rates between
+// two samples
+type loadSampler struct {
+	at      time.Time
+	accepts uint64
+	cpu     time.Duration // -1 if unknown
+}
+
+// startOverloadWatch checks the server's load every OverloadCheckInterval
+// and throttles rate limits while it is overloaded
+func (s *Server) startOverloadWatch() {
+	s.stopOverload = make(chan struct{})
+	s.overloadDone = make(chan struct{})
+	go func() {
+		defer close(s.overloadDone)
+		ticker := time.NewTicker(config.OverloadCheckInterval)
+		defer ticker.Stop()
+
+		prev := s.loadCounters(time.Now())
+		for {
+			select {
+			case <-s.stopOverload:
+				return
+			case now := <-ticker.C:
+				cur := s.loadCounters(now)
+				s.checkLoad(loadSample(prev, cur, s.inFlightRequests.Load()), now)
+				prev = cur
+			}
+		}
+	}()
+}
+
+// stopOverloadWatch stops the load checks started by startOverloadWatch
+func (s *Server) stopOverloadWatch() {
+	if s.stopOverload == nil {
+		return
+	}
+	close(s.stopOverload)
+	<-s.overloadDone
+}
+
+// checkLoad feeds a sample to the detector and throttles or relaxes the
+// rate limits when the server becomes overloaded or calm again
+func (s *Server) checkLoad(sample LoadSample, now time.Time) {
+	if !s.overload.Update(sample, now) {
+		return
+	}
+	if s.overload.Active() {
+		log.Printf("Server overloaded (%s): cutting rate limits to %d%%", strings.Join(s.overload.Reasons(), ", "), config.EmergencyThrottlePercent)
+		s.setThrottle(config.EmergencyThrottlePercent)
+	} else {
+		log.Printf("Server load back to normal: restoring rate limits")
+		s.setThrottle(0)
+	}
+}
+
+// setThrottle cuts the limits of every tunnel and visitor to percent (0
+// lifts the cut). Tunnels registered later pick it up in RegisterTunnel.
+func (s *Server) setThrottle(percent int) {
+	s.throttle.Store(int32(percent))
+	s.visitorLimiter.SetThrottle(percent)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, pool := range s.pools {
+		for _, t := range pool.Tunnels() {
+			t.SetThrottle(percent)
+		}
+	}
+}
+
+// loadCounters reads the cumulative counters load samples are computed from
+func (s *Server) loadCounters(now time.Time) loadSampler {
+	c := loadSampler{at: now, cpu: processCPUTime()}
+	for _, a := range s.accepts {
+		c.accepts += a.Stats().Total
+	}
+	return c
+}
+
+// loadSample computes the load between two readings of the counters
+func loadSample(prev, cur loadSampler, inFlight int64) LoadSample {
+	sample := LoadSample{InFlightRequests: inFlight, CPUPercent: -1}
+	elapsed := cur.at.Sub(prev.at)
+	if elapsed <= 0 {
+		return sample
+	}
+	sample.AcceptsPerSecond = float64(cur.accepts-prev.accepts) / elapsed.Seconds()
+	if prev.cpu >= 0 && cur.cpu >= 0 {
+		sample.CPUPercent = 100 * float64(cur.cpu-prev.cpu) / float64(elapsed) / float64(runtime.NumCPU())
+	}
+	return sample
+}
+
+// processCPUTime reads the CPU time the process has used from /proc, or
+// returns -1 where it is not available
+func processCPUTime() time.Duration {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return -1
+	}
+	// The command name in parentheses may contain spaces; utime and stime
+	// are the 12th and 13th fields after it
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return -1
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 13 {
+		return -1
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return -1
+	}
+	return time.Duration(utime+stime) * time.Second / clockTicks
+}
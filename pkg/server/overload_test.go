@@ -0,0 +1,144 @@
+package server
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestOverloadDetector(t *testing.T) {
+	d := NewOverloadDetector(100, 50, 90)
+	now := time.Unix(1700000000, 0)
+	calm := LoadSample{AcceptsPerSecond: 10, InFlightRequests: 5, CPUPercent: 20}
+
+	if d.Update(calm, now) || d.Active() {
+		t.Fatal("calm load should not throttle")
+	}
+
+	// Any one threshold is enough
+	busy := LoadSample{AcceptsPerSecond: 10, InFlightRequests: 60, CPUPercent: 20}
+	if !d.Update(busy, now) || !d.Active() {
+		t.Fatal("in-flight requests over the threshold should throttle")
+	}
+	if reasons := d.Reasons(); len(reasons) != 1 {
+		t.Errorf("Reasons() = %v, want the in-flight requests", reasons)
+	}
+	if d.Update(busy, now.Add(5*time.Second)) {
+		t.Error("staying overloaded should not report a change")
+	}
+
+	// Throttling lasts until the load has stayed calm for the calm period,
+	// starting over whenever it comes back
+	now = now.Add(10 * time.Second)
+	if d.Update(calm, now) || !d.Active() {
+		t.Fatal("throttling ended on the first calm sample")
+	}
+	d.Update(busy, now.Add(5*time.Second))
+	now = now.Add(10 * time.Second)
+	d.Update(calm, now)
+	if d.Update(calm, now.Add(config.OverloadCalmPeriod-time.Second)) {
+		t.Fatal("throttling ended before the calm period")
+	}
+	if !d.Update(calm, now.Add(config.OverloadCalmPeriod)) || d.Active() {
+		t.Fatal("throttling should end after the calm period")
+	}
+
+	stats := d.Stats()
+	if stats.Throttled || stats.ThrottlePercent != 100 || stats.Activations != 1 || stats.Reasons != nil {
+		t.Errorf("Stats() = %+v, want calm after one activation", stats)
+	}
+}
+
+func TestOverloadDetector_Disabled(t *testing.T) {
+	d := NewOverloadDetector(0, 0, 0)
+	if d.Enabled() {
+		t.Error("Enabled() = true without thresholds")
+	}
+	if d.Update(LoadSample{AcceptsPerSecond: 1e6, InFlightRequests: 1e6, CPUPercent: 100}, time.Now()) {
+		t.Error("a detector without thresholds should never throttle")
+	}
+}
+
+func TestLoadSample(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	prev := loadSampler{at: at, accepts: 100, cpu: time.Second}
+	cur := loadSampler{at: at.Add(2 * time.Second), accepts: 300, cpu: time.Second + time.Duration(runtime.NumCPU())*time.Second}
+
+	sample := loadSample(prev, cur, 7)
+	if sample.AcceptsPerSecond != 100 || sample.InFlightRequests != 7 {
+		t.Errorf("sample = %+v, want 100 accepts/s and 7 in flight", sample)
+	}
+	// One second of every CPU over two seconds
+	if sample.CPUPercent != 50 {
+		t.Errorf("CPUPercent = %v, want 50", sample.CPUPercent)
+	}
+
+	cur.cpu = -1
+	if sample := loadSample(prev, cur, 0); sample.CPUPercent != -1 {
+		t.Errorf("CPUPercent = %v without CPU times, want -1", sample.CPUPercent)
+	}
+}
+
+func TestProcessCPUTime(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reads /proc")
+	}
+	if d := processCPUTime(); d < 0 {
+		t.Errorf("processCPUTime() = %v, want the process's CPU time", d)
+	}
+}
+
+func TestCheckLoad_ThrottlesLimits(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	tun := s.RegisterTunnel(sub, "", 0, newTestListener(t), "", 80, "1.2.3.4")
+	now := time.Now()
+
+	s.checkLoad(LoadSample{InFlightRequests: int64(config.DefaultOverloadInFlightRequests)}, now)
+	if stats := s.GetStats(false, false).Overload; !stats.Throttled || stats.ThrottlePercent != config.EmergencyThrottlePercent {
+		t.Fatalf("overload stats = %+v, want throttled", stats)
+	}
+
+	// The tunnel's burst of 20 is cut to 5, and so is that of tunnels opened later
+	later := s.RegisterTunnel("calm-eagle-12345678", "", 0, newTestListener(t), "", 80, "5.6.7.8")
+	want := config.BurstSize * config.EmergencyThrottlePercent / 100
+	if got := countAllowed(tun.AllowRequest, config.BurstSize); got != want {
+		t.Errorf("existing tunnel: %d requests allowed, want a throttled burst of %d", got, want)
+	}
+	if got := countAllowed(later.AllowRequest, config.BurstSize); got != want {
+		t.Errorf("later tunnel: %d requests allowed, want a throttled burst of %d", got, want)
+	}
+
+	// Visitors get a burst of 2 instead of 10
+	visitor := func() bool { return s.visitorLimiter.Allow("9.9.9.9", sub) }
+	if got, want := countAllowed(visitor, config.VisitorBurstSize), config.VisitorBurstSize*config.EmergencyThrottlePercent/100; got != want {
+		t.Errorf("visitor: %d requests allowed, want a throttled burst of %d", got, want)
+	}
+
+	// Limits are restored once the load stays calm
+	s.checkLoad(LoadSample{}, now.Add(time.Second))
+	s.checkLoad(LoadSample{}, now.Add(time.Second+config.OverloadCalmPeriod))
+	if s.GetStats(false, false).Overload.Throttled {
+		t.Fatal("still throttled after the calm period")
+	}
+	if rate, burst := tun.RateLimit(), tun.Burst(); rate != config.RequestsPerSecond || burst != config.BurstSize {
+		t.Errorf("configured limits = %d/%d, want the defaults", rate, burst)
+	}
+	fresh := s.RegisterTunnel("brave-otter-12345678", "", 0, newTestListener(t), "", 80, "5.6.7.9")
+	if got := countAllowed(fresh.AllowRequest, config.BurstSize); got != config.BurstSize {
+		t.Errorf("%d requests allowed after throttling ended, want the full burst of %d", got, config.BurstSize)
+	}
+}
+
+// countAllowed calls allow n times and counts the requests it let through
+func countAllowed(allow func() bool, n int) int {
+	allowed := 0
+	for range n {
+		if allow() {
+			allowed++
+		}
+	}
+	return allowed
+}
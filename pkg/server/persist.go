@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"time"
+
+	"tunnl.gg/internal/store"
+	"tunnl.gg/pkg/config"
+)
+
+// openStore opens the persistent store, restores the state saved by the
+// previous run and starts saving it periodically
+func (s *Server) openStore(path string) error {
+	st, err := store.Open(path)
+	if err != nil {
+		return err
+	}
+	s.store = st
+
+	if err := s.restoreState(); err != nil {
+		st.Close()
+		return fmt.Errorf("failed to restore state from %s: %w", path, err)
+	}
+
+	s.stopPersist = make(chan struct{})
+	s.persistDone = make(chan struct{})
+	go s.persistLoop()
+	return nil
+}
+
+// closeStore saves the current state and closes the store
+func (s *Server) closeStore() {
+	close(s.stopPersist)
+	<-s.persistDone
+	if err := s.store.Close(); err != nil {
+		log.Printf("Failed to close store: %v", err)
+	}
+}
+
+// restoreState loads IP blocks and today's bandwidth usage saved by a previous run
+func (s *Server) restoreState() error {
+	now := time.Now()
+	blocks, err := s.store.Blocks(now)
+	if err != nil {
+		return err
+	}
+	s.abuseTracker.RestoreBlocks(blocks)
+
+	day := now.UTC().Format(dayFormat)
+	ipUsage, err := s.store.Usage(store.UsageIP, day)
+	if err != nil {
+		return err
+	}
+	s.bandwidth.Restore(day, ipUsage)
+
+	accountUsage, err := s.store.Usage(store.UsageAccount, day)
+	if err != nil {
+		return err
+	}
+	s.quotas.bandwidth.Restore(day, accountUsage)
+
+	if len(blocks) > 0 || len(ipUsage) > 0 || len(accountUsage) > 0 {
+		log.Printf("Restored %d IP block(s) and bandwidth usage for %d IP(s) and %d account(s)", len(blocks), len(ipUsage), len(accountUsage))
+	}
+	return nil
+}
+
+// saveState writes IP blocks, today's bandwidth usage and the usage counters to the store
+func (s *Server) saveState() {
+	s.flushUsage()
+	day, usage := s.bandwidth.Snapshot()
+	if err := s.store.SaveUsage(store.UsageIP, day, usage); err != nil {
+		log.Printf("Failed to save IP bandwidth usage: %v", err)
+	}
+	day, usage = s.quotas.bandwidth.Snapshot()
+	if err := s.store.SaveUsage(store.UsageAccount, day, usage); err != nil {
+		log.Printf("Failed to save account bandwidth usage: %v", err)
+	}
+	if err := s.store.SaveBlocks(s.abuseTracker.Blocks()); err != nil {
+		log.Printf("Failed to save IP blocks: %v", err)
+	}
+	if err := s.store.Prune(time.Now()); err != nil {
+		log.Printf("Failed to prune store: %v", err)
+	}
+}
+
+// persistLoop saves state every StoreFlushInterval, and once more on stop
+func (s *Server) persistLoop() {
+	defer close(s.persistDone)
+	ticker := time.NewTicker(config.StoreFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopPersist:
+			s.saveState()
+			return
+		case <-ticker.C:
+			s.saveState()
+		}
+	}
+}
+
+// recordUser notes a connection by a named account
+func (s *Server) recordUser(account string) {
+	if s.store == nil || account == "" {
+		return
+	}
+	if err := s.store.TouchUser(account, time.Now()); err != nil {
+		log.Printf("Failed to record user %s: %v", account, err)
+	}
+}
+
+// holdSubdomain reserves a new subdomain for its client, so the join command
+// shown in the banner can resume it after a disconnect or restart
+func (s *Server) holdSubdomain(sub, account, token string) {
+	if s.reservations == nil {
+		return
+	}
+	err := s.reservations.SaveReservation(store.Reservation{
+		Subdomain:   sub,
+		Account:     account,
+		ResumeToken: token,
+		ExpiresAt:   time.Now().Add(config.ResumeWindow),
+	})
+	s.noteRegistry(err)
+	if err != nil {
+		log.Printf("Failed to save reservation for %s: %v", sub, err)
+	}
+}
+
+// releaseSubdomain starts the resume window once a subdomain's last backend is gone
+func (s *Server) releaseSubdomain(sub string) {
+	if s.reservations == nil || s.GetPool(sub) != nil {
+		return
+	}
+	s.extendReservation(sub)
+}
+
+// extendReservation holds a subdomain for ResumeWindow from now
+func (s *Server) extendReservation(sub string) {
+	err := s.reservations.ExtendReservation(sub, time.Now().Add(config.ResumeWindow))
+	s.noteRegistry(err)
+	if err != nil {
+		log.Printf("Failed to extend reservation for %s: %v", sub, err)
+	}
+}
+
+// isHeld reports whether a free subdomain is held for resumption
+func (s *Server) isHeld(sub string) bool {
+	if s.reservations == nil {
+		return false
+	}
+	_, ok, err := s.reservations.Reservation(sub, time.Now())
+	s.noteRegistry(err)
+	if err != nil {
+		log.Printf("Failed to look up reservation for %s: %v", sub, err)
+	}
+	return ok
+}
+
+// canResume reports whether token resumes a held subdomain
+func (s *Server) canResume(sub, token string) bool {
+	if s.reservations == nil {
+		return false
+	}
+	r, ok, err := s.reservations.Reservation(sub, time.Now())
+	s.noteRegistry(err)
+	if err != nil {
+		log.Printf("Failed to look up reservation for %s: %v", sub, err)
+		return false
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(r.ResumeToken), []byte(token)) == 1
+}
+
+// noteRegistry records whether the last reservation lookup or update reached
+// the registry
+func (s *Server) noteRegistry(err error) {
+	s.registryDown.Store(err != nil)
+}
+
+// RegistryAvailable reports whether the subdomain registry answered the last
+// reservation lookup or update
+func (s *Server) RegistryAvailable() bool {
+	return !s.registryDown.Load()
+}
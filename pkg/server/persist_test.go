@@ -0,0 +1,71 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func newStoreTestServer(t *testing.T, path string) *Server {
+	t.Helper()
+	cfg := config.Default()
+	cfg.HostKeyPath = filepath.Join(filepath.Dir(path), "host_key")
+	cfg.StorePath = path
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create test server: %v", err)
+	}
+	return s
+}
+
+func TestStore_RestoresStateAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnl.db")
+
+	s := newStoreTestServer(t, path)
+	s.BlockIP("1.2.3.4")
+	s.bandwidth.Add("5.6.7.8", 1000)
+	s.quotas.Meter(&strings.Builder{}, "alice").Write([]byte("hello"))
+	s.Stop()
+
+	s = newStoreTestServer(t, path)
+	defer s.Stop()
+	if s.abuseTracker.GetBlockExpiry("1.2.3.4").IsZero() {
+		t.Error("IP block should survive a restart")
+	}
+	if got := s.bandwidth.Usage("5.6.7.8"); got != 1000 {
+		t.Errorf("IP bandwidth usage = %d after restart, want 1000", got)
+	}
+	if got := s.quotas.bandwidth.Usage("alice"); got != 5 {
+		t.Errorf("account bandwidth usage = %d after restart, want 5", got)
+	}
+}
+
+func TestStore_ResumeSubdomain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnl.db")
+	s := newStoreTestServer(t, path)
+	defer s.Stop()
+
+	sub := "happy-tiger-abcdef01"
+	s.holdSubdomain(sub, "alice", "secret")
+	tun := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	s.RemoveTunnel(sub, tun)
+	s.releaseSubdomain(sub)
+
+	if _, _, _, ok := s.ResolveJoin(sub + "+wrong"); ok {
+		t.Error("ResolveJoin() should reject a wrong resume token")
+	}
+	got, token, _, ok := s.ResolveJoin(sub + "+secret")
+	if !ok || got != sub || token != "secret" {
+		t.Errorf("ResolveJoin() = %q, %q, %v, want the held subdomain", got, token, ok)
+	}
+	if !s.isHeld(sub) {
+		t.Error("subdomain should be held for resumption")
+	}
+
+	// Without a store there is nothing to resume
+	if _, _, _, ok := newTestServer(t).ResolveJoin(sub + "+secret"); ok {
+		t.Error("servers without a store should not resume subdomains")
+	}
+}
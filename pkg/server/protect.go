@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+var unlockPage = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Passphrase required</title></head>
+<body>
+<h1>This tunnel is protected</h1>
+<p>Enter the passphrase shared by the tunnel owner to continue.</p>
+{{if .Failed}}<p><strong>Incorrect passphrase.</strong></p>{{end}}
+<form method="POST" action="{{.Action}}">
+<input type="hidden" name="next" value="{{.Next}}">
+<input type="password" name="passphrase" autofocus autocomplete="off">
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// passphraseCookieValue signs the subdomain and its current passphrase, so the
+// cookie stops working once the tunnel (and its passphrase) goes away
+func (s *Server) passphraseCookieValue(sub, passphrase string) string {
+	mac := hmac.New(sha256.New, s.cookieKey)
+	mac.Write([]byte(sub + "\x00" + passphrase))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkPassphrase enforces passphrase protection for a subdomain. It returns true
+// if the request may proceed; otherwise it has already written a response.
+func (s *Server) checkPassphrase(w http.ResponseWriter, r *http.Request, sub string, pool *tunnel.Pool) bool {
+	passphrase := pool.Passphrase()
+	if passphrase == "" {
+		return true
+	}
+
+	// Programmatic clients can send the passphrase as a header, which is
+	// stripped so that the secret does not reach the backend
+	h := r.Header.Get(config.PassphraseHeader)
+	r.Header.Del(config.PassphraseHeader)
+	if h != "" && subtle.ConstantTimeCompare([]byte(h), []byte(passphrase)) == 1 {
+		return true
+	}
+
+	cookieName := config.PassphraseCookieName + "_" + sub
+	expected := s.passphraseCookieValue(sub, passphrase)
+	if cookie, err := r.Cookie(cookieName); err == nil &&
+		hmac.Equal([]byte(cookie.Value), []byte(expected)) {
+		return true
+	}
+
+	if r.URL.Path == config.UnlockPath && r.Method == http.MethodPost {
+		if subtle.ConstantTimeCompare([]byte(r.PostFormValue("passphrase")), []byte(passphrase)) == 1 {
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookieName,
+				Value:    expected,
+				Path:     "/",
+				Secure:   true,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, safeRedirectPath(r.PostFormValue("next")), http.StatusSeeOther)
+			return false
+		}
+		serveUnlockPage(w, r.PostFormValue("next"), true)
+		return false
+	}
+
+	serveUnlockPage(w, r.URL.RequestURI(), false)
+	return false
+}
+
+// checkBasicAuth enforces the tunnel's auth option. It returns true if the
+// request may proceed; otherwise it has already written a 401 response. The
+// credentials are stripped so they do not reach the backend.
+func checkBasicAuth(w http.ResponseWriter, r *http.Request, sub string, pool *tunnel.Pool) bool {
+	if pool.BasicAuthUser() == "" {
+		return true
+	}
+	if user, pass, ok := r.BasicAuth(); ok && pool.CheckBasicAuth(user, pass) {
+		r.Header.Del("Authorization")
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+sub+`", charset="UTF-8"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func serveUnlockPage(w http.ResponseWriter, next string, failed bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	data := struct {
+		Action string
+		Next   string
+		Failed bool
+	}{config.UnlockPath, safeRedirectPath(next), failed}
+	if err := unlockPage.Execute(w, data); err != nil {
+		log.Printf("Failed to render unlock page: %v", err)
+	}
+}
+
+// safeRedirectPath only allows same-origin absolute paths, preventing open redirects
+func safeRedirectPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") ||
+		strings.HasPrefix(next, config.UnlockPath) || strings.HasPrefix(next, config.WarningPath) {
+		return "/"
+	}
+	return next
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+func newProtectedPool(t *testing.T) (*tunnel.Pool, string) {
+	t.Helper()
+	pool := tunnel.NewPool("happy-tiger-abcdef01", "secret")
+	passphrase, err := pool.EnableProtection()
+	if err != nil {
+		t.Fatalf("EnableProtection() error: %v", err)
+	}
+	return pool, passphrase
+}
+
+func TestCheckPassphrase_Unprotected(t *testing.T) {
+	s := newTestServer(t)
+	pool := tunnel.NewPool("happy-tiger-abcdef01", "secret")
+
+	w := httptest.NewRecorder()
+	if !s.checkPassphrase(w, httptest.NewRequest("GET", "/", nil), pool.Subdomain, pool) {
+		t.Error("unprotected subdomain should let requests through")
+	}
+}
+
+func TestCheckPassphrase_RequiresUnlock(t *testing.T) {
+	s := newTestServer(t)
+	pool, _ := newProtectedPool(t)
+
+	w := httptest.NewRecorder()
+	if s.checkPassphrase(w, httptest.NewRequest("GET", "/private?x=1", nil), pool.Subdomain, pool) {
+		t.Fatal("protected subdomain should block requests without a cookie")
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if !strings.Contains(w.Body.String(), `value="/private?x=1"`) {
+		t.Error("unlock page should carry the original path")
+	}
+}
+
+func TestCheckPassphrase_Header(t *testing.T) {
+	s := newTestServer(t)
+	pool, passphrase := newProtectedPool(t)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(config.PassphraseHeader, passphrase)
+	if !s.checkPassphrase(httptest.NewRecorder(), r, pool.Subdomain, pool) {
+		t.Error("correct passphrase header should let the request through")
+	}
+	if r.Header.Get(config.PassphraseHeader) != "" {
+		t.Error("passphrase header should be stripped before the request is proxied")
+	}
+}
+
+func TestCheckPassphrase_UnlockFlow(t *testing.T) {
+	s := newTestServer(t)
+	pool, passphrase := newProtectedPool(t)
+
+	// Wrong passphrase
+	form := url.Values{"passphrase": {"nope"}, "next": {"/dashboard"}}
+	r := httptest.NewRequest("POST", config.UnlockPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	if s.checkPassphrase(w, r, pool.Subdomain, pool) || w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong passphrase should be rejected, got status %d", w.Code)
+	}
+
+	// Correct passphrase
+	form.Set("passphrase", passphrase)
+	r = httptest.NewRequest("POST", config.UnlockPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	s.checkPassphrase(w, r, pool.Subdomain, pool)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if loc := w.Header().Get("Location"); loc != "/dashboard" {
+		t.Errorf("Location = %q, want /dashboard", loc)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+
+	// Cookie grants access
+	r = httptest.NewRequest("GET", "/dashboard", nil)
+	r.AddCookie(cookies[0])
+	if !s.checkPassphrase(httptest.NewRecorder(), r, pool.Subdomain, pool) {
+		t.Error("signed cookie should let the request through")
+	}
+
+	// Tampered cookie does not
+	r = httptest.NewRequest("GET", "/dashboard", nil)
+	r.AddCookie(&http.Cookie{Name: cookies[0].Name, Value: "forged"})
+	if s.checkPassphrase(httptest.NewRecorder(), r, pool.Subdomain, pool) {
+		t.Error("forged cookie should be rejected")
+	}
+}
+
+func TestSafeRedirectPath(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"/path?q=1", "/path?q=1"},
+		{"", "/"},
+		{"https://evil.com", "/"},
+		{"//evil.com", "/"},
+		{"/\\evil.com", "/"},
+		{config.UnlockPath, "/"},
+	}
+
+	for _, tt := range tests {
+		if got := safeRedirectPath(tt.input); got != tt.want {
+			t.Errorf("safeRedirectPath(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestCheckBasicAuth(t *testing.T) {
+	pool := tunnel.NewPool("happy-tiger-abcdef01", "secret")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if !checkBasicAuth(httptest.NewRecorder(), r, pool.Subdomain, pool) {
+		t.Fatal("tunnel without auth should let requests through")
+	}
+
+	pool.SetBasicAuth("user", "pass")
+
+	w := httptest.NewRecorder()
+	if checkBasicAuth(w, httptest.NewRequest("GET", "/", nil), pool.Subdomain, pool) {
+		t.Fatal("request without credentials should be rejected")
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("WWW-Authenticate = %q, want Basic challenge", w.Header().Get("WWW-Authenticate"))
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("user", "wrong")
+	if checkBasicAuth(httptest.NewRecorder(), r, pool.Subdomain, pool) {
+		t.Error("wrong password should be rejected")
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("user", "pass")
+	if !checkBasicAuth(httptest.NewRecorder(), r, pool.Subdomain, pool) {
+		t.Fatal("correct credentials should be accepted")
+	}
+	if r.Header.Get("Authorization") != "" {
+		t.Error("credentials should be stripped before proxying")
+	}
+}
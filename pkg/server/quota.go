@@ -0,0 +1,268 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tunnl.gg/pkg/tunnel"
+)
+
+// AccountQuotas enforces per-account limits on concurrent tunnels, daily
+// bandwidth and request rate, on top of the per-IP and per-tunnel limits.
+// Accounts are named by Server.quotaAccount. Anonymous clients ("") are never
+// limited here.
+type AccountQuotas struct {
+	mu       sync.Mutex
+	accounts map[string]*accountUsage
+
+	bandwidth *BandwidthTracker
+	rate      int // requests per second shared by an account's tunnels, 0 disables
+	burst     int
+
+	totalLimited atomic.Uint64
+}
+
+// accountUsage is the live state of an account with open tunnels
+type accountUsage struct {
+	tunnels    int
+	maxTunnels int
+	rate       int
+	limiter    *tunnel.RateLimiter // nil when the account is not rate limited
+	limited    uint64              // requests rejected by the account rate limit
+}
+
+// AccountQuota is the quota state of an account, as reported by the stats API
+type AccountQuota struct {
+	Account           string `json:"account"`
+	Tunnels           int    `json:"tunnels"`
+	MaxTunnels        int    `json:"max_tunnels"`
+	BandwidthToday    int64  `json:"bandwidth_today_bytes"`
+	BandwidthQuota    int64  `json:"bandwidth_quota_bytes"`
+	BandwidthExceeded bool   `json:"bandwidth_exceeded"`
+	RequestsPerSecond int    `json:"requests_per_second"`
+	RateLimited       uint64 `json:"rate_limited"`
+}
+
+// NewAccountQuotas creates quotas with the given daily bandwidth (bytes) and
+// request rate (per second) per account; 0 disables either limit
+func NewAccountQuotas(dailyBandwidth int64, rate int) *AccountQuotas {
+	return &AccountQuotas{
+		accounts:  make(map[string]*accountUsage),
+		bandwidth: NewBandwidthTracker(dailyBandwidth),
+		rate:      rate,
+		burst:     rate * 2,
+	}
+}
+
+// Check returns an error if the account cannot open another tunnel
+func (q *AccountQuotas) Check(account string, maxTunnels int) error {
+	if account == "" {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.check(account, maxTunnels)
+}
+
+// check must be called with lock held
+func (q *AccountQuotas) check(account string, maxTunnels int) error {
+	if u := q.accounts[account]; u != nil && u.tunnels >= maxTunnels {
+		return fmt.Errorf("rate limit exceeded: max %d tunnels for user %s. Close an existing tunnel and try again", maxTunnels, account)
+	}
+	if q.bandwidth.Exceeded(account) {
+		return fmt.Errorf("daily bandwidth quota of %d MB exceeded for user %s. Quota resets at midnight UTC", q.bandwidth.Quota()/(1024*1024), account)
+	}
+	return nil
+}
+
+// Reserve checks the account's quotas and atomically takes a tunnel slot.
+// A positive rate raises the account's request rate above the default.
+// Caller MUST call Release when done if this returns nil.
+func (q *AccountQuotas) Reserve(account string, maxTunnels, rate int) error {
+	if account == "" {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.check(account, maxTunnels); err != nil {
+		return err
+	}
+
+	u := q.accounts[account]
+	if u == nil {
+		u = &accountUsage{rate: q.rate}
+		q.accounts[account] = u
+	}
+	u.tunnels++
+	u.maxTunnels = maxTunnels
+	if rate > u.rate {
+		u.rate = rate
+	}
+	if u.rate > 0 {
+		burst := max(u.rate*2, q.burst)
+		if u.limiter == nil {
+			u.limiter = tunnel.NewRateLimiter(float64(u.rate), burst)
+		} else {
+			u.limiter.SetRate(float64(u.rate), burst)
+		}
+	}
+	return nil
+}
+
+// Release frees a tunnel slot taken with Reserve
+func (q *AccountQuotas) Release(account string) {
+	if account == "" {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.accounts[account]
+	if u == nil {
+		return
+	}
+	u.tunnels--
+	if u.tunnels <= 0 {
+		delete(q.accounts, account)
+	}
+}
+
+// Allow returns true if the account may make another request
+func (q *AccountQuotas) Allow(account string) bool {
+	if account == "" {
+		return true
+	}
+	q.mu.Lock()
+	u := q.accounts[account]
+	q.mu.Unlock()
+	if u == nil || u.limiter == nil || u.limiter.Allow() {
+		return true
+	}
+	q.mu.Lock()
+	u.limited++
+	q.mu.Unlock()
+	q.totalLimited.Add(1)
+	return false
+}
+
+// Delay returns how long until the account may make another request, or
+// zero if it may now
+func (q *AccountQuotas) Delay(account string) time.Duration {
+	q.mu.Lock()
+	u := q.accounts[account]
+	q.mu.Unlock()
+	if u == nil || u.limiter == nil {
+		return 0
+	}
+	return u.limiter.Delay()
+}
+
+// BandwidthExceeded returns true if the account has used up its daily quota
+func (q *AccountQuotas) BandwidthExceeded(account string) bool {
+	return account != "" && q.bandwidth.Exceeded(account)
+}
+
+// Meter wraps w so bytes written through it count against the account's
+// daily bandwidth
+func (q *AccountQuotas) Meter(w io.Writer, account string) io.Writer {
+	if account == "" {
+		return w
+	}
+	return &meteredWriter{w: w, bt: q.bandwidth, ip: account}
+}
+
+// Count returns the number of accounts with open tunnels
+func (q *AccountQuotas) Count() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.accounts)
+}
+
+// Get returns the quota state of an account that has open tunnels or has
+// used bandwidth today
+func (q *AccountQuotas) Get(account string) (AccountQuota, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used := q.bandwidth.Usage(account)
+	u := q.accounts[account]
+	if u == nil && used == 0 {
+		return AccountQuota{}, false
+	}
+	return q.quota(account, u, used), true
+}
+
+// List returns the quota state of every account with open tunnels or
+// bandwidth used today, sorted by name
+func (q *AccountQuotas) List() []AccountQuota {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, usage := q.bandwidth.Snapshot()
+	for account := range q.accounts {
+		if _, ok := usage[account]; !ok {
+			usage[account] = 0
+		}
+	}
+
+	out := make([]AccountQuota, 0, len(usage))
+	for account, used := range usage {
+		out = append(out, q.quota(account, q.accounts[account], used))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Account < out[j].Account })
+	return out
+}
+
+// quota builds an account's report (must be called with lock held)
+func (q *AccountQuotas) quota(account string, u *accountUsage, used int64) AccountQuota {
+	aq := AccountQuota{
+		Account:           account,
+		BandwidthToday:    used,
+		BandwidthQuota:    q.bandwidth.Quota(),
+		BandwidthExceeded: q.bandwidth.Quota() > 0 && used >= q.bandwidth.Quota(),
+		RequestsPerSecond: q.rate,
+	}
+	if u != nil {
+		aq.Tunnels = u.tunnels
+		aq.MaxTunnels = u.maxTunnels
+		aq.RequestsPerSecond = u.rate
+		aq.RateLimited = u.limited
+	}
+	return aq
+}
+
+// GetStats returns the number of accounts over their bandwidth quota and the
+// total requests rejected by account rate limits
+func (q *AccountQuotas) GetStats() (exceededAccounts int, totalLimited uint64) {
+	_, exceededAccounts = q.bandwidth.GetStats()
+	return exceededAccounts, q.totalLimited.Load()
+}
+
+// accountsHandler serves GET /api/accounts
+func (s *Server) accountsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, struct {
+			Accounts []AccountQuota `json:"accounts"`
+		}{s.quotas.List()})
+	})
+}
+
+// accountHandler serves GET /api/accounts/{name}
+func (s *Server) accountHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		aq, ok := s.quotas.Get(name)
+		if !ok {
+			// Key fingerprints are case-sensitive; names are lowercase
+			aq, ok = s.quotas.Get(strings.ToLower(name))
+		}
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, aq)
+	})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestAccountQuotas_Reserve(t *testing.T) {
+	q := NewAccountQuotas(0, 0)
+	limit := config.MaxTunnelsPerAccount
+
+	for i := 0; i < limit; i++ {
+		if err := q.Reserve("alice", limit, 0); err != nil {
+			t.Fatalf("reservation %d failed: %v", i+1, err)
+		}
+	}
+	if err := q.Reserve("alice", limit, 0); err == nil {
+		t.Error("reservation over the account limit should fail")
+	}
+	if err := q.Check("alice", limit); err == nil {
+		t.Error("Check() should report the account at its limit")
+	}
+	if err := q.Reserve("bob", limit, 0); err != nil {
+		t.Errorf("other accounts should not be affected: %v", err)
+	}
+	if err := q.Reserve("", limit, 0); err != nil {
+		t.Errorf("anonymous clients should not be limited per account: %v", err)
+	}
+
+	q.Release("alice")
+	if err := q.Reserve("alice", limit, 0); err != nil {
+		t.Errorf("released slot should be reusable: %v", err)
+	}
+	if got := q.Count(); got != 2 {
+		t.Errorf("Count() = %d, want 2", got)
+	}
+
+	for i := 0; i < limit; i++ {
+		q.Release("alice")
+	}
+	if got := q.Count(); got != 1 {
+		t.Errorf("Count() = %d after releasing every slot, want 1", got)
+	}
+}
+
+func TestAccountQuotas_Bandwidth(t *testing.T) {
+	q := NewAccountQuotas(100, 0)
+	if err := q.Reserve("alice", 1, 0); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	q.Release("alice")
+
+	var sink strings.Builder
+	io.WriteString(q.Meter(&sink, "alice"), strings.Repeat("x", 100))
+	io.WriteString(q.Meter(&sink, ""), strings.Repeat("x", 100))
+
+	if !q.BandwidthExceeded("alice") {
+		t.Error("alice should be over her bandwidth quota")
+	}
+	if q.BandwidthExceeded("") {
+		t.Error("anonymous traffic should not be metered per account")
+	}
+	if err := q.Reserve("alice", 1, 0); err == nil {
+		t.Error("accounts over their bandwidth quota should not open tunnels")
+	}
+	if exceeded, _ := q.GetStats(); exceeded != 1 {
+		t.Errorf("GetStats() exceeded = %d, want 1", exceeded)
+	}
+}
+
+func TestAccountQuotas_Allow(t *testing.T) {
+	q := NewAccountQuotas(0, 1)
+	if err := q.Reserve("alice", 2, 0); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+
+	// Burst is twice the rate
+	for i := 0; i < 2; i++ {
+		if !q.Allow("alice") {
+			t.Fatalf("request %d within the burst should be allowed", i+1)
+		}
+	}
+	if q.Allow("alice") {
+		t.Error("request over the account rate should be rejected")
+	}
+	if d := q.Delay("alice"); d <= 0 || d > time.Second {
+		t.Errorf("Delay() = %v over the account rate of 1/s, want up to 1s", d)
+	}
+	if q.Delay("bob") != 0 {
+		t.Error("accounts without tunnels should have no delay")
+	}
+	if !q.Allow("bob") || !q.Allow("") {
+		t.Error("accounts without tunnels and anonymous clients should not be rate limited")
+	}
+
+	// A key with a higher rate raises the account's limit
+	if err := q.Reserve("alice", 2, 50); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	aq, ok := q.Get("alice")
+	if !ok {
+		t.Fatal("Get() should find an account with open tunnels")
+	}
+	if aq.Tunnels != 2 || aq.RequestsPerSecond != 50 || aq.RateLimited != 1 {
+		t.Errorf("Get() = %+v, want 2 tunnels at 50 req/s with 1 rate limited", aq)
+	}
+	if _, limited := q.GetStats(); limited != 1 {
+		t.Errorf("GetStats() limited = %d, want 1", limited)
+	}
+}
+
+func TestAccountsAPI(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.quotas.Reserve("alice", config.MaxTunnelsPerAccount, 0); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	io.WriteString(s.quotas.Meter(io.Discard, "bob"), "hello")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "127.0.0.1:12345"
+		w := httptest.NewRecorder()
+		s.StatsHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/api/accounts")
+	var list struct {
+		Accounts []AccountQuota `json:"accounts"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(list.Accounts) != 2 || list.Accounts[0].Account != "alice" || list.Accounts[1].Account != "bob" {
+		t.Fatalf("accounts = %+v, want alice and bob", list.Accounts)
+	}
+	if list.Accounts[0].Tunnels != 1 || list.Accounts[0].MaxTunnels != config.MaxTunnelsPerAccount {
+		t.Errorf("alice = %+v, want 1 of %d tunnels", list.Accounts[0], config.MaxTunnelsPerAccount)
+	}
+	if list.Accounts[1].BandwidthToday != 5 {
+		t.Errorf("bob bandwidth = %d, want 5", list.Accounts[1].BandwidthToday)
+	}
+
+	w = get("/api/accounts/Alice")
+	var aq AccountQuota
+	if err := json.NewDecoder(w.Body).Decode(&aq); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if aq.Account != "alice" || aq.RequestsPerSecond != config.DefaultAccountRequestsPerSecond {
+		t.Errorf("GET /api/accounts/Alice = %+v", aq)
+	}
+
+	if w := get("/api/accounts/nobody"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown account status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if got := s.GetStats(false, false).Accounts; got != 1 {
+		t.Errorf("Accounts = %d, want 1", got)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// capRange shortens a single byte range in a request's Range header so the
+// partial response fits within max bytes. Open-ended ranges such as
+// "bytes=1000-", which resuming downloaders send, would otherwise ask for the
+// rest of a large file at once. The client learns from Content-Range which
+// part it got and requests the next one. Suffix and multi-part ranges are
+// left alone.
+func capRange(h http.Header, max int64) {
+	spec, ok := strings.CutPrefix(h.Get("Range"), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok || first == "" {
+		return
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return
+	}
+	capped := start + max - 1
+	if last != "" {
+		end, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start || end <= capped {
+			return
+		}
+	}
+	h.Set("Range", fmt.Sprintf("bytes=%d-%d", start, capped))
+}
+
+// acceptsRanges reports whether a response advertises byte range support
+func acceptsRanges(resp *http.Response) bool {
+	for _, v := range resp.Header.Values("Accept-Ranges") {
+		for _, unit := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+				return true
+			}
+		}
+	}
+	return false
+}
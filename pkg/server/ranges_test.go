@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestCapRange(t *testing.T) {
+	tests := []struct {
+		rng  string
+		want string
+	}{
+		{"", ""},
+		{"bytes=0-99", "bytes=0-99"},
+		{"bytes=0-", "bytes=0-999"},
+		{"bytes=5000-", "bytes=5000-5999"},
+		{"bytes=0-999", "bytes=0-999"},
+		{"bytes=0-1000", "bytes=0-999"},
+		{"bytes=-500", "bytes=-500"},
+		{"bytes=-5000", "bytes=-5000"},
+		{"bytes=0-10,20-", "bytes=0-10,20-"},
+		{"items=0-", "items=0-"},
+		{"bytes=x-", "bytes=x-"},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.rng != "" {
+			h.Set("Range", tt.rng)
+		}
+		capRange(h, 1000)
+		if got := h.Get("Range"); got != tt.want {
+			t.Errorf("capRange(%q) = %q, want %q", tt.rng, got, tt.want)
+		}
+	}
+}
+
+func TestServeHTTP_LargeRangedDownload(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	ln := newTestListener(t)
+	s.RegisterTunnel(sub, "", 0, ln, "", 80, "1.2.3.4")
+
+	ranges := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err == nil {
+				ranges <- req.Header.Get("Range")
+				// A file over the limit whose backend supports ranges
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nAccept-Ranges: bytes\r\nContent-Length: %d\r\n\r\nstart", config.MaxResponseBodySize*2)
+			}
+			conn.Close()
+		}
+	}()
+
+	r := httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/big.iso", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want the download started for a backend that supports ranges", w.Code)
+	}
+	if got := <-ranges; got != "" {
+		t.Errorf("backend got Range %q for a plain request", got)
+	}
+
+	r = httptest.NewRequest("GET", "https://"+sub+"."+s.domain+"/big.iso", nil)
+	r.Header.Set("Range", "bytes=100-")
+	s.ServeHTTP(httptest.NewRecorder(), r)
+	want := fmt.Sprintf("bytes=100-%d", 100+config.MaxResponseBodySize-1)
+	if got := <-ranges; got != want {
+		t.Errorf("backend got Range %q, want %q", got, want)
+	}
+}
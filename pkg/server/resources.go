@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Listeners whose accepts are counted
+const (
+	listenerSSH   = "ssh"
+	listenerHTTP  = "http"
+	listenerHTTPS = "https"
+)
+
+// ResourceStats are the process resources operators watch to alert before
+// hitting ulimits
+type ResourceStats struct {
+	Goroutines        int                    `json:"goroutines"`
+	OpenFDs           int                    `json:"open_fds"` // -1 if unknown
+	MaxFDs            uint64                 `json:"max_fds"`  // soft limit, 0 if unknown
+	ForwardedChannels int64                  `json:"forwarded_channels"`
+	Accepts           map[string]AcceptStats `json:"accepts"`
+}
+
+// AcceptStats are the connections a listener accepted, and its failed
+// accepts where the server runs the accept loop (SSH)
+type AcceptStats struct {
+	Total      uint64 `json:"total"`
+	LastMinute uint64 `json:"last_minute"`
+	Errors     uint64 `json:"errors,omitempty"`
+}
+
+// acceptCounter counts accepted connections in total and per second over
+// the last minute
+type acceptCounter struct {
+	mu      sync.Mutex
+	total   uint64
+	errors  uint64
+	seconds [60]struct {
+		second int64
+		count  uint64
+	}
+
+	now func() time.Time // overridable for tests
+}
+
+func newAcceptCounter() *acceptCounter {
+	return &acceptCounter{now: time.Now}
+}
+
+// Record counts an accepted connection
+func (a *acceptCounter) Record() {
+	second := a.now().Unix()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.total++
+	b := &a.seconds[second%int64(len(a.seconds))]
+	if b.second != second {
+		b.second, b.count = second, 0
+	}
+	b.count++
+}
+
+// RecordError counts a failed accept
+func (a *acceptCounter) RecordError() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.errors++
+}
+
+// Stats returns the total accepts and those of the last minute
+func (a *acceptCounter) Stats() AcceptStats {
+	now := a.now().Unix()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := AcceptStats{Total: a.total, Errors: a.errors}
+	for _, b := range a.seconds {
+		if b.second > now-int64(len(a.seconds)) && b.second <= now {
+			stats.LastMinute += b.count
+		}
+	}
+	return stats
+}
+
+// resourceStats gathers the process's current resource usage
+func (s *Server) resourceStats() ResourceStats {
+	stats := ResourceStats{
+		Goroutines:        runtime.NumGoroutine(),
+		OpenFDs:           openFDs(),
+		MaxFDs:            maxFDs(),
+		ForwardedChannels: s.forwardedChannels.Load(),
+		Accepts:           make(map[string]AcceptStats, len(s.accepts)),
+	}
+	for name, a := range s.accepts {
+		stats.Accepts[name] = a.Stats()
+	}
+	return stats
+}
+
+// HTTPConnState counts connections accepted by the HTTP redirect server;
+// use it as http.Server.ConnState
+func (s *Server) HTTPConnState(c net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		s.accepts[listenerHTTP].Record()
+	}
+}
+
+// openFDs counts the process's open file descriptors, or returns -1 where
+// /proc is not available
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// maxFDs reads the soft limit of open file descriptors from /proc, or
+// returns 0 where it is not available or unlimited
+func maxFDs() uint64 {
+	f, err := os.Open("/proc/self/limits")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "Max open files")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return 0
+		}
+		n, _ := strconv.ParseUint(fields[0], 10, 64)
+		return n
+	}
+	return 0
+}
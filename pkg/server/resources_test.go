@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAcceptCounter(t *testing.T) {
+	a := newAcceptCounter()
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+
+	a.Record()
+	a.Record()
+	now = now.Add(30 * time.Second)
+	a.Record()
+	if got := a.Stats(); got.Total != 3 || got.LastMinute != 3 {
+		t.Errorf("Stats() = %+v, want 3 total and 3 in the last minute", got)
+	}
+
+	// Accepts older than a minute leave the rate but not the total
+	now = now.Add(45 * time.Second)
+	if got := a.Stats(); got.Total != 3 || got.LastMinute != 1 {
+		t.Errorf("Stats() = %+v, want 3 total and 1 in the last minute", got)
+	}
+	now = now.Add(time.Hour)
+	a.Record()
+	if got := a.Stats(); got.Total != 4 || got.LastMinute != 1 {
+		t.Errorf("Stats() = %+v, want 4 total and 1 in the last minute", got)
+	}
+}
+
+func TestResourceStats(t *testing.T) {
+	s := newTestServer(t)
+	s.HTTPConnState(nil, http.StateNew)
+	s.HTTPConnState(nil, http.StateClosed)
+
+	stats := s.GetStats(false, false).Resources
+	if stats.Goroutines < 1 {
+		t.Errorf("goroutines = %d", stats.Goroutines)
+	}
+	if stats.OpenFDs == 0 {
+		t.Error("open FDs should be counted or -1 if unknown")
+	}
+	if got := stats.Accepts[listenerHTTP]; got.Total != 1 || got.LastMinute != 1 {
+		t.Errorf("HTTP accepts = %+v, want 1", got)
+	}
+	if _, ok := stats.Accepts[listenerSSH]; !ok {
+		t.Error("SSH accepts missing")
+	}
+}
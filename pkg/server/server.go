@@ -0,0 +1,749 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikesmitty/edkey"
+	"golang.org/x/crypto/ssh"
+
+	"tunnl.gg/internal/storage"
+	"tunnl.gg/internal/store"
+	"tunnl.gg/internal/subdomain"
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+// Server manages SSH tunnels and HTTP proxying
+type Server struct {
+	pools         map[string]*tunnel.Pool // Backends per subdomain
+	tunnelCount   int                     // Total tunnels across all pools
+	ipConnections map[string]int
+	ipTunnels     map[string][]*tunnel.Tunnel  // Open tunnels per client IP, for fair sharing
+	sshConns      map[string][]*ssh.ServerConn // SSH connections per IP for forced closure
+	mu            sync.RWMutex
+	sshConfig     *ssh.ServerConfig
+	domain        string   // default serving domain
+	domains       []string // all serving domains, default first
+
+	// Stats
+	totalConnections uint64
+	totalRequests    uint64
+
+	// Abuse protection
+	abuseTracker   *AbuseTracker
+	visitorLimiter *VisitorLimiter
+	tarpitSlots    chan struct{}
+	totalTarpitted atomic.Uint64
+	blocklists     *BlocklistFetcher
+
+	// TLS fingerprints of HTTPS visitors, tracked and optionally blocked
+	fingerprints     *FingerprintTracker
+	fingerprintSlots sync.Map // net.Conn -> *fingerprintSlot until the handshake
+
+	// SSH host key, served through hostKeySigner so it can be rotated
+	hostKey atomic.Pointer[ssh.Signer]
+
+	// Optional authorized keys granting per-key privileges
+	authorizedKeys *AuthorizedKeys
+
+	// Optional named tiers with their own limits and features (nil = built-in limits)
+	tiers *Tiers
+
+	// Daily bandwidth quota per client IP
+	bandwidth *BandwidthTracker
+
+	// Request rate shared fairly by all tunnels of a client IP (0 = disabled)
+	ipRequestsPerSecond int
+	ipv6Prefix          int // IPv6 clients are counted by their prefix of this length
+
+	// Largest response size keys and tiers may raise a tunnel's limit to
+	maxResponseCeiling int64
+
+	// Max time for a backend to produce response headers (0 = no deadline)
+	upstreamTimeout  time.Duration
+	upstreamTimeouts atomic.Uint64
+
+	// Tunnel, bandwidth and request rate quotas per account (SSH username)
+	quotas *AccountQuotas
+
+	// Per-account, per-subdomain daily usage for the usage export
+	usage *UsageRecorder
+
+	// Optional persistent store, saved every StoreFlushInterval
+	store       *store.Store
+	stopPersist chan struct{}
+	persistDone chan struct{}
+
+	// Subdomain reservations: the store's, or shared through STORAGE_URL (nil = none)
+	reservations store.Reservations
+	registryDown atomic.Bool // the last reservation call failed
+
+	// Sessions told where to reconnect when a clustered server shuts down
+	clustered         bool     // reservations are shared through STORAGE_URL
+	migrationNodes    []string // other servers' SSH addresses
+	migrationMu       sync.Mutex
+	migrationSessions map[*tunnel.Tunnel]migrationSession
+
+	// Bytes relayed by the proxy and WebSocket relay, for /metrics
+	proxyMetrics ProxyMetrics
+
+	// Open /stats/stream connections
+	statsStreams atomic.Int32
+
+	// Rolling per-minute traffic of subdomains and visitor IPs
+	topTalkers *TopTalkers
+
+	// Request and response bodies of tunnels with the inspect option
+	captures *CaptureStore
+
+	// Memory shared by captures, session log buffers and abuse maps
+	memory *MemoryBudget
+
+	// Set by operators to refuse new tunnels while existing ones drain
+	maintenance maintenanceMode
+
+	// Global load shedding
+	inFlightRequests atomic.Int64
+	activeWebSockets atomic.Int64
+
+	// Resource counters for capacity planning
+	forwardedChannels     atomic.Int64              // open forwarded-tcpip channels
+	accepts               map[string]*acceptCounter // per listener
+	acceptBackoff         time.Duration             // first wait after a failed SSH accept, overridable for tests
+	maxConcurrentRequests int64
+	totalShed             atomic.Uint64
+
+	// Emergency throttling of rate limits while the server is overloaded
+	overload     *OverloadDetector
+	throttle     atomic.Int32 // percent of the limits left (0 = not throttled)
+	stopOverload chan struct{}
+	overloadDone chan struct{}
+
+	// Backend responses refused or aborted for exceeding their tunnel's size limit
+	totalTooLarge atomic.Uint64
+
+	// Backend connections dropped after waiting for one of MaxBackendConns slots
+	backendConnsDropped atomic.Uint64
+
+	// Channel opens retried after the client's local server refused them
+	dialBackoff        time.Duration // overridable for tests
+	backendDialRetries atomic.Uint64
+
+	// Channel opens dropped after queuing for one of MaxChannelOpens slots
+	channelOpensDropped atomic.Uint64
+
+	// Connections to tunnel listeners that did not start with an HTTP request
+	nonHTTPRejected atomic.Uint64
+
+	// Tunnels torn down after their client refused channels for the failure budget
+	refusedTunnelsClosed atomic.Uint64
+
+	// Optional country database for the request log's visitor columns
+	geoIP *GeoIP
+
+	// Requests refused by a tunnel's block-bots option
+	botsBlocked atomic.Uint64
+
+	// Pin visitors to one backend of multi-client subdomains via cookie
+	stickySessions bool
+
+	// Key for signing visitor cookies (generated per process)
+	cookieKey []byte
+
+	// Translations of the browser warning interstitial
+	warningLocales *WarningLocales
+
+	// Warning cookie policy
+	warningCookieMaxAge     int // seconds, 0 = session cookie
+	warningCookieSameSite   http.SameSite
+	warningCookiePerVisitor bool
+}
+
+// New creates a new server instance from the given configuration
+func New(cfg *config.Config) (_ *Server, err error) {
+	s := &Server{
+		pools:          make(map[string]*tunnel.Pool),
+		ipConnections:  make(map[string]int),
+		ipTunnels:      make(map[string][]*tunnel.Tunnel),
+		sshConns:       make(map[string][]*ssh.ServerConn),
+		abuseTracker:   NewAbuseTracker(),
+		memory:         NewMemoryBudget(cfg.MemoryBudget),
+		visitorLimiter: NewVisitorLimiter(),
+		tarpitSlots:    make(chan struct{}, config.MaxTarpitConnections),
+		bandwidth:      NewBandwidthTracker(cfg.DailyBandwidthQuota),
+		quotas:         NewAccountQuotas(cfg.AccountDailyBandwidthQuota, cfg.AccountRequestsPerSecond),
+		usage:          NewUsageRecorder(),
+		topTalkers:     NewTopTalkers(),
+		fingerprints:   NewFingerprintTracker(cfg.TLSFingerprintBlocklist),
+		domain:         cfg.Domain,
+		domains:        append([]string{cfg.Domain}, cfg.ExtraDomains...),
+		clustered:      cfg.StorageURL != "",
+
+		ipRequestsPerSecond:   cfg.IPRequestsPerSecond,
+		ipv6Prefix:            cfg.IPv6Prefix,
+		maxResponseCeiling:    cfg.MaxResponseSizeCeiling,
+		upstreamTimeout:       cfg.UpstreamResponseTimeout,
+		dialBackoff:           config.BackendDialBackoff,
+		acceptBackoff:         config.SSHAcceptBackoff,
+		maxConcurrentRequests: int64(cfg.MaxConcurrentRequests),
+		overload:              NewOverloadDetector(cfg.OverloadAcceptsPerSecond, cfg.OverloadInFlightRequests, cfg.OverloadCPUPercent),
+		stickySessions:        cfg.StickySessions,
+		migrationSessions:     make(map[*tunnel.Tunnel]migrationSession),
+		accepts: map[string]*acceptCounter{
+			listenerSSH:   newAcceptCounter(),
+			listenerHTTP:  newAcceptCounter(),
+			listenerHTTPS: newAcceptCounter(),
+		},
+	}
+	// The constructors above started background work, and later steps start
+	// more and open the store; all of it is stopped if a step fails
+	defer func() {
+		if err != nil {
+			s.Stop()
+		}
+	}()
+
+	for _, node := range cfg.MigrationNodes {
+		s.migrationNodes = append(s.migrationNodes, normalizeNode(node))
+	}
+
+	s.abuseTracker.SetMemoryBudget(s.memory)
+	s.abuseTracker.SetIPv6Prefix(cfg.IPv6Prefix)
+	s.visitorLimiter.SetMemoryBudget(s.memory)
+
+	// Set callback to close SSH connections when IP is blocked
+	// Closing SSH connections triggers cleanup which removes tunnels via defers
+	s.abuseTracker.SetOnBlockCallback(func(ip string) {
+		connCount := s.CloseAllForIP(ip)
+		if connCount > 0 {
+			log.Printf("Closed %d SSH connection(s) for blocked IP %s", connCount, ip)
+		}
+	})
+
+	if len(cfg.TrustedIPs) > 0 {
+		var trusted []netip.Prefix
+		for _, entry := range cfg.TrustedIPs {
+			prefix, ok := parsePrefix(entry)
+			if !ok {
+				return nil, fmt.Errorf("invalid trusted IP or CIDR %q", entry)
+			}
+			trusted = append(trusted, prefix)
+		}
+		s.abuseTracker.SetTrusted(trusted)
+	}
+	s.abuseTracker.SetPolicy(ViolationConnectionRate, ViolationPolicy{
+		Threshold: cfg.ConnectionRateBlockAfter,
+		Window:    config.ViolationWindow,
+		BlockFor:  cfg.ConnectionRateBlockDuration,
+	})
+	s.abuseTracker.SetPolicy(ViolationHTTPRateLimit, ViolationPolicy{
+		Threshold: cfg.HTTPAbuseBlockAfter,
+		Window:    config.ViolationWindow,
+		BlockFor:  cfg.HTTPAbuseBlockDuration,
+	})
+
+	if cfg.NFTSet != "" || cfg.NFTSet6 != "" {
+		enforcer, err := NewNFTEnforcer(cfg.NFTSet, cfg.NFTSet6)
+		if err != nil {
+			return nil, err
+		}
+		s.abuseTracker.SetEnforcer(enforcer)
+	}
+
+	if len(cfg.Blocklists) > 0 {
+		s.blocklists = NewBlocklistFetcher(cfg.Blocklists, s.abuseTracker)
+		s.blocklists.Start()
+	}
+
+	warningLocales, err := LoadWarningLocales(cfg.WarningLocalesDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load warning page translations: %w", err)
+	}
+	s.warningLocales = warningLocales
+
+	if err := s.configureWarningCookie(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.GeoIPPath != "" {
+		geoIP, err := LoadGeoIP(cfg.GeoIPPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load GeoIP database: %w", err)
+		}
+		s.geoIP = geoIP
+		log.Printf("Loaded %d GeoIP ranges from %s", geoIP.Len(), cfg.GeoIPPath)
+	}
+
+	for _, fp := range cfg.TLSFingerprintBlocklist {
+		if !isValidFingerprint(fp) {
+			return nil, fmt.Errorf("invalid TLS fingerprint %q: want a JA3 hash or JA4 fingerprint", fp)
+		}
+	}
+
+	s.cookieKey = make([]byte, 32)
+	if _, err := rand.Read(s.cookieKey); err != nil {
+		return nil, fmt.Errorf("failed to generate cookie key: %w", err)
+	}
+
+	if cfg.TiersPath != "" {
+		tiers, err := LoadTiers(cfg.TiersPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tiers: %w", err)
+		}
+		s.tiers = tiers
+	}
+
+	s.sshConfig = &ssh.ServerConfig{
+		NoClientAuth:         true,
+		NoClientAuthCallback: s.authNone,
+	}
+
+	// With an authorized keys file, "none" is refused so clients offer their
+	// keys. Clients without an authorized key fall back to a keyboard-interactive
+	// exchange with no questions, unless keys are required.
+	if cfg.AuthorizedKeysPath != "" {
+		keys, err := LoadAuthorizedKeys(cfg.AuthorizedKeysPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load authorized keys: %w", err)
+		}
+		s.authorizedKeys = keys
+		s.authorizedKeys.Start()
+
+		s.sshConfig.NoClientAuth = false
+		s.sshConfig.NoClientAuthCallback = nil
+		s.sshConfig.PublicKeyCallback = s.authPublicKey
+		if !cfg.RequireAuthorizedKey {
+			s.sshConfig.KeyboardInteractiveCallback = s.authKeyboardInteractive
+		}
+	}
+
+	// A host key kept in a secret manager is set by the caller with SetHostKey
+	if cfg.HostKeySecret == "" {
+		hostKey, err := loadOrGenerateHostKey(cfg.HostKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load host key: %w", err)
+		}
+		s.setHostKey(hostKey)
+	}
+
+	if cfg.StorePath != "" {
+		if err := s.openStore(cfg.StorePath); err != nil {
+			return nil, err
+		}
+		s.reservations = s.store
+	}
+	if cfg.StorageURL != "" {
+		shared, err := storage.Open(cfg.StorageURL, os.Getenv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open storage: %w", err)
+		}
+		s.reservations = store.NewSharedReservations(shared)
+	}
+
+	var spill storage.Storage
+	if cfg.CaptureSpillURL != "" {
+		st, err := storage.Open(cfg.CaptureSpillURL, os.Getenv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open capture spill storage: %w", err)
+		}
+		spill = storage.WithPrefix(st, "captures/")
+	}
+	s.captures = NewCaptureStore(cfg.CaptureBodyLimit, spill)
+	s.captures.SetMemoryBudget(s.memory)
+
+	if s.overload.Enabled() {
+		s.startOverloadWatch()
+	}
+
+	return s, nil
+}
+
+// Domain returns the default serving domain
+func (s *Server) Domain() string {
+	return s.domain
+}
+
+// SSHConfig returns the SSH server configuration
+func (s *Server) SSHConfig() *ssh.ServerConfig {
+	return s.sshConfig
+}
+
+func loadOrGenerateHostKey(path string) (ssh.Signer, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Printf("Generating new host key at %s", path)
+
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		pemBlock := &pem.Block{
+			Type:  "OPENSSH PRIVATE KEY",
+			Bytes: edkey.MarshalED25519PrivateKey(priv),
+		}
+
+		if err := os.WriteFile(path, pem.EncodeToMemory(pemBlock), 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(keyBytes)
+}
+
+// SetHostKey parses a PEM private key and serves it as the SSH host key,
+// replacing the current one for new connections
+func (s *Server) SetHostKey(pemBytes []byte) error {
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return err
+	}
+	s.setHostKey(signer)
+	return nil
+}
+
+func (s *Server) setHostKey(signer ssh.Signer) {
+	if s.hostKey.Swap(&signer) == nil {
+		s.sshConfig.AddHostKey(hostKeySigner{s})
+	}
+}
+
+// hostKeySigner signs with the server's current host key, so that the key
+// can be rotated without touching the shared SSH server configuration
+type hostKeySigner struct{ s *Server }
+
+func (h hostKeySigner) current() ssh.Signer { return *h.s.hostKey.Load() }
+
+func (h hostKeySigner) PublicKey() ssh.PublicKey { return h.current().PublicKey() }
+
+func (h hostKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return h.current().Sign(rand, data)
+}
+
+func (h hostKeySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if as, ok := h.current().(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return h.current().Sign(rand, data)
+}
+
+// GenerateUniqueSubdomain generates a subdomain with a hex suffix of suffixLen
+// characters that doesn't collide with existing ones. Subdomains for an account
+// share a stable prefix derived from the account name.
+func (s *Server) GenerateUniqueSubdomain(account string, suffixLen int) (string, error) {
+	const maxAttempts = 10
+	for i := 0; i < maxAttempts; i++ {
+		generate := func() (string, error) { return subdomain.Generate(suffixLen) }
+		if account != "" {
+			generate = func() (string, error) { return subdomain.GenerateFor(account, suffixLen) }
+		}
+		sub, err := generate()
+		if err != nil {
+			return "", err
+		}
+
+		s.mu.RLock()
+		_, exists := s.pools[sub]
+		s.mu.RUnlock()
+
+		if !exists && !s.isReservedSubdomain(sub) && !s.isHeld(sub) {
+			return sub, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate unique subdomain after %d attempts", maxAttempts)
+}
+
+// CheckAndReserveConnection checks if a new connection from the given IP is allowed
+// and atomically reserves a slot if allowed. Returns true if reservation was made.
+// Caller MUST call DecrementIPConnection when done if this returns nil.
+func (s *Server) CheckAndReserveConnection(clientIP string) error {
+	// New tunnels are paused during maintenance
+	if err := s.checkMaintenance(); err != nil {
+		return err
+	}
+
+	// Check if IP is blocked
+	if expiry := s.abuseTracker.GetBlockExpiry(clientIP); !expiry.IsZero() {
+		remaining := time.Until(expiry).Round(time.Minute)
+		return fmt.Errorf("IP %s is temporarily blocked. Try again in %v", clientIP, remaining)
+	}
+
+	// Trusted IPs skip the blocklists and connection rate limit
+	trusted := s.abuseTracker.IsTrusted(clientIP)
+
+	// Check external blocklists
+	if !trusted && s.abuseTracker.IsListed(clientIP) {
+		return fmt.Errorf("IP %s is listed on a blocklist used by this server", clientIP)
+	}
+
+	// Check daily bandwidth quota
+	if s.bandwidth.Exceeded(s.ipKey(clientIP)) {
+		return fmt.Errorf("daily bandwidth quota of %d MB exceeded for IP %s. Quota resets at midnight UTC", s.bandwidth.Quota()/(1024*1024), clientIP)
+	}
+
+	// Check connection rate limit
+	if !trusted && !s.abuseTracker.CheckConnectionRate(clientIP) {
+		return fmt.Errorf("connection rate limit exceeded: max %d connections per minute. Try again in a minute; repeated violations will result in a temporary block", config.MaxConnectionsPerMinute)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The per-IP tunnel limit is checked during authentication, once the
+	// client's authorized key (and so its limit) is known
+	if s.tunnelCount >= config.MaxTotalTunnels {
+		return fmt.Errorf("server capacity reached: max %d total tunnels. Try again later", config.MaxTotalTunnels)
+	}
+
+	// Atomically reserve the connection slot
+	s.ipConnections[s.ipKey(clientIP)]++
+	return nil
+}
+
+// ipKey returns the key clientIP is counted under (see ipKey)
+func (s *Server) ipKey(clientIP string) string {
+	return ipKey(clientIP, s.ipv6Prefix)
+}
+
+// BlockIP blocks an IP address
+func (s *Server) BlockIP(ip string) {
+	s.abuseTracker.BlockIP(ip)
+}
+
+// DecrementIPConnection decrements the connection count for an IP
+func (s *Server) DecrementIPConnection(clientIP string) {
+	key := s.ipKey(clientIP)
+	s.mu.Lock()
+	s.ipConnections[key]--
+	if s.ipConnections[key] <= 0 {
+		delete(s.ipConnections, key)
+	}
+	s.mu.Unlock()
+}
+
+// RegisterTunnel registers a new tunnel, attaching it to the subdomain's pool.
+// The pool is created with the given join token if it does not exist yet.
+// A non-zero trafficPercent registers the tunnel as a canary backend.
+func (s *Server) RegisterTunnel(sub, joinToken string, trafficPercent int, listener net.Listener, bindAddr string, bindPort uint32, clientIP string) *tunnel.Tunnel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pool, ok := s.pools[sub]
+	if !ok {
+		pool = tunnel.NewPool(sub, joinToken)
+		s.pools[sub] = pool
+	}
+	t := tunnel.New(sub, listener, bindAddr, bindPort, clientIP)
+	t.SetTrafficPercent(trafficPercent)
+	t.SetThrottle(int(s.throttle.Load()))
+	pool.Add(t)
+	s.tunnelCount++
+	s.trackIPTunnel(t)
+	return t
+}
+
+// RemoveTunnel removes and closes a tunnel, dropping the subdomain once its last backend is gone
+func (s *Server) RemoveTunnel(sub string, t *tunnel.Tunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pool, ok := s.pools[sub]
+	if !ok {
+		return
+	}
+	before := pool.Len()
+	remaining := pool.Remove(t)
+	if remaining < before {
+		t.Close()
+		s.tunnelCount--
+		s.untrackIPTunnel(t)
+	}
+	if remaining == 0 {
+		delete(s.pools, sub)
+	}
+}
+
+// GetTunnel retrieves a tunnel by subdomain, picking among its backends round-robin
+func (s *Server) GetTunnel(sub string) *tunnel.Tunnel {
+	s.mu.RLock()
+	pool := s.pools[sub]
+	s.mu.RUnlock()
+	if pool == nil {
+		return nil
+	}
+	return pool.Next()
+}
+
+// GetPool retrieves the pool of backends serving a subdomain
+func (s *Server) GetPool(sub string) *tunnel.Pool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pools[sub]
+}
+
+// ResolveJoin parses an SSH username of the form "<subdomain>+<token>[+<percent>]"
+// and returns the subdomain, token and canary traffic percentage (0 for a regular
+// backend) if they match an active pool.
+func (s *Server) ResolveJoin(user string) (sub, token string, percent int, ok bool) {
+	parts := strings.Split(user, "+")
+	if len(parts) < 2 || len(parts) > 3 || !s.isValidSubdomain(parts[0]) {
+		return "", "", 0, false
+	}
+	sub, token = parts[0], parts[1]
+	if len(parts) == 3 {
+		p, err := strconv.Atoi(parts[2])
+		if err != nil || p < 1 || p > 99 {
+			return "", "", 0, false
+		}
+		percent = p
+	}
+	// Subdomains whose last backend has gone can be resumed with their token
+	// while the store still holds them
+	pool := s.GetPool(sub)
+	if pool == nil && s.canResume(sub, token) {
+		return sub, token, percent, true
+	}
+	if pool == nil || !pool.CheckJoinToken(token) {
+		return "", "", 0, false
+	}
+	return sub, token, percent, true
+}
+
+// generateJoinToken returns a random secret used to attach extra backends to a subdomain
+func generateJoinToken() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// RegisterSSHConn registers an SSH connection for an IP (for forced closure on block)
+func (s *Server) RegisterSSHConn(clientIP string, conn *ssh.ServerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.ipKey(clientIP)
+	s.sshConns[key] = append(s.sshConns[key], conn)
+}
+
+// UnregisterSSHConn removes an SSH connection from tracking
+func (s *Server) UnregisterSSHConn(clientIP string, conn *ssh.ServerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.ipKey(clientIP)
+	conns := s.sshConns[key]
+	// Build new slice without the target connection
+	newConns := make([]*ssh.ServerConn, 0, len(conns))
+	for _, c := range conns {
+		if c != conn {
+			newConns = append(newConns, c)
+		}
+	}
+
+	if len(newConns) == 0 {
+		delete(s.sshConns, key)
+	} else {
+		s.sshConns[key] = newConns
+	}
+}
+
+// CloseAllForIP closes all SSH connections for a specific IP, or for every
+// address of an IPv6 prefix
+// Closing SSH connections triggers cleanup which removes tunnels via defers
+// Returns the number of connections closed
+func (s *Server) CloseAllForIP(ip string) int {
+	// Collect connections while holding the lock
+	ip = s.ipKey(ip)
+	s.mu.Lock()
+	sshConns := s.sshConns[ip]
+	// Make a copy of the slice since we'll modify the map after releasing lock
+	connsCopy := make([]*ssh.ServerConn, len(sshConns))
+	copy(connsCopy, sshConns)
+	// Remove from map now to prevent double-close attempts
+	delete(s.sshConns, ip)
+	s.mu.Unlock()
+
+	// Close connections outside the lock to avoid deadlock
+	// The cleanup handlers (UnregisterSSHConn) will be no-ops since we already removed from map
+	for _, conn := range connsCopy {
+		conn.Close()
+	}
+
+	return len(connsCopy)
+}
+
+// CloseAll closes every SSH connection, ending all tunnels, and returns the
+// number of connections closed
+func (s *Server) CloseAll() int {
+	s.mu.Lock()
+	var conns []*ssh.ServerConn
+	for ip, ipConns := range s.sshConns {
+		conns = append(conns, ipConns...)
+		delete(s.sshConns, ip)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// Drain waits until no proxied requests or WebSocket connections are in
+// flight, so shutdown does not cut them off when tunnels close. It returns
+// ctx's error if they are still open when ctx is done.
+func (s *Server) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(config.DrainCheckInterval)
+	defer ticker.Stop()
+	for {
+		requests, websockets := s.inFlightRequests.Load(), s.activeWebSockets.Load()
+		if requests == 0 && websockets == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopped draining with %d requests and %d WebSocket connections open", requests, websockets)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop gracefully stops the server's background goroutines
+func (s *Server) Stop() {
+	s.abuseTracker.Stop()
+	s.visitorLimiter.Stop()
+	if s.captures != nil {
+		s.captures.Stop()
+	}
+	s.stopOverloadWatch()
+	if s.blocklists != nil {
+		s.blocklists.Stop()
+	}
+	if s.authorizedKeys != nil {
+		s.authorizedKeys.Stop()
+	}
+	if s.store != nil {
+		s.closeStore()
+	}
+}
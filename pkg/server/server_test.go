@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+func newTestListener(t testing.TB) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create test listener: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func TestRegisterTunnel_SharedSubdomain(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+
+	a := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	b := s.RegisterTunnel(sub, "ignored", 0, newTestListener(t), "", 80, "5.6.7.8")
+
+	if got := s.GetPool(sub).Len(); got != 2 {
+		t.Fatalf("pool size = %d, want 2", got)
+	}
+	if s.GetPool(sub).JoinToken != "secret" {
+		t.Error("joining tunnel should not replace the pool's join token")
+	}
+	if first, second := s.GetTunnel(sub), s.GetTunnel(sub); first == second {
+		t.Error("GetTunnel() should alternate between backends")
+	}
+	if got := s.GetStats(false, false).ActiveTunnels; got != 2 {
+		t.Errorf("ActiveTunnels = %d, want 2", got)
+	}
+
+	s.RemoveTunnel(sub, a)
+	if s.GetTunnel(sub) != b {
+		t.Error("remaining backend should serve the subdomain")
+	}
+
+	s.RemoveTunnel(sub, b)
+	if s.GetTunnel(sub) != nil || s.GetPool(sub) != nil {
+		t.Error("subdomain should be released once its last backend is removed")
+	}
+	if got := s.GetStats(false, false).ActiveTunnels; got != 0 {
+		t.Errorf("ActiveTunnels = %d, want 0", got)
+	}
+}
+
+func TestResolveJoin(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+
+	tests := []struct {
+		name string
+		user string
+		want bool
+	}{
+		{"valid token", sub + "+secret", true},
+		{"canary percent", sub + "+secret+10", true},
+		{"percent out of range", sub + "+secret+100", false},
+		{"percent not a number", sub + "+secret+ten", false},
+		{"wrong token", sub + "+nope", false},
+		{"no token", sub, false},
+		{"plain username", "alice", false},
+		{"unknown subdomain", "calm-eagle-12345678+secret", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotSub, _, _, ok := s.ResolveJoin(tt.user)
+			if ok != tt.want {
+				t.Fatalf("ResolveJoin(%q) ok = %v, want %v", tt.user, ok, tt.want)
+			}
+			if ok && gotSub != sub {
+				t.Errorf("ResolveJoin(%q) sub = %q, want %q", tt.user, gotSub, sub)
+			}
+		})
+	}
+}
+
+func TestGetStats_Subdomains(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	a := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	b := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "5.6.7.8")
+	s.RegisterTunnel("calm-eagle-12345678", "", 0, newTestListener(t), "", 80, "1.2.3.4")
+	a.IncrementRequests()
+	b.IncrementRequests()
+	a.AddBytes(100)
+	b.RecordRateLimitHit()
+
+	subs := s.GetStats(true, false).Subdomains
+	if len(subs) != 2 || subs[0].Subdomain != "calm-eagle-12345678" {
+		t.Fatalf("Subdomains = %+v, want two sorted by name", subs)
+	}
+	got := subs[1]
+	if got.Backends != 2 || len(got.ClientIPs) != 2 || got.Requests != 2 || got.Bytes != 100 || got.RateLimitHits != 1 {
+		t.Errorf("subdomain = %+v", got)
+	}
+	if !got.ExpiresAt.After(got.CreatedAt) {
+		t.Errorf("ExpiresAt = %v, want after CreatedAt %v", got.ExpiresAt, got.CreatedAt)
+	}
+}
+
+func TestNew_CleansUpOnError(t *testing.T) {
+	before := runtime.NumGoroutine()
+	cfg := config.Default()
+	dir := t.TempDir()
+	cfg.HostKeyPath = dir + "/host_key"
+	cfg.StorePath = dir + "/tunnl.db"
+	cfg.CaptureSpillURL = "bogus://spill"
+	if _, err := New(cfg); err == nil {
+		t.Fatal("New() should reject an invalid capture spill URL")
+	}
+
+	// The goroutines New started are gone once it has failed
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines after a failed New(), want at most %d", n, before)
+	}
+}
+
+func TestCheckAndReserveConnection_Trusted(t *testing.T) {
+	cfg := config.Default()
+	cfg.HostKeyPath = t.TempDir() + "/host_key"
+	cfg.TrustedIPs = []string{"not-an-ip"}
+	if _, err := New(cfg); err == nil {
+		t.Fatal("New() should reject an invalid trusted IP")
+	}
+
+	cfg.TrustedIPs = []string{"192.0.2.0/24"}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Stop()
+	s.abuseTracker.SetBlocklist([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+
+	for i := 0; i < 2*config.MaxConnectionsPerMinute; i++ {
+		if err := s.CheckAndReserveConnection("192.0.2.10"); err != nil {
+			t.Fatalf("trusted connection %d refused: %v", i+1, err)
+		}
+		s.DecrementIPConnection("192.0.2.10")
+	}
+	if err := s.CheckAndReserveConnection("198.51.100.1"); err != nil {
+		t.Fatalf("untrusted connection refused: %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain() of an idle server = %v", err)
+	}
+
+	s.inFlightRequests.Add(1)
+	s.activeWebSockets.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain() with open connections = %v, want DeadlineExceeded", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Drain(context.Background()) }()
+	s.inFlightRequests.Add(-1)
+	s.activeWebSockets.Add(-1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Drain() = %v once connections finished", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Drain() did not return once connections finished")
+	}
+}
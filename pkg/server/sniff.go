@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// sniffLen is how many bytes are peeked at; every HTTP/1.x request and the
+// HTTP/2 preface is longer
+const sniffLen = 16
+
+// sniffedConn is a connection whose first bytes were peeked at
+type sniffedConn struct {
+	net.Conn
+	r io.Reader // replays the peeked bytes, then reads the connection
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// sniffHTTP waits for the first bytes of a connection to a tunnel listener
+// and reports whether they start an HTTP request. The returned connection
+// replays the peeked bytes. Only the proxy should connect to the listeners,
+// so anything else is another local program speaking raw TCP to them.
+func sniffHTTP(conn net.Conn) (net.Conn, []byte, bool) {
+	// The transport may keep a connection it dialed idle before writing a
+	// request, so the wait outlasts its idle timeout
+	conn.SetReadDeadline(time.Now().Add(config.SniffTimeout))
+	r := bufio.NewReaderSize(conn, sniffLen)
+	head, _ := r.Peek(sniffLen)
+	conn.SetReadDeadline(time.Time{})
+	return &sniffedConn{Conn: conn, r: r}, head, looksLikeHTTP(head)
+}
+
+// looksLikeHTTP reports whether b starts with a request method, an
+// uppercase token followed by a space, as in "GET / HTTP/1.1" or the
+// "PRI * HTTP/2.0" preface
+func looksLikeHTTP(b []byte) bool {
+	i := bytes.IndexByte(b, ' ')
+	if i < 1 {
+		return false
+	}
+	for _, c := range b[:i] {
+		if (c < 'A' || c > 'Z') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestLooksLikeHTTP(t *testing.T) {
+	tests := []struct {
+		head string
+		want bool
+	}{
+		{"GET / HTTP/1.1\r\n", true},
+		{"OPTIONS * HTTP/1.", true},
+		{"PROPFIND /dav HTT", true},
+		{"PRI * HTTP/2.0\r\n", true},
+		{"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", false}, // TLS ClientHello
+		{"SSH-2.0-OpenSSH_9", false},
+		{"*1\r\n$4\r\nPING\r\n", false}, // Redis
+		{" GET / HTTP/1.1", false},
+		{"get / HTTP/1.1\r\n", false},
+		{"GET", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := looksLikeHTTP([]byte(tt.head)); got != tt.want {
+			t.Errorf("looksLikeHTTP(%q) = %v, want %v", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestForwardToSSH_RejectsNonHTTP(t *testing.T) {
+	s := newTestServer(t)
+	sshConn := newForwardingConn(t, 0)
+	tun := s.RegisterTunnel("happy-tiger-abcdef01", "", 0, newTestListener(t), "", 80, "1.2.3.4")
+
+	// Raw TCP is closed without reaching the client
+	local, backend := net.Pipe()
+	go local.Write([]byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00\x00\x00\x00\x00"))
+	s.forwardToSSH(sshConn, backend, tun, tun.BindPort)
+	if got := s.nonHTTPRejected.Load(); got != 1 {
+		t.Errorf("nonHTTPRejected = %d, want 1", got)
+	}
+	if got := s.forwardedChannels.Load(); got != 0 {
+		t.Errorf("forwardedChannels = %d, want no channel opened", got)
+	}
+
+	// HTTP is relayed, peeked bytes included (the client echoes)
+	local, backend = net.Pipe()
+	defer local.Close()
+	go s.forwardToSSH(sshConn, backend, tun, tun.BindPort)
+	req := "GET / HTTP/1.1\r\nHost: x\r\n\r\n"
+	go local.Write([]byte(req))
+	buf := make([]byte, len(req))
+	if _, err := io.ReadFull(local, buf); err != nil || string(buf) != req {
+		t.Errorf("relayed %q, %v, want the request echoed", buf, err)
+	}
+}
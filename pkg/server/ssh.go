@@ -0,0 +1,949 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnl.gg/internal/subdomain"
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+type tcpipForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type envRequest struct {
+	Name  string
+	Value string
+}
+
+type execRequest struct {
+	Command string
+}
+
+// ptyRequest is the payload of a pty-req session request (RFC 4254 6.2)
+type ptyRequest struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32 // pixels
+	Modes         string
+}
+
+// windowChangeRequest is the payload of a window-change session request (RFC 4254 6.7)
+type windowChangeRequest struct {
+	Columns, Rows uint32
+	Width, Height uint32 // pixels
+}
+
+type forwardedTCPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// HandleSSHConnection handles a new SSH connection
+func (s *Server) HandleSSHConnection(conn net.Conn) {
+	s.accepts[listenerSSH].Record()
+	clientIP := addrIP(conn.RemoteAddr())
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		// Set TCP_NODELAY to prevent SSH library from logging errors
+		tcpConn.SetNoDelay(true)
+	}
+
+	// Check rate limits and reservations before the handshake. Rejected clients
+	// still complete key exchange so the reason reaches them as an auth banner,
+	// after which authentication fails.
+	sshConfig := s.sshConfig
+	if err := s.CheckAndReserveConnection(clientIP); err != nil {
+		log.Printf("Connection rejected from %s: %v", clientIP, err)
+		sshConfig = s.rejectionConfig(err)
+	} else {
+		// Connection slot reserved - must decrement on exit
+		defer s.DecrementIPConnection(clientIP)
+	}
+
+	conn.SetDeadline(time.Now().Add(config.SSHHandshakeTimeout))
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
+	if err != nil {
+		if sshConfig == s.sshConfig {
+			log.Printf("SSH handshake failed: %v", err)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{}) // clear deadline after successful handshake
+	defer sshConn.Close()
+
+	// Track SSH connection for forced closure on IP block
+	s.RegisterSSHConn(clientIP, sshConn)
+	defer s.UnregisterSSHConn(clientIP, sshConn)
+
+	// Authorized keys and non-generic usernames identify an account with its
+	// own quotas. The auth callbacks already turned away accounts over quota,
+	// so this only fails if a concurrent connection took the last slot.
+	key := s.clientKey(sshConn)
+	account := accountName(sshConn.User())
+	quotaAccount := s.quotaAccount(account, key, clientIP)
+	tier := s.tiers.For(key)
+	_, accountLimit := tunnelLimits(tier, key)
+	if err := s.quotas.Reserve(quotaAccount, accountLimit, accountRate(tier, key)); err != nil {
+		log.Printf("Connection rejected from %s: %v", clientIP, err)
+		return
+	}
+	defer s.quotas.Release(quotaAccount)
+	s.recordUser(account)
+
+	s.IncrementConnections()
+
+	// Clients presenting "<subdomain>+<token>[+<percent>]" as the username attach
+	// as an additional (or canary) backend of an existing subdomain; everyone
+	// else gets a new one
+	sub, joinToken, trafficPercent, joined := s.ResolveJoin(sshConn.User())
+	if joined {
+		log.Printf("New SSH connection from %s, joined subdomain: %s", sshConn.RemoteAddr(), sub)
+	} else if reserved := strings.ToLower(sshConn.User()); key != nil && key.Reserves(reserved) {
+		// Keys claim their reserved subdomains by connecting as <subdomain>@domain;
+		// further connections with the key attach as extra backends
+		sub = reserved
+		if pool := s.GetPool(sub); pool != nil {
+			joinToken, joined = pool.JoinToken, true
+		} else if joinToken, err = generateJoinToken(); err != nil {
+			log.Printf("Failed to generate join token: %v", err)
+			return
+		}
+		log.Printf("New SSH connection from %s (key %q), claimed reserved subdomain: %s", sshConn.RemoteAddr(), key.Name, sub)
+	} else {
+		// The auth callbacks refused unknown entropy levels
+		_, level := splitEntropy(sshConn.User())
+		suffixLen, _ := subdomain.SuffixLength(level)
+		sub, err = s.GenerateUniqueSubdomain(account, suffixLen)
+		if err != nil {
+			log.Printf("Failed to generate subdomain: %v", err)
+			return
+		}
+		joinToken, err = generateJoinToken()
+		if err != nil {
+			log.Printf("Failed to generate join token: %v", err)
+			return
+		}
+		log.Printf("New SSH connection from %s (account %q), assigned subdomain: %s", sshConn.RemoteAddr(), account, sub)
+		s.holdSubdomain(sub, account, joinToken)
+	}
+
+	tunnelListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("Failed to create tunnel listener: %v", err)
+		return
+	}
+	// Ensure listener is closed on early return (before tunnel registration)
+	// This is safe even after tunnel registration since net.Listener.Close() is idempotent
+	defer tunnelListener.Close()
+
+	var bindAddr string
+	var bindPort uint32
+	tunnelRegistered := make(chan struct{})
+	var tun *tunnel.Tunnel
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Handle global requests (port forwarding and OpenSSH keepalives)
+	go func() {
+		for {
+			select {
+			case req, ok := <-reqs:
+				if !ok {
+					return
+				}
+				switch req.Type {
+				case "tcpip-forward":
+					var fwdReq tcpipForwardRequest
+					if err := ssh.Unmarshal(req.Payload, &fwdReq); err != nil {
+						req.Reply(false, nil)
+						continue
+					}
+					if tun != nil {
+						// Further forwards serve the paths routed to them
+						req.Reply(s.addForward(sshConn, tun, fwdReq.BindPort), nil)
+						continue
+					}
+					bindAddr = fwdReq.BindAddr
+					bindPort = fwdReq.BindPort
+					tun = s.RegisterTunnel(sub, joinToken, trafficPercent, tunnelListener, bindAddr, bindPort, clientIP)
+					tun.SetSSHConn(sshConn)
+					tun.SetAccount(account)
+					tun.SetQuotaAccount(quotaAccount)
+					close(tunnelRegistered)
+					req.Reply(true, nil)
+				case "cancel-tcpip-forward":
+					req.Reply(true, nil)
+				case "keepalive@openssh.com", "no-more-sessions@openssh.com":
+					// Sent by OpenSSH clients with ServerAliveInterval, and by
+					// those that will open no further sessions; both need no action
+					req.Reply(true, nil)
+				default:
+					req.Reply(false, nil)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-tunnelRegistered:
+	case <-time.After(30 * time.Second):
+		log.Printf("Timeout waiting for tcpip-forward request from %s", sshConn.RemoteAddr())
+		return
+	}
+
+	defer s.releaseSubdomain(sub)
+	defer s.RemoveTunnel(sub, tun)
+	defer func() { s.usage.AddTunnelTime(account, sub, tun.CreatedAt, time.Now()) }()
+
+	pool := s.GetPool(sub)
+
+	// Limits of the client's tier, then privileges granted by its authorized key
+	tierRate, lifetime, idleTimeout := tier.TunnelLimits()
+	tun.SetTier(tier.Name)
+	tun.SetRateLimit(tierRate)
+	tun.SetLifetime(lifetime, idleTimeout)
+	wsIdleTimeout, wsMaxTransfer := tier.WebSocketLimits()
+	if key != nil {
+		if key.Rate > 0 {
+			tun.SetRateLimit(key.Rate)
+		}
+		if key.WebSocketIdleTimeout > 0 {
+			wsIdleTimeout = key.WebSocketIdleTimeout
+		}
+		if key.MaxWebSocketTransfer > 0 {
+			wsMaxTransfer = key.MaxWebSocketTransfer
+		}
+		if key.NoWarning {
+			pool.SetNoWarning(true)
+		}
+		if key.Domain != "" && !joined {
+			if s.servesDomain(key.Domain) {
+				pool.SetDomain(key.Domain)
+			} else {
+				log.Printf("Authorized key %q assigns domain %q, which is not served; using %s", key.Name, key.Domain, s.domain)
+			}
+		}
+	}
+	tun.SetWebSocketLimits(wsIdleTimeout, wsMaxTransfer)
+	tun.SetMaxResponseSize(s.responseLimit(tier, key))
+	// Limits set by an operator on the subdomain apply to every backend
+	if rps, burst, ok := pool.RateLimits(); ok {
+		tun.SetRateBurst(rps, burst)
+	}
+
+	expiresAt := tun.CreatedAt.Add(lifetime).Format("Jan 02, 2006 at 15:04 MST")
+	expiresLine := fmt.Sprintf("%s (or %s idle)", expiresAt, formatDuration(idleTimeout))
+
+	status := "Tunnel is live!"
+	if joined && trafficPercent > 0 {
+		status = fmt.Sprintf("Joined tunnel as canary receiving %d%% of traffic!", trafficPercent)
+	} else if joined {
+		status = fmt.Sprintf("Joined tunnel as backend %d!", pool.Len())
+	}
+
+	// The banner is built once session setup (env options) is complete, and
+	// rebuilt for the new width when the terminal is resized
+	buildBanner := func(width int) string {
+		url, domain := s.publicURL(pool), s.domainOf(pool)
+		rows := []bannerRow{
+			{value: "Connected to " + domain + ".", sep: " "},
+			{value: status, color: boldGreen, sep: " "},
+			{label: "Public URL:", value: url, color: purple},
+			{label: "Expires:", value: expiresLine, sep: " "},
+		}
+		if account != "" {
+			rows = append(rows, bannerRow{label: "Account:", value: account, color: purple})
+		}
+		if tier.Name != "" {
+			rows = append(rows, bannerRow{label: "Tier:", value: tier.Name, color: purple})
+		}
+		if tun.Private() {
+			rows = append(rows, bannerRow{label: "Privacy:", value: "on", color: purple, note: "(visitor IPs and user agents are not sent to your app)"})
+		}
+		for _, svc := range tun.Services() {
+			rows = append(rows, bannerRow{label: "Service:", value: s.serviceURL(pool, svc.Name), color: purple, note: fmt.Sprintf("(to port %d)", svc.Port)})
+		}
+		for _, r := range tun.Routes() {
+			rows = append(rows, bannerRow{label: "Route:", value: url + r.Prefix, color: purple, note: fmt.Sprintf("(to port %d)", r.Port)})
+		}
+		if passphrase := pool.Passphrase(); passphrase != "" {
+			rows = append(rows, bannerRow{label: "Passphrase:", value: passphrase, color: purple, note: "(visitors must enter it once)"})
+		}
+		if user := pool.BasicAuthUser(); user != "" {
+			rows = append(rows, bannerRow{label: "Basic auth:", value: user, color: purple, note: "(visitors must log in)"})
+		}
+		if token := pool.BypassToken(); token != "" {
+			rows = append(rows, bannerRow{label: "Bypass:", value: url + "/?" + config.BypassQueryParam + "=" + token, color: purple, note: "(skips the browser warning)"})
+		}
+		if !joined {
+			rows = append(rows, bannerRow{label: "Add backend:", value: "ssh -t -R 80:localhost:<port> " + sub + "+" + joinToken + "@" + domain})
+			if s.reservations != nil {
+				rows = append(rows, bannerRow{label: " ", value: "(also resumes this URL up to " + formatDuration(config.ResumeWindow) + " after disconnecting)", sep: " "})
+			}
+		}
+		rows = append(rows, bannerRow{label: "Keys:", value: "l logging on/off, v verbose, i visitors, h history, d download, p pause, Ctrl+C quit", sep: ", "})
+		return renderBanner(rows, width)
+	}
+
+	// Inactivity checker
+	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if tun.IsExpired() {
+					log.Printf("Tunnel %s expired due to inactivity", sub)
+					sshConn.Close()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Backend health prober
+	go func() {
+		ticker := time.NewTicker(config.HealthProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				healthy, probed := probeBackend(sshConn, tun)
+				if !probed || !tun.SetHealthy(healthy) {
+					continue
+				}
+				logger := tun.Logger()
+				if healthy {
+					log.Printf("Backend for %s is responding again", sub)
+					if logger != nil {
+						logger.LogNotice("Local server is responding again")
+					}
+				} else {
+					log.Printf("Backend for %s is not responding", sub)
+					if logger != nil {
+						logger.LogNotice(fmt.Sprintf("Local server not responding (forwarded port %d)", tun.BindPort))
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Wait for a session channel with timeout
+	sessionReceived := make(chan ssh.NewChannel, 1)
+	go func() {
+		for {
+			select {
+			case newChannel, ok := <-chans:
+				if !ok {
+					return
+				}
+				if newChannel.ChannelType() == "session" {
+					sessionReceived <- newChannel
+					return
+				}
+				newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var sessionChannel ssh.NewChannel
+	select {
+	case sessionChannel = <-sessionReceived:
+	case <-time.After(5 * time.Second):
+		log.Printf("Connection from %s rejected: no session channel (use ssh -t)", sshConn.RemoteAddr())
+		return
+	}
+
+	channel, requests, err := sessionChannel.Accept()
+	if err != nil {
+		log.Printf("Failed to accept session channel: %v", err)
+		return
+	}
+
+	// Handle session requests. Clients send env options before the shell
+	// request, so the banner waits for it to reflect them.
+	shellRequested := make(chan struct{})
+	var shellOnce sync.Once
+	var termWidth atomic.Uint32
+	resized := make(chan struct{}, 1)
+	go func(ch ssh.Channel, reqs <-chan *ssh.Request) {
+		for req := range reqs {
+			switch req.Type {
+			case "pty-req":
+				var pty ptyRequest
+				if err := ssh.Unmarshal(req.Payload, &pty); err == nil {
+					tun.SetLogColor(pty.Term != "dumb")
+					termWidth.Store(pty.Columns)
+					tun.SetLogWidth(int(pty.Columns))
+				}
+				if req.WantReply {
+					req.Reply(true, nil)
+				}
+			case "window-change":
+				var wc windowChangeRequest
+				if err := ssh.Unmarshal(req.Payload, &wc); err == nil && termWidth.Swap(wc.Columns) != wc.Columns {
+					tun.SetLogWidth(int(wc.Columns))
+					select {
+					case resized <- struct{}{}:
+					default:
+					}
+				}
+				// window-change never wants a reply
+			case "shell":
+				if req.WantReply {
+					req.Reply(true, nil)
+				}
+				shellOnce.Do(func() { close(shellRequested) })
+			case "signal":
+				if req.WantReply {
+					req.Reply(true, nil)
+				}
+				sshConn.Close()
+				return
+			case "env":
+				var env envRequest
+				ok := ssh.Unmarshal(req.Payload, &env) == nil && s.applyEnv(pool, tun, key, env)
+				if req.WantReply {
+					req.Reply(ok, nil)
+				}
+			case "exec":
+				// The command is the tunnel's options, e.g. "auth=user:pass rate=5"
+				var exec execRequest
+				if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+					if req.WantReply {
+						req.Reply(false, nil)
+					}
+					continue
+				}
+				if req.WantReply {
+					req.Reply(true, nil)
+				}
+				opts, err := tunnel.ParseOptions(exec.Command)
+				if err == nil {
+					err = s.applyOptions(pool, tun, key, opts)
+				}
+				if err != nil {
+					log.Printf("Rejected options from %s for %s: %v", sshConn.RemoteAddr(), sub, err)
+					fmt.Fprint(ch, formatOptionsError(err))
+					ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+					ch.Close()
+					continue
+				}
+				shellOnce.Do(func() { close(shellRequested) })
+			default:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+		}
+	}(channel, requests)
+
+	select {
+	case <-shellRequested:
+	case <-time.After(config.BannerWaitTimeout):
+	}
+
+	bannerWidth := termWidth.Load()
+	fmt.Fprint(channel, buildBanner(int(bannerWidth)))
+
+	logger := tunnel.NewRequestLogger(channel, config.LogBufferSize)
+	logger.SetBudget(s.memory.For(memoryLogs))
+	tun.SetLogger(logger)
+	defer logger.Close()
+
+	// On shutdown, clustered servers point the client at another node
+	defer s.registerMigration(tun, func(hint MigrationHint) {
+		if s.reservations != nil {
+			// Held from now on, as the tunnel is still registered here
+			s.extendReservation(sub)
+			hint.Resume = sub + "+" + joinToken
+		}
+		writeMigrationHint(channel, logger, hint)
+		sshConn.Close()
+	})()
+
+	// Redraw the banner once the terminal has settled on a new width, as the
+	// old one no longer fits or leaves long lines broken
+	go func() {
+		for {
+			select {
+			case <-resized:
+			case <-ctx.Done():
+				return
+			}
+			timer := time.NewTimer(config.ResizeRedrawDelay)
+		settle:
+			for {
+				select {
+				case <-resized:
+					timer.Reset(config.ResizeRedrawDelay)
+				case <-timer.C:
+					break settle
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+			if width := termWidth.Load(); width != bannerWidth {
+				bannerWidth = width
+				logger.Print(buildBanner(int(width)))
+			}
+		}
+	}()
+
+	// Accept connections on the tunnel listener
+	go s.acceptForwarded(tunnelListener, sshConn, tun, tun.BindPort)
+
+	// Read from channel to detect disconnect, Ctrl+C and log keypresses
+	buf := make([]byte, 1)
+	for {
+		_, err := channel.Read(buf)
+		if err != nil {
+			break
+		}
+		if buf[0] == 0x03 { // Ctrl+C
+			sshConn.Close()
+			break
+		}
+		switch buf[0] {
+		case 'l', 'L':
+			logger.ToggleRequests()
+		case 'v', 'V':
+			logger.ToggleVerbose()
+		case 'i', 'I':
+			logger.ToggleVisitors()
+		case 'h', 'H':
+			logger.LogHistory(tun.History().Recent(config.HistoryReplaySize))
+		case 'd', 'D':
+			logger.LogNotice("Access log: curl -OJ '" + s.accessLogURL(pool) + "' (add &format=json for JSON)")
+		case 'p', 'P', ' ':
+			logger.TogglePause()
+		}
+	}
+
+	log.Printf("SSH connection closed for subdomain: %s", sub)
+}
+
+// applyEnv applies a client environment variable sent via ssh -o SetEnv.
+// Returns false if the variable is not a recognized tunnl option.
+func (s *Server) applyEnv(pool *tunnel.Pool, tun *tunnel.Tunnel, key *AuthorizedKey, env envRequest) bool {
+	opts := &tunnel.Options{}
+	switch {
+	case strings.HasPrefix(env.Name, config.LabelEnvPrefix):
+		// Labels arrive as TUNNL_LABEL_<key>=<value>
+		key := strings.ToLower(strings.TrimPrefix(env.Name, config.LabelEnvPrefix))
+		opts.Labels = map[string]string{key: env.Value}
+	case env.Name == config.NoColorEnv:
+		// Any non-empty value opts out, as with NO_COLOR elsewhere
+		opts.NoColor = env.Value != ""
+	case env.Name == config.PassphraseEnv, env.Name == config.BypassEnv:
+		enabled, err := strconv.ParseBool(env.Value)
+		if err != nil {
+			return false
+		}
+		opts.Passphrase = enabled && env.Name == config.PassphraseEnv
+		opts.BypassToken = enabled && env.Name == config.BypassEnv
+	default:
+		return false
+	}
+	return s.applyOptions(pool, tun, key, opts) == nil
+}
+
+// applyOptions applies a client's tunnel options to its tunnel and subdomain
+// pool. key is the client's authorized key, nil for anonymous clients.
+func (s *Server) applyOptions(pool *tunnel.Pool, tun *tunnel.Tunnel, key *AuthorizedKey, opts *tunnel.Options) error {
+	if opts.Subdomain != "" && opts.Subdomain != pool.Subdomain {
+		return fmt.Errorf("subdomain=%s: connect as %s@%s with an authorized key that reserves it", opts.Subdomain, opts.Subdomain, s.domainOf(pool))
+	}
+	if opts.Domain != "" && opts.Domain != s.domainOf(pool) {
+		if !s.servesDomain(opts.Domain) {
+			return fmt.Errorf("domain=%s: not served here (available: %s)", opts.Domain, strings.Join(s.domains, ", "))
+		}
+		// Extra backends follow the domain the subdomain already has
+		if pool.Len() > 1 {
+			return fmt.Errorf("domain=%s: %s is already served on %s", opts.Domain, pool.Subdomain, s.domainOf(pool))
+		}
+	}
+
+	// Options outside the client's tier are refused before any is applied.
+	// no-warning turns off the anti-phishing page, so it also needs a key
+	// granting it unless the tier lists it.
+	tier := s.tiers.Get(tun.Tier())
+	for feature, requested := range map[string]bool{
+		"labels":       len(opts.Labels) > 0,
+		"auth":         opts.AuthUser != "",
+		"no-warning":   opts.NoWarning && (key == nil || !key.NoWarning),
+		"passphrase":   opts.Passphrase,
+		"bypass-token": opts.BypassToken,
+		"compress":     opts.Compress,
+		"inspect":      opts.Inspect,
+		"headers":      opts.RequestHeaders != nil || opts.ResponseHeaders != nil,
+	} {
+		if requested && !tier.Allows(feature) {
+			if tier == builtinTier {
+				return fmt.Errorf("%s: requires an authorized key that grants it", feature)
+			}
+			return fmt.Errorf("%s: not available on the %s tier", feature, tier.Name)
+		}
+	}
+
+	for _, r := range opts.Routes {
+		if !tun.HasForward(r.Port) {
+			return fmt.Errorf("route=%s:%d: port %d is not forwarded; add -R %d:localhost:<port>", r.Prefix, r.Port, r.Port, r.Port)
+		}
+	}
+	for _, svc := range opts.Services {
+		if !tun.HasForward(svc.Port) {
+			return fmt.Errorf("service=%s:%d: port %d is not forwarded; add -R %d:localhost:<port>", svc.Name, svc.Port, svc.Port, svc.Port)
+		}
+	}
+
+	for key, value := range opts.Labels {
+		if !tun.SetLabel(key, value) {
+			return fmt.Errorf("label.%s: invalid label or too many labels", key)
+		}
+	}
+	if opts.AuthUser != "" {
+		pool.SetBasicAuth(opts.AuthUser, opts.AuthPass)
+	}
+	// rate can only lower the tunnel's limit
+	if opts.Rate > 0 && opts.Rate < tun.RateLimit() {
+		tun.SetRateLimit(opts.Rate)
+	}
+	if opts.QueueTimeout > 0 {
+		tun.SetQueueTimeout(opts.QueueTimeout)
+	}
+	if opts.NoQueue {
+		tun.SetQueueTimeout(0)
+	}
+	if opts.NoWarning {
+		pool.SetNoWarning(true)
+	}
+	if opts.Compress {
+		pool.SetCompress(true)
+	}
+	if opts.AllowIndexing {
+		pool.SetIndexing(true)
+	}
+	if opts.Inspect {
+		pool.SetInspect(true)
+	}
+	if opts.LogVisitors {
+		tun.SetLogVisitors(true)
+	}
+	if opts.NoColor {
+		tun.DisableLogColor()
+	}
+	if opts.LogExclude != nil {
+		tun.SetLogExclude(opts.LogExclude)
+	}
+	if opts.BlockBots != "" {
+		pool.SetBlockBots(opts.BlockBots)
+	}
+	if opts.Routes != nil {
+		tun.SetRoutes(opts.Routes)
+	}
+	if opts.Services != nil {
+		tun.SetServices(opts.Services)
+	}
+	if opts.NoIdentify {
+		tun.SetIdentify(false)
+	}
+	if opts.Privacy {
+		tun.SetPrivate(true)
+	}
+	if opts.RequestHeaders != nil || opts.ResponseHeaders != nil {
+		tun.SetHeaderRules(opts.RequestHeaders, opts.ResponseHeaders)
+	}
+	if opts.Domain != "" {
+		pool.SetDomain(opts.Domain)
+	}
+	if opts.Passphrase {
+		if _, err := pool.EnableProtection(); err != nil {
+			log.Printf("Failed to enable passphrase protection for %s: %v", pool.Subdomain, err)
+			return errors.New("passphrase: could not be enabled")
+		}
+	}
+	if opts.BypassToken {
+		if _, err := pool.EnableBypass(); err != nil {
+			log.Printf("Failed to enable warning bypass for %s: %v", pool.Subdomain, err)
+			return errors.New("bypass-token: could not be enabled")
+		}
+	}
+	return nil
+}
+
+// formatOptionsError renders an options error and usage for the client's terminal
+func formatOptionsError(err error) string {
+	msg := "\r\n  ERROR: " + err.Error() + "\r\n"
+	var optsErr *tunnel.OptionsError
+	if errors.As(err, &optsErr) {
+		msg = "\r\n  ERROR: invalid tunnel options\r\n"
+		for _, p := range optsErr.Problems {
+			msg += "    - " + p + "\r\n"
+		}
+	}
+	return msg + "\r\n" + strings.ReplaceAll(tunnel.OptionsUsage, "\n", "\r\n") + "\r\n\r\n"
+}
+
+// rejectionBanner formats a rejection reason as a pre-auth SSH banner
+func rejectionBanner(reason error) string {
+	if isMaintenance(reason) {
+		return "\n  MAINTENANCE: " + reason.Error() + "\n\n"
+	}
+	return "\n  ERROR: " + reason.Error() + "\n\n"
+}
+
+// rejectionConfig returns a copy of the SSH config that shows reason to the
+// client in a pre-auth banner and then fails authentication
+func (s *Server) rejectionConfig(reason error) *ssh.ServerConfig {
+	cfg := *s.sshConfig
+	cfg.BannerCallback = func(ssh.ConnMetadata) string {
+		return rejectionBanner(reason)
+	}
+	cfg.PublicKeyCallback = nil
+	cfg.KeyboardInteractiveCallback = nil
+	cfg.NoClientAuth = true
+	cfg.NoClientAuthCallback = func(ssh.ConnMetadata) (*ssh.Permissions, error) {
+		return nil, reason
+	}
+	return &cfg
+}
+
+// addForward serves a further port the client forwarded through its own
+// local listener, for the route option to send path prefixes to
+func (s *Server) addForward(sshConn *ssh.ServerConn, tun *tunnel.Tunnel, port uint32) bool {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("Failed to create forward listener: %v", err)
+		return false
+	}
+	if !tun.AddForward(port, ln) {
+		ln.Close()
+		return false
+	}
+	go s.acceptForwarded(ln, sshConn, tun, port)
+	return true
+}
+
+// acceptForwarded relays the connections of a tunnel listener to the
+// client's forward of port until the listener is closed
+func (s *Server) acceptForwarded(ln net.Listener, sshConn *ssh.ServerConn, tun *tunnel.Tunnel, port uint32) {
+	for {
+		tcpConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		tun.Touch()
+		go s.forwardToSSH(sshConn, tcpConn, tun, port)
+	}
+}
+
+// errChannelOpenQueueFull reports a channel open that waited too long for
+// one of the tunnel's MaxChannelOpens slots
+var errChannelOpenQueueFull = errors.New("too many channel opens awaiting the client")
+
+// closeRefusedTunnel tears down a tunnel whose client has refused every
+// channel for the failure budget, telling the client why first
+func (s *Server) closeRefusedTunnel(tun *tunnel.Tunnel, port uint32, err *ssh.OpenChannelError) {
+	s.refusedTunnelsClosed.Add(1)
+	log.Printf("Tunnel %s closed: client refused %d channels in a row over %v (last: %v)",
+		tun.Subdomain, config.ChannelFailureBudget, config.ChannelFailureWindow, err)
+	if logger := tun.Logger(); logger != nil {
+		logger.LogNotice(fmt.Sprintf("Closing tunnel: your client refused the last %d connections to forwarded port %d over %v (%s). "+
+			"Check that your local server is running, then reconnect.",
+			config.ChannelFailureBudget, port, formatDuration(config.ChannelFailureWindow), err.Message))
+	}
+	tun.Close() // flushes the notice to the session
+	tun.CloseSSH()
+}
+
+// openForwardedChannel opens a forwarded-tcpip channel. While the client
+// reports that its local server refused the connection, as dev servers do for
+// a moment during hot reloads, or that it is short of resources, the open is
+// retried BackendDialRetries times with jittered backoff, within
+// BackendDialRetryWindow. At most MaxChannelOpens opens of a tunnel await
+// the client's answer at once; the others queue for up to ChannelOpenWait.
+func (s *Server) openForwardedChannel(conn ssh.Conn, tun *tunnel.Tunnel, payload []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	deadline := time.Now().Add(config.BackendDialRetryWindow)
+	backoff := s.dialBackoff
+	for attempt := 0; ; attempt++ {
+		if !tun.AcquireOpen(config.ChannelOpenWait) {
+			s.channelOpensDropped.Add(1)
+			return nil, nil, errChannelOpenQueueFull
+		}
+		channel, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+		tun.ReleaseOpen()
+		var openErr *ssh.OpenChannelError
+		if err == nil || attempt == config.BackendDialRetries ||
+			!errors.As(err, &openErr) || (openErr.Reason != ssh.ConnectionFailed && openErr.Reason != ssh.ResourceShortage) {
+			return channel, reqs, err
+		}
+		// Between half and one and a half times the backoff, so a burst of
+		// requests does not retry in lockstep
+		wait := backoff/2 + rand.N(backoff+1)
+		if time.Now().Add(wait).After(deadline) {
+			return nil, nil, err
+		}
+		s.backendDialRetries.Add(1)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// forwardToSSH relays a local connection to the client's forward of port
+func (s *Server) forwardToSSH(sshConn *ssh.ServerConn, tcpConn net.Conn, tun *tunnel.Tunnel, port uint32) {
+	defer tcpConn.Close()
+
+	// Tunnels carry HTTP; raw TCP pointed at a listener would only surface
+	// as confusing proxy errors on the client's side
+	tcpConn, head, ok := sniffHTTP(tcpConn)
+	if !ok {
+		if len(head) > 0 {
+			s.nonHTTPRejected.Add(1)
+			log.Printf("Rejected non-HTTP connection to the listener of %s from %s: %q", tun.Subdomain, tcpConn.RemoteAddr(), head)
+		}
+		return
+	}
+
+	// Refuse new streams once the client IP or account has exhausted its daily quota
+	if s.bandwidth.Exceeded(s.ipKey(tun.ClientIP)) || s.quotas.BandwidthExceeded(tun.QuotaAccount()) {
+		return
+	}
+
+	// Bound the channels open over one SSH connection, queuing briefly for a slot
+	if !tun.AcquireConn(config.BackendConnWait) {
+		s.backendConnsDropped.Add(1)
+		return
+	}
+	defer tun.ReleaseConn()
+
+	var originAddr string
+	var originPort uint32
+	if tcpAddr, ok := tcpConn.RemoteAddr().(*net.TCPAddr); ok {
+		originAddr = tcpAddr.IP.String()
+		originPort = uint32(tcpAddr.Port)
+	} else {
+		originAddr = "0.0.0.0"
+		originPort = 0
+	}
+
+	channel, reqs, err := s.openForwardedChannel(sshConn, tun, ssh.Marshal(&forwardedTCPPayload{
+		Addr:       tun.BindAddr,
+		Port:       port,
+		OriginAddr: originAddr,
+		OriginPort: originPort,
+	}))
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		// Refused by the client, as opposed to the connection going away
+		if tun.RecordChannelOpen(false) {
+			s.closeRefusedTunnel(tun, port, openErr)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to open forwarded-tcpip channel: %v", err)
+		return
+	}
+	tun.RecordChannelOpen(true)
+	defer channel.Close()
+	s.forwardedChannels.Add(1)
+	defer s.forwardedChannels.Add(-1)
+
+	go ssh.DiscardRequests(reqs)
+
+	// Copy data bidirectionally. When one direction completes (or errors),
+	// close the write side to signal the other goroutine to finish.
+	// Both directions count against the client IP's and account's daily
+	// bandwidth quotas.
+	done := make(chan struct{})
+	go func() {
+		bufp := copyBuffers.Get().(*[]byte)
+		defer copyBuffers.Put(bufp)
+		n, _ := io.CopyBuffer(s.quotas.Meter(s.meterIP(channel, tun.ClientIP), tun.QuotaAccount()), tcpConn, *bufp)
+		s.usage.AddBytes(tun.Account(), tun.Subdomain, n)
+		// Signal SSH channel we're done sending
+		channel.CloseWrite()
+	}()
+	go func() {
+		defer close(done)
+		bufp := copyBuffers.Get().(*[]byte)
+		defer copyBuffers.Put(bufp)
+		n, _ := io.CopyBuffer(s.quotas.Meter(s.meterIP(tcpConn, tun.ClientIP), tun.QuotaAccount()), channel, *bufp)
+		s.usage.AddBytes(tun.Account(), tun.Subdomain, n)
+	}()
+	<-done
+}
+
+// probeBackend checks whether the SSH client can reach its local backend by
+// opening, and immediately closing, a forwarded-tcpip channel. The client only
+// confirms the channel once its connection to the local service succeeds.
+// probed is false if every channel open of the connection is in flight:
+// the client is busy with requests, which say more than a probe would.
+func probeBackend(sshConn ssh.Conn, tun *tunnel.Tunnel) (healthy, probed bool) {
+	// The probe makes the client connect like a request, so it counts
+	// against the same cap on opens
+	if !tun.AcquireOpen(0) {
+		return false, false
+	}
+	result := make(chan bool, 1)
+	go func() {
+		channel, reqs, err := sshConn.OpenChannel("forwarded-tcpip", ssh.Marshal(&forwardedTCPPayload{
+			Addr:       tun.BindAddr,
+			Port:       tun.BindPort,
+			OriginAddr: "127.0.0.1",
+			OriginPort: 0,
+		}))
+		tun.ReleaseOpen()
+		if err != nil {
+			result <- false
+			return
+		}
+		// Closed even when confirmed after the probe timed out
+		go ssh.DiscardRequests(reqs)
+		channel.Close()
+		result <- true
+	}()
+
+	select {
+	case ok := <-result:
+		return ok, true
+	case <-time.After(config.HealthProbeTimeout):
+		return false, true
+	}
+}
+
+// formatDuration formats a duration as a human-readable string (e.g., "2h", "45m")
+func formatDuration(d time.Duration) string {
+	if d >= time.Hour {
+		h := int(d.Hours())
+		return fmt.Sprintf("%dh", h)
+	}
+	return fmt.Sprintf("%dm", int(d.Minutes()))
+}
@@ -0,0 +1,435 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+func TestHandleSSHConnection_RejectionBanner(t *testing.T) {
+	s := newTestServer(t)
+	s.BlockIP("127.0.0.1")
+
+	ln := newTestListener(t)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.HandleSSHConnection(conn)
+	}()
+
+	banner := make(chan string, 1)
+	_, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(msg string) error {
+			banner <- msg
+			return nil
+		},
+		Timeout: 5 * time.Second,
+	})
+	if err == nil {
+		t.Fatal("blocked client should fail authentication")
+	}
+
+	select {
+	case msg := <-banner:
+		if !strings.Contains(msg, "temporarily blocked") {
+			t.Errorf("banner = %q, want block reason", msg)
+		}
+	default:
+		t.Fatal("rejected client should receive a banner")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if n := s.ipConnections["127.0.0.1"]; n != 0 {
+		t.Errorf("ipConnections = %d, rejected connection should not hold a slot", n)
+	}
+}
+
+func TestApplyOptions(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	tun := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	pool := s.GetPool(sub)
+
+	opts, err := tunnel.ParseOptions("auth=u:p no-warning bypass-token label.env=staging subdomain=" + sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.applyOptions(pool, tun, &AuthorizedKey{NoWarning: true}, opts); err != nil {
+		t.Fatalf("applyOptions() error = %v", err)
+	}
+	if pool.BasicAuthUser() != "u" || !pool.NoWarning() || pool.BypassToken() == "" {
+		t.Error("pool options were not applied")
+	}
+	if tun.Labels()["env"] != "staging" {
+		t.Errorf("labels = %v, want env=staging", tun.Labels())
+	}
+
+	if tun.QueueTimeout() != config.RequestQueueTimeout {
+		t.Errorf("QueueTimeout() = %v without the option, want the default", tun.QueueTimeout())
+	}
+	opts, _ = tunnel.ParseOptions("queue=15")
+	if err := s.applyOptions(pool, tun, nil, opts); err != nil || tun.QueueTimeout() != 15*time.Second {
+		t.Errorf("queue=15: QueueTimeout() = %v (%v), want 15s", tun.QueueTimeout(), err)
+	}
+	opts, _ = tunnel.ParseOptions("queue=0")
+	if err := s.applyOptions(pool, tun, nil, opts); err != nil || tun.QueueTimeout() != 0 {
+		t.Errorf("queue=0: QueueTimeout() = %v (%v), want 0", tun.QueueTimeout(), err)
+	}
+
+	opts, _ = tunnel.ParseOptions("subdomain=myapp")
+	if err := s.applyOptions(pool, tun, nil, opts); err == nil {
+		t.Error("requesting a different subdomain should fail")
+	}
+}
+
+func TestApplyOptions_AnonymousNoWarning(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	tun := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	pool := s.GetPool(sub)
+
+	opts, _ := tunnel.ParseOptions("auth=u:p no-warning")
+	err := s.applyOptions(pool, tun, nil, opts)
+	if err == nil || !strings.Contains(err.Error(), "no-warning: requires an authorized key") {
+		t.Errorf("applyOptions() error = %v, want no-warning refused without a key", err)
+	}
+	if err := s.applyOptions(pool, tun, &AuthorizedKey{}, opts); err == nil {
+		t.Error("a key without no-warning should not grant it")
+	}
+	if pool.NoWarning() || pool.BasicAuthUser() != "" {
+		t.Error("no option should be applied when no-warning is refused")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	tun := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	pool := s.GetPool(sub)
+
+	tests := []struct {
+		env  envRequest
+		want bool
+	}{
+		{envRequest{"TUNNL_LABEL_PROJECT", "foo"}, true},
+		{envRequest{"TUNNL_LABEL_BAD!", "foo"}, false},
+		{envRequest{config.PassphraseEnv, "1"}, true},
+		{envRequest{config.BypassEnv, "maybe"}, false},
+		{envRequest{"LANG", "en_US.UTF-8"}, false},
+	}
+	for _, tt := range tests {
+		if got := s.applyEnv(pool, tun, nil, tt.env); got != tt.want {
+			t.Errorf("applyEnv(%s=%s) = %v, want %v", tt.env.Name, tt.env.Value, got, tt.want)
+		}
+	}
+	if pool.Passphrase() == "" {
+		t.Error("passphrase env should enable protection")
+	}
+	if tun.Labels()["project"] != "foo" {
+		t.Errorf("labels = %v, want project=foo", tun.Labels())
+	}
+}
+
+func TestFormatOptionsError(t *testing.T) {
+	_, err := tunnel.ParseOptions("rate=0 bogus")
+	out := formatOptionsError(err)
+	for _, want := range []string{"invalid tunnel options", "- rate:", "- bogus: unknown option", "Usage:"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestHandleSSHConnection_AccountLimitBanner(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < config.MaxTunnelsPerAccount; i++ {
+		if err := s.quotas.Reserve(s.quotaAccount("alice", nil, "127.0.0.1"), config.MaxTunnelsPerAccount, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ln := newTestListener(t)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.HandleSSHConnection(conn)
+	}()
+
+	banner := make(chan string, 1)
+	_, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(msg string) error {
+			banner <- msg
+			return nil
+		},
+		Timeout: 5 * time.Second,
+	})
+	if err == nil {
+		t.Fatal("client over its account limit should fail authentication")
+	}
+	select {
+	case msg := <-banner:
+		if !strings.Contains(msg, "tunnels for user alice") {
+			t.Errorf("banner = %q, want account limit reason", msg)
+		}
+	default:
+		t.Fatal("rejected client should receive a banner")
+	}
+}
+
+func TestHandleSSHConnection_Keepalive(t *testing.T) {
+	s := newTestServer(t)
+
+	ln := newTestListener(t)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.HandleSSHConnection(conn)
+	}()
+
+	client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, name := range []string{"keepalive@openssh.com", "no-more-sessions@openssh.com"} {
+		ok, _, err := client.SendRequest(name, true, nil)
+		if err != nil || !ok {
+			t.Errorf("%s: ok = %v, err = %v, want success", name, ok, err)
+		}
+	}
+	if ok, _, _ := client.SendRequest("streamlocal-forward@openssh.com", true, nil); ok {
+		t.Error("unsupported global requests should be refused")
+	}
+}
+
+func TestSetHostKey_Rotation(t *testing.T) {
+	s := newTestServer(t)
+	ln := newTestListener(t)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.HandleSSHConnection(conn)
+		}
+	}()
+
+	hostKey := func() ssh.PublicKey {
+		var got ssh.PublicKey
+		client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+			User: "test",
+			HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				got = key
+				return nil
+			},
+			Timeout: 5 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		return got
+	}
+
+	before := hostKey()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetHostKey(pem.EncodeToMemory(block)); err != nil {
+		t.Fatalf("SetHostKey() error = %v", err)
+	}
+	after := hostKey()
+	if bytes.Equal(before.Marshal(), after.Marshal()) || !bytes.Equal(after.Marshal(), (*s.hostKey.Load()).PublicKey().Marshal()) {
+		t.Error("new connections should be served the rotated host key")
+	}
+	if err := s.SetHostKey([]byte("not a key")); err == nil {
+		t.Error("an invalid key should be refused")
+	}
+}
+
+// newForwardingConn returns the server side of an SSH connection whose client
+// refuses its first refuse forwarded-tcpip channels and echoes the data of
+// the others back
+func newForwardingConn(tb testing.TB, refuse int) *ssh.ServerConn {
+	tb.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	// net.Pipe is unbuffered and deadlocks the simultaneous version exchange
+	ln := newTestListener(tb)
+	clientSide, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serverSide, err := ln.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	type result struct {
+		conn *ssh.ServerConn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, chans, reqs, err := ssh.NewServerConn(serverSide, serverConfig)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "")
+				}
+			}()
+		}
+		done <- result{conn, err}
+	}()
+
+	client, chans, reqs, err := ssh.NewClientConn(clientSide, "pipe", &ssh.ClientConfig{
+		User:            "bench",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for newCh := range chans {
+			// As a client whose local server is not listening yet
+			if refuse > 0 {
+				refuse--
+				newCh.Reject(ssh.ConnectionFailed, "connect failed: connection refused")
+				continue
+			}
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(chReqs)
+			go func() {
+				io.Copy(ch, ch)
+				ch.CloseWrite()
+			}()
+		}
+	}()
+	r := <-done
+	if r.err != nil {
+		tb.Fatal(r.err)
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		r.conn.Close()
+	})
+	return r.conn
+}
+
+func TestOpenForwardedChannel_Retry(t *testing.T) {
+	s := newTestServer(t)
+	s.dialBackoff = time.Millisecond
+	tun := s.RegisterTunnel("happy-tiger-abcdef01", "", 0, newTestListener(t), "", 80, "1.2.3.4")
+
+	// Refused twice, then the local server is back
+	channel, _, err := s.openForwardedChannel(newForwardingConn(t, 2), tun, nil)
+	if err != nil {
+		t.Fatalf("open after two refusals: %v", err)
+	}
+	channel.Close()
+	if got := s.backendDialRetries.Load(); got != 2 {
+		t.Errorf("backendDialRetries = %d, want 2", got)
+	}
+
+	// Still refused after the retries
+	_, _, err = s.openForwardedChannel(newForwardingConn(t, config.BackendDialRetries+1), tun, nil)
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.ConnectionFailed {
+		t.Errorf("open error = %v, want the refusal", err)
+	}
+	if got := s.backendDialRetries.Load(); got != 2+config.BackendDialRetries {
+		t.Errorf("backendDialRetries = %d, want %d", got, 2+config.BackendDialRetries)
+	}
+}
+
+func TestProbeBackend(t *testing.T) {
+	s := newTestServer(t)
+	tun := s.RegisterTunnel("happy-tiger-abcdef01", "", 0, newTestListener(t), "", 80, "1.2.3.4")
+
+	if healthy, probed := probeBackend(newForwardingConn(t, 0), tun); !healthy || !probed {
+		t.Errorf("probeBackend() = %v, %v, want a healthy backend", healthy, probed)
+	}
+	if healthy, probed := probeBackend(newForwardingConn(t, 1), tun); healthy || !probed {
+		t.Errorf("probeBackend() = %v, %v with the local server down, want unhealthy", healthy, probed)
+	}
+
+	// The probes gave their slots back; with every slot taken, none is sent
+	for range config.MaxChannelOpens {
+		if !tun.AcquireOpen(0) {
+			t.Fatal("probe kept a channel open slot")
+		}
+	}
+	defer func() {
+		for range config.MaxChannelOpens {
+			tun.ReleaseOpen()
+		}
+	}()
+	if _, probed := probeBackend(newForwardingConn(t, 0), tun); probed {
+		t.Error("probeBackend() probed with every channel open in flight")
+	}
+}
+
+func BenchmarkForwardToSSH(b *testing.B) {
+	s := newTestServer(b)
+	sshConn := newForwardingConn(b, 0)
+	tun := s.RegisterTunnel("happy-tiger-abcdef01", "", 0, newTestListener(b), "", 80, "1.2.3.4")
+
+	payload := make([]byte, 16<<10)
+	copy(payload, "POST / HTTP/1.1\r\n")
+	buf := make([]byte, len(payload))
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for b.Loop() {
+		visitor, backend := net.Pipe()
+		go s.forwardToSSH(sshConn, backend, tun, tun.BindPort)
+		go visitor.Write(payload)
+		if _, err := io.ReadFull(visitor, buf); err != nil {
+			b.Fatal(err)
+		}
+		visitor.Close()
+	}
+}
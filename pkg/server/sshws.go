@@ -0,0 +1,24 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"tunnl.gg/internal/websocket"
+)
+
+// serveSSHWebSocket takes over a WebSocket handshake to the domain's
+// SSHWebSocketPath and runs an SSH connection inside it, for clients behind
+// proxies that only let HTTPS through. The connection gets the same checks
+// as one to the SSH listener.
+func (s *Server) serveSSHWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		if !errors.Is(err, websocket.ErrBadHandshake) {
+			log.Printf("SSH over WebSocket from %s failed: %v", visitorIP(r.RemoteAddr), err)
+		}
+		return
+	}
+	s.HandleSSHConnection(conn)
+}
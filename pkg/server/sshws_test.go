@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestServeHTTP_SSHWebSocketPath(t *testing.T) {
+	s := newTestServer(t)
+
+	// Only handshakes to the domain itself are taken over; the recorder
+	// cannot be hijacked, as with HTTP/2
+	tests := []struct {
+		host string
+		want int
+	}{
+		{s.domain, http.StatusHTTPVersionNotSupported},
+		{"happy-tiger-a1b2c3d4." + s.domain, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "https://"+tt.host+config.SSHWebSocketPath, nil)
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("GET %s%s = %d, want %d", tt.host, config.SSHWebSocketPath, rec.Code, tt.want)
+		}
+	}
+}
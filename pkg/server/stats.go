@@ -0,0 +1,354 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+// Stats holds server statistics
+type Stats struct {
+	ActiveTunnels    int             `json:"active_tunnels"`
+	UnhealthyTunnels int             `json:"unhealthy_tunnels"`
+	UniqueIPs        int             `json:"unique_ips"`
+	Accounts         int             `json:"accounts"`
+	TotalConnections uint64          `json:"total_connections"`
+	TotalRequests    uint64          `json:"total_requests"`
+	Subdomains       []SubdomainInfo `json:"subdomains,omitempty"`
+	Tunnels          []TunnelInfo    `json:"tunnels,omitempty"`
+
+	// Whether maintenance mode refuses new tunnels, and whether the last
+	// reservation call failed to reach the subdomain registry
+	Maintenance         bool `json:"maintenance"`
+	RegistryUnavailable bool `json:"registry_unavailable"`
+
+	// Abuse protection stats
+	BlockedIPs       int    `json:"blocked_ips"`
+	TotalBlocked     uint64 `json:"total_blocked"`
+	TotalRateLimited uint64 `json:"total_rate_limited"`
+	VisitorLimited   uint64 `json:"visitor_rate_limited"`
+	TotalTarpitted   uint64 `json:"total_tarpitted"`
+	BlocklistEntries int    `json:"blocklist_entries"`
+	BlocklistMatches uint64 `json:"blocklist_matches"`
+
+	// Requests rejected by the limit shared by visitors with the same
+	// network, user agent and TLS fingerprint
+	FingerprintLimited uint64 `json:"fingerprint_rate_limited"`
+
+	// Violations and the blocks they caused, per class (connection_rate, http_rate_limit)
+	Violations map[string]ViolationStats `json:"violations"`
+
+	// Bandwidth quota stats
+	BandwidthToday   int64 `json:"bandwidth_today_bytes"`
+	QuotaExceededIPs int   `json:"quota_exceeded_ips"`
+
+	// Per-account quota stats
+	QuotaExceededAccounts int    `json:"quota_exceeded_accounts"`
+	AccountRateLimited    uint64 `json:"account_rate_limited"`
+
+	// Load shedding stats
+	InFlightRequests int64  `json:"in_flight_requests"`
+	ActiveWebSockets int64  `json:"active_websockets"`
+	TotalShed        uint64 `json:"total_shed"`
+
+	// Emergency throttling of rate limits under server-wide load
+	Overload OverloadStats `json:"overload"`
+
+	// Backend responses over the size limit, and backends too slow to respond
+	ResponsesTooLarge uint64 `json:"responses_too_large"`
+	UpstreamTimeouts  uint64 `json:"upstream_timeouts"`
+
+	// Backend connections dropped while a tunnel had MaxBackendConns open,
+	// and channel opens retried after the local server refused them
+	BackendConnsDropped uint64 `json:"backend_conns_dropped"`
+	BackendDialRetries  uint64 `json:"backend_dial_retries"`
+	ChannelOpensDropped uint64 `json:"channel_opens_dropped"` // waited too long behind MaxChannelOpens others
+
+	// Tunnels closed after their client refused channels for the failure budget
+	RefusedTunnelsClosed uint64 `json:"refused_tunnels_closed"`
+
+	// Connections to tunnel listeners that were not HTTP
+	NonHTTPRejected uint64 `json:"non_http_rejected"`
+
+	// HTTPS handshakes refused for a blocked TLS fingerprint
+	FingerprintsBlocked uint64 `json:"tls_fingerprints_blocked"`
+
+	// Requests refused by tunnels' block-bots option
+	BotsBlocked uint64 `json:"bots_blocked"`
+
+	// File descriptors, goroutines, forwarded channels and accept rates
+	Resources ResourceStats `json:"resources"`
+
+	// Use of the memory budget by captures, session logs and abuse maps
+	Memory MemoryStats `json:"memory"`
+
+	// Go version, VCS revision and hot path benchmark numbers of the binary
+	Build BuildInfo `json:"build"`
+}
+
+// SubdomainInfo describes an active subdomain across its backends
+type SubdomainInfo struct {
+	Subdomain     string    `json:"subdomain"`
+	Backends      int       `json:"backends"`
+	ClientIPs     []string  `json:"client_ips"`
+	CreatedAt     time.Time `json:"created_at"` // when the oldest backend connected
+	ExpiresAt     time.Time `json:"expires_at"` // when the last backend will expire if left idle
+	Requests      uint64    `json:"requests"`
+	Bytes         uint64    `json:"bytes"`
+	RateLimitHits int       `json:"rate_limit_hits"`
+}
+
+// TunnelInfo describes a single active tunnel
+type TunnelInfo struct {
+	Subdomain string            `json:"subdomain"`
+	BackendID string            `json:"backend_id"`
+	Account   string            `json:"account,omitempty"`
+	Tier      string            `json:"tier,omitempty"`
+	Conns     int               `json:"backend_conns"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// IncrementConnections increments the total connection counter
+func (s *Server) IncrementConnections() {
+	atomic.AddUint64(&s.totalConnections, 1)
+}
+
+// IncrementRequests increments the total request counter
+func (s *Server) IncrementRequests() {
+	atomic.AddUint64(&s.totalRequests, 1)
+}
+
+// GetStats returns current server statistics
+func (s *Server) GetStats(includeSubdomains, includeTunnels bool) Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blockedIPs, totalBlocked, totalRateLimited := s.abuseTracker.GetStats()
+	bandwidthToday, quotaExceededIPs := s.bandwidth.GetStats()
+	blocklistEntries, blocklistMatches := s.abuseTracker.GetBlocklistStats()
+	quotaExceededAccounts, accountRateLimited := s.quotas.GetStats()
+
+	stats := Stats{
+		ActiveTunnels:    s.tunnelCount,
+		UniqueIPs:        len(s.ipConnections),
+		Accounts:         s.quotas.Count(),
+		TotalConnections: atomic.LoadUint64(&s.totalConnections),
+		TotalRequests:    atomic.LoadUint64(&s.totalRequests),
+		BlockedIPs:       blockedIPs,
+		TotalBlocked:     totalBlocked,
+		TotalRateLimited: totalRateLimited,
+		VisitorLimited:   s.visitorLimiter.TotalLimited(),
+		TotalTarpitted:   s.totalTarpitted.Load(),
+		BlocklistEntries: blocklistEntries,
+		BlocklistMatches: blocklistMatches,
+		Violations:       s.abuseTracker.ViolationStats(),
+		BandwidthToday:   bandwidthToday,
+		QuotaExceededIPs: quotaExceededIPs,
+		InFlightRequests: s.inFlightRequests.Load(),
+		ActiveWebSockets: s.activeWebSockets.Load(),
+		TotalShed:        s.totalShed.Load(),
+
+		QuotaExceededAccounts: quotaExceededAccounts,
+		AccountRateLimited:    accountRateLimited,
+
+		ResponsesTooLarge: s.totalTooLarge.Load(),
+		UpstreamTimeouts:  s.upstreamTimeouts.Load(),
+
+		BackendConnsDropped: s.backendConnsDropped.Load(),
+		BackendDialRetries:  s.backendDialRetries.Load(),
+		ChannelOpensDropped: s.channelOpensDropped.Load(),
+
+		FingerprintsBlocked: s.fingerprints.TotalBlocked(),
+		FingerprintLimited:  s.visitorLimiter.FingerprintLimited(),
+
+		RefusedTunnelsClosed: s.refusedTunnelsClosed.Load(),
+		NonHTTPRejected:      s.nonHTTPRejected.Load(),
+
+		BotsBlocked: s.botsBlocked.Load(),
+	}
+	stats.Maintenance, _ = s.Maintenance()
+	stats.RegistryUnavailable = !s.RegistryAvailable()
+	stats.Overload = s.overload.Stats()
+	stats.Resources = s.resourceStats()
+	stats.Memory = s.memory.Stats()
+	stats.Build = buildInfo()
+
+	for _, pool := range s.pools {
+		for _, t := range pool.Tunnels() {
+			if !t.Healthy() {
+				stats.UnhealthyTunnels++
+			}
+		}
+	}
+
+	if includeSubdomains {
+		stats.Subdomains = make([]SubdomainInfo, 0, len(s.pools))
+		for sub, pool := range s.pools {
+			if info, ok := subdomainInfo(sub, pool); ok {
+				stats.Subdomains = append(stats.Subdomains, info)
+			}
+		}
+		sort.Slice(stats.Subdomains, func(i, j int) bool { return stats.Subdomains[i].Subdomain < stats.Subdomains[j].Subdomain })
+	}
+
+	if includeTunnels {
+		stats.Tunnels = make([]TunnelInfo, 0, s.tunnelCount)
+		for sub, pool := range s.pools {
+			for _, t := range pool.Tunnels() {
+				stats.Tunnels = append(stats.Tunnels, TunnelInfo{
+					Subdomain: sub,
+					BackendID: t.BackendID(),
+					Account:   t.Account(),
+					Tier:      t.Tier(),
+					Conns:     t.ActiveConns(),
+					Labels:    t.Labels(),
+				})
+			}
+		}
+	}
+
+	return stats
+}
+
+// subdomainInfo sums up the backends of a subdomain
+func subdomainInfo(sub string, pool *tunnel.Pool) (SubdomainInfo, bool) {
+	tunnels := pool.Tunnels()
+	if len(tunnels) == 0 {
+		return SubdomainInfo{}, false
+	}
+	info := SubdomainInfo{Subdomain: sub, Backends: len(tunnels), ClientIPs: []string{}}
+	now := time.Now()
+	for _, t := range tunnels {
+		if !slices.Contains(info.ClientIPs, t.ClientIP) {
+			info.ClientIPs = append(info.ClientIPs, t.ClientIP)
+		}
+		if info.CreatedAt.IsZero() || t.CreatedAt.Before(info.CreatedAt) {
+			info.CreatedAt = t.CreatedAt
+		}
+		if expires := now.Add(t.TimeRemaining()); expires.After(info.ExpiresAt) {
+			info.ExpiresAt = expires
+		}
+		info.Requests += t.RequestCount()
+		info.Bytes += t.BytesRelayed()
+		info.RateLimitHits += t.RateLimitHits()
+	}
+	info.ExpiresAt = info.ExpiresAt.Truncate(time.Second)
+	return info, true
+}
+
+// StatsHandler returns an http.Handler for the stats endpoint and the
+// ngrok-compatible agent API
+func (s *Server) StatsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", s.statsHandler())
+	mux.Handle("GET /stats/stream", s.statsStreamHandler())
+	mux.Handle("GET /metrics", s.metricsHandler())
+	mux.Handle("GET /api/tunnels", s.agentTunnelsHandler())
+	mux.Handle("GET /api/tunnels/{name}", s.agentTunnelHandler())
+	mux.Handle("GET /api/tunnels/{name}/requests", s.tunnelRequestsHandler())
+	mux.Handle("GET /tunnels/{sub}/tail", s.tailHandler())
+	mux.Handle("GET /api/tunnels/{name}/limits", s.rateLimitsHandler())
+	mux.Handle("PUT /api/tunnels/{name}/limits", s.rateLimitsHandler())
+	mux.Handle("GET /api/captures/{id}", s.captureHandler())
+	mux.Handle("GET /api/captures/{id}/{part}", s.captureBodyHandler())
+	mux.Handle("GET /api/top", s.topTalkersHandler())
+	mux.Handle("GET /api/maintenance", s.maintenanceHandler())
+	mux.Handle("PUT /api/maintenance", s.maintenanceHandler())
+	mux.Handle("POST /api/broadcast", s.broadcastHandler())
+	mux.Handle("GET /api/accounts", s.accountsHandler())
+	mux.Handle("GET /api/accounts/{name}", s.accountHandler())
+	mux.Handle("GET /api/usage", s.usageHandler())
+	mux.Handle("GET /api/fingerprints", s.fingerprintsHandler())
+	mux.Handle("PUT /api/fingerprints/{fingerprint}/block", s.fingerprintBlockHandler())
+	mux.Handle("DELETE /api/fingerprints/{fingerprint}/block", s.fingerprintBlockHandler())
+	return localhostOnly(mux)
+}
+
+// localhostOnly rejects requests that do not originate from a loopback address
+func localhostOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) statsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		includeSubdomains := r.URL.Query().Get("subdomains") == "true"
+		includeTunnels := r.URL.Query().Get("tunnels") == "true"
+		stats := s.GetStats(includeSubdomains, includeTunnels)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Printf("Failed to encode stats response: %v", err)
+		}
+	})
+}
+
+// statsStreamHandler serves GET /stats/stream: a Server-Sent Events stream
+// of the stats every interval seconds, with the same subdomains and tunnels
+// options as the stats endpoint
+func (s *Server) statsStreamHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		interval, err := intParam(r, "interval", config.DefaultStatsStreamInterval, config.MaxStatsStreamInterval)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		includeSubdomains := r.URL.Query().Get("subdomains") == "true"
+		includeTunnels := r.URL.Query().Get("tunnels") == "true"
+
+		if s.statsStreams.Add(1) > config.MaxStatsStreams {
+			s.statsStreams.Add(-1)
+			http.Error(w, "Too many stats streams", http.StatusTooManyRequests)
+			return
+		}
+		defer s.statsStreams.Add(-1)
+
+		// The stats server's write timeout would cut the stream
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			data, err := json.Marshal(s.GetStats(includeSubdomains, includeTunnels))
+			if err != nil {
+				log.Printf("Failed to encode stats: %v", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: stats\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			if rc.Flush() != nil {
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
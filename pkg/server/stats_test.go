@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestStatsStreamHandler(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterTunnel("happy-tiger-abcdef01", "", 0, newTestListener(t), "", 80, "1.2.3.4")
+	ts := httptest.NewServer(s.StatsHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/stats/stream?interval=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("interval=0: status %d, want 400", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/stats/stream?subdomains=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// The first snapshot is sent right away
+	scanner := bufio.NewScanner(resp.Body)
+	if !scanner.Scan() || scanner.Text() != "event: stats" || !scanner.Scan() {
+		t.Fatalf("first line = %q, want a stats event", scanner.Text())
+	}
+	var stats Stats
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &stats); err != nil {
+		t.Fatalf("data = %q: %v", scanner.Text(), err)
+	}
+	if stats.ActiveTunnels != 1 || len(stats.Subdomains) != 1 {
+		t.Errorf("stats = %+v, want one tunnel with its subdomain", stats)
+	}
+
+	s.statsStreams.Store(config.MaxStatsStreams)
+	resp2, err := http.Get(ts.URL + "/stats/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("over the stream limit: status %d, want 429", resp2.StatusCode)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+
+	"tunnl.gg/pkg/config"
+)
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Title}} - {{.Domain}}</title></head>
+<body>
+<header><strong>{{.Domain}}</strong></header>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<p>The tunnel at <code>{{.Host}}</code> may be back once this is over. Please try again later.</p>
+</body>
+</html>
+`))
+
+// registryMessage is shown to visitors while the subdomain registry cannot be reached
+const registryMessage = "We are having trouble reaching our tunnel registry, so some tunnels may be temporarily unavailable."
+
+// serveStatusPage responds to a request for a subdomain without tunnels
+// with a status page when the server is in maintenance or its subdomain
+// registry is unavailable, and reports whether it did
+func (s *Server) serveStatusPage(w http.ResponseWriter, host, domain string) bool {
+	title := "Scheduled maintenance"
+	enabled, message := s.Maintenance()
+	if !enabled {
+		if s.RegistryAvailable() {
+			return false
+		}
+		title, message = "Service disruption", registryMessage
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(config.StatusPageRetryAfter.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	data := struct {
+		Domain, Host, Title, Message string
+	}{domain, host, title, message}
+	if err := statusPage.Execute(w, data); err != nil {
+		log.Printf("Failed to render status page: %v", err)
+	}
+	return true
+}
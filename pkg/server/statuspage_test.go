@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnl.gg/internal/store"
+)
+
+// unreachableReservations fails every call, like a registry that is down
+type unreachableReservations struct{}
+
+var errUnreachable = errors.New("connection refused")
+
+func (unreachableReservations) SaveReservation(store.Reservation) error { return errUnreachable }
+func (unreachableReservations) Reservation(string, time.Time) (store.Reservation, bool, error) {
+	return store.Reservation{}, false, errUnreachable
+}
+func (unreachableReservations) ExtendReservation(string, time.Time) error { return errUnreachable }
+
+func TestServeHTTP_StatusPage(t *testing.T) {
+	s := newTestServer(t)
+	get := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "https://happy-tiger-abcdef01."+s.domain+"/", nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Errorf("unknown subdomain status = %d, want 404", w.Code)
+	}
+
+	s.SetMaintenance(true, "Upgrading, back at 14:00 UTC")
+	w := get()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("maintenance status = %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if body := w.Body.String(); !strings.Contains(body, "Upgrading, back at 14:00 UTC") || !strings.Contains(body, s.domain) {
+		t.Errorf("maintenance page = %q", body)
+	}
+	s.SetMaintenance(false, "")
+
+	// A failed reservation lookup marks the registry unavailable until one succeeds
+	s.reservations = unreachableReservations{}
+	s.isHeld("happy-tiger-abcdef01")
+	if w := get(); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "registry") {
+		t.Errorf("registry down status = %d, body %q", w.Code, w.Body)
+	}
+	if !s.GetStats(false, false).RegistryUnavailable {
+		t.Error("stats should report the registry unavailable")
+	}
+	s.noteRegistry(nil)
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Errorf("status after the registry recovered = %d, want 404", w.Code)
+	}
+}
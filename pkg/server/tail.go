@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// tailHandler serves GET /tunnels/{sub}/tail: a Server-Sent Events stream of
+// the subdomain's requests as they complete. The tunnel's join token, shown
+// to its owner in the banner, authenticates the stream as a bearer token or,
+// for browsers' EventSource, as the token query parameter.
+func (s *Server) tailHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pool := s.GetPool(strings.ToLower(r.PathValue("sub")))
+		if pool == nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		token := r.URL.Query().Get("token")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = bearer
+		}
+		if !pool.CheckJoinToken(token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		records, cancel, ok := pool.Feed().Subscribe()
+		if !ok {
+			http.Error(w, "Too many tails for this tunnel", http.StatusTooManyRequests)
+			return
+		}
+		defer cancel()
+
+		// The stats server's write timeout would cut the stream
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		ping := time.NewTicker(config.TailPingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case rec := <-records:
+				data, err := json.Marshal(rec)
+				if err != nil {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: request\ndata: %s\n\n", data); err != nil {
+					return
+				}
+			case <-ping.C:
+				// The subdomain went away with its last backend
+				if s.GetPool(pool.Subdomain) != pool {
+					fmt.Fprint(w, "event: closed\ndata: {}\n\n")
+					rc.Flush()
+					return
+				}
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+			if rc.Flush() != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/tunnel"
+)
+
+func TestTailHandler(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	ts := httptest.NewServer(s.StatsHandler())
+	defer ts.Close()
+
+	for _, url := range []string{"/tunnels/" + sub + "/tail", "/tunnels/" + sub + "/tail?token=wrong"} {
+		resp, err := http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET %s: status %d, want 401", url, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/tunnels/"+sub+"/tail", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	s.GetPool(sub).Feed().Publish(tunnel.RequestRecord{Method: "GET", Path: "/live", Status: 200})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	timeout := time.After(2 * time.Second)
+	var got []string
+	for len(got) < 2 {
+		select {
+		case line := <-lines:
+			if line != "" {
+				got = append(got, line)
+			}
+		case <-timeout:
+			t.Fatalf("timed out, got %q", got)
+		}
+	}
+	if got[0] != "event: request" || !strings.HasPrefix(got[1], "data: ") || !strings.Contains(got[1], `"path":"/live"`) {
+		t.Errorf("event = %q, want a request event for /live", got)
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// tierFeatures are the tunnel options a tier can allow or withhold
+var tierFeatures = []string{"auth", "no-warning", "passphrase", "bypass-token", "labels", "compress", "inspect", "headers"}
+
+// privilegeFeatures weaken protections for visitors, so only tiers that list
+// them allow them
+var privilegeFeatures = []string{"no-warning"}
+
+// Tier is a named plan with its own limits and features. Zero limits fall
+// back to the built-in defaults.
+type Tier struct {
+	Name              string   `json:"-"`
+	MaxTunnels        int      `json:"max_tunnels"`         // per IP and per user
+	RequestsPerSecond int      `json:"requests_per_second"` // per tunnel
+	Lifetime          duration `json:"lifetime"`            // max tunnel duration
+	IdleTimeout       duration `json:"idle_timeout"`        // inactivity before a tunnel closes
+	Features          []string `json:"features"`            // allowed tunnel options (omitted = all but privilegeFeatures)
+
+	WebSocketIdleTimeout duration `json:"websocket_idle_timeout"` // inactivity before a WebSocket closes
+	MaxWebSocketTransfer int64    `json:"max_websocket_transfer"` // bytes per WebSocket and direction
+	MaxResponseSize      int64    `json:"max_response_size"`      // bytes per response, up to the operator ceiling
+}
+
+// builtinTier applies when no tiers file is configured
+var builtinTier = &Tier{}
+
+// Allows reports whether the tier permits a feature
+func (t *Tier) Allows(feature string) bool {
+	if t.Features == nil {
+		return !slices.Contains(privilegeFeatures, feature)
+	}
+	return slices.Contains(t.Features, feature)
+}
+
+// TunnelLimits returns the tier's per-tunnel limits with defaults filled in
+func (t *Tier) TunnelLimits() (rate int, lifetime, idleTimeout time.Duration) {
+	rate, lifetime, idleTimeout = config.RequestsPerSecond, config.MaxTunnelLifetime, config.InactivityTimeout
+	if t.RequestsPerSecond > 0 {
+		rate = t.RequestsPerSecond
+	}
+	if t.Lifetime > 0 {
+		lifetime = time.Duration(t.Lifetime)
+	}
+	if t.IdleTimeout > 0 {
+		idleTimeout = time.Duration(t.IdleTimeout)
+	}
+	return rate, lifetime, idleTimeout
+}
+
+// WebSocketLimits returns the tier's WebSocket idle timeout and transfer limit with defaults filled in
+func (t *Tier) WebSocketLimits() (idleTimeout time.Duration, maxTransfer int64) {
+	idleTimeout, maxTransfer = config.WebSocketIdleTimeout, config.MaxWebSocketTransfer
+	if t.WebSocketIdleTimeout > 0 {
+		idleTimeout = time.Duration(t.WebSocketIdleTimeout)
+	}
+	if t.MaxWebSocketTransfer > 0 {
+		maxTransfer = t.MaxWebSocketTransfer
+	}
+	return idleTimeout, maxTransfer
+}
+
+// Tiers defines the named tiers authorized keys are put on. Tiers are not
+// granted by username, as usernames are not authenticated.
+type Tiers struct {
+	Default string           `json:"default"` // tier for clients without a key tier ("" = built-in limits)
+	Tiers   map[string]*Tier `json:"tiers"`
+}
+
+// LoadTiers reads a tiers file
+func LoadTiers(path string) (*Tiers, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t Tiers
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for name, tier := range t.Tiers {
+		if tier == nil {
+			return nil, fmt.Errorf("%s: tier %q is empty", path, name)
+		}
+		tier.Name = name
+		if tier.MaxTunnels < 0 || tier.RequestsPerSecond < 0 || tier.Lifetime < 0 || tier.IdleTimeout < 0 ||
+			tier.WebSocketIdleTimeout < 0 || tier.MaxWebSocketTransfer < 0 || tier.MaxResponseSize < 0 {
+			return nil, fmt.Errorf("%s: tier %q has a negative limit", path, name)
+		}
+		for _, f := range tier.Features {
+			if !slices.Contains(tierFeatures, f) {
+				return nil, fmt.Errorf("%s: tier %q has unknown feature %q (want one of %s)", path, name, f, strings.Join(tierFeatures, ", "))
+			}
+		}
+	}
+	if t.Default != "" && t.Tiers[t.Default] == nil {
+		return nil, fmt.Errorf("%s: default tier %q is not defined", path, t.Default)
+	}
+	return &t, nil
+}
+
+// For returns the tier of a client: its authorized key's tier, else the
+// default. A nil Tiers returns the built-in tier.
+func (t *Tiers) For(key *AuthorizedKey) *Tier {
+	if t == nil {
+		return builtinTier
+	}
+	if key != nil && key.Tier != "" {
+		if tier := t.Tiers[key.Tier]; tier != nil {
+			return tier
+		}
+		log.Printf("Authorized key %q has undefined tier %q, using the default tier", key.Name, key.Tier)
+	}
+	if t.Default != "" {
+		return t.Tiers[t.Default]
+	}
+	return builtinTier
+}
+
+// Get returns the named tier, or the built-in tier if it is not defined
+func (t *Tiers) Get(name string) *Tier {
+	if t == nil || t.Tiers[name] == nil {
+		return builtinTier
+	}
+	return t.Tiers[name]
+}
+
+// duration is a time.Duration read from a JSON string such as "24h"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"24h\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
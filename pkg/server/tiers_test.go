@@ -0,0 +1,128 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+const testTiers = `{
+	"default": "free",
+	"tiers": {
+		"free": {"requests_per_second": 5, "lifetime": "4h", "features": ["auth", "passphrase"]},
+		"pro": {"max_tunnels": 20, "requests_per_second": 50, "lifetime": "168h", "idle_timeout": "12h",
+			"websocket_idle_timeout": "8h", "max_websocket_transfer": 10737418240}
+	}
+}`
+
+func writeTiersFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tiers.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTiers(t *testing.T) {
+	tiers, err := LoadTiers(writeTiersFile(t, testTiers))
+	if err != nil {
+		t.Fatalf("LoadTiers() error = %v", err)
+	}
+
+	tests := []struct {
+		key  *AuthorizedKey
+		want string
+	}{
+		{nil, "free"},
+		{&AuthorizedKey{}, "free"},
+		{&AuthorizedKey{Tier: "pro"}, "pro"},
+		{&AuthorizedKey{Tier: "free"}, "free"},
+		{&AuthorizedKey{Tier: "enterprise"}, "free"},
+	}
+	for _, tt := range tests {
+		if got := tiers.For(tt.key).Name; got != tt.want {
+			t.Errorf("For(%+v) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+
+	rate, lifetime, idle := tiers.Get("pro").TunnelLimits()
+	if rate != 50 || lifetime != 168*time.Hour || idle != 12*time.Hour {
+		t.Errorf("pro TunnelLimits() = %d, %v, %v", rate, lifetime, idle)
+	}
+	rate, lifetime, idle = tiers.Get("free").TunnelLimits()
+	if rate != 5 || lifetime != 4*time.Hour || idle != config.InactivityTimeout {
+		t.Errorf("free TunnelLimits() = %d, %v, %v, want unset limits to use defaults", rate, lifetime, idle)
+	}
+	if idle, transfer := tiers.Get("pro").WebSocketLimits(); idle != 8*time.Hour || transfer != 10<<30 {
+		t.Errorf("pro WebSocketLimits() = %v, %d", idle, transfer)
+	}
+	if idle, transfer := tiers.Get("free").WebSocketLimits(); idle != config.WebSocketIdleTimeout || transfer != config.MaxWebSocketTransfer {
+		t.Errorf("free WebSocketLimits() = %v, %d, want defaults", idle, transfer)
+	}
+	if tiers.Get("free").Allows("compress") || !tiers.Get("pro").Allows("compress") {
+		t.Error("features should be restricted only when listed")
+	}
+	if tiers.Get("pro").Allows("no-warning") || builtinTier.Allows("no-warning") {
+		t.Error("no-warning should be allowed only by tiers listing it")
+	}
+	if (*Tiers)(nil).For(nil) != builtinTier {
+		t.Error("without tiers every client should get the built-in tier")
+	}
+}
+
+func TestLoadTiers_Errors(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown default": `{"default": "gold", "tiers": {"free": {}}}`,
+		"users mapping":   `{"tiers": {"pro": {}}, "users": {"alice": "pro"}}`,
+		"unknown feature": `{"tiers": {"free": {"features": ["teleport"]}}}`,
+		"bad duration":    `{"tiers": {"free": {"lifetime": 3600}}}`,
+		"unknown field":   `{"tiers": {"free": {"max_tunnel": 3}}}`,
+	} {
+		if _, err := LoadTiers(writeTiersFile(t, content)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestApplyOptions_Tier(t *testing.T) {
+	s := newTestServer(t)
+	tiers, err := LoadTiers(writeTiersFile(t, testTiers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tiers = tiers
+
+	sub := "happy-tiger-abcdef01"
+	tun := s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+	tun.SetTier("free")
+	tun.SetRateLimit(5)
+	pool := s.GetPool(sub)
+
+	opts, _ := tunnel.ParseOptions("auth=u:p no-warning")
+	err = s.applyOptions(pool, tun, nil, opts)
+	if err == nil || !strings.Contains(err.Error(), "no-warning: not available on the free tier") {
+		t.Errorf("applyOptions() error = %v, want no-warning refused", err)
+	}
+	if pool.BasicAuthUser() != "" {
+		t.Error("no option should be applied when one is refused")
+	}
+
+	opts, _ = tunnel.ParseOptions("rate=8")
+	if err := s.applyOptions(pool, tun, nil, opts); err != nil {
+		t.Fatalf("applyOptions() error = %v", err)
+	}
+	if tun.RateLimit() != 5 {
+		t.Errorf("RateLimit() = %d, rate= should not raise the tier's limit", tun.RateLimit())
+	}
+	opts, _ = tunnel.ParseOptions("rate=2")
+	s.applyOptions(pool, tun, nil, opts)
+	if tun.RateLimit() != 2 {
+		t.Errorf("RateLimit() = %d, want 2", tun.RateLimit())
+	}
+}
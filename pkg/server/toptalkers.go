@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// Talker is a subdomain or visitor IP with its traffic over a time window
+type Talker struct {
+	Name     string `json:"name"`
+	Requests uint64 `json:"requests"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+// talkerMinute holds one minute of per-subdomain and per-visitor counters
+type talkerMinute struct {
+	minute   int64 // Unix minute the counters belong to
+	tunnels  map[string]*Talker
+	visitors map[string]*Talker
+}
+
+// TopTalkers keeps rolling per-minute request and byte counters of
+// subdomains and visitor IPs for the last TopTalkersWindow minutes. Each
+// minute tracks at most MaxTopTalkerKeys of each; traffic from further
+// keys is not counted.
+type TopTalkers struct {
+	mu      sync.Mutex
+	minutes [config.TopTalkersWindow]talkerMinute
+
+	now func() time.Time // overridable for tests
+}
+
+// NewTopTalkers creates an empty tracker
+func NewTopTalkers() *TopTalkers {
+	return &TopTalkers{now: time.Now}
+}
+
+// Record counts a request or WebSocket connection of a visitor to a subdomain
+func (tt *TopTalkers) Record(sub, visitor string, bytes int64) {
+	minute := tt.now().Unix() / 60
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	m := &tt.minutes[minute%config.TopTalkersWindow]
+	if m.minute != minute || m.tunnels == nil {
+		*m = talkerMinute{
+			minute:   minute,
+			tunnels:  make(map[string]*Talker),
+			visitors: make(map[string]*Talker),
+		}
+	}
+	countTalker(m.tunnels, sub, bytes)
+	countTalker(m.visitors, visitor, bytes)
+}
+
+func countTalker(talkers map[string]*Talker, name string, bytes int64) {
+	t := talkers[name]
+	if t == nil {
+		if len(talkers) >= config.MaxTopTalkerKeys {
+			return
+		}
+		t = &Talker{Name: name}
+		talkers[name] = t
+	}
+	t.Requests++
+	t.Bytes += uint64(bytes)
+}
+
+// Top returns the limit busiest subdomains and visitor IPs of the last
+// minutes minutes, ranked by bytes if byBytes is set and by requests otherwise
+func (tt *TopTalkers) Top(minutes, limit int, byBytes bool) (tunnels, visitors []Talker) {
+	now := tt.now().Unix() / 60
+	tunnelTotals := make(map[string]*Talker)
+	visitorTotals := make(map[string]*Talker)
+	tt.mu.Lock()
+	for i := range tt.minutes {
+		m := &tt.minutes[i]
+		if m.tunnels == nil || m.minute <= now-int64(minutes) || m.minute > now {
+			continue
+		}
+		for name, t := range m.tunnels {
+			addTalker(tunnelTotals, name, t)
+		}
+		for name, t := range m.visitors {
+			addTalker(visitorTotals, name, t)
+		}
+	}
+	tt.mu.Unlock()
+	return rankTalkers(tunnelTotals, limit, byBytes), rankTalkers(visitorTotals, limit, byBytes)
+}
+
+func addTalker(totals map[string]*Talker, name string, t *Talker) {
+	total := totals[name]
+	if total == nil {
+		total = &Talker{Name: name}
+		totals[name] = total
+	}
+	total.Requests += t.Requests
+	total.Bytes += t.Bytes
+}
+
+func rankTalkers(totals map[string]*Talker, limit int, byBytes bool) []Talker {
+	ranked := make([]Talker, 0, len(totals))
+	for _, t := range totals {
+		ranked = append(ranked, *t)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if byBytes && a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Name < b.Name
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked
+}
+
+// topTalkersHandler serves GET /api/top?minutes=N&limit=N&by=requests|bytes
+func (s *Server) topTalkersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		minutes, err := intParam(r, "minutes", config.DefaultTopTalkersMinutes, config.TopTalkersWindow)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, err := intParam(r, "limit", config.DefaultTopTalkersLimit, config.MaxTopTalkersLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		by := r.URL.Query().Get("by")
+		if by == "" {
+			by = "requests"
+		}
+		if by != "requests" && by != "bytes" {
+			http.Error(w, "by must be requests or bytes", http.StatusBadRequest)
+			return
+		}
+
+		tunnels, visitors := s.topTalkers.Top(minutes, limit, by == "bytes")
+		writeJSON(w, struct {
+			Minutes  int      `json:"minutes"`
+			By       string   `json:"by"`
+			Tunnels  []Talker `json:"tunnels"`
+			Visitors []Talker `json:"visitors"`
+		}{minutes, by, tunnels, visitors})
+	})
+}
+
+// intParam parses an optional query parameter between 1 and upper
+func intParam(r *http.Request, name string, def, upper int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > upper {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, upper)
+	}
+	return n, nil
+}
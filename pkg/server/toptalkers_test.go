@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopTalkers(t *testing.T) {
+	tt := NewTopTalkers()
+	now := time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC)
+	tt.now = func() time.Time { return now }
+
+	tt.Record("old-sub", "9.9.9.9", 1<<20)
+	now = now.Add(10 * time.Minute)
+	for range 3 {
+		tt.Record("busy-sub", "1.2.3.4", 10)
+	}
+	tt.Record("big-sub", "5.6.7.8", 5000)
+	now = now.Add(time.Minute)
+	tt.Record("busy-sub", "5.6.7.8", 10)
+
+	tunnels, visitors := tt.Top(5, 10, false)
+	if len(tunnels) != 2 || tunnels[0].Name != "busy-sub" || tunnels[0].Requests != 4 || tunnels[0].Bytes != 40 {
+		t.Errorf("tunnels by requests = %+v", tunnels)
+	}
+	if len(visitors) != 2 || visitors[0].Name != "1.2.3.4" || visitors[1].Requests != 2 {
+		t.Errorf("visitors by requests = %+v", visitors)
+	}
+	if tunnels, _ := tt.Top(5, 1, true); len(tunnels) != 1 || tunnels[0].Name != "big-sub" {
+		t.Errorf("top tunnel by bytes = %+v, want big-sub", tunnels)
+	}
+	if tunnels, _ := tt.Top(1, 10, false); len(tunnels) != 1 || tunnels[0].Requests != 1 {
+		t.Errorf("last minute = %+v, want busy-sub's one request", tunnels)
+	}
+	if tunnels, _ := tt.Top(60, 10, false); len(tunnels) != 3 {
+		t.Errorf("last hour = %+v, want all three subdomains", tunnels)
+	}
+
+	// A slot reused an hour later starts over
+	now = now.Add(time.Hour)
+	tt.Record("busy-sub", "1.2.3.4", 10)
+	if tunnels, _ := tt.Top(60, 10, false); len(tunnels) != 1 || tunnels[0].Requests != 1 {
+		t.Errorf("an hour later = %+v", tunnels)
+	}
+}
+
+func TestTopTalkersHandler(t *testing.T) {
+	s := newTestServer(t)
+	s.topTalkers.Record("happy-tiger-abcdef01", "1.2.3.4", 100)
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		want  string
+	}{
+		{"", 200, `"tunnels":[{"name":"happy-tiger-abcdef01","requests":1,"bytes":100}]`},
+		{"?minutes=60&limit=1&by=bytes", 200, `"visitors":[{"name":"1.2.3.4"`},
+		{"?minutes=61", 400, "minutes must be between 1 and 60"},
+		{"?limit=0", 400, "limit must be between 1 and 100"},
+		{"?by=latency", 400, "by must be requests or bytes"},
+	} {
+		r := httptest.NewRequest("GET", "/api/top"+tc.query, nil)
+		r.RemoteAddr = "127.0.0.1:1"
+		w := httptest.NewRecorder()
+		s.StatsHandler().ServeHTTP(w, r)
+		if w.Code != tc.code || !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("GET /api/top%s = %d %s, want %d containing %s", tc.query, w.Code, w.Body.String(), tc.code, tc.want)
+		}
+	}
+}
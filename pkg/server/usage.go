@@ -0,0 +1,295 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"tunnl.gg/internal/store"
+	"tunnl.gg/pkg/config"
+)
+
+const dayFormat = "2006-01-02"
+
+// dayCache formats UTC days, formatting again only once the day changes
+type dayCache struct {
+	start, end time.Time // the cached day's bounds
+	day        string
+}
+
+func (c *dayCache) format(t time.Time) string {
+	if c.day == "" || t.Before(c.start) || !t.Before(c.end) {
+		c.start = t.UTC().Truncate(24 * time.Hour)
+		c.end = c.start.Add(24 * time.Hour)
+		c.day = c.start.Format(dayFormat)
+	}
+	return c.day
+}
+
+// usageKey identifies the daily counters of one subdomain under one account
+type usageKey struct {
+	day, account, subdomain string
+}
+
+// UsageRecorder accumulates per-account, per-subdomain daily usage. With a
+// store, counters are drained into it periodically; without one they are kept
+// in memory for config.UsageRetention.
+type UsageRecorder struct {
+	mu       sync.Mutex
+	counters map[usageKey]*store.TunnelUsage
+	pruned   string   // last day old counters were pruned on
+	days     dayCache // formats the current day without allocating
+
+	now func() time.Time // overridable for tests
+}
+
+// NewUsageRecorder creates an empty recorder
+func NewUsageRecorder() *UsageRecorder {
+	return &UsageRecorder{
+		counters: make(map[usageKey]*store.TunnelUsage),
+		now:      time.Now,
+	}
+}
+
+// counter returns the counters for a day (must be called with lock held)
+func (u *UsageRecorder) counter(day, account, sub string) *store.TunnelUsage {
+	k := usageKey{day, account, sub}
+	c := u.counters[k]
+	if c == nil {
+		c = &store.TunnelUsage{Day: day, Account: account, Subdomain: sub}
+		u.counters[k] = c
+	}
+	return c
+}
+
+// today returns the current UTC day, pruning counters past the retention
+// period once per day (must be called with lock held)
+func (u *UsageRecorder) today() string {
+	now := u.now().UTC()
+	day := u.days.format(now)
+	if day != u.pruned {
+		u.pruned = day
+		cutoff := now.Add(-config.UsageRetention).Format(dayFormat)
+		for k := range u.counters {
+			if k.day < cutoff {
+				delete(u.counters, k)
+			}
+		}
+	}
+	return day
+}
+
+// AddRequest counts a proxied request
+func (u *UsageRecorder) AddRequest(account, sub string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.counter(u.today(), account, sub).Requests++
+}
+
+// AddBytes counts bytes transferred through a tunnel in either direction
+func (u *UsageRecorder) AddBytes(account, sub string, n int64) {
+	if n <= 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.counter(u.today(), account, sub).Bytes += n
+}
+
+// AddTunnelTime counts the time a tunnel was open, split across UTC days
+func (u *UsageRecorder) AddTunnelTime(account, sub string, start, end time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.today()
+	start, end = start.UTC(), end.UTC()
+	for start.Before(end) {
+		midnight := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, time.UTC)
+		until := midnight
+		if end.Before(until) {
+			until = end
+		}
+		u.counter(start.Format(dayFormat), account, sub).TunnelSeconds += int64(until.Sub(start).Seconds())
+		start = until
+	}
+}
+
+// Drain returns and clears the accumulated counters
+func (u *UsageRecorder) Drain() []store.TunnelUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	records := make([]store.TunnelUsage, 0, len(u.counters))
+	for _, c := range u.counters {
+		records = append(records, *c)
+	}
+	u.counters = make(map[usageKey]*store.TunnelUsage)
+	return records
+}
+
+// Between returns the accumulated counters from one UTC day to another, inclusive
+func (u *UsageRecorder) Between(from, to string) []store.TunnelUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var records []store.TunnelUsage
+	for k, c := range u.counters {
+		if k.day >= from && k.day <= to {
+			records = append(records, *c)
+		}
+	}
+	return records
+}
+
+// UsageRollup is the usage of an account, or of one of its subdomains, over a date range
+type UsageRollup struct {
+	Account     string  `json:"account"`
+	Subdomain   string  `json:"subdomain,omitempty"`
+	Requests    int64   `json:"requests"`
+	Bytes       int64   `json:"bytes"`
+	TunnelHours float64 `json:"tunnel_hours"`
+}
+
+// usageRollups returns usage from one UTC day to another, inclusive, per
+// account or, with perTunnel, per account and subdomain
+func (s *Server) usageRollups(from, to string, perTunnel bool) ([]UsageRollup, error) {
+	records := s.usage.Between(from, to)
+	if s.store != nil {
+		stored, err := s.store.TunnelUsageBetween(from, to)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, stored...)
+	}
+
+	seconds := make(map[usageKey]int64)
+	rollups := make(map[usageKey]*UsageRollup)
+	for _, r := range records {
+		k := usageKey{account: r.Account}
+		if perTunnel {
+			k.subdomain = r.Subdomain
+		}
+		ru := rollups[k]
+		if ru == nil {
+			ru = &UsageRollup{Account: k.account, Subdomain: k.subdomain}
+			rollups[k] = ru
+		}
+		ru.Requests += r.Requests
+		ru.Bytes += r.Bytes
+		seconds[k] += r.TunnelSeconds
+	}
+
+	out := make([]UsageRollup, 0, len(rollups))
+	for k, ru := range rollups {
+		ru.TunnelHours = float64(seconds[k]) / 3600
+		out = append(out, *ru)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Account != out[j].Account {
+			return out[i].Account < out[j].Account
+		}
+		return out[i].Subdomain < out[j].Subdomain
+	})
+	return out, nil
+}
+
+// flushUsage moves the accumulated usage counters into the store
+func (s *Server) flushUsage() {
+	records := s.usage.Drain()
+	if len(records) == 0 {
+		return
+	}
+	if err := s.store.AddTunnelUsage(records); err != nil {
+		log.Printf("Failed to save usage counters: %v", err)
+	}
+}
+
+// usageRange parses the from and to query parameters (UTC days, inclusive).
+// The range defaults to the last 30 days.
+func usageRange(r *http.Request, now time.Time) (from, to string, err error) {
+	to = now.UTC().Format(dayFormat)
+	from = now.UTC().AddDate(0, 0, -29).Format(dayFormat)
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse(dayFormat, v)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid to %q: want YYYY-MM-DD", v)
+		}
+		to = t.Format(dayFormat)
+		from = t.AddDate(0, 0, -29).Format(dayFormat)
+	}
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse(dayFormat, v)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid from %q: want YYYY-MM-DD", v)
+		}
+		from = t.Format(dayFormat)
+	}
+	if from > to {
+		return "", "", fmt.Errorf("from %s is after to %s", from, to)
+	}
+	return from, to, nil
+}
+
+// usageHandler serves GET /api/usage?from=YYYY-MM-DD&to=YYYY-MM-DD&group=account|tunnel&format=json|csv
+func (s *Server) usageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, to, err := usageRange(r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		group := r.URL.Query().Get("group")
+		if group == "" {
+			group = "account"
+		}
+		if group != "account" && group != "tunnel" {
+			http.Error(w, "group must be account or tunnel", http.StatusBadRequest)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			http.Error(w, "format must be json or csv", http.StatusBadRequest)
+			return
+		}
+
+		rollups, err := s.usageRollups(from, to, group == "tunnel")
+		if err != nil {
+			log.Printf("Failed to query usage: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"usage-%s-%s.csv\"", from, to))
+			writeUsageCSV(w, from, to, rollups)
+			return
+		}
+		writeJSON(w, struct {
+			From  string        `json:"from"`
+			To    string        `json:"to"`
+			Group string        `json:"group"`
+			Usage []UsageRollup `json:"usage"`
+		}{from, to, group, rollups})
+	})
+}
+
+// writeUsageCSV writes rollups as CSV with a header row
+func writeUsageCSV(w http.ResponseWriter, from, to string, rollups []UsageRollup) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"from", "to", "account", "subdomain", "requests", "bytes", "tunnel_hours"})
+	for _, ru := range rollups {
+		cw.Write([]string{
+			from, to, ru.Account, ru.Subdomain,
+			strconv.FormatInt(ru.Requests, 10),
+			strconv.FormatInt(ru.Bytes, 10),
+			strconv.FormatFloat(ru.TunnelHours, 'f', 3, 64),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Failed to write usage CSV: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageRecorder_TunnelTimeSplitsDays(t *testing.T) {
+	u := NewUsageRecorder()
+	start := time.Date(2025, 1, 1, 23, 0, 0, 0, time.UTC)
+	u.AddTunnelTime("alice", "happy-tiger-abcdef01", start, start.Add(3*time.Hour))
+
+	got := map[string]int64{}
+	for _, r := range u.Drain() {
+		got[r.Day] = r.TunnelSeconds
+	}
+	if got["2025-01-01"] != 3600 || got["2025-01-02"] != 7200 {
+		t.Errorf("tunnel seconds per day = %v, want 3600 on Jan 1 and 7200 on Jan 2", got)
+	}
+	if len(u.Drain()) != 0 {
+		t.Error("Drain() should clear the counters")
+	}
+}
+
+func TestUsageRecorder_Retention(t *testing.T) {
+	u := NewUsageRecorder()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	u.now = func() time.Time { return now }
+	u.AddRequest("alice", "happy-tiger-abcdef01")
+
+	now = now.AddDate(0, 2, 0)
+	u.AddRequest("alice", "happy-tiger-abcdef01")
+	if records := u.Between("2025-01-01", "2025-12-31"); len(records) != 1 {
+		t.Errorf("got %d records, want only the one inside the retention period", len(records))
+	}
+}
+
+func getUsage(t *testing.T, s *Server, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/api/usage"+query, nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	w := httptest.NewRecorder()
+	s.StatsHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestUsageAPI(t *testing.T) {
+	s := newTestServer(t)
+	today := time.Now().UTC().Format(dayFormat)
+	s.usage.AddRequest("alice", "happy-tiger-abcdef01")
+	s.usage.AddRequest("alice", "calm-eagle-abcdef02")
+	s.usage.AddBytes("alice", "calm-eagle-abcdef02", 1000)
+	s.usage.AddRequest("", "swift-wolf-abcdef03")
+	s.usage.AddTunnelTime("alice", "happy-tiger-abcdef01", time.Now().Add(-90*time.Minute), time.Now())
+
+	w := getUsage(t, s, "")
+	var resp struct {
+		From, To, Group string
+		Usage           []UsageRollup
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.To != today || resp.Group != "account" {
+		t.Errorf("range = %s..%s grouped by %s, want ending today grouped by account", resp.From, resp.To, resp.Group)
+	}
+	if len(resp.Usage) != 2 {
+		t.Fatalf("got %d rollups, want anonymous and alice", len(resp.Usage))
+	}
+	alice := resp.Usage[1]
+	if alice.Account != "alice" || alice.Requests != 2 || alice.Bytes != 1000 || alice.TunnelHours < 1.4 {
+		t.Errorf("alice = %+v", alice)
+	}
+
+	w = getUsage(t, s, "?group=tunnel&format=csv&from="+today+"&to="+today)
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Content-Type = %q, want text/csv", ct)
+	}
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if len(rows) != 4 || rows[0][2] != "account" || rows[1][3] != "swift-wolf-abcdef03" {
+		t.Errorf("CSV rows = %v, want a header and one row per tunnel", rows)
+	}
+
+	for _, query := range []string{"?from=yesterday", "?from=2025-02-01&to=2025-01-01", "?group=ip", "?format=xml"} {
+		if w := getUsage(t, s, query); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /api/usage%s status = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestUsageAPI_Store(t *testing.T) {
+	s := newStoreTestServer(t, filepath.Join(t.TempDir(), "tunnl.db"))
+	defer s.Stop()
+
+	s.usage.AddRequest("alice", "happy-tiger-abcdef01")
+	s.flushUsage()
+	s.usage.AddRequest("alice", "happy-tiger-abcdef01")
+
+	rollups, err := s.usageRollups("2000-01-01", "2999-12-31", false)
+	if err != nil {
+		t.Fatalf("usageRollups() error = %v", err)
+	}
+	if len(rollups) != 1 || rollups[0].Requests != 2 {
+		t.Errorf("usageRollups() = %+v, want stored and pending requests combined", rollups)
+	}
+}
+
+func TestDayCache(t *testing.T) {
+	var c dayCache
+	// Not UTC: the day is that of the UTC time
+	est := time.FixedZone("EST", -5*3600)
+	for _, tc := range []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Date(2025, 1, 1, 23, 59, 59, 0, time.UTC), "2025-01-01"},
+		{time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC), "2025-01-02"},
+		{time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC), "2025-01-01"},
+		{time.Date(2025, 1, 1, 20, 0, 0, 0, est), "2025-01-02"},
+	} {
+		if got := c.format(tc.t); got != tc.want {
+			t.Errorf("format(%v) = %q, want %q", tc.t, got, tc.want)
+		}
+	}
+}
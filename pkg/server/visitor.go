@@ -0,0 +1,298 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/tunnel"
+)
+
+// visitorEntry is the token bucket for one visitor IP, or one visitor
+// fingerprint, on one subdomain
+type visitorEntry struct {
+	limiter     *tunnel.RateLimiter
+	lastSeen    time.Time
+	fingerprint bool // keyed by visitorFingerprint rather than IP
+}
+
+// visitorKey identifies a visitor IP's or fingerprint's limiter for one subdomain
+type visitorKey struct {
+	ip, sub string
+}
+
+// offender tracks rate limit violations by one visitor IP across all tunnels
+type offender struct {
+	violations    int
+	lastViolation time.Time
+}
+
+// VisitorLimiter rate limits individual visitor IPs per subdomain before the
+// per-tunnel limiter, so a single hostile visitor cannot exhaust a tunnel's
+// budget and get its owner blocked. A looser limit is shared by visitors with
+// the same fingerprint, which catches clients spreading their requests over
+// the addresses of a network. Visitors that keep hitting either limit are
+// flagged as repeat offenders so they can be tarpitted.
+type VisitorLimiter struct {
+	mu        sync.Mutex
+	visitors  map[visitorKey]*visitorEntry
+	offenders map[string]*offender // keyed by visitor IP
+	memory    *MemoryBudget        // optional budget counting visitor entries
+	throttle  int                  // percent of the limits left by emergency throttling (0 = not throttled)
+
+	// Stats
+	totalLimited       atomic.Uint64
+	fingerprintLimited atomic.Uint64
+
+	// Lifecycle management for cleanup goroutine
+	stopCleanup chan struct{}
+	cleanupDone chan struct{}
+}
+
+// NewVisitorLimiter creates a new visitor limiter
+func NewVisitorLimiter() *VisitorLimiter {
+	vl := &VisitorLimiter{
+		visitors:    make(map[visitorKey]*visitorEntry),
+		offenders:   make(map[string]*offender),
+		stopCleanup: make(chan struct{}),
+		cleanupDone: make(chan struct{}),
+	}
+
+	// Start cleanup goroutine
+	go vl.cleanup()
+
+	return vl
+}
+
+// Stop gracefully stops the cleanup goroutine
+func (vl *VisitorLimiter) Stop() {
+	close(vl.stopCleanup)
+	<-vl.cleanupDone
+}
+
+// SetMemoryBudget makes visitor entries count against b
+func (vl *VisitorLimiter) SetMemoryBudget(b *MemoryBudget) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	vl.memory = b
+}
+
+// Allow returns true if the visitor may send another request to the subdomain
+func (vl *VisitorLimiter) Allow(visitorIP, sub string) bool {
+	if !vl.take(visitorKey{visitorIP, sub}, false) {
+		vl.totalLimited.Add(1)
+		vl.RecordViolation(visitorIP)
+		return false
+	}
+	return true
+}
+
+// AllowFingerprint returns true if visitors with the fingerprint (see
+// visitorFingerprint) may send another request to the subdomain. A rejection
+// counts as a violation of the visitor IP that sent the request.
+func (vl *VisitorLimiter) AllowFingerprint(fingerprint, visitorIP, sub string) bool {
+	if !vl.take(visitorKey{fingerprint, sub}, true) {
+		vl.fingerprintLimited.Add(1)
+		vl.RecordViolation(visitorIP)
+		return false
+	}
+	return true
+}
+
+// take takes a token from the limiter of key, creating it with the visitor
+// or fingerprint limits on first use
+func (vl *VisitorLimiter) take(key visitorKey, fingerprint bool) bool {
+	vl.mu.Lock()
+	entry, ok := vl.visitors[key]
+	if !ok {
+		rate, burst := vl.limits(fingerprint)
+		entry = &visitorEntry{
+			limiter:     tunnel.NewRateLimiter(rate, burst),
+			fingerprint: fingerprint,
+		}
+		// Over the memory budget, arbitrary visitors are forgotten to make
+		// room; with none left the visitor is limited by its tunnel only
+		if vl.reserveEntry() {
+			vl.visitors[key] = entry
+		}
+	}
+	entry.lastSeen = time.Now()
+	vl.mu.Unlock()
+
+	return entry.limiter.Allow()
+}
+
+// SetThrottle cuts every visitor's limits, current and future, to percent
+// of the defaults while the server is overloaded (0 or 100 lifts the cut)
+func (vl *VisitorLimiter) SetThrottle(percent int) {
+	if percent >= 100 {
+		percent = 0
+	}
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	vl.throttle = percent
+	for _, entry := range vl.visitors {
+		entry.limiter.SetRate(vl.limits(entry.fingerprint))
+	}
+}
+
+// limits returns the rate and burst of a visitor's or fingerprint's limiter
+// (must be called with vl.mu held)
+func (vl *VisitorLimiter) limits(fingerprint bool) (float64, int) {
+	rate, burst := config.VisitorRequestsPerSecond, config.VisitorBurstSize
+	if fingerprint {
+		rate, burst = config.FingerprintRequestsPerSecond, config.FingerprintBurstSize
+	}
+	if vl.throttle > 0 {
+		rate = max(1, rate*vl.throttle/100)
+		burst = max(1, burst*vl.throttle/100)
+	}
+	return float64(rate), burst
+}
+
+// Delay returns how long until the visitor IP or fingerprint may send another
+// request to the subdomain, or zero if it may now
+func (vl *VisitorLimiter) Delay(visitor, sub string) time.Duration {
+	vl.mu.Lock()
+	entry, ok := vl.visitors[visitorKey{visitor, sub}]
+	vl.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	return entry.limiter.Delay()
+}
+
+// reserveEntry takes budget for a new visitor entry, evicting arbitrary
+// visitors while over budget (must be called with lock held)
+func (vl *VisitorLimiter) reserveEntry() bool {
+	for !vl.memory.Reserve(memoryAbuse, config.AbuseEntryMemory) {
+		vl.memory.Evicted(memoryAbuse)
+		evicted := false
+		for key := range vl.visitors {
+			vl.deleteVisitor(key)
+			evicted = true
+			break
+		}
+		if !evicted {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteVisitor forgets a visitor entry (must be called with lock held)
+func (vl *VisitorLimiter) deleteVisitor(key visitorKey) {
+	delete(vl.visitors, key)
+	vl.memory.Release(memoryAbuse, config.AbuseEntryMemory)
+}
+
+// RecordViolation records a rate limit violation by a visitor IP. Violations
+// older than the tarpit window are forgotten.
+func (vl *VisitorLimiter) RecordViolation(visitorIP string) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	now := time.Now()
+	o, ok := vl.offenders[visitorIP]
+	if !ok || now.Sub(o.lastViolation) > config.TarpitWindow {
+		o = &offender{}
+		vl.offenders[visitorIP] = o
+	}
+	o.violations++
+	o.lastViolation = now
+}
+
+// IsRepeatOffender returns true if the visitor has hit rate limits often enough
+// recently to be tarpitted
+func (vl *VisitorLimiter) IsRepeatOffender(visitorIP string) bool {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	o, ok := vl.offenders[visitorIP]
+	if !ok || time.Since(o.lastViolation) > config.TarpitWindow {
+		return false
+	}
+	return o.violations >= config.TarpitViolationThreshold
+}
+
+// TotalLimited returns the number of requests rejected by visitor limits
+func (vl *VisitorLimiter) TotalLimited() uint64 {
+	return vl.totalLimited.Load()
+}
+
+// FingerprintLimited returns the number of requests rejected by fingerprint limits
+func (vl *VisitorLimiter) FingerprintLimited() uint64 {
+	return vl.fingerprintLimited.Load()
+}
+
+// cleanup periodically removes idle visitors
+func (vl *VisitorLimiter) cleanup() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	defer close(vl.cleanupDone)
+
+	for {
+		select {
+		case <-vl.stopCleanup:
+			return
+		case <-ticker.C:
+			vl.removeIdle(time.Now().Add(-config.VisitorIdleTimeout))
+		}
+	}
+}
+
+// removeIdle forgets visitors not seen since the given time
+func (vl *VisitorLimiter) removeIdle(since time.Time) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	for key, entry := range vl.visitors {
+		if entry.lastSeen.Before(since) {
+			vl.deleteVisitor(key)
+		}
+	}
+
+	offenseThreshold := time.Now().Add(-config.TarpitWindow)
+	for ip, o := range vl.offenders {
+		if o.lastViolation.Before(offenseThreshold) {
+			delete(vl.offenders, ip)
+		}
+	}
+}
+
+// visitorIP extracts the visitor's IP from the request's remote address.
+// X-Forwarded-For is not trusted since the service runs directly on the internet.
+func visitorIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// visitorFingerprint identifies a visitor by its network, user agent and TLS
+// fingerprint (if the request came over TLS). Clients that rotate through the
+// addresses of a network but keep their software share it, where their IPs
+// each stay under the per-visitor limit.
+func visitorFingerprint(visitorIP, userAgent string, tlsFP *TLSFingerprint) string {
+	network := visitorIP
+	if addr, err := netip.ParseAddr(visitorIP); err == nil {
+		addr = addr.Unmap().WithZone("")
+		bits := config.FingerprintIPv6Prefix
+		if addr.Is4() {
+			bits = config.FingerprintIPv4Prefix
+		}
+		network = netip.PrefixFrom(addr, bits).Masked().String()
+	}
+	ja4 := ""
+	if tlsFP != nil {
+		ja4 = tlsFP.JA4
+	}
+	// Hashed so that long user agents cost no more memory than short ones
+	sum := sha256.Sum256([]byte(userAgent + "\x00" + ja4))
+	return network + "|" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+func newTestVisitorLimiter(t *testing.T) *VisitorLimiter {
+	t.Helper()
+	vl := NewVisitorLimiter()
+	t.Cleanup(func() { vl.Stop() })
+	return vl
+}
+
+func TestVisitorLimiter_Burst(t *testing.T) {
+	vl := newTestVisitorLimiter(t)
+
+	for i := 0; i < 10; i++ {
+		if !vl.Allow("1.2.3.4", "happy-tiger-abcdef01") {
+			t.Fatalf("Allow() returned false on burst request %d", i+1)
+		}
+	}
+	if vl.Allow("1.2.3.4", "happy-tiger-abcdef01") {
+		t.Error("Allow() should return false after visitor burst exhausted")
+	}
+	if got := vl.TotalLimited(); got != 1 {
+		t.Errorf("TotalLimited() = %d, want 1", got)
+	}
+}
+
+func TestVisitorLimiter_Delay(t *testing.T) {
+	vl := newTestVisitorLimiter(t)
+
+	if d := vl.Delay("1.2.3.4", "happy-tiger-abcdef01"); d != 0 {
+		t.Errorf("Delay() = %v for an unknown visitor, want 0", d)
+	}
+	for i := 0; i < 10; i++ {
+		vl.Allow("1.2.3.4", "happy-tiger-abcdef01")
+	}
+	// One token refills every 1/VisitorRequestsPerSecond seconds
+	if d := vl.Delay("1.2.3.4", "happy-tiger-abcdef01"); d <= 0 || d > time.Second/5 {
+		t.Errorf("Delay() = %v after the burst, want up to 200ms", d)
+	}
+}
+
+func TestVisitorLimiter_Isolation(t *testing.T) {
+	vl := newTestVisitorLimiter(t)
+
+	for i := 0; i < 10; i++ {
+		vl.Allow("1.2.3.4", "happy-tiger-abcdef01")
+	}
+
+	if !vl.Allow("5.6.7.8", "happy-tiger-abcdef01") {
+		t.Error("other visitors should not be affected")
+	}
+	if !vl.Allow("1.2.3.4", "calm-eagle-12345678") {
+		t.Error("same visitor on another tunnel should not be affected")
+	}
+}
+
+func TestVisitorLimiter_RemoveIdle(t *testing.T) {
+	vl := newTestVisitorLimiter(t)
+	vl.Allow("1.2.3.4", "happy-tiger-abcdef01")
+	vl.Allow("5.6.7.8", "happy-tiger-abcdef01")
+
+	vl.mu.Lock()
+	vl.visitors[visitorKey{"1.2.3.4", "happy-tiger-abcdef01"}].lastSeen = time.Now().Add(-time.Hour)
+	vl.mu.Unlock()
+
+	vl.removeIdle(time.Now().Add(-5 * time.Minute))
+
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	if _, ok := vl.visitors[visitorKey{"1.2.3.4", "happy-tiger-abcdef01"}]; ok {
+		t.Error("idle visitor should be removed")
+	}
+	if _, ok := vl.visitors[visitorKey{"5.6.7.8", "happy-tiger-abcdef01"}]; !ok {
+		t.Error("active visitor should be kept")
+	}
+}
+
+func TestVisitorIP(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"1.2.3.4:5678", "1.2.3.4"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"1.2.3.4", "1.2.3.4"},
+	}
+
+	for _, tt := range tests {
+		if got := visitorIP(tt.input); got != tt.want {
+			t.Errorf("visitorIP(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestVisitorFingerprint(t *testing.T) {
+	chrome := &TLSFingerprint{JA4: "t13d1516h2_8daaf6152771_e5627efa2ab1"}
+	curl := &TLSFingerprint{JA4: "t13d3112h2_e8f1e7e78f70_6bebaf5329ac"}
+	base := visitorFingerprint("198.51.100.7", "Mozilla/5.0", chrome)
+
+	tests := []struct {
+		name      string
+		ip, ua    string
+		fp        *TLSFingerprint
+		wantShare bool
+	}{
+		{"another address of the network", "198.51.100.200", "Mozilla/5.0", chrome, true},
+		{"IPv4-mapped address", "::ffff:198.51.100.9", "Mozilla/5.0", chrome, true},
+		{"another network", "198.51.101.7", "Mozilla/5.0", chrome, false},
+		{"another user agent", "198.51.100.7", "curl/8.0", chrome, false},
+		{"another TLS stack", "198.51.100.7", "Mozilla/5.0", curl, false},
+		{"no TLS", "198.51.100.7", "Mozilla/5.0", nil, false},
+	}
+	for _, tt := range tests {
+		if got := visitorFingerprint(tt.ip, tt.ua, tt.fp); (got == base) != tt.wantShare {
+			t.Errorf("%s: shares the fingerprint = %v, want %v", tt.name, got == base, tt.wantShare)
+		}
+	}
+
+	v6 := visitorFingerprint("2001:db8:1:2::1", "Mozilla/5.0", chrome)
+	if visitorFingerprint("2001:db8:1:ffff::9", "Mozilla/5.0", chrome) != v6 {
+		t.Error("addresses of an IPv6 /48 should share the fingerprint")
+	}
+	if visitorFingerprint("2001:db8:2::1", "Mozilla/5.0", chrome) == v6 {
+		t.Error("another IPv6 /48 should not share the fingerprint")
+	}
+}
+
+func TestVisitorLimiter_Fingerprint(t *testing.T) {
+	vl := newTestVisitorLimiter(t)
+	fp := visitorFingerprint("198.51.100.1", "scraper/1.0", nil)
+	sub := "happy-tiger-abcdef01"
+
+	// Spread over addresses, each under its own limit, the requests share one budget
+	for i := range config.FingerprintBurstSize {
+		ip := fmt.Sprintf("198.51.100.%d", i+1)
+		if !vl.Allow(ip, sub) || !vl.AllowFingerprint(fp, ip, sub) {
+			t.Fatalf("request %d within the fingerprint's burst was rejected", i+1)
+		}
+	}
+	if vl.AllowFingerprint(fp, "198.51.100.99", sub) {
+		t.Error("AllowFingerprint() should return false after the burst is exhausted")
+	}
+	if got := vl.FingerprintLimited(); got != 1 {
+		t.Errorf("FingerprintLimited() = %d, want 1", got)
+	}
+	if d := vl.Delay(fp, sub); d <= 0 {
+		t.Errorf("Delay() = %v, want the time until the next token", d)
+	}
+	if !vl.AllowFingerprint(fp, "198.51.100.99", "calm-eagle-12345678") {
+		t.Error("the same fingerprint on another tunnel should not be affected")
+	}
+
+	// Throttling cuts the fingerprint's own limits
+	vl.SetThrottle(50)
+	fresh := visitorFingerprint("203.0.113.1", "scraper/1.0", nil)
+	allowed := 0
+	for range config.FingerprintBurstSize {
+		if vl.AllowFingerprint(fresh, "203.0.113.1", sub) {
+			allowed++
+		}
+	}
+	if allowed != config.FingerprintBurstSize/2 {
+		t.Errorf("%d requests allowed throttled to 50%%, want %d", allowed, config.FingerprintBurstSize/2)
+	}
+}
+
+func TestVisitorLimiter_RepeatOffender(t *testing.T) {
+	vl := newTestVisitorLimiter(t)
+
+	for i := 0; i < 19; i++ {
+		vl.RecordViolation("1.2.3.4")
+	}
+	if vl.IsRepeatOffender("1.2.3.4") {
+		t.Fatal("visitor below the threshold should not be a repeat offender")
+	}
+
+	vl.RecordViolation("1.2.3.4")
+	if !vl.IsRepeatOffender("1.2.3.4") {
+		t.Error("visitor at the threshold should be a repeat offender")
+	}
+	if vl.IsRepeatOffender("5.6.7.8") {
+		t.Error("other visitors should not be flagged")
+	}
+}
+
+func TestVisitorLimiter_OffenseExpiry(t *testing.T) {
+	vl := newTestVisitorLimiter(t)
+
+	for i := 0; i < 20; i++ {
+		vl.RecordViolation("1.2.3.4")
+	}
+
+	vl.mu.Lock()
+	vl.offenders["1.2.3.4"].lastViolation = time.Now().Add(-time.Hour)
+	vl.mu.Unlock()
+
+	if vl.IsRepeatOffender("1.2.3.4") {
+		t.Error("stale violations should not flag a visitor")
+	}
+
+	vl.RecordViolation("1.2.3.4")
+	if vl.IsRepeatOffender("1.2.3.4") {
+		t.Error("a new violation after the window should start a fresh count")
+	}
+}
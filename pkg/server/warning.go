@@ -0,0 +1,272 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tunnl.gg/pkg/config"
+)
+
+//go:embed locales/*.json
+var embeddedLocales embed.FS
+
+// defaultLocale is used when none of the visitor's languages are available
+const defaultLocale = "en"
+
+var warningPage = template.Must(template.New("warning").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Heading}}</h1>
+<p>{{.Body}}</p>
+<p><strong>{{.Caution}}</strong></p>
+<form method="POST" action="{{.Action}}">
+<input type="hidden" name="next" value="{{.Next}}">
+<button type="submit">{{.Continue}}</button>
+</form>
+</body>
+</html>
+`))
+
+// warningText is one translation of the warning interstitial.
+// "{{host}}" in any field is replaced with the tunnel's hostname.
+type warningText struct {
+	Title    string `json:"title"`
+	Heading  string `json:"heading"`
+	Body     string `json:"body"`
+	Caution  string `json:"caution"`
+	Continue string `json:"continue"`
+}
+
+// WarningLocales holds the warning page translations keyed by lowercase language tag
+type WarningLocales struct {
+	texts map[string]warningText
+}
+
+// LoadWarningLocales loads the translations embedded in the binary and, if
+// overrideDir is set, merges <lang>.json files from it on top. Fields missing
+// from an override fall back to the embedded translation (or English).
+func LoadWarningLocales(overrideDir string) (*WarningLocales, error) {
+	wl := &WarningLocales{texts: make(map[string]warningText)}
+
+	entries, err := embeddedLocales.ReadDir("locales")
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		data, err := embeddedLocales.ReadFile("locales/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		if err := wl.add(e.Name(), data); err != nil {
+			return nil, err
+		}
+	}
+
+	if overrideDir == "" {
+		return wl, nil
+	}
+	if _, err := os.Stat(overrideDir); err != nil {
+		return nil, fmt.Errorf("locale directory: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(overrideDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := wl.add(filepath.Base(path), data); err != nil {
+			return nil, err
+		}
+	}
+	return wl, nil
+}
+
+// add merges a translation file named <lang>.json into the bundle
+func (wl *WarningLocales) add(name string, data []byte) error {
+	lang := strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+	text, ok := wl.texts[lang]
+	if !ok {
+		text = wl.texts[defaultLocale]
+	}
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("invalid locale %s: %w", name, err)
+	}
+	if text.Heading == "" || text.Continue == "" {
+		return fmt.Errorf("invalid locale %s: heading and continue are required", name)
+	}
+	wl.texts[lang] = text
+	return nil
+}
+
+// Match picks the best available translation for an Accept-Language header
+func (wl *WarningLocales) Match(acceptLanguage string) (string, warningText) {
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		if text, ok := wl.texts[tag]; ok {
+			return tag, text
+		}
+		if base, _, found := strings.Cut(tag, "-"); found {
+			if text, ok := wl.texts[base]; ok {
+				return base, text
+			}
+		}
+	}
+	return defaultLocale, wl.texts[defaultLocale]
+}
+
+// parseAcceptLanguage returns the lowercase language tags of an Accept-Language
+// header ordered by preference, dropping wildcards and tags with q=0
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= 0 {
+			continue
+		}
+		tags = append(tags, weighted{tag, q})
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	out := make([]string, len(tags))
+	for i, t := range tags {
+		out[i] = t.tag
+	}
+	return out
+}
+
+// handleWarning serves the phishing interstitial, or records the visitor's
+// acknowledgement and sends them on to the page they asked for
+func (s *Server) handleWarning(w http.ResponseWriter, r *http.Request, sub string) {
+	if r.URL.Path == config.WarningPath && r.Method == http.MethodPost {
+		s.setWarningCookie(w, sub)
+		http.Redirect(w, r, safeRedirectPath(r.PostFormValue("next")), http.StatusSeeOther)
+		return
+	}
+	s.serveWarningPage(w, r, sub)
+}
+
+// checkBypassToken reports whether the request carries the subdomain's warning
+// bypass token. On a match it also sets the warning cookie so that follow-up
+// navigations without the token are not interrupted.
+func (s *Server) checkBypassToken(w http.ResponseWriter, r *http.Request, sub string) bool {
+	pool := s.GetPool(sub)
+	if pool == nil {
+		return false
+	}
+	token := r.Header.Get(config.BypassHeader)
+	if token == "" {
+		token = r.URL.Query().Get(config.BypassQueryParam)
+	}
+	if !pool.CheckBypassToken(token) {
+		return false
+	}
+	s.setWarningCookie(w, sub)
+	return true
+}
+
+// configureWarningCookie validates and applies the operator's warning cookie policy
+func (s *Server) configureWarningCookie(cfg *config.Config) error {
+	if cfg.WarningCookieMaxAge < 0 {
+		return fmt.Errorf("invalid warning cookie max age %v", cfg.WarningCookieMaxAge)
+	}
+	s.warningCookieMaxAge = int(cfg.WarningCookieMaxAge.Seconds())
+
+	switch strings.ToLower(cfg.WarningCookieSameSite) {
+	case "", "lax":
+		s.warningCookieSameSite = http.SameSiteLaxMode
+	case "strict":
+		s.warningCookieSameSite = http.SameSiteStrictMode
+	case "none":
+		s.warningCookieSameSite = http.SameSiteNoneMode
+	default:
+		return fmt.Errorf("invalid warning cookie SameSite %q: must be lax, strict or none", cfg.WarningCookieSameSite)
+	}
+
+	switch cfg.WarningCookieScope {
+	case "", config.WarningScopeSubdomain:
+		s.warningCookiePerVisitor = false
+	case config.WarningScopeVisitor:
+		s.warningCookiePerVisitor = true
+	default:
+		return fmt.Errorf("invalid warning cookie scope %q: must be %s or %s",
+			cfg.WarningCookieScope, config.WarningScopeSubdomain, config.WarningScopeVisitor)
+	}
+	return nil
+}
+
+// warningCookieName returns the name of the cookie remembering the warning for a subdomain
+func (s *Server) warningCookieName(sub string) string {
+	if s.warningCookiePerVisitor {
+		return config.WarningCookieName
+	}
+	return config.WarningCookieName + "_" + sub
+}
+
+// setWarningCookie records that the visitor has seen the warning. Per-visitor
+// cookies are scoped to the whole domain so they cover every subdomain.
+func (s *Server) setWarningCookie(w http.ResponseWriter, sub string) {
+	cookie := &http.Cookie{
+		Name:     s.warningCookieName(sub),
+		Value:    "1",
+		Path:     "/",
+		MaxAge:   s.warningCookieMaxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: s.warningCookieSameSite,
+	}
+	if s.warningCookiePerVisitor {
+		cookie.Domain = s.domainFor(sub)
+	}
+	http.SetCookie(w, cookie)
+}
+
+func (s *Server) serveWarningPage(w http.ResponseWriter, r *http.Request, sub string) {
+	lang, text := s.warningLocales.Match(r.Header.Get("Accept-Language"))
+	host := sub + "." + s.domainFor(sub)
+	localize := func(v string) string { return strings.ReplaceAll(v, "{{host}}", host) }
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("Vary", "Accept-Language")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	data := struct {
+		Lang, Title, Heading, Body, Caution, Continue string
+		Action, Next                                  string
+	}{
+		lang, localize(text.Title), localize(text.Heading), localize(text.Body),
+		localize(text.Caution), localize(text.Continue),
+		config.WarningPath, safeRedirectPath(r.URL.RequestURI()),
+	}
+	if err := warningPage.Execute(w, data); err != nil {
+		log.Printf("Failed to render warning page: %v", err)
+	}
+}
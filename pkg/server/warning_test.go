@@ -0,0 +1,293 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"de", []string{"de"}},
+		{"fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5", []string{"fr-ch", "fr", "en"}},
+		{"en;q=0.5, el", []string{"el", "en"}},
+		{"es;q=0, it", []string{"it"}},
+		{"pt;q=bogus, de", []string{"de"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := parseAcceptLanguage(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAcceptLanguage(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarningLocales_Match(t *testing.T) {
+	wl, err := LoadWarningLocales("")
+	if err != nil {
+		t.Fatalf("LoadWarningLocales() error = %v", err)
+	}
+
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"de-DE,de;q=0.9", "de"},
+		{"el", "el"},
+		{"xx, fr;q=0.5", "fr"},
+		{"xx", "en"},
+	}
+	for _, tt := range tests {
+		if got, _ := wl.Match(tt.header); got != tt.want {
+			t.Errorf("Match(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestLoadWarningLocales_Override(t *testing.T) {
+	dir := t.TempDir()
+	// Partial override of an embedded language
+	if err := os.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"continue": "Weiter"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// New language with only the required fields
+	if err := os.WriteFile(filepath.Join(dir, "nl.json"), []byte(`{"heading": "U gaat naar {{host}}", "continue": "Doorgaan"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	wl, err := LoadWarningLocales(dir)
+	if err != nil {
+		t.Fatalf("LoadWarningLocales() error = %v", err)
+	}
+
+	_, de := wl.Match("de")
+	if de.Continue != "Weiter" {
+		t.Errorf("de continue = %q, want override", de.Continue)
+	}
+	if !strings.Contains(de.Heading, "{{host}}") {
+		t.Errorf("de heading = %q, want embedded translation kept", de.Heading)
+	}
+
+	lang, nl := wl.Match("nl-BE")
+	if lang != "nl" || nl.Continue != "Doorgaan" {
+		t.Errorf("Match(nl-BE) = %q %+v, want nl override", lang, nl)
+	}
+	_, en := wl.Match("en")
+	if nl.Caution != en.Caution {
+		t.Error("missing fields of a new language should fall back to English")
+	}
+}
+
+func TestLoadWarningLocales_Errors(t *testing.T) {
+	if _, err := LoadWarningLocales(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing directory")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fr.json"), []byte(`{not json`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadWarningLocales(dir); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestServeWarningPage(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	r := httptest.NewRequest("GET", "https://happy-tiger-abcdef01.tunnl.gg/path?q=1", nil)
+	r.Header.Set("Accept-Language", "es-ES,es;q=0.9")
+	w := httptest.NewRecorder()
+
+	s.handleWarning(w, r, sub)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Content-Language"); got != "es" {
+		t.Errorf("Content-Language = %q, want es", got)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "Visitar el sitio") {
+		t.Error("page should be rendered in Spanish")
+	}
+	if !strings.Contains(body, "happy-tiger-abcdef01.tunnl.gg") {
+		t.Error("page should name the tunnel host")
+	}
+	if !strings.Contains(body, `value="/path?q=1"`) {
+		t.Error("page should carry the original path")
+	}
+}
+
+func TestHandleWarning_Continue(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	form := url.Values{"next": {"/path?q=1"}}
+	r := httptest.NewRequest("POST", config.WarningPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	s.handleWarning(w, r, sub)
+
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if loc := w.Header().Get("Location"); loc != "/path?q=1" {
+		t.Errorf("Location = %q, want /path?q=1", loc)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != config.WarningCookieName+"_"+sub || cookies[0].Value != "1" {
+		t.Fatalf("cookies = %v, want warning cookie", cookies)
+	}
+
+	next := httptest.NewRequest("GET", "/path", nil)
+	next.AddCookie(cookies[0])
+	if !s.hasWarningCookie(next, sub) {
+		t.Error("cookie set by the continue form should satisfy hasWarningCookie")
+	}
+}
+
+func TestCheckBypassToken(t *testing.T) {
+	s := newTestServer(t)
+	sub := "happy-tiger-abcdef01"
+	s.RegisterTunnel(sub, "secret", 0, newTestListener(t), "", 80, "1.2.3.4")
+
+	r := httptest.NewRequest("GET", "/?"+config.BypassQueryParam+"=anything", nil)
+	if s.checkBypassToken(httptest.NewRecorder(), r, sub) {
+		t.Fatal("bypass should be disabled until the tunnel enables it")
+	}
+
+	token, err := s.GetPool(sub).EnableBypass()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		want   bool
+	}{
+		{"header", token, "", true},
+		{"query", "", token, true},
+		{"wrong token", "nope", "", false},
+		{"none", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/"
+			if tt.query != "" {
+				target += "?" + config.BypassQueryParam + "=" + tt.query
+			}
+			r := httptest.NewRequest("GET", target, nil)
+			if tt.header != "" {
+				r.Header.Set(config.BypassHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			if got := s.checkBypassToken(w, r, sub); got != tt.want {
+				t.Errorf("checkBypassToken() = %v, want %v", got, tt.want)
+			}
+			if tt.want && len(w.Result().Cookies()) != 1 {
+				t.Error("a valid token should set the warning cookie")
+			}
+		})
+	}
+}
+
+func TestConfigureWarningCookie(t *testing.T) {
+	tests := []struct {
+		name     string
+		sameSite string
+		scope    string
+		maxAge   time.Duration
+		wantErr  bool
+	}{
+		{"defaults", "lax", config.WarningScopeSubdomain, config.DefaultWarningCookieMaxAge, false},
+		{"strict visitor session", "Strict", config.WarningScopeVisitor, 0, false},
+		{"none", "none", "", time.Hour, false},
+		{"bad samesite", "sometimes", config.WarningScopeSubdomain, time.Hour, true},
+		{"bad scope", "lax", "tunnel", time.Hour, true},
+		{"negative max age", "lax", config.WarningScopeSubdomain, -time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.WarningCookieSameSite = tt.sameSite
+			cfg.WarningCookieScope = tt.scope
+			cfg.WarningCookieMaxAge = tt.maxAge
+			err := (&Server{}).configureWarningCookie(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("configureWarningCookie() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetWarningCookie_Policy(t *testing.T) {
+	sub := "happy-tiger-abcdef01"
+
+	t.Run("per subdomain", func(t *testing.T) {
+		s := newTestServer(t)
+		w := httptest.NewRecorder()
+		s.setWarningCookie(w, sub)
+
+		c := w.Result().Cookies()[0]
+		if c.Name != config.WarningCookieName+"_"+sub || c.Domain != "" {
+			t.Errorf("cookie = %s (domain %q), want host-only per-subdomain cookie", c.Name, c.Domain)
+		}
+		if c.MaxAge != int(config.DefaultWarningCookieMaxAge.Seconds()) {
+			t.Errorf("MaxAge = %d, want %d", c.MaxAge, int(config.DefaultWarningCookieMaxAge.Seconds()))
+		}
+		if c.SameSite != http.SameSiteLaxMode {
+			t.Errorf("SameSite = %v, want Lax", c.SameSite)
+		}
+	})
+
+	t.Run("per visitor", func(t *testing.T) {
+		cfg := config.Default()
+		cfg.HostKeyPath = t.TempDir() + "/host_key"
+		cfg.WarningCookieScope = config.WarningScopeVisitor
+		cfg.WarningCookieSameSite = "strict"
+		cfg.WarningCookieMaxAge = 0
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Stop)
+
+		w := httptest.NewRecorder()
+		s.setWarningCookie(w, sub)
+
+		c := w.Result().Cookies()[0]
+		if c.Name != config.WarningCookieName || c.Domain != cfg.Domain {
+			t.Errorf("cookie = %s (domain %q), want domain-wide cookie", c.Name, c.Domain)
+		}
+		if c.MaxAge != 0 {
+			t.Errorf("MaxAge = %d, want session cookie", c.MaxAge)
+		}
+		if c.SameSite != http.SameSiteStrictMode {
+			t.Errorf("SameSite = %v, want Strict", c.SameSite)
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(c)
+		if !s.hasWarningCookie(r, "other-sub-00000000") {
+			t.Error("per-visitor cookie should cover other subdomains")
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker fast-fails requests to a backend that keeps failing.
+// After threshold consecutive failures it opens for the cooldown period,
+// then lets a single probe request through (half-open). A successful probe
+// closes the breaker again; a failed one reopens it.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int       // consecutive failures
+	openUntil time.Time // zero when closed
+	probing   bool      // a half-open probe is in flight
+	mu        sync.Mutex
+}
+
+// NewCircuitBreaker creates a circuit breaker that trips after threshold
+// consecutive failures and stays open for cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow returns true if a request may be sent to the backend
+func (b *CircuitBreaker) Allow() bool {
+	allowed, _ := b.AllowProbe()
+	return allowed
+}
+
+// AllowProbe is Allow that also reports whether the request is the
+// half-open probe. A probe must end with RecordSuccess, RecordFailure or
+// Release, or no further request is let through.
+func (b *CircuitBreaker) AllowProbe() (allowed, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true, false
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false, false
+	}
+	// Cooldown elapsed: let one probe through
+	b.probing = true
+	return true, true
+}
+
+// Release ends a half-open probe that told nothing about the backend, such
+// as one whose visitor went away, so that the next request probes instead
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// RecordSuccess resets the failure count and closes the breaker
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+// RecordFailure records a backend failure and returns true if this failure tripped the breaker
+func (b *CircuitBreaker) RecordFailure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.probing {
+		// Failed probe: reopen for another cooldown
+		b.probing = false
+		b.openUntil = time.Now().Add(b.cooldown)
+		return false
+	}
+
+	b.failures++
+	if b.openUntil.IsZero() && b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+// IsOpen returns true if the breaker is currently rejecting requests
+func (b *CircuitBreaker) IsOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
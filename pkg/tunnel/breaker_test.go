@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_ClosedByDefault(t *testing.T) {
+	b := NewCircuitBreaker(3, time.Minute)
+	if !b.Allow() {
+		t.Error("new breaker should allow requests")
+	}
+	if b.IsOpen() {
+		t.Error("new breaker should not be open")
+	}
+}
+
+func TestCircuitBreaker_TripsAfterThreshold(t *testing.T) {
+	b := NewCircuitBreaker(3, time.Minute)
+
+	if b.RecordFailure() || b.RecordFailure() {
+		t.Fatal("RecordFailure() should not trip before threshold")
+	}
+	if !b.RecordFailure() {
+		t.Fatal("RecordFailure() should trip on reaching threshold")
+	}
+	if b.Allow() {
+		t.Error("open breaker should reject requests")
+	}
+	if b.RecordFailure() {
+		t.Error("RecordFailure() should only report the trip once")
+	}
+}
+
+func TestCircuitBreaker_SuccessResets(t *testing.T) {
+	b := NewCircuitBreaker(3, time.Minute)
+
+	b.RecordFailure()
+	b.RecordFailure()
+	b.RecordSuccess()
+
+	if b.RecordFailure() {
+		t.Error("success should reset the consecutive failure count")
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbe(t *testing.T) {
+	b := NewCircuitBreaker(1, 20*time.Millisecond)
+	b.RecordFailure()
+
+	time.Sleep(30 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatal("breaker should allow a probe after cooldown")
+	}
+	if b.Allow() {
+		t.Error("breaker should allow only one probe at a time")
+	}
+
+	// Failed probe reopens
+	b.RecordFailure()
+	if b.Allow() {
+		t.Error("failed probe should reopen the breaker")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	b.Allow()
+	b.RecordSuccess()
+	if b.IsOpen() || !b.Allow() {
+		t.Error("successful probe should close the breaker")
+	}
+}
+
+func TestCircuitBreaker_ReleaseProbe(t *testing.T) {
+	b := NewCircuitBreaker(1, 20*time.Millisecond)
+	b.RecordFailure()
+	if allowed, probe := b.AllowProbe(); allowed || probe {
+		t.Fatalf("AllowProbe() = %v, %v during the cooldown, want false, false", allowed, probe)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if allowed, probe := b.AllowProbe(); !allowed || !probe {
+		t.Fatalf("AllowProbe() = %v, %v after the cooldown, want a probe", allowed, probe)
+	}
+
+	// A released probe neither closes nor reopens the breaker
+	b.Release()
+	if allowed, probe := b.AllowProbe(); !allowed || !probe {
+		t.Errorf("AllowProbe() = %v, %v after Release, want another probe", allowed, probe)
+	}
+	if !b.IsOpen() {
+		t.Error("Release should leave the breaker open until a probe succeeds")
+	}
+}
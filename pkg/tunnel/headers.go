@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Actions of a header rule
+const (
+	HeaderSet    = "set"    // replace any values the header had
+	HeaderAdd    = "add"    // append a value, keeping existing ones
+	HeaderRemove = "remove" // drop the header
+)
+
+// Headers identifying the tunnel and the visitor to the local server. They
+// are always removed from visitors' requests, so they cannot be forged.
+const (
+	HeaderSubdomain = "X-Tunnl-Subdomain"
+	HeaderVisitorIP = "X-Tunnl-Visitor-Ip"
+	HeaderProto     = "X-Tunnl-Proto" // https, or http for requests the server did not redirect
+)
+
+// HeaderPrefix starts the name of every header tunnl.gg itself adds
+const HeaderPrefix = "X-Tunnl-"
+
+// visitorHeaders carry the visitor's address or client as seen by a proxy in
+// front; the privacy option keeps them from the local server
+var visitorHeaders = []string{
+	"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto",
+	"X-Real-Ip", "True-Client-Ip", "Cf-Connecting-Ip", "Via", "From",
+}
+
+// StripVisitorHeaders removes the headers identifying the visitor or the
+// tunnel from a request to the local server. X-Forwarded-For is left nil and
+// User-Agent empty, which keeps the reverse proxy and the HTTP client from
+// adding their own.
+func StripVisitorHeaders(h http.Header) {
+	StripTunnlHeaders(h)
+	for _, name := range visitorHeaders {
+		delete(h, name)
+	}
+	h["X-Forwarded-For"] = nil
+	h["User-Agent"] = []string{""}
+}
+
+// StripTunnlHeaders removes every X-Tunnl-* header
+func StripTunnlHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(name, HeaderPrefix) {
+			delete(h, name)
+		}
+	}
+}
+
+// HeaderRule adds, overrides or removes a header of the requests sent to the
+// local server or of the responses it sends back
+type HeaderRule struct {
+	Action string // one of HeaderSet, HeaderAdd, HeaderRemove
+	Name   string // canonical header name
+	Value  string // empty for HeaderRemove
+}
+
+// protectedHeaders frame the message or the connection, or are managed by the
+// proxy itself, so rules may not touch them
+var protectedHeaders = []string{
+	"Host", "Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade", "Content-Length", "Content-Encoding",
+}
+
+// IsProtectedHeader reports whether rules may not change the canonical header name
+func IsProtectedHeader(name string) bool {
+	return slices.Contains(protectedHeaders, name)
+}
+
+// ApplyHeaderRules changes h as the rules say, in order
+func ApplyHeaderRules(h http.Header, rules []HeaderRule) {
+	for _, r := range rules {
+		switch r.Action {
+		case HeaderSet:
+			h[r.Name] = []string{r.Value}
+		case HeaderAdd:
+			h[r.Name] = append(h[r.Name], r.Value)
+		case HeaderRemove:
+			delete(h, r.Name)
+		}
+	}
+}
+
+// SetIdentify sets whether requests to the local server carry the X-Tunnl-*
+// headers, which they do unless the owner opts out with no-tunnl-headers
+func (t *Tunnel) SetIdentify(on bool) {
+	t.mu.Lock()
+	t.noIdentify = !on
+	t.mu.Unlock()
+}
+
+// Identify reports whether requests to the local server carry the X-Tunnl-* headers
+func (t *Tunnel) Identify() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.noIdentify
+}
+
+// SetPrivate sets whether the tunnel keeps visitor data and X-Tunnl-*
+// headers from the local server, and X-Tunnl-* headers from visitors
+func (t *Tunnel) SetPrivate(on bool) {
+	t.mu.Lock()
+	t.private = on
+	t.mu.Unlock()
+}
+
+// Private reports whether the tunnel was started with the privacy option
+func (t *Tunnel) Private() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.private
+}
+
+// SetHeaderRules replaces the rules applied to requests toward the local
+// server and to the responses it sends back
+func (t *Tunnel) SetHeaderRules(request, response []HeaderRule) {
+	t.mu.Lock()
+	t.requestHeaders = slices.Clone(request)
+	t.responseHeaders = slices.Clone(response)
+	t.mu.Unlock()
+}
+
+// HeaderRules returns the tunnel's request and response header rules. The
+// slices are never modified in place, so callers may hold on to them.
+func (t *Tunnel) HeaderRules() (request, response []HeaderRule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.requestHeaders, t.responseHeaders
+}
@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// RequestRecord summarizes one proxied request
+type RequestRecord struct {
+	Time      time.Time `json:"time"`
+	BackendID string    `json:"backend_id,omitempty"`
+	Method    string    `json:"method"` // "WS" for WebSocket connections
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMS int64     `json:"latency_ms"` // connection duration for WebSockets
+	VisitorIP string    `json:"visitor_ip"`
+	Country   string    `json:"country,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	CaptureID string    `json:"capture_id,omitempty"` // bodies captured for inspected tunnels
+}
+
+// RequestHistory is a fixed-size ring buffer of the most recent requests
+type RequestHistory struct {
+	mu      sync.Mutex
+	records []RequestRecord
+	next    int  // slot the next record goes into
+	full    bool // every slot has been written
+}
+
+// NewRequestHistory creates a history holding the last size requests
+func NewRequestHistory(size int) *RequestHistory {
+	return &RequestHistory{records: make([]RequestRecord, size)}
+}
+
+// Add records a request, overwriting the oldest once the buffer is full
+func (h *RequestHistory) Add(r RequestRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.records) == 0 {
+		return
+	}
+	h.records[h.next] = r
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Recent returns up to n of the latest requests, oldest first (n <= 0 = all)
+func (h *RequestHistory) Recent(n int) []RequestRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	count := h.next
+	if h.full {
+		count = len(h.records)
+	}
+	if n > 0 && n < count {
+		count = n
+	}
+	out := make([]RequestRecord, count)
+	for i := range out {
+		idx := (h.next - count + i + len(h.records)) % len(h.records)
+		out[i] = h.records[idx]
+	}
+	return out
+}
+
+// RequestFeed fans request records out to live subscribers. Slow subscribers
+// miss records rather than holding up requests.
+type RequestFeed struct {
+	mu   sync.Mutex
+	subs map[chan RequestRecord]struct{}
+	max  int
+}
+
+// NewRequestFeed creates a feed allowing up to max concurrent subscribers
+func NewRequestFeed(max int) *RequestFeed {
+	return &RequestFeed{subs: make(map[chan RequestRecord]struct{}), max: max}
+}
+
+// Subscribe returns a channel of new records and a function that ends the
+// subscription, or ok = false if the feed has max subscribers already
+func (f *RequestFeed) Subscribe() (records <-chan RequestRecord, cancel func(), ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subs) >= f.max {
+		return nil, nil, false
+	}
+	ch := make(chan RequestRecord, config.RequestFeedBuffer)
+	f.subs[ch] = struct{}{}
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.subs, ch)
+	}, true
+}
+
+// Publish sends a record to every subscriber with room for it
+func (f *RequestFeed) Publish(r RequestRecord) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+}
+
+// Access log formats accepted by WriteAccessLog
+const (
+	AccessLogText = "text" // Combined Log Format plus latency
+	AccessLogJSON = "json"
+)
+
+// WriteAccessLog renders records as a downloadable access log
+func WriteAccessLog(w io.Writer, records []RequestRecord, format string) error {
+	if format == AccessLogJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+	bw := bufio.NewWriter(w)
+	for _, r := range records {
+		ua := r.UserAgent
+		if ua == "" {
+			ua = "-"
+		}
+		fmt.Fprintf(bw, "%s - - [%s] %q %d %d \"-\" %q %dms\n",
+			r.VisitorIP, r.Time.Format("02/Jan/2006:15:04:05 -0700"), r.Method+" "+r.Path, r.Status, r.Bytes, ua, r.LatencyMS)
+	}
+	return bw.Flush()
+}
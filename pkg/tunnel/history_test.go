@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestHistory(t *testing.T) {
+	h := NewRequestHistory(3)
+	if got := h.Recent(0); len(got) != 0 {
+		t.Fatalf("Recent() on an empty history = %v", got)
+	}
+
+	for _, path := range []string{"/a", "/b"} {
+		h.Add(RequestRecord{Path: path})
+	}
+	if got := paths(h.Recent(0)); got != "/a/b" {
+		t.Errorf("Recent(0) = %s, want /a/b", got)
+	}
+
+	for _, path := range []string{"/c", "/d", "/e"} {
+		h.Add(RequestRecord{Path: path})
+	}
+	if got := paths(h.Recent(0)); got != "/c/d/e" {
+		t.Errorf("Recent(0) after wrapping = %s, want /c/d/e", got)
+	}
+	if got := paths(h.Recent(2)); got != "/d/e" {
+		t.Errorf("Recent(2) = %s, want /d/e", got)
+	}
+}
+
+func paths(records []RequestRecord) string {
+	var s string
+	for _, r := range records {
+		s += r.Path
+	}
+	return s
+}
+
+func TestRequestFeed(t *testing.T) {
+	f := NewRequestFeed(1)
+	records, cancel, ok := f.Subscribe()
+	if !ok {
+		t.Fatal("Subscribe() failed on an empty feed")
+	}
+	if _, _, ok := f.Subscribe(); ok {
+		t.Error("Subscribe() should fail beyond the subscriber limit")
+	}
+
+	f.Publish(RequestRecord{Path: "/a"})
+	if r := <-records; r.Path != "/a" {
+		t.Errorf("received %q, want /a", r.Path)
+	}
+
+	// A subscriber that stops reading does not block publishers
+	for range 1000 {
+		f.Publish(RequestRecord{})
+	}
+
+	cancel()
+	if _, _, ok := f.Subscribe(); !ok {
+		t.Error("Subscribe() should succeed after cancel")
+	}
+}
+
+func TestWriteAccessLog(t *testing.T) {
+	records := []RequestRecord{
+		{Time: time.Date(2024, 3, 5, 14, 2, 9, 0, time.UTC), Method: "POST", Path: "/api", Status: 201, Bytes: 42, LatencyMS: 7, VisitorIP: "1.2.3.4", UserAgent: "curl/8.0"},
+		{Time: time.Date(2024, 3, 5, 14, 2, 10, 0, time.UTC), Method: "GET", Path: "/", Status: 404, VisitorIP: "5.6.7.8"},
+	}
+	var b strings.Builder
+	if err := WriteAccessLog(&b, records, AccessLogText); err != nil {
+		t.Fatal(err)
+	}
+	want := `1.2.3.4 - - [05/Mar/2024:14:02:09 +0000] "POST /api" 201 42 "-" "curl/8.0" 7ms
+5.6.7.8 - - [05/Mar/2024:14:02:10 +0000] "GET /" 404 0 "-" "-" 0ms
+`
+	if b.String() != want {
+		t.Errorf("text log = %q, want %q", b.String(), want)
+	}
+
+	b.Reset()
+	if err := WriteAccessLog(&b, []RequestRecord{}, AccessLogJSON); err != nil || b.String() != "[]\n" {
+		t.Errorf("empty json log = %q, %v", b.String(), err)
+	}
+}
@@ -0,0 +1,386 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"tunnl.gg/internal/subdomain"
+	"tunnl.gg/pkg/config"
+)
+
+// OptionsUsage describes the options accepted by ParseOptions
+const OptionsUsage = `Usage: ssh -t -R 80:localhost:<port> <domain> "[option ...]"
+
+Options:
+  subdomain=<name>      Request a specific subdomain
+  domain=<name>         Serve the tunnel on another of the server's domains
+  auth=<user>:<pass>    Require HTTP basic auth from visitors
+  rate=<n>              Lower the tunnel's rate limit to n requests per second
+  queue=<seconds>       Let requests over the rate limit wait up to this long for their turn
+                        instead of failing with 429 (0 fails them at once)
+  no-warning            Skip the browser warning page (needs a key or tier granting it)
+  passphrase            Protect the tunnel with a generated passphrase
+  bypass-token          Generate a token that lets automated browsers skip the warning
+  compress              Compress responses the local server sent uncompressed (gzip/brotli)
+  allow-indexing        Let search engines index the tunnel (no noindex, robots.txt from your app)
+  block-bots=<action>   Answer bots, scanners and empty user agents with 404, 403 or challenge
+  no-color              Do not color status codes and latencies in this log
+  inspect               Capture request and response bodies for inspection
+  log-visitors          Show each visitor's IP, country and user agent in this log
+  log-exclude=<globs>   Hide requests to these paths from this log, e.g. /healthz,/static/*
+  route=<prefix>:<port> Send requests under a path prefix, with the prefix removed, to
+                        another port you forwarded, e.g. route=/api:8080 with -R 8080:localhost:8080
+  service=<name>:<port> Serve another port you forwarded at <name>--<subdomain>, e.g. service=api:8080
+  request-header=<name>:<value>
+                        Set a header on requests to your local server (repeatable); +<name>:<value>
+                        adds a value instead, -<name> removes the header; write spaces as %20
+  response-header=<name>:<value>
+                        The same for responses your local server sends, e.g. response-header=-Server
+  no-tunnl-headers      Do not send X-Tunnl-Subdomain, -Visitor-IP and -Proto to your local server
+  privacy               Keep visitor IPs, user agents and X-Tunnl-* headers from your local server,
+                        and X-Tunnl-* headers from visitors
+  label.<key>=<value>   Attach a metadata label (repeatable)`
+
+// Options is the structured set of options a client requested for its tunnel
+type Options struct {
+	Subdomain     string
+	Domain        string
+	AuthUser      string
+	AuthPass      string
+	Rate          int           // requests per second, 0 = server default
+	QueueTimeout  time.Duration // wait over the rate limit, 0 = server default
+	NoQueue       bool          // queue=0: reject requests over the rate limit at once
+	NoWarning     bool
+	Passphrase    bool
+	BypassToken   bool
+	Compress      bool
+	AllowIndexing bool     // omit the default X-Robots-Tag: noindex
+	BlockBots     string   // one of BotActions, empty = bots are let through
+	LogExclude    []string // path globs left out of the request log
+	LogVisitors   bool
+	NoColor       bool
+	Inspect       bool // capture request and response bodies
+	NoIdentify    bool // leave out the X-Tunnl-* headers
+	Privacy       bool // strip visitor data and X-Tunnl-* headers in both directions
+	Routes        []Route
+	Services      []Service
+	Labels        map[string]string
+
+	// Rules applied to requests toward the local server and to its responses
+	RequestHeaders  []HeaderRule
+	ResponseHeaders []HeaderRule
+}
+
+// Actions taken by the block-bots option on requests from bots and scanners
+const (
+	BotAction404       = "404"
+	BotAction403       = "403"
+	BotActionChallenge = "challenge" // JavaScript challenge; clients that pass it get through
+)
+
+// BotActions are the accepted block-bots values
+var BotActions = []string{BotAction404, BotAction403, BotActionChallenge}
+
+// OptionsError lists every problem found while parsing options
+type OptionsError struct {
+	Problems []string
+}
+
+func (e *OptionsError) Error() string {
+	return "invalid tunnel options: " + strings.Join(e.Problems, "; ")
+}
+
+// ParseOptions parses whitespace-separated tunnel options such as
+// "auth=user:pass rate=5 no-warning". All problems are reported together in an
+// *OptionsError so clients can fix them in one go.
+func ParseOptions(s string) (*Options, error) {
+	opts := &Options{}
+	var problems []string
+	seen := make(map[string]bool)
+
+	for _, field := range strings.Fields(s) {
+		name, value, hasValue := strings.Cut(field, "=")
+		name = strings.ToLower(name)
+
+		key := name
+		if strings.HasPrefix(name, "label.") {
+			key = field // labels are repeatable, but each key only once
+		}
+		if name == "request-header" || name == "response-header" {
+			key = field // header rules are repeatable
+		}
+		if seen[key] {
+			problems = append(problems, fmt.Sprintf("%s: given more than once", name))
+			continue
+		}
+		seen[key] = true
+
+		if err := opts.set(name, value, hasValue); err != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, &OptionsError{Problems: problems}
+	}
+	return opts, nil
+}
+
+// set applies a single option and returns a description of what is wrong with it, if anything
+func (o *Options) set(name, value string, hasValue bool) string {
+	switch name {
+	case "no-warning", "passphrase", "bypass-token", "compress", "allow-indexing", "log-visitors", "no-color", "inspect", "no-tunnl-headers", "privacy":
+		if hasValue {
+			return "does not take a value"
+		}
+		switch name {
+		case "no-warning":
+			o.NoWarning = true
+		case "passphrase":
+			o.Passphrase = true
+		case "bypass-token":
+			o.BypassToken = true
+		case "compress":
+			o.Compress = true
+		case "allow-indexing":
+			o.AllowIndexing = true
+		case "log-visitors":
+			o.LogVisitors = true
+		case "no-color":
+			o.NoColor = true
+		case "inspect":
+			o.Inspect = true
+		case "no-tunnl-headers":
+			o.NoIdentify = true
+		case "privacy":
+			o.Privacy = true
+		}
+		return ""
+	}
+
+	if !hasValue || value == "" {
+		if strings.HasPrefix(name, "label.") || isKnownOption(name) {
+			return "requires a value"
+		}
+		return "unknown option"
+	}
+
+	switch {
+	case name == "subdomain":
+		value = strings.ToLower(value)
+		if !subdomain.IsValidName(value) {
+			return "must be 3-63 lowercase letters, digits or hyphens, not starting or ending with a hyphen"
+		}
+		o.Subdomain = value
+	case name == "entropy":
+		// The subdomain is generated before options arrive
+		return "choose it with the SSH username, e.g. alice+entropy=high@<domain>"
+	case name == "domain":
+		value = strings.TrimSuffix(strings.ToLower(value), ".")
+		if !isValidDomain(value) {
+			return "must be a domain name such as tunnl.dev"
+		}
+		o.Domain = value
+	case name == "auth":
+		user, pass, ok := strings.Cut(value, ":")
+		if !ok || user == "" || pass == "" {
+			return "must be in the form user:password"
+		}
+		if len(user) > config.MaxLabelLength || len(pass) > config.MaxLabelLength ||
+			!isPrintableASCII(user) || !isPrintableASCII(pass) {
+			return fmt.Sprintf("user and password must be printable ASCII of at most %d characters", config.MaxLabelLength)
+		}
+		o.AuthUser, o.AuthPass = user, pass
+	case name == "block-bots":
+		value = strings.ToLower(value)
+		if !slices.Contains(BotActions, value) {
+			return "must be 404, 403 or challenge"
+		}
+		o.BlockBots = value
+	case name == "log-exclude":
+		patterns := strings.Split(value, ",")
+		if len(patterns) > config.MaxLogExcludePatterns {
+			return fmt.Sprintf("at most %d patterns are allowed", config.MaxLogExcludePatterns)
+		}
+		for _, p := range patterns {
+			if !strings.HasPrefix(p, "/") || len(p) > config.MaxLabelLength || !isPrintableASCII(p) {
+				return fmt.Sprintf("patterns must start with '/' and be printable ASCII of at most %d characters", config.MaxLabelLength)
+			}
+		}
+		o.LogExclude = patterns
+	case name == "route":
+		routes := strings.Split(value, ",")
+		if len(routes) > config.MaxRoutes {
+			return fmt.Sprintf("at most %d routes are allowed", config.MaxRoutes)
+		}
+		for _, r := range routes {
+			prefix, port, ok := parseRoute(r)
+			if !ok {
+				return fmt.Sprintf("routes must be <prefix>:<port> with a prefix such as /api of at most %d characters", config.MaxLabelLength)
+			}
+			if slices.ContainsFunc(o.Routes, func(other Route) bool { return other.Prefix == prefix }) {
+				return fmt.Sprintf("%s is routed more than once", prefix)
+			}
+			o.Routes = append(o.Routes, Route{Prefix: prefix, Port: port})
+		}
+	case name == "service":
+		services := strings.Split(value, ",")
+		if len(services) > config.MaxServices {
+			return fmt.Sprintf("at most %d services are allowed", config.MaxServices)
+		}
+		for _, svc := range services {
+			svcName, port, ok := strings.Cut(svc, ":")
+			n, err := strconv.ParseUint(port, 10, 16)
+			if !ok || err != nil || n == 0 || !subdomain.IsValidService(svcName) {
+				return "services must be <name>:<port> with a name of 1-20 lowercase letters, digits or single hyphens"
+			}
+			if slices.ContainsFunc(o.Services, func(other Service) bool { return other.Name == svcName }) {
+				return fmt.Sprintf("%s is named more than once", svcName)
+			}
+			o.Services = append(o.Services, Service{Name: svcName, Port: uint32(n)})
+		}
+	case name == "request-header", name == "response-header":
+		if len(o.RequestHeaders)+len(o.ResponseHeaders) >= config.MaxHeaderRules {
+			return fmt.Sprintf("at most %d header rules are allowed", config.MaxHeaderRules)
+		}
+		rule, err := parseHeaderRule(value)
+		if err != "" {
+			return err
+		}
+		if name == "request-header" {
+			o.RequestHeaders = append(o.RequestHeaders, rule)
+		} else {
+			o.ResponseHeaders = append(o.ResponseHeaders, rule)
+		}
+	case name == "rate":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > config.RequestsPerSecond {
+			return fmt.Sprintf("must be a whole number between 1 and %d", config.RequestsPerSecond)
+		}
+		o.Rate = n
+	case name == "queue":
+		limit := int(config.MaxRequestQueueTimeout / time.Second)
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > limit {
+			return fmt.Sprintf("must be a whole number of seconds between 0 and %d", limit)
+		}
+		if n == 0 {
+			o.NoQueue = true
+		} else {
+			o.QueueTimeout = time.Duration(n) * time.Second
+		}
+	case strings.HasPrefix(name, "label."):
+		key := strings.TrimPrefix(name, "label.")
+		if !isValidLabel(key) {
+			return "key must be lowercase letters, digits, '_', '.' or '-'"
+		}
+		if len(value) > config.MaxLabelLength || !isPrintableASCII(value) {
+			return fmt.Sprintf("value must be printable ASCII of at most %d characters", config.MaxLabelLength)
+		}
+		if o.Labels == nil {
+			o.Labels = make(map[string]string)
+		}
+		if len(o.Labels) >= config.MaxLabelsPerTunnel {
+			return fmt.Sprintf("at most %d labels are allowed", config.MaxLabelsPerTunnel)
+		}
+		o.Labels[key] = value
+	default:
+		return "unknown option"
+	}
+	return ""
+}
+
+// isKnownOption reports whether name is an option that takes a value
+func isKnownOption(name string) bool {
+	return name == "subdomain" || name == "entropy" || name == "domain" || name == "auth" || name == "rate" || name == "queue" || name == "block-bots" || name == "log-exclude" || name == "route" || name == "service" ||
+		name == "request-header" || name == "response-header"
+}
+
+// parseRoute parses "<prefix>:<port>" of the route option. The prefix loses
+// any trailing '/' and may not be "/" itself, which the first forward serves.
+func parseRoute(s string) (prefix string, port uint32, ok bool) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return "", 0, false
+	}
+	prefix = strings.TrimRight(s[:i], "/")
+	n, err := strconv.ParseUint(s[i+1:], 10, 16)
+	if err != nil || n == 0 || !strings.HasPrefix(prefix, "/") ||
+		len(prefix) > config.MaxLabelLength || !isPrintableASCII(prefix) ||
+		strings.ContainsAny(prefix, "?#") {
+		return "", 0, false
+	}
+	return prefix, uint32(n), true
+}
+
+// parseHeaderRule parses "<name>:<value>", "+<name>:<value>" or "-<name>"
+// of the request-header and response-header options. Values are
+// percent-decoded, as options cannot contain spaces.
+func parseHeaderRule(s string) (HeaderRule, string) {
+	rule := HeaderRule{Action: HeaderSet}
+	switch s[0] {
+	case '+':
+		rule.Action, s = HeaderAdd, s[1:]
+	case '-':
+		rule.Action, s = HeaderRemove, s[1:]
+	}
+	name, value, hasValue := strings.Cut(s, ":")
+	if !isHeaderName(name) {
+		return rule, "must be <name>:<value>, +<name>:<value> or -<name> with a header name such as X-Api-Key"
+	}
+	rule.Name = http.CanonicalHeaderKey(name)
+	if IsProtectedHeader(rule.Name) {
+		return rule, fmt.Sprintf("%s cannot be changed", rule.Name)
+	}
+	if rule.Action == HeaderRemove {
+		if hasValue {
+			return rule, "-<name> does not take a value"
+		}
+		return rule, ""
+	}
+	value, err := url.PathUnescape(value)
+	if !hasValue || value == "" || err != nil ||
+		len(value) > config.MaxHeaderValueLength || !isPrintableASCII(value) {
+		return rule, fmt.Sprintf("value must be printable ASCII of at most %d characters, with %%20 for spaces", config.MaxHeaderValueLength)
+	}
+	rule.Value = value
+	return rule, ""
+}
+
+// isHeaderName reports whether s is a valid HTTP header field name (an RFC 9110 token)
+func isHeaderName(s string) bool {
+	if s == "" || len(s) > config.MaxLabelLength {
+		return false
+	}
+	for _, c := range s {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidDomain reports whether s is a lowercase domain name of at least two labels
+func isValidDomain(s string) bool {
+	labels := strings.Split(s, ".")
+	if len(s) > 253 || len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
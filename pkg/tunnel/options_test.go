@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Options
+	}{
+		{"", Options{}},
+		{"no-warning", Options{NoWarning: true}},
+		{"subdomain=MyApp auth=u:p rate=5 no-warning", Options{
+			Subdomain: "myapp", AuthUser: "u", AuthPass: "p", Rate: 5, NoWarning: true,
+		}},
+		{"auth=user:pa:ss", Options{AuthUser: "user", AuthPass: "pa:ss"}},
+		{"queue=15", Options{QueueTimeout: 15 * time.Second}},
+		{"queue=0", Options{NoQueue: true}},
+		{"passphrase bypass-token", Options{Passphrase: true, BypassToken: true}},
+		{"compress", Options{Compress: true}},
+		{"allow-indexing", Options{AllowIndexing: true}},
+		{"no-tunnl-headers", Options{NoIdentify: true}},
+		{"privacy", Options{Privacy: true}},
+		{"log-visitors no-color", Options{LogVisitors: true, NoColor: true}},
+		{"log-exclude=/healthz,/static/*", Options{LogExclude: []string{"/healthz", "/static/*"}}},
+		{"block-bots=Challenge", Options{BlockBots: BotActionChallenge}},
+		{"route=/api/:8080,/admin:9000", Options{Routes: []Route{{"/api", 8080}, {"/admin", 9000}}}},
+		{"domain=Tunnl.Dev.", Options{Domain: "tunnl.dev"}},
+		{"service=api:8080,web:80", Options{Services: []Service{{"api", 8080}, {"web", 80}}}},
+		{"request-header=x-api-key:s3cr%2Ft request-header=Authorization:Bearer%20abc", Options{RequestHeaders: []HeaderRule{
+			{HeaderSet, "X-Api-Key", "s3cr/t"}, {HeaderSet, "Authorization", "Bearer abc"},
+		}}},
+		{"response-header=-server response-header=+Cache-Control:no-store", Options{ResponseHeaders: []HeaderRule{
+			{HeaderRemove, "Server", ""}, {HeaderAdd, "Cache-Control", "no-store"},
+		}}},
+		{"label.project=foo label.env=staging", Options{
+			Labels: map[string]string{"project": "foo", "env": "staging"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseOptions(tt.input)
+			if err != nil {
+				t.Fatalf("ParseOptions(%q) error = %v", tt.input, err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("ParseOptions(%q) = %+v, want %+v", tt.input, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOptions_Errors(t *testing.T) {
+	tests := []struct {
+		input   string
+		problem string
+	}{
+		{"frobnicate", "frobnicate: unknown option"},
+		{"colour=red", "colour: unknown option"},
+		{"entropy=high", "entropy: choose it with the SSH username, e.g. alice+entropy=high@<domain>"},
+		{"no-warning=1", "no-warning: does not take a value"},
+		{"rate", "rate: requires a value"},
+		{"rate=0", "rate: must be a whole number"},
+		{"rate=fast", "rate: must be a whole number"},
+		{"rate=1000", "rate: must be a whole number"},
+		{"queue=-1", "queue: must be a whole number of seconds"},
+		{"queue=2s", "queue: must be a whole number of seconds"},
+		{"queue=21", "queue: must be a whole number of seconds"},
+		{"auth=user", "auth: must be in the form user:password"},
+		{"auth=:pass", "auth: must be in the form user:password"},
+		{"subdomain=-bad", "subdomain: must be 3-63"},
+		{"subdomain=a_b", "subdomain: must be 3-63"},
+		{"label.Bad!=x", "label.bad!: key must be"},
+		{"domain=localhost", "domain: must be a domain name"},
+		{"domain=tunnl_gg.dev", "domain: must be a domain name"},
+		{"rate=5 rate=6", "rate: given more than once"},
+		{"block-bots", "block-bots: requires a value"},
+		{"log-exclude=healthz", "log-exclude: patterns must start with '/'"},
+		{"log-exclude=/a,,/b", "log-exclude: patterns must start with '/'"},
+		{"block-bots=drop", "block-bots: must be 404, 403 or challenge"},
+		{"route=/api", "route: routes must be <prefix>:<port>"},
+		{"route=/:3000", "route: routes must be <prefix>:<port>"},
+		{"route=api:8080", "route: routes must be <prefix>:<port>"},
+		{"route=/api:70000", "route: routes must be <prefix>:<port>"},
+		{"route=/api:8080,/api/:9000", "route: /api is routed more than once"},
+		{"service=api", "service: services must be <name>:<port>"},
+		{"service=a--b:8080", "service: services must be <name>:<port>"},
+		{"service=Api:8080", "service: services must be <name>:<port>"},
+		{"service=api:0", "service: services must be <name>:<port>"},
+		{"service=api:8080,api:9000", "service: api is named more than once"},
+		{"request-header", "request-header: requires a value"},
+		{"request-header=X-Key", "request-header: value must be printable ASCII"},
+		{"request-header=X-Key:%zz", "request-header: value must be printable ASCII"},
+		{"request-header=X-Key:a%0Ab", "request-header: value must be printable ASCII"},
+		{"request-header=Bad(Name):x", "request-header: must be <name>:<value>"},
+		{"request-header=+:x", "request-header: must be <name>:<value>"},
+		{"request-header=host:evil.example", "request-header: Host cannot be changed"},
+		{"response-header=-Content-Length", "response-header: Content-Length cannot be changed"},
+		{"response-header=-Server:x", "response-header: -<name> does not take a value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := ParseOptions(tt.input)
+			var optsErr *OptionsError
+			if !errors.As(err, &optsErr) {
+				t.Fatalf("ParseOptions(%q) error = %v, want *OptionsError", tt.input, err)
+			}
+			if len(optsErr.Problems) != 1 || !strings.HasPrefix(optsErr.Problems[0], tt.problem) {
+				t.Errorf("problems = %q, want one starting with %q", optsErr.Problems, tt.problem)
+			}
+		})
+	}
+}
+
+func TestParseOptions_ReportsAllProblems(t *testing.T) {
+	_, err := ParseOptions("rate=0 bogus no-warning auth=x")
+	var optsErr *OptionsError
+	if !errors.As(err, &optsErr) {
+		t.Fatalf("error = %v, want *OptionsError", err)
+	}
+	if len(optsErr.Problems) != 3 {
+		t.Errorf("got %d problems %q, want 3", len(optsErr.Problems), optsErr.Problems)
+	}
+}
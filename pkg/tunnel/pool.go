@@ -0,0 +1,353 @@
+package tunnel
+
+import (
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+
+	"tunnl.gg/pkg/config"
+)
+
+// Pool is the set of tunnels serving a single subdomain.
+// Additional SSH clients that present the pool's join token attach as extra
+// backends, and requests are distributed across them round-robin. Tunnels with
+// a traffic percentage (canaries) receive that share of requests instead.
+type Pool struct {
+	Subdomain  string
+	JoinToken  string // Secret required to attach another backend to this subdomain
+	mu         sync.Mutex
+	tunnels    []*Tunnel
+	next       int
+	seq        int             // Last backend ID handed out
+	roll       func(n int) int // Random source for weighted routing, overridable for tests
+	passphrase string          // Visitors must enter this before reaching the backends (empty = open)
+	bypass     string          // Lets automated clients skip the browser warning (empty = disabled)
+	authUser   string          // HTTP basic auth credentials visitors must present (empty = open)
+	authPass   string          // Password paired with authUser
+	noWarning  bool            // Skip the browser warning page
+	compress   bool            // Compress responses the backends sent uncompressed
+	indexing   bool            // Let search engines index responses (no X-Robots-Tag)
+	inspect    bool            // Capture request and response bodies for the admin API
+	blockBots  string          // Action taken on bot and scanner requests (empty = let through)
+	domain     string          // Serving domain (empty = the server's default domain)
+	rate       int             // Operator-set requests per second for every backend (0 = per-tunnel limits)
+	burst      int             // Burst size paired with rate
+	feed       *RequestFeed    // Live requests of all backends, for tail subscribers
+	logToken   string          // Read-only secret for downloading the access log
+}
+
+// NewPool creates an empty pool for a subdomain
+func NewPool(subdomain, joinToken string) *Pool {
+	return &Pool{
+		Subdomain: subdomain,
+		JoinToken: joinToken,
+		roll:      rand.IntN,
+		feed:      NewRequestFeed(config.MaxTailSubscribers),
+		logToken:  crand.Text(),
+	}
+}
+
+// Add attaches a tunnel to the pool and assigns it a backend ID unique within the pool
+func (p *Pool) Add(t *Tunnel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq++
+	t.setBackendID(strconv.Itoa(p.seq))
+	p.tunnels = append(p.tunnels, t)
+}
+
+// Get returns the tunnel with the given backend ID, or nil if it is not attached
+func (p *Pool) Get(backendID string) *Tunnel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.tunnels {
+		if t.BackendID() == backendID {
+			return t
+		}
+	}
+	return nil
+}
+
+// Remove detaches a tunnel from the pool and returns the number of tunnels left
+func (p *Pool) Remove(t *Tunnel) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	remaining := make([]*Tunnel, 0, len(p.tunnels))
+	for _, existing := range p.tunnels {
+		if existing != t {
+			remaining = append(remaining, existing)
+		}
+	}
+	p.tunnels = remaining
+	return len(p.tunnels)
+}
+
+// Next picks the tunnel for the next request, or nil if the pool is empty.
+// Canary tunnels win their traffic percentage of requests; the rest are
+// distributed round-robin across the regular tunnels.
+func (p *Pool) Next() *Tunnel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.tunnels) == 0 {
+		return nil
+	}
+
+	var regular []*Tunnel
+	r := p.roll(100)
+	cumulative := 0
+	for _, t := range p.tunnels {
+		percent := t.TrafficPercent()
+		if percent == 0 {
+			regular = append(regular, t)
+			continue
+		}
+		cumulative += percent
+		if r < cumulative {
+			return t
+		}
+	}
+
+	// Only canaries left (e.g. the primary disconnected): use them all
+	if len(regular) == 0 {
+		regular = p.tunnels
+	}
+	t := regular[p.next%len(regular)]
+	p.next = (p.next + 1) % len(regular)
+	return t
+}
+
+// Tunnels returns a snapshot of the tunnels in the pool
+func (p *Pool) Tunnels() []*Tunnel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]*Tunnel, len(p.tunnels))
+	copy(out, p.tunnels)
+	return out
+}
+
+// Len returns the number of tunnels in the pool
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.tunnels)
+}
+
+// EnableProtection turns on passphrase protection for the subdomain and returns
+// the passphrase. Calling it again returns the existing passphrase.
+func (p *Pool) EnableProtection() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.passphrase != "" {
+		return p.passphrase, nil
+	}
+	// 64 bits, in groups of four hex characters that are easy to copy out
+	b := make([]byte, 8)
+	if _, err := crand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	h := hex.EncodeToString(b)
+	p.passphrase = h[:4] + "-" + h[4:8] + "-" + h[8:12] + "-" + h[12:]
+	return p.passphrase, nil
+}
+
+// Passphrase returns the subdomain's passphrase, or "" if it is not protected
+func (p *Pool) Passphrase() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.passphrase
+}
+
+// EnableBypass turns on the browser warning bypass token for the subdomain and
+// returns it. Calling it again returns the existing token.
+func (p *Pool) EnableBypass() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bypass != "" {
+		return p.bypass, nil
+	}
+	b := make([]byte, 8)
+	if _, err := crand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	p.bypass = hex.EncodeToString(b)
+	return p.bypass, nil
+}
+
+// BypassToken returns the subdomain's warning bypass token, or "" if it is not enabled
+func (p *Pool) BypassToken() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bypass
+}
+
+// CheckBypassToken reports whether token matches the pool's warning bypass token
+func (p *Pool) CheckBypassToken(token string) bool {
+	bypass := p.BypassToken()
+	if bypass == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(bypass)) == 1
+}
+
+// SetBasicAuth requires visitors to present the given HTTP basic auth credentials
+func (p *Pool) SetBasicAuth(user, pass string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.authUser, p.authPass = user, pass
+}
+
+// BasicAuthUser returns the required basic auth user, or "" if basic auth is off
+func (p *Pool) BasicAuthUser() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.authUser
+}
+
+// CheckBasicAuth reports whether the credentials match the pool's. It returns
+// true if basic auth is not enabled.
+func (p *Pool) CheckBasicAuth(user, pass string) bool {
+	p.mu.Lock()
+	wantUser, wantPass := p.authUser, p.authPass
+	p.mu.Unlock()
+	if wantUser == "" {
+		return true
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass)) == 1
+	return userOK && passOK
+}
+
+// SetNoWarning turns the browser warning page off for the subdomain
+func (p *Pool) SetNoWarning(skip bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.noWarning = skip
+}
+
+// NoWarning reports whether the browser warning page is turned off
+func (p *Pool) NoWarning() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.noWarning
+}
+
+// SetRateLimits sets the rate limit and burst size of every backend, now and
+// for backends that join later
+func (p *Pool) SetRateLimits(rps, burst int) {
+	p.mu.Lock()
+	p.rate, p.burst = rps, burst
+	tunnels := append([]*Tunnel(nil), p.tunnels...)
+	p.mu.Unlock()
+	for _, t := range tunnels {
+		t.SetRateBurst(rps, burst)
+	}
+}
+
+// RateLimits returns the limits set with SetRateLimits, if any
+func (p *Pool) RateLimits() (rps, burst int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate, p.burst, p.rate > 0
+}
+
+// Feed returns the live feed of the subdomain's requests
+func (p *Pool) Feed() *RequestFeed {
+	return p.feed
+}
+
+// SetCompress turns edge compression of responses on or off for the subdomain
+func (p *Pool) SetCompress(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.compress = on
+}
+
+// Compress reports whether responses are compressed at the edge
+func (p *Pool) Compress() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.compress
+}
+
+// SetInspect turns body capture for the subdomain's requests on or off
+func (p *Pool) SetInspect(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inspect = on
+}
+
+// Inspect reports whether request and response bodies are captured
+func (p *Pool) Inspect() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inspect
+}
+
+// SetIndexing allows or forbids search engine indexing of the subdomain
+func (p *Pool) SetIndexing(allowed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.indexing = allowed
+}
+
+// Indexing reports whether search engines may index the subdomain
+func (p *Pool) Indexing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.indexing
+}
+
+// SetBlockBots sets the action taken on requests from bots and scanners
+// (one of BotActions, empty = let them through)
+func (p *Pool) SetBlockBots(action string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.blockBots = action
+}
+
+// BlockBots returns the action taken on requests from bots and scanners
+func (p *Pool) BlockBots() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.blockBots
+}
+
+// SetDomain sets the serving domain of the subdomain
+func (p *Pool) SetDomain(domain string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.domain = domain
+}
+
+// Domain returns the serving domain set with SetDomain, or "" for the default domain
+func (p *Pool) Domain() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.domain
+}
+
+// AccessLogToken returns the secret that downloads the subdomain's access
+// log. Unlike the join token, it cannot attach backends, so links to the log
+// can be shared.
+func (p *Pool) AccessLogToken() string {
+	return p.logToken
+}
+
+// CheckAccessLogToken reports whether token matches the pool's access log token
+func (p *Pool) CheckAccessLogToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.logToken)) == 1
+}
+
+// CheckJoinToken reports whether token matches the pool's join token
+func (p *Pool) CheckJoinToken(token string) bool {
+	if p.JoinToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.JoinToken)) == 1
+}
@@ -0,0 +1,182 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func newPoolTunnel(t *testing.T) *Tunnel {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create test listener: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return New("test-sub-00000000", ln, "127.0.0.1", 8080, "127.0.0.1")
+}
+
+func TestPool_RoundRobin(t *testing.T) {
+	p := NewPool("test-sub-00000000", "secret")
+	a, b := newPoolTunnel(t), newPoolTunnel(t)
+	p.Add(a)
+	p.Add(b)
+
+	got := []*Tunnel{p.Next(), p.Next(), p.Next()}
+	want := []*Tunnel{a, b, a}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Next() call %d returned wrong tunnel", i+1)
+		}
+	}
+}
+
+func TestPool_Remove(t *testing.T) {
+	p := NewPool("test-sub-00000000", "secret")
+	a, b := newPoolTunnel(t), newPoolTunnel(t)
+	p.Add(a)
+	p.Add(b)
+
+	if n := p.Remove(a); n != 1 {
+		t.Errorf("Remove() = %d, want 1", n)
+	}
+	for i := 0; i < 3; i++ {
+		if p.Next() != b {
+			t.Fatal("Next() should only return the remaining tunnel")
+		}
+	}
+	if n := p.Remove(b); n != 0 {
+		t.Errorf("Remove() = %d, want 0", n)
+	}
+	if p.Next() != nil {
+		t.Error("Next() on an empty pool should return nil")
+	}
+}
+
+func TestPool_CheckJoinToken(t *testing.T) {
+	p := NewPool("test-sub-00000000", "secret")
+	if !p.CheckJoinToken("secret") {
+		t.Error("CheckJoinToken() should accept the correct token")
+	}
+	if p.CheckJoinToken("wrong") {
+		t.Error("CheckJoinToken() should reject an incorrect token")
+	}
+	if NewPool("test-sub-00000000", "").CheckJoinToken("") {
+		t.Error("CheckJoinToken() should reject everything when no token is set")
+	}
+}
+
+func TestPool_CanaryPercent(t *testing.T) {
+	p := NewPool("test-sub-00000000", "secret")
+	primary, canary := newPoolTunnel(t), newPoolTunnel(t)
+	canary.SetTrafficPercent(10)
+	p.Add(primary)
+	p.Add(canary)
+
+	var r int
+	p.roll = func(int) int { return r }
+
+	for r = 0; r < 100; r++ {
+		got := p.Next()
+		if r < 10 && got != canary {
+			t.Errorf("roll %d should route to canary", r)
+		}
+		if r >= 10 && got != primary {
+			t.Errorf("roll %d should route to primary", r)
+		}
+	}
+}
+
+func TestPool_OnlyCanaries(t *testing.T) {
+	p := NewPool("test-sub-00000000", "secret")
+	canary := newPoolTunnel(t)
+	canary.SetTrafficPercent(10)
+	p.Add(canary)
+	p.roll = func(int) int { return 50 }
+
+	if p.Next() != canary {
+		t.Error("canary should take all traffic when no regular backends remain")
+	}
+}
+
+func TestPool_Get(t *testing.T) {
+	p := NewPool("test-sub-00000000", "secret")
+	a, b := newPoolTunnel(t), newPoolTunnel(t)
+	p.Add(a)
+	p.Add(b)
+
+	if a.BackendID() == b.BackendID() {
+		t.Fatal("backends in a pool should have distinct IDs")
+	}
+	if p.Get(b.BackendID()) != b {
+		t.Error("Get() should return the tunnel with the matching backend ID")
+	}
+	if p.Get("nope") != nil {
+		t.Error("Get() should return nil for an unknown backend ID")
+	}
+}
+
+func TestPool_EnableProtection(t *testing.T) {
+	p := NewPool("test-sub-00000000", "secret")
+	if p.Passphrase() != "" {
+		t.Fatal("new pool should not be protected")
+	}
+
+	first, err := p.EnableProtection()
+	if err != nil {
+		t.Fatalf("EnableProtection() error: %v", err)
+	}
+	if len(first) != 19 {
+		t.Errorf("passphrase %q should be 19 characters (16 hex digits)", first)
+	}
+	second, _ := p.EnableProtection()
+	if first != second || p.Passphrase() != first {
+		t.Error("EnableProtection() should keep the existing passphrase")
+	}
+}
+
+func TestPool_EnableBypass(t *testing.T) {
+	p := NewPool("test-sub-00000000", "secret")
+	if p.CheckBypassToken("") {
+		t.Fatal("empty token should not match a pool without bypass")
+	}
+
+	token, err := p.EnableBypass()
+	if err != nil {
+		t.Fatalf("EnableBypass() error: %v", err)
+	}
+	if again, _ := p.EnableBypass(); again != token {
+		t.Error("EnableBypass() should keep the existing token")
+	}
+	if !p.CheckBypassToken(token) {
+		t.Error("CheckBypassToken() should accept the pool's token")
+	}
+	if p.CheckBypassToken("wrong") || p.CheckBypassToken("") {
+		t.Error("CheckBypassToken() should reject other tokens")
+	}
+}
+
+func TestPool_BasicAuth(t *testing.T) {
+	p := NewPool("test-sub-00000000", "secret")
+	if !p.CheckBasicAuth("", "") {
+		t.Fatal("pool without basic auth should allow any request")
+	}
+
+	p.SetBasicAuth("user", "pass")
+	if p.BasicAuthUser() != "user" {
+		t.Errorf("BasicAuthUser() = %q, want user", p.BasicAuthUser())
+	}
+	tests := []struct {
+		user, pass string
+		want       bool
+	}{
+		{"user", "pass", true},
+		{"user", "wrong", false},
+		{"other", "pass", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := p.CheckBasicAuth(tt.user, tt.pass); got != tt.want {
+			t.Errorf("CheckBasicAuth(%q, %q) = %v, want %v", tt.user, tt.pass, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter implements a token bucket rate limiter
+type RateLimiter struct {
+	tokens     float64
+	maxTokens  float64
+	refillRate float64 // tokens per second
+	lastRefill time.Time
+	changed    chan struct{} // closed and replaced by SetRate to wake waiters
+	mu         sync.Mutex
+}
+
+// NewRateLimiter creates a new rate limiter with the given rate and burst size
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		tokens:     float64(burst),
+		maxTokens:  float64(burst),
+		refillRate: rate,
+		lastRefill: time.Now(),
+		changed:    make(chan struct{}),
+	}
+}
+
+// refill adds tokens accrued since the last refill (must be called with lock held)
+func (r *RateLimiter) refill() {
+	now := time.Now()
+	elapsed := now.Sub(r.lastRefill).Seconds()
+	r.tokens += elapsed * r.refillRate
+	if r.tokens > r.maxTokens {
+		r.tokens = r.maxTokens
+	}
+	r.lastRefill = now
+}
+
+// Allow returns true if a request is allowed, false if rate limited
+func (r *RateLimiter) Allow() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refill()
+
+	if r.tokens >= 1 {
+		r.tokens--
+		return true
+	}
+	return false
+}
+
+// Delay returns how long until a token becomes available, or zero if one is available now.
+// It does not consume a token.
+func (r *RateLimiter) Delay() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refill()
+
+	if r.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - r.tokens) / r.refillRate * float64(time.Second))
+}
+
+// SetRate changes the refill rate and burst size on a live limiter. Tokens
+// above the new burst are dropped, so a lowered limit applies to the next
+// request, and callers waiting on Changed re-check their delay.
+func (r *RateLimiter) SetRate(rate float64, burst int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refill()
+	r.refillRate = rate
+	r.maxTokens = float64(burst)
+	if r.tokens > r.maxTokens {
+		r.tokens = r.maxTokens
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Limits returns the current refill rate and burst size
+func (r *RateLimiter) Limits() (rate float64, burst int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refillRate, int(r.maxTokens)
+}
+
+// Changed returns a channel that is closed the next time the limits change
+func (r *RateLimiter) Changed() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.changed
+}
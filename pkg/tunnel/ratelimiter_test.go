@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_BurstCapacity(t *testing.T) {
+	rl := NewRateLimiter(10, 5) // 10 tokens/sec, burst of 5
+
+	for i := 0; i < 5; i++ {
+		if !rl.Allow() {
+			t.Fatalf("Allow() returned false on burst request %d", i+1)
+		}
+	}
+}
+
+func TestRateLimiter_LimitAfterBurst(t *testing.T) {
+	rl := NewRateLimiter(10, 5) // 10 tokens/sec, burst of 5
+
+	// Exhaust burst
+	for i := 0; i < 5; i++ {
+		rl.Allow()
+	}
+
+	// Next request should be denied
+	if rl.Allow() {
+		t.Error("Allow() should return false after burst exhausted")
+	}
+}
+
+func TestRateLimiter_TokenRefill(t *testing.T) {
+	rl := NewRateLimiter(10, 5) // 10 tokens/sec, burst of 5
+
+	// Exhaust burst
+	for i := 0; i < 5; i++ {
+		rl.Allow()
+	}
+
+	// Wait for tokens to refill (at 10/sec, 150ms should give ~1.5 tokens)
+	time.Sleep(150 * time.Millisecond)
+
+	if !rl.Allow() {
+		t.Error("Allow() should return true after token refill")
+	}
+}
+
+func TestRateLimiter_Delay(t *testing.T) {
+	rl := NewRateLimiter(10, 1) // 10 tokens/sec, burst of 1
+
+	if d := rl.Delay(); d != 0 {
+		t.Errorf("Delay() = %v with a token available, want 0", d)
+	}
+
+	rl.Allow()
+
+	d := rl.Delay()
+	if d <= 0 || d > 100*time.Millisecond {
+		t.Errorf("Delay() = %v after exhausting burst, want (0, 100ms]", d)
+	}
+}
+
+func TestRateLimiter_SetRate(t *testing.T) {
+	rl := NewRateLimiter(10, 5)
+	rl.SetRate(1, 2)
+
+	// Burst is capped at the new size
+	for i := 0; i < 2; i++ {
+		if !rl.Allow() {
+			t.Fatalf("Allow() returned false on burst request %d", i+1)
+		}
+	}
+	if rl.Allow() {
+		t.Error("Allow() should return false after the reduced burst is exhausted")
+	}
+	if d := rl.Delay(); d < 900*time.Millisecond {
+		t.Errorf("Delay() = %v, want about 1s at the new rate", d)
+	}
+}
+
+func TestRateLimiter_Changed(t *testing.T) {
+	rl := NewRateLimiter(10, 5)
+	changed := rl.Changed()
+
+	select {
+	case <-changed:
+		t.Fatal("Changed() closed before the limits changed")
+	default:
+	}
+
+	rl.SetRate(20, 8)
+	select {
+	case <-changed:
+	default:
+		t.Error("Changed() should be closed by SetRate")
+	}
+	if rate, burst := rl.Limits(); rate != 20 || burst != 8 {
+		t.Errorf("Limits() = %v, %d, want 20, 8", rate, burst)
+	}
+}
@@ -0,0 +1,512 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Column widths of the request log. The path and user agent columns are
+// fitted to the terminal's width when it is known, within these bounds.
+const (
+	defaultPathColumn   = 53
+	minPathColumn       = 16
+	maxPathColumn       = 120
+	maxUserAgentDisplay = 40
+	minUserAgentDisplay = 12
+	requestLineFixed    = 29 // request line without the path column
+	visitorColumnsFixed = 22 // visitor columns without the user agent
+)
+
+// Visitor identifies who made a request, shown when visitor columns are on
+type Visitor struct {
+	IP        string
+	Country   string // ISO country code, empty if unknown
+	UserAgent string
+}
+
+// RequestLogger writes formatted request logs to an io.Writer (typically an SSH channel).
+// It uses a buffered channel and a single drain goroutine to avoid blocking callers.
+// The session can switch request lines off, switch to a verbose format, and pause
+// output; lines logged while paused wait in the buffer, and are dropped once it is full.
+type RequestLogger struct {
+	w      io.Writer
+	ch     chan string
+	done   chan struct{}
+	closeOnce sync.Once
+	exclude   atomic.Pointer[[]*regexp.Regexp] // paths left out of the log
+	quiet     atomic.Bool                      // request and WebSocket lines are off
+	verbose   atomic.Bool                      // timestamps and untruncated paths
+	visitors  atomic.Bool                      // visitor IP, country and user agent columns
+	color     atomic.Bool                      // ANSI colors for status codes and latencies
+	width     atomic.Int64                     // terminal width in columns, 0 if unknown
+	dropped   atomic.Uint64                    // lines lost to a full buffer or budget
+	budget    Budget                           // optional memory budget of queued lines
+
+	mu      sync.Mutex // guards paused and resumed, and serializes writes to w
+	paused  bool
+	resumed chan struct{} // closed when output resumes
+
+	closeMu sync.RWMutex // keeps lines logged during Close from reaching a closed ch
+	closed  bool
+}
+
+// Budget is a memory budget shared with other loggers. Queued lines take
+// their length from it until written.
+type Budget interface {
+	Reserve(n int64) bool
+	Release(n int64)
+}
+
+// NewRequestLogger creates a RequestLogger that writes to w with the given buffer size.
+func NewRequestLogger(w io.Writer, bufSize int) *RequestLogger {
+	l := &RequestLogger{
+		w:    w,
+		ch:   make(chan string, bufSize),
+		done: make(chan struct{}),
+	}
+	go l.drain()
+	return l
+}
+
+// drain reads from the channel and writes to the underlying writer.
+func (l *RequestLogger) drain() {
+	defer close(l.done)
+	for line := range l.ch {
+		l.mu.Lock()
+		for l.paused {
+			resumed := l.resumed
+			l.mu.Unlock()
+			<-resumed
+			l.mu.Lock()
+		}
+		l.w.Write([]byte(line))
+		l.mu.Unlock()
+		if l.budget != nil {
+			l.budget.Release(int64(len(line)))
+		}
+	}
+}
+
+// SetBudget makes queued lines count against b; lines that do not fit are
+// dropped. It must be called before the logger is shared.
+func (l *RequestLogger) SetBudget(b Budget) {
+	l.budget = b
+}
+
+// send queues a line without blocking, dropping it if the buffer is full or
+// the budget used up
+func (l *RequestLogger) send(line string) {
+	if l.budget != nil && !l.budget.Reserve(int64(len(line))) {
+		l.dropped.Add(1)
+		return
+	}
+	l.closeMu.RLock()
+	defer l.closeMu.RUnlock()
+	if l.closed {
+		// Connections such as WebSockets may outlive the session
+		if l.budget != nil {
+			l.budget.Release(int64(len(line)))
+		}
+		return
+	}
+	select {
+	case l.ch <- line:
+	default:
+		l.dropped.Add(1)
+		if l.budget != nil {
+			l.budget.Release(int64(len(line)))
+		}
+	}
+}
+
+// ToggleRequests switches request and WebSocket lines off or back on and
+// reports whether they are now on. Notices are always shown.
+func (l *RequestLogger) ToggleRequests() bool {
+	on := l.quiet.Load() // was quiet, so now on
+	l.quiet.Store(!on)
+	if on {
+		l.LogNotice("Request logging on")
+	} else {
+		l.LogNotice("Request logging off (press l to turn it back on)")
+	}
+	return on
+}
+
+// ToggleVerbose switches between the compact and the verbose format and
+// reports whether the verbose format is now used
+func (l *RequestLogger) ToggleVerbose() bool {
+	on := !l.verbose.Load()
+	l.verbose.Store(on)
+	if on {
+		l.LogNotice("Verbose log format (timestamps, full paths)")
+	} else {
+		l.LogNotice("Compact log format")
+	}
+	return on
+}
+
+// SetColor turns ANSI colors for status codes and latencies on or off
+func (l *RequestLogger) SetColor(on bool) {
+	l.color.Store(on)
+}
+
+// SetWidth fits the path and user agent columns to a terminal width; 0
+// restores the defaults
+func (l *RequestLogger) SetWidth(columns int) {
+	l.width.Store(int64(columns))
+}
+
+// columns returns the widths of the path column and of the user agent
+func (l *RequestLogger) columns() (path, userAgent int) {
+	width := int(l.width.Load())
+	if width <= 0 {
+		return defaultPathColumn, maxUserAgentDisplay
+	}
+	avail := width - requestLineFixed
+	userAgent = maxUserAgentDisplay
+	if l.visitors.Load() {
+		userAgent = min(max(avail/3, minUserAgentDisplay), maxUserAgentDisplay)
+		avail -= visitorColumnsFixed + userAgent
+	}
+	return min(max(avail, minPathColumn), maxPathColumn), userAgent
+}
+
+// SetVisitorColumns turns the visitor IP, country and user agent columns on or off
+func (l *RequestLogger) SetVisitorColumns(on bool) {
+	l.visitors.Store(on)
+}
+
+// ToggleVisitors switches the visitor columns and reports whether they are now on
+func (l *RequestLogger) ToggleVisitors() bool {
+	on := !l.visitors.Load()
+	l.visitors.Store(on)
+	if on {
+		l.LogNotice("Visitor columns on (IP, country, user agent)")
+	} else {
+		l.LogNotice("Visitor columns off")
+	}
+	return on
+}
+
+// withVisitor appends the visitor columns to a line if they are on
+func (l *RequestLogger) withVisitor(line string, v Visitor) string {
+	if !l.visitors.Load() {
+		return line
+	}
+	_, userAgent := l.columns()
+	return strings.TrimSuffix(line, "\r\n") + formatVisitor(v, userAgent) + "\r\n"
+}
+
+// TogglePause pauses or resumes output and reports whether it is now paused
+func (l *RequestLogger) TogglePause() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.paused {
+		// Written directly, as queued lines are held back from now on
+		l.w.Write([]byte(formatNotice("Output paused (press p to resume)")))
+		l.paused = true
+		l.resumed = make(chan struct{})
+		return true
+	}
+	l.paused = false
+	close(l.resumed)
+	msg := "Output resumed"
+	if n := l.dropped.Swap(0); n > 0 {
+		msg += fmt.Sprintf(" (%d lines dropped)", n)
+	}
+	l.w.Write([]byte(formatNotice(msg)))
+	return false
+}
+
+// logsRequests reports whether a request or WebSocket line for path is wanted
+func (l *RequestLogger) logsRequests(path string) bool {
+	return !l.quiet.Load() && !l.excluded(path)
+}
+
+// stamp prefixes a line with the time of day in the verbose format
+func (l *RequestLogger) stamp(line string) string {
+	if !l.verbose.Load() {
+		return line
+	}
+	return "  " + time.Now().Format("15:04:05") + line
+}
+
+// SetExcludedPaths leaves requests whose path matches one of the glob
+// patterns out of the log. '*' matches any run of characters, including '/',
+// and '?' matches a single character.
+func (l *RequestLogger) SetExcludedPaths(patterns []string) {
+	globs := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		globs[i] = compileGlob(p)
+	}
+	l.exclude.Store(&globs)
+}
+
+// excluded reports whether path matches an excluded pattern
+func (l *RequestLogger) excluded(path string) bool {
+	globs := l.exclude.Load()
+	if globs == nil {
+		return false
+	}
+	for _, g := range *globs {
+		if g.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileGlob turns a path glob into an anchored regular expression
+func compileGlob(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// LogRequest logs an HTTP request with method, path, status, response size, and latency.
+func (l *RequestLogger) LogRequest(method, path string, status int, size int64, latency time.Duration, v Visitor) {
+	if !l.logsRequests(path) {
+		return
+	}
+	if l.verbose.Load() {
+		l.send(l.stamp(l.withVisitor(formatRequestLogFull(method, path, status, size, latency, l.color.Load()), v)))
+		return
+	}
+	column, _ := l.columns()
+	l.send(l.withVisitor(formatRequestLog(method, path, status, size, latency, column, l.color.Load()), v))
+}
+
+// LogHistory replays recent requests, oldest first, with their times
+func (l *RequestLogger) LogHistory(records []RequestRecord) {
+	if len(records) == 0 {
+		l.LogNotice("No requests yet")
+		return
+	}
+	l.LogNotice(fmt.Sprintf("Last %d requests:", len(records)))
+	color := l.color.Load()
+	column, _ := l.columns()
+	if l.width.Load() > 0 {
+		column = max(column-10, minPathColumn) // room for the times
+	}
+	for _, r := range records {
+		var line string
+		if r.Method == "WS" {
+			line = formatWSClose(r.Path, time.Duration(r.LatencyMS)*time.Millisecond, r.Bytes, column)
+		} else {
+			line = formatRequestLog(r.Method, r.Path, r.Status, r.Bytes, time.Duration(r.LatencyMS)*time.Millisecond, column, color)
+		}
+		v := Visitor{IP: r.VisitorIP, Country: r.Country, UserAgent: r.UserAgent}
+		l.send("  " + r.Time.Format("15:04:05") + l.withVisitor(line, v))
+	}
+}
+
+// LogWebSocketOpen logs a WebSocket connection opening.
+func (l *RequestLogger) LogWebSocketOpen(path string, v Visitor) {
+	if !l.logsRequests(path) {
+		return
+	}
+	column, _ := l.columns()
+	l.send(l.stamp(l.withVisitor(formatWSOpen(path, column), v)))
+}
+
+// LogWebSocketClose logs a WebSocket connection closing with duration and bytes transferred.
+func (l *RequestLogger) LogWebSocketClose(path string, duration time.Duration, bytes int64) {
+	if !l.logsRequests(path) {
+		return
+	}
+	column, _ := l.columns()
+	l.send(l.stamp(formatWSClose(path, duration, bytes, column)))
+}
+
+// Print queues preformatted text, such as a redrawn session banner
+func (l *RequestLogger) Print(text string) {
+	l.send(text)
+}
+
+// LogNotice logs a server notice (e.g., backend health changes) to the session.
+func (l *RequestLogger) LogNotice(msg string) {
+	l.send(formatNotice(msg))
+}
+
+// LogAnnouncement logs a message from the server's operator to the session.
+// Like notices, announcements are shown even with request logging off.
+func (l *RequestLogger) LogAnnouncement(msg string) {
+	l.send(formatAnnouncement(msg))
+}
+
+// Close stops the logger, draining any remaining messages. It is idempotent.
+func (l *RequestLogger) Close() {
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		if l.paused {
+			l.paused = false
+			close(l.resumed)
+		}
+		l.mu.Unlock()
+		l.closeMu.Lock()
+		l.closed = true
+		close(l.ch)
+		l.closeMu.Unlock()
+	})
+	<-l.done
+}
+
+// truncatePath shortens a path to fit a column, leaving a gap after it
+func truncatePath(path string, column int) string {
+	if limit := column - 3; len(path) > limit {
+		return path[:limit-3] + "..."
+	}
+	return path
+}
+
+func formatRequestLog(method, path string, status int, size int64, latency time.Duration, column int, color bool) string {
+	return fmt.Sprintf("  %-4s %-*s %s  %7s  %s\r\n", method, column, truncatePath(path, column), paintStatus(status, color), formatBytes(size), paintLatency(latency, color))
+}
+
+// formatRequestLogFull is the verbose request line, with the path untruncated
+func formatRequestLogFull(method, path string, status int, size int64, latency time.Duration, color bool) string {
+	return fmt.Sprintf("  %-4s %s  %s  %s  %s\r\n", method, path, paintStatus(status, color), formatBytes(size), paintLatency(latency, color))
+}
+
+// ANSI colors of the request log
+const (
+	colorReset  = "\033[0m"
+	colorGreen  = "\033[32m"
+	colorCyan   = "\033[36m"
+	colorYellow = "\033[33m"
+	colorRed    = "\033[31m"
+)
+
+// paintStatus colors a status code: green 2xx, cyan 3xx, yellow 4xx, red 5xx
+func paintStatus(status int, color bool) string {
+	code := strconv.Itoa(status)
+	if !color {
+		return code
+	}
+	switch {
+	case status >= 500:
+		return colorRed + code + colorReset
+	case status >= 400:
+		return colorYellow + code + colorReset
+	case status >= 300:
+		return colorCyan + code + colorReset
+	case status >= 200:
+		return colorGreen + code + colorReset
+	}
+	return code
+}
+
+// paintLatency colors a latency: green under 100ms, yellow under 1s, red above
+func paintLatency(d time.Duration, color bool) string {
+	latency := formatLatency(d)
+	if !color {
+		return latency
+	}
+	switch {
+	case d >= time.Second:
+		return colorRed + latency + colorReset
+	case d >= 100*time.Millisecond:
+		return colorYellow + latency + colorReset
+	}
+	return colorGreen + latency + colorReset
+}
+
+// formatVisitor renders the visitor columns; the user agent is truncated
+// and stripped of anything that is not printable ASCII
+func formatVisitor(v Visitor, maxUserAgent int) string {
+	country := v.Country
+	if country == "" {
+		country = "--"
+	}
+	ua := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '?'
+		}
+		return r
+	}, v.UserAgent)
+	if len(ua) > maxUserAgent {
+		ua = ua[:maxUserAgent-3] + "..."
+	}
+	if ua == "" {
+		ua = "-"
+	}
+	return fmt.Sprintf("  %-15s %-2s  %s", v.IP, country, ua)
+}
+
+func formatWSOpen(path string, column int) string {
+	return fmt.Sprintf("  %-4s %-*s -    OPEN\r\n", "WS", column, truncatePath(path, column))
+}
+
+func formatWSClose(path string, duration time.Duration, bytes int64, column int) string {
+	return fmt.Sprintf("  %-4s %-*s -    CLOSED (%s, %s)\r\n", "WS", column, truncatePath(path, column), formatDurationHuman(duration), formatBytes(bytes))
+}
+
+func formatNotice(msg string) string {
+	return fmt.Sprintf("  ! %s\r\n", msg)
+}
+
+func formatAnnouncement(msg string) string {
+	return fmt.Sprintf("  ** Announcement: %s\r\n", msg)
+}
+
+func formatLatency(d time.Duration) string {
+	if d < time.Millisecond {
+		us := d.Microseconds()
+		if us == 0 {
+			return "<1us"
+		}
+		return fmt.Sprintf("%dus", us)
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
+
+func formatDurationHuman(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+	if d < time.Hour {
+		m := int(d.Minutes())
+		s := int(d.Seconds()) - m*60
+		if s == 0 {
+			return fmt.Sprintf("%dm", m)
+		}
+		return fmt.Sprintf("%dm%ds", m, s)
+	}
+	h := int(d.Hours())
+	m := int(d.Minutes()) - h*60
+	if m == 0 {
+		return fmt.Sprintf("%dh", h)
+	}
+	return fmt.Sprintf("%dh%dm", h, m)
+}
+
+func formatBytes(b int64) string {
+	switch {
+	case b < 1024:
+		return fmt.Sprintf("%dB", b)
+	case b < 1024*1024:
+		return fmt.Sprintf("%.1fKB", float64(b)/1024)
+	case b < 1024*1024*1024:
+		return fmt.Sprintf("%.1fMB", float64(b)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.1fGB", float64(b)/(1024*1024*1024))
+	}
+}
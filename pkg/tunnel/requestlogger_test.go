@@ -0,0 +1,496 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogRequest(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+
+	l.LogRequest("GET", "/api/users", 200, 1536, 12*time.Millisecond, Visitor{})
+	l.Close()
+
+	out := buf.String()
+	if !strings.Contains(out, "GET") {
+		t.Errorf("output missing method: %q", out)
+	}
+	if !strings.Contains(out, "/api/users") {
+		t.Errorf("output missing path: %q", out)
+	}
+	if !strings.Contains(out, "200") {
+		t.Errorf("output missing status: %q", out)
+	}
+	if !strings.Contains(out, "1.5KB") {
+		t.Errorf("output missing response size: %q", out)
+	}
+	if !strings.Contains(out, "12ms") {
+		t.Errorf("output missing latency: %q", out)
+	}
+	if !strings.HasSuffix(out, "\r\n") {
+		t.Errorf("output should end with \\r\\n: %q", out)
+	}
+}
+
+func TestLogWebSocketOpen(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+
+	l.LogWebSocketOpen("/ws/chat", Visitor{})
+	l.Close()
+
+	out := buf.String()
+	if !strings.Contains(out, "WS") {
+		t.Errorf("output missing WS: %q", out)
+	}
+	if !strings.Contains(out, "/ws/chat") {
+		t.Errorf("output missing path: %q", out)
+	}
+	if !strings.Contains(out, "OPEN") {
+		t.Errorf("output missing OPEN: %q", out)
+	}
+	if !strings.HasSuffix(out, "\r\n") {
+		t.Errorf("output should end with \\r\\n: %q", out)
+	}
+}
+
+func TestLogWebSocketClose(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+
+	l.LogWebSocketClose("/ws/chat", 2*time.Minute+31*time.Second, 1258291)
+	l.Close()
+
+	out := buf.String()
+	if !strings.Contains(out, "WS") {
+		t.Errorf("output missing WS: %q", out)
+	}
+	if !strings.Contains(out, "/ws/chat") {
+		t.Errorf("output missing path: %q", out)
+	}
+	if !strings.Contains(out, "CLOSED") {
+		t.Errorf("output missing CLOSED: %q", out)
+	}
+	if !strings.Contains(out, "2m31s") {
+		t.Errorf("output missing duration: %q", out)
+	}
+	if !strings.Contains(out, "1.2MB") {
+		t.Errorf("output missing bytes: %q", out)
+	}
+}
+
+func TestNonBlocking(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 1)
+
+	// Send 100 lines with buffer size 1 — should not block
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			l.LogRequest("GET", "/test", 200, 0, time.Millisecond, Visitor{})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("LogRequest blocked with full buffer")
+	}
+
+	l.Close()
+}
+
+type errorWriter struct{}
+
+func (errorWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write error")
+}
+
+func TestClosedWriter(t *testing.T) {
+	l := NewRequestLogger(errorWriter{}, 16)
+	// Should not panic even though writer returns errors
+	l.LogRequest("GET", "/test", 200, 0, time.Millisecond, Visitor{})
+	l.Close()
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+	l.Close()
+	l.Close() // second call should not panic
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		name  string
+		bytes int64
+		want  string
+	}{
+		{"zero", 0, "0B"},
+		{"small", 512, "512B"},
+		{"1KB", 1024, "1.0KB"},
+		{"1.5MB", 1572864, "1.5MB"},
+		{"2.3GB", 2469606195, "2.3GB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatBytes(tt.bytes); got != tt.want {
+				t.Errorf("formatBytes(%d) = %q, want %q", tt.bytes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatDurationHuman(t *testing.T) {
+	tests := []struct {
+		name string
+		d    time.Duration
+		want string
+	}{
+		{"5 seconds", 5 * time.Second, "5s"},
+		{"2m30s", 2*time.Minute + 30*time.Second, "2m30s"},
+		{"1h5m", 1*time.Hour + 5*time.Minute, "1h5m"},
+		{"exact minutes", 3 * time.Minute, "3m"},
+		{"exact hours", 2 * time.Hour, "2h"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatDurationHuman(tt.d); got != tt.want {
+				t.Errorf("formatDurationHuman(%v) = %q, want %q", tt.d, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatRequestLog_LongPath(t *testing.T) {
+	longPath := "/api/v1/very/long/path/that/exceeds/the/fifty/character/limit/by/a/lot"
+	out := formatRequestLog("GET", longPath, 200, 0, 5*time.Millisecond, defaultPathColumn, false)
+
+	if !strings.Contains(out, "...") {
+		t.Errorf("long path should be truncated with ...: %q", out)
+	}
+	// Original path should NOT appear in full
+	if strings.Contains(out, longPath) {
+		t.Errorf("full long path should not appear in output: %q", out)
+	}
+}
+
+func TestLogAnnouncement(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+	l.ToggleRequests() // announcements are shown with request logging off
+
+	l.LogAnnouncement("server restart in 5 minutes")
+	l.Close()
+
+	if out := buf.String(); !strings.Contains(out, "Announcement: server restart in 5 minutes\r\n") {
+		t.Errorf("output missing announcement: %q", out)
+	}
+}
+
+// fixedBudget is a Budget of a fixed number of bytes
+type fixedBudget struct {
+	mu        sync.Mutex
+	available int64
+}
+
+func (b *fixedBudget) Reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.available {
+		return false
+	}
+	b.available -= n
+	return true
+}
+
+func (b *fixedBudget) Release(n int64) {
+	b.mu.Lock()
+	b.available += n
+	b.mu.Unlock()
+}
+
+func TestRequestLogger_Budget(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+	budget := &fixedBudget{available: 20}
+	l.SetBudget(budget)
+	l.TogglePause() // keep lines queued
+
+	l.LogNotice("fits") // 10 bytes with the prefix
+	l.LogNotice("too long for what is left")
+	l.TogglePause()
+	l.Close()
+
+	if out := buf.String(); !strings.Contains(out, "fits") || strings.Contains(out, "too long") {
+		t.Errorf("output = %q, want only the line within the budget", out)
+	}
+	if budget.available != 20 {
+		t.Errorf("budget left = %d after writing, want 20", budget.available)
+	}
+}
+
+func TestRequestLogger_LogAfterClose(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+	budget := &fixedBudget{available: 100}
+	l.SetBudget(budget)
+	l.Close()
+
+	// A WebSocket closing after the session ended logs without panicking
+	l.LogWebSocketClose("/socket", time.Second, 42)
+	l.LogNotice("too late")
+
+	if buf.Len() != 0 {
+		t.Errorf("output = %q, want nothing after Close", buf.String())
+	}
+	if budget.available != 100 {
+		t.Errorf("budget left = %d, want 100", budget.available)
+	}
+}
+
+func TestLogNotice(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+
+	l.LogNotice("local server down")
+	l.Close()
+
+	out := buf.String()
+	if !strings.Contains(out, "local server down") {
+		t.Errorf("output missing notice: %q", out)
+	}
+	if !strings.HasSuffix(out, "\r\n") {
+		t.Errorf("output should end with \\r\\n: %q", out)
+	}
+}
+
+func TestExcludedPaths(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+	l.SetExcludedPaths([]string{"/healthz", "/static/*", "/v?/ping"})
+
+	l.LogRequest("GET", "/healthz", 200, 0, time.Millisecond, Visitor{})
+	l.LogRequest("GET", "/static/js/app.js", 200, 0, time.Millisecond, Visitor{})
+	l.LogRequest("GET", "/v1/ping", 200, 0, time.Millisecond, Visitor{})
+	l.LogWebSocketOpen("/static/live", Visitor{})
+	l.LogRequest("GET", "/healthz/deep", 200, 0, time.Millisecond, Visitor{})
+	l.LogRequest("GET", "/api/static/x", 200, 0, time.Millisecond, Visitor{})
+	l.Close()
+
+	out := buf.String()
+	if strings.Count(out, "\r\n") != 2 || !strings.Contains(out, "/healthz/deep") || !strings.Contains(out, "/api/static/x") {
+		t.Errorf("output = %q, want only the two non-matching requests", out)
+	}
+}
+
+func TestToggleRequests(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+
+	if l.ToggleRequests() {
+		t.Error("ToggleRequests() = true, want logging off")
+	}
+	l.LogRequest("GET", "/hidden", 200, 0, time.Millisecond, Visitor{})
+	l.LogNotice("still shown")
+	if !l.ToggleRequests() {
+		t.Error("ToggleRequests() = false, want logging on")
+	}
+	l.LogRequest("GET", "/shown", 200, 0, time.Millisecond, Visitor{})
+	l.Close()
+
+	out := buf.String()
+	if strings.Contains(out, "/hidden") || !strings.Contains(out, "still shown") || !strings.Contains(out, "/shown") {
+		t.Errorf("output = %q", out)
+	}
+}
+
+func TestToggleVerbose(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+	longPath := "/api/v1/very/long/path/that/exceeds/the/fifty/character/limit/by/a/lot"
+
+	if !l.ToggleVerbose() {
+		t.Error("ToggleVerbose() = false, want verbose")
+	}
+	l.LogRequest("GET", longPath, 200, 0, time.Millisecond, Visitor{})
+	l.Close()
+
+	out := buf.String()
+	if !strings.Contains(out, longPath) {
+		t.Errorf("verbose output should show the full path: %q", out)
+	}
+	if !strings.Contains(out, time.Now().Format("15:04")) {
+		t.Errorf("verbose output should be timestamped: %q", out)
+	}
+}
+
+func TestTogglePause(t *testing.T) {
+	var buf safeBuffer
+	l := NewRequestLogger(&buf, 2)
+
+	if !l.TogglePause() {
+		t.Fatal("TogglePause() = false, want paused")
+	}
+	for i := range 5 {
+		l.LogRequest("GET", fmt.Sprintf("/held-%d", i), 200, 0, time.Millisecond, Visitor{})
+	}
+	time.Sleep(20 * time.Millisecond)
+	if strings.Contains(buf.String(), "/held") {
+		t.Fatalf("output while paused: %q", buf.String())
+	}
+
+	if l.TogglePause() {
+		t.Fatal("TogglePause() = true, want resumed")
+	}
+	l.Close()
+
+	// The drain goroutine may hold one line besides the two buffered ones
+	out := buf.String()
+	if !strings.Contains(out, "/held-0") || strings.Contains(out, "/held-4") || !strings.Contains(out, "lines dropped") {
+		t.Errorf("output = %q, want the buffered lines and a dropped count", out)
+	}
+}
+
+// safeBuffer is a bytes.Buffer safe for concurrent use
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCloseWhilePaused(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+	l.TogglePause()
+	l.LogRequest("GET", "/queued", 200, 0, time.Millisecond, Visitor{})
+	l.Close() // must not hang
+	if !strings.Contains(buf.String(), "/queued") {
+		t.Errorf("queued line should be written on close: %q", buf.String())
+	}
+}
+
+func TestVisitorColumns(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+	v := Visitor{IP: "203.0.113.7", Country: "DE", UserAgent: "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 \x1b[2J"}
+
+	l.LogRequest("GET", "/off", 200, 0, time.Millisecond, v)
+	if !l.ToggleVisitors() {
+		t.Error("ToggleVisitors() = false, want on")
+	}
+	l.LogRequest("GET", "/on", 200, 0, time.Millisecond, v)
+	l.LogWebSocketOpen("/ws", Visitor{IP: "2001:db8::1"})
+	l.Close()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4: %q", len(lines), buf.String())
+	}
+	if strings.Contains(lines[0], "203.0.113.7") {
+		t.Errorf("visitor shown while columns are off: %q", lines[0])
+	}
+	if !strings.Contains(lines[2], "203.0.113.7     DE  Mozilla/5.0") || !strings.HasSuffix(lines[2], "...") {
+		t.Errorf("request line = %q, want IP, country and truncated user agent", lines[2])
+	}
+	if strings.Contains(lines[2], "\x1b") {
+		t.Errorf("control characters should be stripped: %q", lines[2])
+	}
+	if !strings.Contains(lines[3], "2001:db8::1     --  -") {
+		t.Errorf("WebSocket line = %q, want unknown country and user agent", lines[3])
+	}
+}
+
+func TestFormatRequestLog_Color(t *testing.T) {
+	tests := []struct {
+		status  int
+		latency time.Duration
+		want    []string
+	}{
+		{200, 5 * time.Millisecond, []string{colorGreen + "200" + colorReset, colorGreen + "5ms" + colorReset}},
+		{301, 150 * time.Millisecond, []string{colorCyan + "301", colorYellow + "150ms"}},
+		{404, time.Millisecond, []string{colorYellow + "404"}},
+		{502, 2 * time.Second, []string{colorRed + "502", colorRed + "2000ms"}},
+	}
+	for _, tt := range tests {
+		out := formatRequestLog("GET", "/", tt.status, 0, tt.latency, defaultPathColumn, true)
+		for _, want := range tt.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("formatRequestLog(%d, %v) = %q, want it to contain %q", tt.status, tt.latency, out, want)
+			}
+		}
+	}
+	if out := formatRequestLog("GET", "/", 500, 0, time.Second, defaultPathColumn, false); strings.Contains(out, "\033") {
+		t.Errorf("formatRequestLog without color = %q, want no escape codes", out)
+	}
+}
+
+func TestLogHistory(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+	l.LogHistory(nil)
+	l.LogHistory([]RequestRecord{
+		{Time: time.Date(2025, 1, 31, 12, 0, 5, 0, time.UTC), Method: "GET", Path: "/a", Status: 404, Bytes: 10},
+		{Time: time.Date(2025, 1, 31, 12, 0, 9, 0, time.UTC), Method: "WS", Path: "/ws", Status: 101, LatencyMS: 65000},
+	})
+	l.Close()
+
+	out := buf.String()
+	for _, want := range []string{"No requests yet", "Last 2 requests", "12:00:05  GET  /a", "12:00:09  WS   /ws", "CLOSED (1m5s"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output = %q, want it to contain %q", out, want)
+		}
+	}
+}
+
+func TestRequestLogger_SetWidth(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRequestLogger(&buf, 16)
+	path := "/" + strings.Repeat("a", 99)
+	v := Visitor{IP: "1.2.3.4", Country: "DE", UserAgent: strings.Repeat("Mozilla ", 10)}
+
+	l.SetWidth(80)
+	l.LogRequest("GET", path, 200, 0, 5*time.Millisecond, v)
+	l.SetVisitorColumns(true)
+	l.LogRequest("GET", path, 200, 0, 5*time.Millisecond, v)
+	l.SetWidth(200)
+	l.SetVisitorColumns(false)
+	l.LogRequest("GET", path, 200, 0, 5*time.Millisecond, v)
+	l.Close()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines: %q", len(lines), buf.String())
+	}
+	for i, line := range lines[:2] {
+		if len(line) > 80 {
+			t.Errorf("line %d is %d columns wide in an 80-column terminal: %q", i, len(line), line)
+		}
+	}
+	if !strings.Contains(lines[1], "1.2.3.4") || !strings.Contains(lines[1], "...") {
+		t.Errorf("visitor line = %q, want a truncated user agent", lines[1])
+	}
+	if !strings.Contains(lines[2], path) {
+		t.Errorf("wide terminal line = %q, want the full path", lines[2])
+	}
+}
@@ -0,0 +1,147 @@
+package tunnel
+
+import (
+	"net"
+	"slices"
+	"sort"
+	"strings"
+
+	"tunnl.gg/pkg/config"
+)
+
+// Route sends requests under a path prefix to another port the client
+// forwarded, e.g. /api to the local server behind -R 8080:localhost:8080
+type Route struct {
+	Prefix string // starts with '/', no trailing '/'
+	Port   uint32 // remote port of one of the client's forwards
+}
+
+// Service is a forwarded port reachable at a hostname of its own,
+// <name>--<subdomain>, e.g. api--happy-tiger-a1b2c3d4 for service=api:8080
+type Service struct {
+	Name string
+	Port uint32 // remote port of one of the client's forwards
+}
+
+// forward is an extra port the client forwarded, served through its own
+// local listener so connections to it open channels for that port
+type forward struct {
+	listener net.Listener
+	addr     string
+}
+
+// AddForward registers a further port the client forwarded and the listener
+// its connections arrive on. It returns false once the tunnel has
+// config.MaxForwards of them, for a port it already has or after Close.
+func (t *Tunnel) AddForward(port uint32, ln net.Listener) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || port == t.BindPort || len(t.forwards) >= config.MaxForwards {
+		return false
+	}
+	if _, ok := t.forwards[port]; ok {
+		return false
+	}
+	if t.forwards == nil {
+		t.forwards = make(map[uint32]forward)
+	}
+	t.forwards[port] = forward{listener: ln, addr: ln.Addr().String()}
+	return true
+}
+
+// HasForward reports whether the client forwarded the port
+func (t *Tunnel) HasForward(port uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.forwards[port]
+	return ok || port == t.BindPort
+}
+
+// SetRoutes replaces the tunnel's path prefix routes
+func (t *Tunnel) SetRoutes(routes []Route) {
+	routes = append([]Route(nil), routes...)
+	// Longest prefix first, so /api/v2 wins over /api
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].Prefix) > len(routes[j].Prefix) })
+	t.mu.Lock()
+	t.routes = routes
+	t.mu.Unlock()
+}
+
+// Routes returns the tunnel's path prefix routes, longest prefix first
+func (t *Tunnel) Routes() []Route {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Route(nil), t.routes...)
+}
+
+// SetServices replaces the tunnel's named services
+func (t *Tunnel) SetServices(services []Service) {
+	services = slices.Clone(services)
+	slices.SortFunc(services, func(a, b Service) int { return strings.Compare(a.Name, b.Name) })
+	t.mu.Lock()
+	t.services = services
+	t.mu.Unlock()
+}
+
+// Services returns the tunnel's named services, sorted by name
+func (t *Tunnel) Services() []Service {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.services)
+}
+
+// ServiceAddr returns the local address serving a named service
+func (t *Tunnel) ServiceAddr(name string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.services {
+		if s.Name != name {
+			continue
+		}
+		if f, ok := t.forwards[s.Port]; ok {
+			return f.addr, true
+		}
+		return t.ListenerAddr, true
+	}
+	return "", false
+}
+
+// Route returns the local address serving a request path and the prefix to
+// strip from it, or the tunnel's listener and "" if no route matches
+func (t *Tunnel) Route(path string) (addr, prefix string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range t.routes {
+		if path != r.Prefix && !strings.HasPrefix(path, r.Prefix+"/") {
+			continue
+		}
+		if f, ok := t.forwards[r.Port]; ok {
+			return f.addr, r.Prefix
+		}
+		// Routed to the tunnel's own port
+		return t.ListenerAddr, r.Prefix
+	}
+	return t.ListenerAddr, ""
+}
+
+// dialAddr returns addr if it is one of the tunnel's listeners, so the
+// transport never dials anywhere else, and the tunnel's listener otherwise
+func (t *Tunnel) dialAddr(addr string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, f := range t.forwards {
+		if f.addr == addr {
+			return addr
+		}
+	}
+	return t.ListenerAddr
+}
+
+// StripPrefix returns path without a route's prefix, keeping it absolute
+func StripPrefix(path, prefix string) string {
+	path = strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
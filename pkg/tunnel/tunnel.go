@@ -0,0 +1,746 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+// SSHCloser is an interface for closing SSH connections
+type SSHCloser interface {
+	Close() error
+}
+
+// Tunnel represents an active SSH tunnel
+type Tunnel struct {
+	Subdomain     string
+	Listener      net.Listener
+	ListenerAddr  string // Listener's address, formatted once for dialing
+	CreatedAt     time.Time
+	LastActive    time.Time
+	BindAddr      string
+	BindPort      uint32
+	ClientIP      string // SSH client IP that created this tunnel
+	mu            sync.Mutex
+	rateLimiter   *RateLimiter
+	rate          int               // Requests per second configured for this tunnel
+	burst         int               // Burst size configured for this tunnel
+	share         int               // Fair share of the client IP's request budget (0 = unlimited)
+	throttle      int               // Percent of the limits left by emergency throttling (0 = not throttled)
+	lifetime      time.Duration     // Max tunnel duration regardless of activity
+	idleTimeout   time.Duration     // Tunnel closes after this long without requests
+	wsIdleTimeout time.Duration     // WebSocket closes after this long without data
+	wsMaxTransfer int64             // Max bytes per WebSocket connection and direction
+	maxResponse   int64             // Max bytes per proxied response body
+	queue         chan struct{}     // Bounded slots for requests waiting on the rate limiter
+	queueTimeout  time.Duration     // Max time a request waits in the queue (0 = rejected at once)
+	connSlots     chan struct{}     // Held by each open backend connection
+	openSlots     chan struct{}     // Held by each channel open awaiting the client's answer
+	breaker       *CircuitBreaker   // Fast-fails requests while the local backend is down
+	unhealthy     bool              // Last health probe failed to reach the local backend
+	trafficPct    int               // Share of the subdomain's requests for canary backends (0 = regular)
+	backendID     string            // Identifies this tunnel within its subdomain's pool
+	labels        map[string]string // Free-form client metadata (e.g. project=foo)
+	account       string            // SSH username identifying the client's account ("" = anonymous)
+	quotaAccount  string            // name the account's quotas are kept under ("" = not limited)
+	tier          string            // Name of the client's tier ("" = built-in limits)
+	requests      atomic.Uint64     // Proxied HTTP requests served by this tunnel
+	bytes         atomic.Uint64     // Bytes relayed both ways by requests and WebSockets
+	sshConn       SSHCloser         // Reference to SSH connection for forced closure
+	rateLimitHits int               // Count of rate limit violations
+	chanFailures  int               // Channel opens refused in a row by the client
+	chanFailedAt  time.Time         // First refusal of the current run
+	chanExhausted bool              // Failure budget used up; reported once
+	transport     *http.Transport   // Reusable HTTP transport for proxying
+	logger        *RequestLogger    // Async request logger for SSH terminal output
+	logExclude    []string          // Path globs left out of the request log
+	logVisitors   bool              // Show visitor columns in the request log
+	logColor      bool              // Client terminal supports colors (pty requested)
+	logNoColor    bool              // Client opted out of colors
+	logWidth      int               // Client terminal width in columns (0 = unknown)
+	history       *RequestHistory   // Most recent requests, for owners who were not watching
+
+	// Further ports the client forwarded, the path prefixes routed to them,
+	// longest first, and the services named after them
+	forwards map[uint32]forward
+	routes   []Route
+	services []Service
+	closed   bool
+
+	// Headers added, overridden or removed on the way to and from the
+	// local server, whether the X-Tunnl-* headers are left out and whether
+	// visitor data is kept from it (privacy option)
+	requestHeaders  []HeaderRule
+	responseHeaders []HeaderRule
+	noIdentify      bool
+	private         bool
+}
+
+// New creates a new tunnel with the given parameters
+func New(subdomain string, listener net.Listener, bindAddr string, bindPort uint32, clientIP string) *Tunnel {
+	now := time.Now()
+	listenerAddr := listener.Addr().String()
+	t := &Tunnel{
+		Subdomain:     subdomain,
+		Listener:      listener,
+		ListenerAddr:  listenerAddr,
+		CreatedAt:     now,
+		LastActive:    now,
+		BindAddr:      bindAddr,
+		BindPort:      bindPort,
+		ClientIP:      clientIP,
+		rateLimiter:   NewRateLimiter(config.RequestsPerSecond, config.BurstSize),
+		rate:          config.RequestsPerSecond,
+		burst:         config.BurstSize,
+		lifetime:      config.MaxTunnelLifetime,
+		idleTimeout:   config.InactivityTimeout,
+		wsIdleTimeout: config.WebSocketIdleTimeout,
+		wsMaxTransfer: config.MaxWebSocketTransfer,
+		maxResponse:   config.MaxResponseBodySize,
+		queue:         make(chan struct{}, config.RequestQueueSize),
+		queueTimeout:  config.RequestQueueTimeout,
+		connSlots:     make(chan struct{}, config.MaxBackendConns),
+		openSlots:     make(chan struct{}, config.MaxChannelOpens),
+		breaker:       NewCircuitBreaker(config.BreakerFailureThreshold, config.BreakerCooldown),
+		history:       NewRequestHistory(config.RequestHistorySize),
+	}
+	t.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// Routes point requests at the listeners of further forwards
+			return net.DialTimeout("tcp", t.dialAddr(addr), 10*time.Second)
+		},
+		MaxIdleConns:    10,
+		MaxConnsPerHost: config.MaxBackendConns,
+		IdleConnTimeout: 90 * time.Second,
+	}
+	return t
+}
+
+// Touch updates the last active timestamp
+func (t *Tunnel) Touch() {
+	t.mu.Lock()
+	t.LastActive = time.Now()
+	t.mu.Unlock()
+}
+
+// IsExpired returns true if the tunnel has been inactive for too long or exceeded max lifetime
+func (t *Tunnel) IsExpired() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Since(t.LastActive) > t.idleTimeout ||
+		time.Since(t.CreatedAt) > t.lifetime
+}
+
+// IsMaxLifetimeExceeded returns true if the tunnel has exceeded max lifetime
+func (t *Tunnel) IsMaxLifetimeExceeded() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Since(t.CreatedAt) > t.lifetime
+}
+
+// TimeRemaining returns the time remaining before the tunnel expires (either by inactivity or max lifetime)
+func (t *Tunnel) TimeRemaining() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	inactivityRemaining := t.idleTimeout - time.Since(t.LastActive)
+	lifetimeRemaining := t.lifetime - time.Since(t.CreatedAt)
+
+	if inactivityRemaining < lifetimeRemaining {
+		return inactivityRemaining
+	}
+	return lifetimeRemaining
+}
+
+// AllowRequest checks if a request is allowed by the rate limiter
+func (t *Tunnel) AllowRequest() bool {
+	return t.rateLimiter.Allow()
+}
+
+// WaitRequest is like AllowRequest, but when the rate limit is hit the request
+// waits in a small bounded per-tunnel queue for up to the tunnel's queue
+// timeout, or until ctx's deadline if that is sooner. Returns false if the
+// queue is full, the deadline would pass, or ctx is done.
+func (t *Tunnel) WaitRequest(ctx context.Context) bool {
+	if t.rateLimiter.Allow() {
+		return true
+	}
+
+	deadline := time.Now().Add(t.QueueTimeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if !deadline.After(time.Now()) {
+		return false
+	}
+
+	select {
+	case t.queue <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-t.queue }()
+
+	for {
+		changed := t.rateLimiter.Changed()
+		wait := t.rateLimiter.Delay()
+		if time.Now().Add(wait).After(deadline) {
+			return false
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			// The limits were adjusted; re-check the delay at the new rate
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+		if t.rateLimiter.Allow() {
+			return true
+		}
+	}
+}
+
+// RetryDelay returns how long a request rejected by the rate limit should
+// wait before retrying: until the next token, plus a refill for each request
+// already queued ahead of it
+func (t *Tunnel) RetryDelay() time.Duration {
+	rate, _ := t.rateLimiter.Limits()
+	delay := t.rateLimiter.Delay()
+	if queued := len(t.queue); queued > 0 && rate > 0 {
+		delay += time.Duration(float64(queued) / rate * float64(time.Second))
+	}
+	return delay
+}
+
+// SetRateLimit changes the tunnel's rate limit to rps requests per second,
+// scaling the burst size proportionally
+func (t *Tunnel) SetRateLimit(rps int) {
+	t.SetRateBurst(rps, BurstFor(rps))
+}
+
+// BurstFor returns the burst size for rps, in proportion to the default limits
+func BurstFor(rps int) int {
+	return max(1, rps*config.BurstSize/config.RequestsPerSecond)
+}
+
+// SetRateBurst changes the tunnel's rate limit and burst size. It takes
+// effect immediately, including for requests already queued.
+func (t *Tunnel) SetRateBurst(rps, burst int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate, t.burst = rps, burst
+	t.applyLimits()
+}
+
+// SetShare caps the tunnel's rate at its fair share of the client IP's
+// request budget, scaling the burst size down with it (0 removes the cap)
+func (t *Tunnel) SetShare(rps int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.share = rps
+	t.applyLimits()
+}
+
+// SetThrottle cuts the tunnel's limits to percent of what they would
+// otherwise be while the server is overloaded (0 or 100 lifts the cut)
+func (t *Tunnel) SetThrottle(percent int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if percent >= 100 {
+		percent = 0
+	}
+	if percent == t.throttle {
+		return
+	}
+	t.throttle = percent
+	t.applyLimits()
+}
+
+// applyLimits sets the limiter to the configured limits, capped by the fair
+// share and cut by emergency throttling (must be called with lock held)
+func (t *Tunnel) applyLimits() {
+	rps, burst := t.rate, t.burst
+	if t.share > 0 && t.share < rps {
+		burst = max(1, burst*t.share/rps)
+		rps = t.share
+	}
+	if t.throttle > 0 {
+		rps = max(1, rps*t.throttle/100)
+		burst = max(1, burst*t.throttle/100)
+	}
+	t.rateLimiter.SetRate(float64(rps), burst)
+}
+
+// RateLimit returns the tunnel's configured requests per second
+func (t *Tunnel) RateLimit() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rate
+}
+
+// Burst returns the tunnel's configured burst size
+func (t *Tunnel) Burst() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.burst
+}
+
+// SetQueueTimeout sets how long requests over the rate limit wait for a
+// token before they are rejected (0 rejects them at once)
+func (t *Tunnel) SetQueueTimeout(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queueTimeout = d
+}
+
+// QueueTimeout returns how long requests over the rate limit wait for a token
+func (t *Tunnel) QueueTimeout() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.queueTimeout
+}
+
+// Share returns the tunnel's fair share of its client IP's budget (0 = unlimited)
+func (t *Tunnel) Share() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.share
+}
+
+// SetLifetime changes the tunnel's max lifetime and inactivity timeout
+func (t *Tunnel) SetLifetime(lifetime, idleTimeout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lifetime = lifetime
+	t.idleTimeout = idleTimeout
+}
+
+// Lifetime returns the tunnel's max lifetime and inactivity timeout
+func (t *Tunnel) Lifetime() (lifetime, idleTimeout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lifetime, t.idleTimeout
+}
+
+// SetSSHConn sets the SSH connection reference for forced closure
+func (t *Tunnel) SetSSHConn(conn SSHCloser) {
+	t.mu.Lock()
+	t.sshConn = conn
+	t.mu.Unlock()
+}
+
+// RecordRateLimitHit counts a request rejected by the tunnel's rate limit
+func (t *Tunnel) RecordRateLimitHit() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rateLimitHits++
+}
+
+// RateLimitHits returns the number of rate limit violations recorded so far
+func (t *Tunnel) RateLimitHits() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rateLimitHits
+}
+
+// RecordChannelOpen records whether the client accepted a forwarded-tcpip
+// channel. It returns true, once, when the client has refused
+// config.ChannelFailureBudget channels in a row over at least
+// config.ChannelFailureWindow, and the tunnel should be torn down.
+func (t *Tunnel) RecordChannelOpen(ok bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ok {
+		t.chanFailures = 0
+		return false
+	}
+	now := time.Now()
+	if t.chanFailures == 0 {
+		t.chanFailedAt = now
+	}
+	t.chanFailures++
+	if t.chanExhausted || t.chanFailures < config.ChannelFailureBudget || now.Sub(t.chanFailedAt) < config.ChannelFailureWindow {
+		return false
+	}
+	t.chanExhausted = true
+	return true
+}
+
+// CloseSSH closes the SSH connection associated with this tunnel
+func (t *Tunnel) CloseSSH() {
+	t.mu.Lock()
+	conn := t.sshConn
+	t.sshConn = nil // Prevent redundant close calls
+	t.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// History returns the tunnel's recent requests
+func (t *Tunnel) History() *RequestHistory {
+	return t.history
+}
+
+// SetLogger sets the request logger for SSH terminal output
+func (t *Tunnel) SetLogger(l *RequestLogger) {
+	t.mu.Lock()
+	t.logger = l
+	if l != nil && t.logExclude != nil {
+		l.SetExcludedPaths(t.logExclude)
+	}
+	if l != nil && t.logVisitors {
+		l.SetVisitorColumns(true)
+	}
+	if l != nil {
+		l.SetColor(t.logColor && !t.logNoColor)
+		l.SetWidth(t.logWidth)
+	}
+	t.mu.Unlock()
+}
+
+// SetLogColor sets whether the client's terminal can show colors; they are
+// used unless DisableLogColor was called
+func (t *Tunnel) SetLogColor(supported bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logColor = supported
+	if t.logger != nil {
+		t.logger.SetColor(t.logColor && !t.logNoColor)
+	}
+}
+
+// DisableLogColor turns request log colors off for good, as the client asked
+func (t *Tunnel) DisableLogColor() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logNoColor = true
+	if t.logger != nil {
+		t.logger.SetColor(false)
+	}
+}
+
+// SetLogWidth sets the width of the client's terminal, to which request log
+// columns are fitted, whether the logger is already attached or not
+func (t *Tunnel) SetLogWidth(columns int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logWidth = columns
+	if t.logger != nil {
+		t.logger.SetWidth(columns)
+	}
+}
+
+// SetLogVisitors turns the request log's visitor columns on, whether the
+// logger is already attached or not
+func (t *Tunnel) SetLogVisitors(on bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logVisitors = on
+	if t.logger != nil {
+		t.logger.SetVisitorColumns(on)
+	}
+}
+
+// SetLogExclude sets the path globs left out of the request log, whether
+// the logger is already attached or not
+func (t *Tunnel) SetLogExclude(patterns []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logExclude = patterns
+	if t.logger != nil {
+		t.logger.SetExcludedPaths(patterns)
+	}
+}
+
+// Logger returns the request logger, or nil if none is set
+func (t *Tunnel) Logger() *RequestLogger {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.logger
+}
+
+// SetHealthy records the result of a backend health probe and returns true if the state changed
+func (t *Tunnel) SetHealthy(healthy bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := t.unhealthy == healthy
+	t.unhealthy = !healthy
+	return changed
+}
+
+// Healthy returns false if the last backend health probe failed
+func (t *Tunnel) Healthy() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.unhealthy
+}
+
+// SetTrafficPercent marks the tunnel as a canary receiving the given percentage
+// of its subdomain's requests (0 makes it a regular round-robin backend)
+func (t *Tunnel) SetTrafficPercent(percent int) {
+	t.mu.Lock()
+	t.trafficPct = percent
+	t.mu.Unlock()
+}
+
+// TrafficPercent returns the canary traffic percentage, or 0 for a regular backend
+func (t *Tunnel) TrafficPercent() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.trafficPct
+}
+
+// setBackendID sets the pool-assigned backend ID
+func (t *Tunnel) setBackendID(id string) {
+	t.mu.Lock()
+	t.backendID = id
+	t.mu.Unlock()
+}
+
+// BackendID returns the ID identifying this tunnel within its subdomain's pool
+func (t *Tunnel) BackendID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.backendID
+}
+
+// SetAccount records the account (SSH username) that owns the tunnel
+func (t *Tunnel) SetAccount(account string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.account = account
+}
+
+// SetQuotaAccount records the name the owner's account quotas are kept under
+func (t *Tunnel) SetQuotaAccount(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.quotaAccount = name
+}
+
+// QuotaAccount returns the name the owner's account quotas are kept under,
+// or "" if they are not limited per account
+func (t *Tunnel) QuotaAccount() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.quotaAccount
+}
+
+// SetWebSocketLimits changes the idle timeout and per-direction transfer
+// limit of the tunnel's WebSocket connections
+func (t *Tunnel) SetWebSocketLimits(idleTimeout time.Duration, maxTransfer int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.wsIdleTimeout = idleTimeout
+	t.wsMaxTransfer = maxTransfer
+}
+
+// WebSocketLimits returns the idle timeout and per-direction transfer limit of
+// the tunnel's WebSocket connections
+func (t *Tunnel) WebSocketLimits() (idleTimeout time.Duration, maxTransfer int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.wsIdleTimeout, t.wsMaxTransfer
+}
+
+// SetMaxResponseSize changes the largest response body the tunnel may serve
+func (t *Tunnel) SetMaxResponseSize(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxResponse = n
+}
+
+// MaxResponseSize returns the largest response body the tunnel may serve
+func (t *Tunnel) MaxResponseSize() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.maxResponse
+}
+
+// SetTier records the name of the client's tier
+func (t *Tunnel) SetTier(tier string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tier = tier
+}
+
+// Tier returns the name of the client's tier, or "" for built-in limits
+func (t *Tunnel) Tier() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tier
+}
+
+// Account returns the account that owns the tunnel, or "" if anonymous
+func (t *Tunnel) Account() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.account
+}
+
+// SetLabel attaches a metadata label to the tunnel. Returns false if the key or
+// value is invalid or the tunnel already carries the maximum number of labels.
+func (t *Tunnel) SetLabel(key, value string) bool {
+	if !isValidLabel(key) || len(value) > config.MaxLabelLength || !isPrintableASCII(value) {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.labels == nil {
+		t.labels = make(map[string]string)
+	}
+	if _, exists := t.labels[key]; !exists && len(t.labels) >= config.MaxLabelsPerTunnel {
+		return false
+	}
+	t.labels[key] = value
+	return true
+}
+
+// Labels returns a copy of the tunnel's metadata labels
+func (t *Tunnel) Labels() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.labels) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(t.labels))
+	for k, v := range t.labels {
+		out[k] = v
+	}
+	return out
+}
+
+// isValidLabel checks that a label key is non-empty, bounded and limited to [a-z0-9_.-]
+func isValidLabel(key string) bool {
+	if key == "" || len(key) > config.MaxLabelLength {
+		return false
+	}
+	for _, c := range key {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' || c == '.' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func isPrintableASCII(s string) bool {
+	for _, c := range s {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// IncrementRequests increments the tunnel's proxied request counter
+func (t *Tunnel) IncrementRequests() {
+	t.requests.Add(1)
+}
+
+// RequestCount returns the number of proxied requests served by this tunnel
+func (t *Tunnel) RequestCount() uint64 {
+	return t.requests.Load()
+}
+
+// AddBytes counts bytes relayed through the tunnel in either direction
+func (t *Tunnel) AddBytes(n int64) {
+	t.bytes.Add(uint64(n))
+}
+
+// BytesRelayed returns the number of bytes relayed through the tunnel
+func (t *Tunnel) BytesRelayed() uint64 {
+	return t.bytes.Load()
+}
+
+// Breaker returns the backend circuit breaker for this tunnel
+func (t *Tunnel) Breaker() *CircuitBreaker {
+	return t.breaker
+}
+
+// SetBreaker replaces the backend circuit breaker, e.g. with one of another
+// cooldown. It must be called before the tunnel serves requests.
+func (t *Tunnel) SetBreaker(b *CircuitBreaker) {
+	t.breaker = b
+}
+
+// AcquireConn reserves one of the tunnel's config.MaxBackendConns backend
+// connection slots, waiting up to wait for one to free. Returns false if
+// none did; otherwise the caller must call ReleaseConn when done.
+func (t *Tunnel) AcquireConn(wait time.Duration) bool {
+	return acquireSlot(t.connSlots, wait)
+}
+
+// ReleaseConn frees a slot reserved by AcquireConn
+func (t *Tunnel) ReleaseConn() {
+	<-t.connSlots
+}
+
+// AcquireOpen reserves one of the config.MaxChannelOpens slots for a channel
+// open awaiting the client's answer, so a burst of requests does not flood a
+// slow client with opens. Waits up to wait for one to free; returns false if
+// none did, otherwise the caller must call ReleaseOpen once answered.
+func (t *Tunnel) AcquireOpen(wait time.Duration) bool {
+	return acquireSlot(t.openSlots, wait)
+}
+
+// ReleaseOpen frees a slot reserved by AcquireOpen
+func (t *Tunnel) ReleaseOpen() {
+	<-t.openSlots
+}
+
+// acquireSlot sends on a semaphore channel, waiting up to wait
+func acquireSlot(slots chan struct{}, wait time.Duration) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// ActiveConns returns the number of open backend connections
+func (t *Tunnel) ActiveConns() int {
+	return len(t.connSlots)
+}
+
+// Transport returns the reusable HTTP transport for this tunnel
+func (t *Tunnel) Transport() *http.Transport {
+	return t.transport
+}
+
+// Close closes the tunnel's listeners and cleans up the transport and logger
+func (t *Tunnel) Close() {
+	t.Listener.Close()
+	if t.transport != nil {
+		t.transport.CloseIdleConnections()
+	}
+	t.mu.Lock()
+	l := t.logger
+	t.logger = nil
+	t.closed = true
+	for _, f := range t.forwards {
+		f.listener.Close()
+	}
+	t.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
+}
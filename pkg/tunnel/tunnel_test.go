@@ -0,0 +1,730 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tunnl.gg/pkg/config"
+)
+
+func newTestTunnel(t *testing.T) *Tunnel {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create test listener: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return New("test-sub-00000000", ln, "127.0.0.1", 8080, "127.0.0.1")
+}
+
+func TestTouch(t *testing.T) {
+	tun := newTestTunnel(t)
+	before := tun.LastActive
+	time.Sleep(10 * time.Millisecond)
+	tun.Touch()
+	if !tun.LastActive.After(before) {
+		t.Error("Touch() did not update LastActive")
+	}
+}
+
+func TestIsExpired_NotExpiredInitially(t *testing.T) {
+	tun := newTestTunnel(t)
+	if tun.IsExpired() {
+		t.Error("new tunnel should not be expired")
+	}
+}
+
+func TestIsExpired_Inactivity(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.mu.Lock()
+	tun.LastActive = time.Now().Add(-3 * time.Hour)
+	tun.mu.Unlock()
+
+	if !tun.IsExpired() {
+		t.Error("tunnel with old LastActive should be expired")
+	}
+}
+
+func TestIsExpired_MaxLifetime(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.mu.Lock()
+	tun.CreatedAt = time.Now().Add(-25 * time.Hour)
+	tun.mu.Unlock()
+
+	if !tun.IsExpired() {
+		t.Error("tunnel past max lifetime should be expired")
+	}
+}
+
+func TestTimeRemaining(t *testing.T) {
+	tun := newTestTunnel(t)
+	remaining := tun.TimeRemaining()
+
+	// For a new tunnel, remaining should be close to InactivityTimeout (2h)
+	// since it's less than MaxTunnelLifetime (24h)
+	if remaining <= 0 {
+		t.Error("TimeRemaining() should be positive for a new tunnel")
+	}
+	if remaining > 2*time.Hour+time.Second {
+		t.Errorf("TimeRemaining() = %v, want <= 2h", remaining)
+	}
+}
+
+func TestRecordRateLimitHit(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	for i := 0; i < 3; i++ {
+		tun.RecordRateLimitHit()
+	}
+	if got := tun.RateLimitHits(); got != 3 {
+		t.Errorf("RateLimitHits() = %d, want 3", got)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	tun := newTestTunnel(t)
+	tr := tun.Transport()
+	if tr == nil {
+		t.Error("Transport() returned nil")
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	// Should allow requests up to burst size
+	for i := 0; i < 20; i++ {
+		if !tun.AllowRequest() {
+			t.Fatalf("AllowRequest() returned false on request %d (within burst)", i+1)
+		}
+	}
+
+	// Should deny after burst exhausted
+	if tun.AllowRequest() {
+		t.Error("AllowRequest() should return false after burst exhausted")
+	}
+}
+
+func TestIsMaxLifetimeExceeded(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	if tun.IsMaxLifetimeExceeded() {
+		t.Error("new tunnel should not have exceeded max lifetime")
+	}
+
+	tun.mu.Lock()
+	tun.CreatedAt = time.Now().Add(-25 * time.Hour)
+	tun.mu.Unlock()
+
+	if !tun.IsMaxLifetimeExceeded() {
+		t.Error("tunnel past max lifetime should report exceeded")
+	}
+}
+
+type mockSSHConn struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+func (m *mockSSHConn) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errors.New("already closed")
+	}
+	m.closed = true
+	return nil
+}
+
+func (m *mockSSHConn) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+func TestSetSSHConn(t *testing.T) {
+	tun := newTestTunnel(t)
+	mock := &mockSSHConn{}
+	tun.SetSSHConn(mock)
+
+	tun.mu.Lock()
+	got := tun.sshConn
+	tun.mu.Unlock()
+
+	if got != mock {
+		t.Error("SetSSHConn() did not set sshConn")
+	}
+}
+
+func TestRecordChannelOpen(t *testing.T) {
+	tun := newTestTunnel(t)
+	for range config.ChannelFailureBudget {
+		if tun.RecordChannelOpen(false) {
+			t.Fatal("budget should not be spent before the failure window passed")
+		}
+	}
+
+	// A success starts the run over
+	tun.RecordChannelOpen(true)
+	for range config.ChannelFailureBudget - 1 {
+		tun.RecordChannelOpen(false)
+	}
+	tun.mu.Lock()
+	tun.chanFailedAt = tun.chanFailedAt.Add(-config.ChannelFailureWindow)
+	tun.mu.Unlock()
+	if !tun.RecordChannelOpen(false) {
+		t.Error("budget should be spent after enough failures over the window")
+	}
+	if tun.RecordChannelOpen(false) {
+		t.Error("a spent budget should only be reported once")
+	}
+}
+
+func TestCloseSSH(t *testing.T) {
+	tun := newTestTunnel(t)
+	mock := &mockSSHConn{}
+	tun.SetSSHConn(mock)
+
+	tun.CloseSSH()
+
+	if !mock.isClosed() {
+		t.Error("CloseSSH() did not close the SSH connection")
+	}
+
+	// sshConn should be nil after close (prevents double-close)
+	tun.mu.Lock()
+	got := tun.sshConn
+	tun.mu.Unlock()
+	if got != nil {
+		t.Error("CloseSSH() should nil out sshConn")
+	}
+}
+
+func TestCloseSSH_Nil(t *testing.T) {
+	tun := newTestTunnel(t)
+	// Should not panic when no SSH connection is set
+	tun.CloseSSH()
+}
+
+func TestSetLogger(t *testing.T) {
+	tun := newTestTunnel(t)
+	var buf bytes.Buffer
+	logger := NewRequestLogger(&buf, 16)
+	defer logger.Close()
+
+	tun.SetLogger(logger)
+
+	got := tun.Logger()
+	if got != logger {
+		t.Error("SetLogger()/Logger() round-trip failed")
+	}
+}
+
+func TestLogger_NilByDefault(t *testing.T) {
+	tun := newTestTunnel(t)
+	if tun.Logger() != nil {
+		t.Error("Logger() should be nil by default")
+	}
+}
+
+func TestClose_ClosesLogger(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	tun := New("test-sub-00000000", ln, "127.0.0.1", 8080, "127.0.0.1")
+
+	var buf bytes.Buffer
+	logger := NewRequestLogger(&buf, 16)
+	tun.SetLogger(logger)
+
+	tun.Close()
+
+	// After Close, logger should be nil
+	if tun.Logger() != nil {
+		t.Error("Close() should nil out logger")
+	}
+}
+
+func TestClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	tun := New("test-sub-00000000", ln, "127.0.0.1", 8080, "127.0.0.1")
+	tun.Close()
+
+	// Listener should be closed — Accept should fail
+	_, err = ln.Accept()
+	if err == nil {
+		t.Error("Close() should close the listener")
+	}
+}
+
+func TestTimeRemaining_LifetimeShorter(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	// Set CreatedAt so lifetime remaining is shorter than inactivity remaining
+	tun.mu.Lock()
+	tun.CreatedAt = time.Now().Add(-23*time.Hour - 50*time.Minute)
+	tun.LastActive = time.Now() // just touched, so inactivity remaining ~2h
+	tun.mu.Unlock()
+
+	remaining := tun.TimeRemaining()
+	// Lifetime remaining should be ~10 minutes, which is less than inactivity timeout of 2h
+	if remaining > 15*time.Minute {
+		t.Errorf("TimeRemaining() = %v, want <= 15m (lifetime should be limiting)", remaining)
+	}
+}
+
+func TestSetLifetime(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.SetLifetime(7*24*time.Hour, 12*time.Hour)
+
+	tun.mu.Lock()
+	tun.CreatedAt = time.Now().Add(-48 * time.Hour)
+	tun.LastActive = time.Now().Add(-6 * time.Hour)
+	tun.mu.Unlock()
+
+	if tun.IsExpired() || tun.IsMaxLifetimeExceeded() {
+		t.Error("tunnel should outlive the default limits after SetLifetime()")
+	}
+	if remaining := tun.TimeRemaining(); remaining < 5*time.Hour || remaining > 6*time.Hour {
+		t.Errorf("TimeRemaining() = %v, want ~6h of inactivity left", remaining)
+	}
+}
+
+func TestWaitRequest_QueuesPastBurst(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	for i := 0; i < 20; i++ {
+		tun.AllowRequest()
+	}
+
+	start := time.Now()
+	if !tun.WaitRequest(context.Background()) {
+		t.Fatal("WaitRequest() should succeed once a token refills")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("WaitRequest() returned after %v, expected it to wait for a token", elapsed)
+	}
+}
+
+func TestSetShare(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.SetRateBurst(4, 4)
+
+	// A share above the tunnel's own limit changes nothing
+	tun.SetShare(10)
+	if rate, burst := tun.rateLimiter.Limits(); rate != 4 || burst != 4 {
+		t.Errorf("limiter = %v/%d with a larger share, want 4/4", rate, burst)
+	}
+
+	tun.SetShare(2)
+	if rate, burst := tun.rateLimiter.Limits(); rate != 2 || burst != 2 {
+		t.Errorf("limiter = %v/%d with share 2, want 2/2", rate, burst)
+	}
+	if tun.RateLimit() != 4 || tun.Burst() != 4 {
+		t.Errorf("configured limits = %d/%d, want 4/4", tun.RateLimit(), tun.Burst())
+	}
+
+	tun.SetShare(0)
+	if rate, _ := tun.rateLimiter.Limits(); rate != 4 {
+		t.Errorf("limiter rate = %v after removing the share, want 4", rate)
+	}
+}
+
+func TestSetThrottle(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.SetRateBurst(8, 16)
+	tun.SetShare(4)
+
+	// The cut applies on top of the fair share
+	tun.SetThrottle(25)
+	if rate, burst := tun.rateLimiter.Limits(); rate != 1 || burst != 2 {
+		t.Errorf("limiter = %v/%d throttled to 25%%, want 1/2", rate, burst)
+	}
+	if tun.RateLimit() != 8 || tun.Burst() != 16 {
+		t.Errorf("configured limits = %d/%d, want 8/16", tun.RateLimit(), tun.Burst())
+	}
+
+	tun.SetThrottle(100)
+	if rate, burst := tun.rateLimiter.Limits(); rate != 4 || burst != 8 {
+		t.Errorf("limiter = %v/%d after lifting the cut, want 4/8", rate, burst)
+	}
+}
+
+func TestWaitRequest_RateRaised(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.SetRateBurst(1, 1)
+	tun.AllowRequest()
+
+	// A queued request is released as soon as the limit is raised, instead of
+	// waiting out the delay computed at the old rate
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tun.SetRateBurst(100, 10)
+	}()
+	start := time.Now()
+	if !tun.WaitRequest(context.Background()) {
+		t.Fatal("WaitRequest() should succeed after the limit is raised")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("WaitRequest() took %v, want it released when the limit changed", elapsed)
+	}
+}
+
+func TestWaitRequest_QueueFull(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	for i := 0; i < 20; i++ {
+		tun.AllowRequest()
+	}
+	for i := 0; i < cap(tun.queue); i++ {
+		tun.queue <- struct{}{}
+	}
+
+	if tun.WaitRequest(context.Background()) {
+		t.Error("WaitRequest() should fail when the queue is full")
+	}
+}
+
+func TestWaitRequest_ContextCancelled(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	for i := 0; i < 20; i++ {
+		tun.AllowRequest()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if tun.WaitRequest(ctx) {
+		t.Error("WaitRequest() should fail when the context is cancelled")
+	}
+}
+
+func TestWaitRequest_QueueTimeout(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.SetRateBurst(1, 1)
+	tun.AllowRequest()
+
+	// The default timeout is shorter than the second a token takes to refill
+	tun.SetQueueTimeout(100 * time.Millisecond)
+	if tun.WaitRequest(context.Background()) {
+		t.Error("WaitRequest() should fail when the token comes after the queue timeout")
+	}
+
+	tun.SetQueueTimeout(5 * time.Second)
+	start := time.Now()
+	if !tun.WaitRequest(context.Background()) {
+		t.Fatal("WaitRequest() should succeed within a longer queue timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("WaitRequest() returned after %v, expected it to wait for a token", elapsed)
+	}
+}
+
+func TestWaitRequest_NoQueue(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.SetQueueTimeout(0)
+
+	for i := 0; i < 20; i++ {
+		tun.AllowRequest()
+	}
+
+	start := time.Now()
+	if tun.WaitRequest(context.Background()) {
+		t.Error("WaitRequest() should fail at once without a queue")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("WaitRequest() took %v, want an immediate rejection", elapsed)
+	}
+}
+
+func TestWaitRequest_ContextDeadline(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.SetRateBurst(1, 1)
+	tun.SetQueueTimeout(5 * time.Second)
+	tun.AllowRequest()
+
+	// The request's own deadline comes before the token
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if tun.WaitRequest(ctx) {
+		t.Error("WaitRequest() should fail when the token comes after the context deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("WaitRequest() took %v, want it rejected without waiting", elapsed)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.SetRateBurst(2, 1)
+
+	if d := tun.RetryDelay(); d != 0 {
+		t.Errorf("RetryDelay() = %v with a token available, want 0", d)
+	}
+	tun.AllowRequest()
+	if d := tun.RetryDelay(); d <= 0 || d > 500*time.Millisecond {
+		t.Errorf("RetryDelay() = %v, want up to one refill of 500ms", d)
+	}
+
+	// Each queued request takes a token first
+	tun.queue <- struct{}{}
+	tun.queue <- struct{}{}
+	if d := tun.RetryDelay(); d <= time.Second || d > 1500*time.Millisecond {
+		t.Errorf("RetryDelay() = %v with two requests queued, want 1s-1.5s", d)
+	}
+}
+
+func TestAcquireConn(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	for i := 0; i < config.MaxBackendConns; i++ {
+		if !tun.AcquireConn(0) {
+			t.Fatalf("AcquireConn() failed for connection %d", i+1)
+		}
+	}
+	if tun.ActiveConns() != config.MaxBackendConns {
+		t.Errorf("ActiveConns() = %d, want %d", tun.ActiveConns(), config.MaxBackendConns)
+	}
+
+	start := time.Now()
+	if tun.AcquireConn(50 * time.Millisecond) {
+		t.Fatal("AcquireConn() should fail with every slot taken")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("AcquireConn() gave up after %v, want it to wait", elapsed)
+	}
+
+	// A queued connection gets the slot as soon as one is released
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		tun.ReleaseConn()
+	}()
+	if !tun.AcquireConn(time.Second) {
+		t.Error("AcquireConn() should succeed once a slot is released")
+	}
+}
+
+func TestAcquireOpen(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	for i := 0; i < config.MaxChannelOpens; i++ {
+		if !tun.AcquireOpen(0) {
+			t.Fatalf("AcquireOpen() failed for open %d", i+1)
+		}
+	}
+	if tun.AcquireOpen(10 * time.Millisecond) {
+		t.Fatal("AcquireOpen() should fail with every slot taken")
+	}
+	// Open slots are separate from connection slots
+	if !tun.AcquireConn(0) {
+		t.Error("AcquireConn() should not wait for channel opens")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		tun.ReleaseOpen()
+	}()
+	if !tun.AcquireOpen(time.Second) {
+		t.Error("AcquireOpen() should succeed once a slot is released")
+	}
+}
+
+func TestSetHealthy(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	if !tun.Healthy() {
+		t.Fatal("new tunnel should be healthy")
+	}
+	if tun.SetHealthy(true) {
+		t.Error("SetHealthy(true) on a healthy tunnel should not report a change")
+	}
+	if !tun.SetHealthy(false) {
+		t.Error("SetHealthy(false) on a healthy tunnel should report a change")
+	}
+	if tun.Healthy() {
+		t.Error("Healthy() should be false after a failed probe")
+	}
+	if !tun.SetHealthy(true) {
+		t.Error("SetHealthy(true) on an unhealthy tunnel should report a change")
+	}
+}
+
+func TestSetLabel(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	if tun.Labels() != nil {
+		t.Error("Labels() should be nil by default")
+	}
+
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		want  bool
+	}{
+		{"valid", "project", "foo", true},
+		{"dotted key", "app.env", "staging", true},
+		{"empty key", "", "foo", false},
+		{"uppercase key", "Project", "foo", false},
+		{"control chars in value", "env", "a\x1b[31mb", false},
+		{"value too long", "env", strings.Repeat("x", 65), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tun.SetLabel(tt.key, tt.value); got != tt.want {
+				t.Errorf("SetLabel(%q, %q) = %v, want %v", tt.key, tt.value, got, tt.want)
+			}
+		})
+	}
+
+	labels := tun.Labels()
+	if labels["project"] != "foo" || labels["app.env"] != "staging" || len(labels) != 2 {
+		t.Errorf("Labels() = %v, want project=foo app.env=staging", labels)
+	}
+}
+
+func TestSetLabel_Limit(t *testing.T) {
+	tun := newTestTunnel(t)
+
+	for i := 0; i < 16; i++ {
+		if !tun.SetLabel(fmt.Sprintf("k%d", i), "v") {
+			t.Fatalf("SetLabel() rejected label %d below the limit", i+1)
+		}
+	}
+	if tun.SetLabel("extra", "v") {
+		t.Error("SetLabel() should reject labels beyond the limit")
+	}
+	if !tun.SetLabel("k0", "updated") {
+		t.Error("SetLabel() should allow updating an existing label at the limit")
+	}
+}
+
+func TestSetLogExclude(t *testing.T) {
+	// Options may arrive before or after the logger is attached
+	for _, before := range []bool{true, false} {
+		tun := newTestTunnel(t)
+		var buf bytes.Buffer
+		l := NewRequestLogger(&buf, 16)
+		if before {
+			tun.SetLogExclude([]string{"/healthz"})
+			tun.SetLogger(l)
+		} else {
+			tun.SetLogger(l)
+			tun.SetLogExclude([]string{"/healthz"})
+		}
+		l.LogRequest("GET", "/healthz", 200, 0, time.Millisecond, Visitor{})
+		l.Close()
+		if buf.Len() != 0 {
+			t.Errorf("excluded before logger = %v: output = %q, want none", before, buf.String())
+		}
+	}
+}
+
+func TestSetLogColor(t *testing.T) {
+	tun := newTestTunnel(t)
+	l := NewRequestLogger(&bytes.Buffer{}, 16)
+	defer l.Close()
+
+	tun.SetLogColor(true)
+	tun.SetLogger(l)
+	if !l.color.Load() {
+		t.Error("colors should be on for a terminal that supports them")
+	}
+	tun.DisableLogColor()
+	tun.SetLogColor(true) // a later pty request does not override the opt-out
+	if l.color.Load() {
+		t.Error("colors should stay off after the client opted out")
+	}
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	h := http.Header{"Server": {"nginx"}, "Vary": {"Origin"}, "X-Key": {"old"}}
+	ApplyHeaderRules(h, []HeaderRule{
+		{HeaderRemove, "Server", ""},
+		{HeaderAdd, "Vary", "Accept"},
+		{HeaderSet, "X-Key", "new"},
+		{HeaderSet, "X-Added", "1"},
+	})
+	want := http.Header{"Vary": {"Origin", "Accept"}, "X-Key": {"new"}, "X-Added": {"1"}}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("headers = %v, want %v", h, want)
+	}
+}
+
+func TestTunnel_Services(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	api, _ := net.Listen("tcp", "127.0.0.1:0")
+	tun := New("test", ln, "localhost", 80, "1.2.3.4")
+	defer tun.Close()
+
+	tun.AddForward(8080, api)
+	tun.SetServices([]Service{{"web", 80}, {"api", 8080}})
+
+	if got := tun.Services(); len(got) != 2 || got[0].Name != "api" {
+		t.Errorf("Services() = %v, want sorted by name", got)
+	}
+	if addr, ok := tun.ServiceAddr("api"); !ok || addr != api.Addr().String() {
+		t.Errorf("ServiceAddr(api) = %q, %v, want the forward's listener", addr, ok)
+	}
+	if addr, ok := tun.ServiceAddr("web"); !ok || addr != tun.ListenerAddr {
+		t.Errorf("ServiceAddr(web) = %q, %v, want the tunnel's listener", addr, ok)
+	}
+	if _, ok := tun.ServiceAddr("admin"); ok {
+		t.Error("ServiceAddr of an unknown service should fail")
+	}
+}
+
+func TestTunnel_Routes(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	api, _ := net.Listen("tcp", "127.0.0.1:0")
+	tun := New("test", ln, "localhost", 80, "1.2.3.4")
+	defer tun.Close()
+
+	if !tun.AddForward(8080, api) {
+		t.Fatal("AddForward(8080) failed")
+	}
+	if tun.AddForward(8080, api) || tun.AddForward(80, api) {
+		t.Error("a port should only be forwarded once")
+	}
+	tun.SetRoutes([]Route{{"/api", 8080}, {"/api/v1", 80}})
+
+	tests := []struct {
+		path, addr, prefix string
+	}{
+		{"/api", api.Addr().String(), "/api"},
+		{"/api/users", api.Addr().String(), "/api"},
+		{"/api/v1/users", tun.ListenerAddr, "/api/v1"},
+		{"/apiary", tun.ListenerAddr, ""},
+		{"/", tun.ListenerAddr, ""},
+	}
+	for _, tt := range tests {
+		if addr, prefix := tun.Route(tt.path); addr != tt.addr || prefix != tt.prefix {
+			t.Errorf("Route(%q) = %q, %q, want %q, %q", tt.path, addr, prefix, tt.addr, tt.prefix)
+		}
+	}
+	if got := tun.dialAddr("192.0.2.1:80"); got != tun.ListenerAddr {
+		t.Errorf("dialAddr of a foreign address = %q, want the tunnel's listener", got)
+	}
+
+	tun.Close()
+	if _, err := api.Accept(); err == nil {
+		t.Error("Close should close the listeners of further forwards")
+	}
+}
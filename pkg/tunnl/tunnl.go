@@ -0,0 +1,418 @@
+// Package tunnl embeds a tunnl.gg server in another Go program: the SSH
+// listener clients forward their ports through, the HTTPS server visitors
+// reach their tunnels on, the HTTP redirector and the stats endpoint.
+package tunnl
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnl.gg/internal/certs"
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/server"
+)
+
+// Options configures an embedded server
+type Options struct {
+	// Config is the server's configuration, config.Default() if nil. Its
+	// SSHAddr, HTTPSAddr, HTTPAddr and StatsAddr are the addresses to listen
+	// on; an empty HTTPAddr or StatsAddr leaves that listener out.
+	Config *config.Config
+
+	// GetCertificate returns the certificate for each HTTPS handshake. If
+	// nil, Config.TLSCert and Config.TLSKey are served, along with the pairs
+	// in Config.CertsDir, and reloaded when they change.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// ALPNHandlers serve further protocols on the HTTPS port: TLS clients
+	// offering one of these ALPN protocols are handed to its handler after
+	// the handshake, instead of to the HTTPS server. h2 and http/1.1 are
+	// the HTTPS server's.
+	ALPNHandlers map[string]func(*tls.Conn)
+}
+
+// Server is an embedded tunnl.gg server. Start it, then call Shutdown, or
+// let Run do both.
+type Server struct {
+	core        *server.Server
+	cfg         *config.Config
+	tlsConfig   *tls.Config
+	certWatcher *certs.Watcher // nil when the caller supplies certificates
+	alpn        map[string]func(*tls.Conn)
+
+	mu          sync.Mutex // guards the listeners, which restarts replace
+	sshListener net.Listener
+	sshDone     chan struct{}
+	httpServer  *http.Server // nil without an HTTPAddr
+	httpsServer *http.Server
+	statsServer *http.Server // nil without a StatsAddr
+	listeners   map[*http.Server]net.Listener
+
+	errc           chan error
+	closing        chan struct{} // closed by Shutdown
+	restartBackoff time.Duration // overridable for tests
+	started        bool          // Start was called
+	running        bool          // Start succeeded
+}
+
+// NewServer creates a server from opts. It loads the host key and the
+// certificates, but listens on nothing until Start.
+func NewServer(opts Options) (*Server, error) {
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = config.Default()
+	}
+
+	// The store only serves when the caller supplies no certificates, but
+	// also carries the TLS policy's defaults
+	store := certs.NewStore()
+	var certWatcher *certs.Watcher
+	if opts.GetCertificate == nil {
+		certWatcher = certs.NewWatcher(store, cfg.CertsDir, certs.KeyPair{CertFile: cfg.TLSCert, KeyFile: cfg.TLSKey})
+		if err := certWatcher.Load(); err != nil {
+			return nil, fmt.Errorf("failed to load certificates: %w", err)
+		}
+	}
+	tlsConfig, err := certs.TLSConfig(cfg, store)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS policy: %w", err)
+	}
+	if opts.GetCertificate != nil {
+		tlsConfig.GetCertificate = opts.GetCertificate
+	}
+
+	alpn := maps.Clone(opts.ALPNHandlers)
+	for proto := range alpn {
+		if proto == "" || proto == "h2" || proto == "http/1.1" {
+			return nil, fmt.Errorf("ALPN protocol %q cannot have a handler", proto)
+		}
+	}
+
+	core, err := server.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AgentALPN {
+		if alpn == nil {
+			alpn = make(map[string]func(*tls.Conn))
+		}
+		alpn[config.AgentProtocol] = core.HandleAgentConnection
+	}
+	// Fingerprint each ClientHello for abuse tracking and blocking
+	tlsConfig.GetConfigForClient = core.InspectClientHello
+
+	return &Server{
+		core:           core,
+		cfg:            cfg,
+		tlsConfig:      tlsConfig,
+		certWatcher:    certWatcher,
+		alpn:           alpn,
+		sshDone:        make(chan struct{}),
+		listeners:      make(map[*http.Server]net.Listener),
+		errc:           make(chan error, 4),
+		closing:        make(chan struct{}),
+		restartBackoff: config.ListenerRestartBackoff,
+	}, nil
+}
+
+// Core returns the server behind the listeners, for its tunnel registry,
+// stats and administrative methods
+func (s *Server) Core() *server.Server {
+	return s.core
+}
+
+// Start listens on the configured addresses and serves them in the
+// background. A listener that fails later is reopened up to
+// Config.ListenerRestarts times; the error that stops it for good arrives
+// on Errors.
+func (s *Server) Start() error {
+	if s.started {
+		return errors.New("server already started")
+	}
+	s.started = true
+
+	s.httpsServer = &http.Server{
+		Handler:        s.core,
+		ReadTimeout:    config.HTTPSReadTimeout,
+		WriteTimeout:   config.HTTPSWriteTimeout,
+		IdleTimeout:    config.HTTPSIdleTimeout,
+		MaxHeaderBytes: 1 << 20,
+		TLSConfig:      s.tlsConfig,
+		ConnContext:    s.core.TLSConnContext,
+		ConnState:      s.core.TLSConnState,
+	}
+	if !slices.Contains(s.cfg.TLSALPN, "h2") {
+		// A non-nil map keeps net/http from enabling HTTP/2
+		s.httpsServer.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	if s.cfg.HTTPAddr != "" {
+		s.httpServer = &http.Server{
+			Handler:      s.core.HTTPRedirectHandler(),
+			ReadTimeout:  config.HTTPReadTimeout,
+			WriteTimeout: config.HTTPWriteTimeout,
+			IdleTimeout:  config.HTTPIdleTimeout,
+			ConnState:    s.core.HTTPConnState,
+		}
+	}
+	if s.cfg.StatsAddr != "" {
+		s.statsServer = &http.Server{
+			Handler:      s.core.StatsHandler(),
+			ReadTimeout:  config.StatsReadTimeout,
+			WriteTimeout: config.StatsWriteTimeout,
+		}
+	}
+
+	// Listen on everything before serving anything, so a taken address
+	// leaves nothing half started
+	var err error
+	if s.sshListener, err = net.Listen("tcp", s.cfg.SSHAddr); err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.SSHAddr, err)
+	}
+	for srv, addr := range map[*http.Server]string{s.httpsServer: s.cfg.HTTPSAddr, s.httpServer: s.cfg.HTTPAddr, s.statsServer: s.cfg.StatsAddr} {
+		if srv == nil {
+			continue
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		s.listeners[srv] = ln
+	}
+
+	s.running = true
+	if s.certWatcher != nil {
+		s.certWatcher.Start()
+	}
+
+	log.Printf("SSH server listening on %s", s.sshListener.Addr())
+	go s.serveSSH()
+
+	var also []string
+	if s.cfg.SSHOnHTTPSPort {
+		also = append(also, "SSH")
+	}
+	for _, proto := range slices.Sorted(maps.Keys(s.alpn)) {
+		also = append(also, "ALPN "+proto)
+	}
+	if len(also) > 0 {
+		log.Printf("HTTPS server listening on %s (%s accepted too)", s.HTTPSAddr(), strings.Join(also, ", "))
+	} else {
+		log.Printf("HTTPS server listening on %s", s.HTTPSAddr())
+	}
+	go s.serve("HTTPS", s.httpsServer, true)
+	if s.httpServer != nil {
+		log.Printf("HTTP server listening on %s (redirects to HTTPS)", s.HTTPAddr())
+		go s.serve("HTTP", s.httpServer, false)
+	}
+	if s.statsServer != nil {
+		log.Printf("Stats server listening on %s", s.StatsAddr())
+		go s.serve("stats", s.statsServer, false)
+	}
+	return nil
+}
+
+// serveSSH hands the SSH listener's connections to the server until the
+// listener is closed
+func (s *Server) serveSSH() {
+	defer close(s.sshDone)
+	s.supervise("SSH", s.sshListener, func(ln net.Listener) { s.sshListener = ln }, s.core.ServeSSH)
+}
+
+// serve runs an HTTP server on its listener until it is shut down
+func (s *Server) serve(name string, srv *http.Server, useTLS bool) {
+	s.mu.Lock()
+	ln := s.listeners[srv]
+	s.mu.Unlock()
+	s.supervise(name, ln, func(ln net.Listener) { s.listeners[srv] = ln }, func(ln net.Listener) error {
+		var err error
+		if useTLS {
+			if s.cfg.SSHOnHTTPSPort || len(s.alpn) > 0 {
+				ln = s.core.Mux(ln, server.MuxOptions{SSH: s.cfg.SSHOnHTTPSPort, ALPN: s.alpn, TLSConfig: s.tlsConfig})
+			}
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	})
+}
+
+// supervise runs serve on ln until it returns nil or the server shuts down.
+// When serve fails, the listener is reopened on the same address, stored
+// with set, and served again, up to Config.ListenerRestarts times before
+// the failure is reported on Errors.
+func (s *Server) supervise(name string, ln net.Listener, set func(net.Listener), serve func(net.Listener) error) {
+	addr := ln.Addr().String()
+	err := serve(ln)
+	for restarts := 1; err != nil; restarts++ {
+		ln.Close()
+		if restarts > s.cfg.ListenerRestarts {
+			s.errc <- fmt.Errorf("%s server error: %w", name, err)
+			return
+		}
+		log.Printf("%s server failed: %v, restarting it on %s (%d of %d)", name, err, addr, restarts, s.cfg.ListenerRestarts)
+		select {
+		case <-s.closing:
+			return
+		case <-time.After(s.restartBackoff):
+		}
+		if ln, err = s.relisten(addr, set); err == nil {
+			err = serve(ln)
+		}
+	}
+}
+
+// relisten opens a listener on addr in place of one that failed, unless the
+// server is shutting down
+func (s *Server) relisten(addr string, set func(net.Listener)) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closing:
+		ln.Close()
+		return nil, net.ErrClosed
+	default:
+	}
+	set(ln)
+	log.Printf("Listening on %s again", addr)
+	return ln, nil
+}
+
+// closeListeners closes the listeners of a Start that failed
+func (s *Server) closeListeners() {
+	s.sshListener.Close()
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+}
+
+// Errors delivers the errors that stop a listener after Start
+func (s *Server) Errors() <-chan error {
+	return s.errc
+}
+
+// SSHAddr returns the address SSH clients connect to, or nil before Start
+func (s *Server) SSHAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sshListener == nil {
+		return nil
+	}
+	return s.sshListener.Addr()
+}
+
+// HTTPSAddr returns the address visitors reach tunnels on, or nil before Start
+func (s *Server) HTTPSAddr() net.Addr {
+	return s.addr(s.httpsServer)
+}
+
+// HTTPAddr returns the address of the HTTP redirector, or nil before Start
+// or without one
+func (s *Server) HTTPAddr() net.Addr {
+	return s.addr(s.httpServer)
+}
+
+// StatsAddr returns the address of the stats endpoint, or nil before Start
+// or without one
+func (s *Server) StatsAddr() net.Addr {
+	return s.addr(s.statsServer)
+}
+
+func (s *Server) addr(srv *http.Server) net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ln, ok := s.listeners[srv]; ok {
+		return ln.Addr()
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections, lets the HTTP servers finish their
+// requests while ctx allows, waits up to config.DrainTimeout for requests
+// relayed through tunnels, then ends the SSH sessions and stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	// No listener is restarted from here on
+	s.mu.Lock()
+	select {
+	case <-s.closing:
+	default:
+		close(s.closing)
+	}
+	s.mu.Unlock()
+
+	if s.running {
+		for _, srv := range []*http.Server{s.httpServer, s.httpsServer, s.statsServer} {
+			if srv == nil {
+				continue
+			}
+			if err := srv.Shutdown(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		s.mu.Lock()
+		s.sshListener.Close()
+		s.mu.Unlock()
+		<-s.sshDone // Wait for SSH accept loop to finish
+
+		// Let requests and WebSocket connections still relayed through
+		// tunnels finish before the tunnels close
+		drainCtx, cancelDrain := context.WithTimeout(context.Background(), config.DrainTimeout)
+		s.core.Drain(drainCtx)
+		cancelDrain()
+
+		// Tell clients of a cluster where and when to reconnect before
+		// their sessions end
+		s.core.SendMigrationHints()
+		s.core.CloseAll()
+	}
+
+	if s.certWatcher != nil {
+		s.certWatcher.Stop()
+	}
+	s.core.Stop()
+	return errors.Join(errs...)
+}
+
+// Run starts the server and shuts it down once ctx is done or a listener
+// fails, returning that failure
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		s.Shutdown(ctx)
+		return err
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down...")
+	case runErr = <-s.errc:
+		log.Printf("Fatal error: %v, shutting down...", runErr)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown error: %v", err)
+	}
+	return runErr
+}
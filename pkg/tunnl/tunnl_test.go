@@ -0,0 +1,321 @@
+package tunnl
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tunnl.gg/client"
+	"tunnl.gg/pkg/config"
+	"tunnl.gg/pkg/server"
+)
+
+// newTestOptions returns options listening on free local ports and serving
+// a self-signed certificate
+func newTestOptions(t *testing.T) Options {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	cfg := config.Default()
+	cfg.HostKeyPath = t.TempDir() + "/host_key"
+	cfg.SSHAddr = "127.0.0.1:0"
+	cfg.HTTPSAddr = "127.0.0.1:0"
+	cfg.HTTPAddr = "127.0.0.1:0"
+	cfg.StatsAddr = "127.0.0.1:0"
+	return Options{
+		Config:         cfg,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil },
+	}
+}
+
+func TestServer_Lifecycle(t *testing.T) {
+	s, err := NewServer(newTestOptions(t))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if s.SSHAddr() != nil || s.HTTPSAddr() != nil {
+		t.Error("addresses should be nil before Start")
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := s.Start(); err == nil {
+		t.Error("second Start succeeded")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	session, err := client.Open(ctx, client.Options{
+		Addr:            s.SSHAddr().String(),
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "embedded")
+		}),
+	})
+	if err != nil {
+		t.Fatalf("client.Open: %v", err)
+	}
+	defer session.Close()
+
+	// Visit the tunnel over HTTPS, reaching its hostname at the test listener
+	httpsAddr := s.HTTPSAddr().String()
+	visitor := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, httpsAddr)
+		},
+	}}
+	resp, err := visitor.Get(session.URL + "/")
+	if err != nil {
+		t.Fatalf("GET %s: %v", session.URL, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "embedded" {
+		t.Errorf("GET = %d %q, want 200 %q", resp.StatusCode, body, "embedded")
+	}
+
+	resp, err = http.Get("http://" + s.StatsAddr().String() + "/")
+	if err != nil {
+		t.Fatalf("GET stats: %v", err)
+	}
+	var stats server.Stats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil || stats.ActiveTunnels != 1 {
+		t.Errorf("stats = %+v (%v), want one active tunnel", stats, err)
+	}
+
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if _, err := net.Dial("tcp", s.SSHAddr().String()); err == nil {
+		t.Error("SSH listener still accepts connections after Shutdown")
+	}
+	if err := session.Wait(); err == nil {
+		t.Error("session survived Shutdown")
+	}
+}
+
+func TestServer_StartAddressInUse(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	opts := newTestOptions(t)
+	opts.Config.HTTPSAddr = taken.Addr().String()
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if err := s.Run(context.Background()); err == nil || !strings.Contains(err.Error(), taken.Addr().String()) {
+		t.Errorf("Run = %v, want the listen error for %s", err, taken.Addr())
+	}
+	// Nothing was left listening
+	if _, err := net.Dial("tcp", s.SSHAddr().String()); err == nil {
+		t.Error("SSH listener left open after a failed Start")
+	}
+}
+
+func TestServer_RunStopsWithContext(t *testing.T) {
+	s, err := NewServer(newTestOptions(t))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after its context was done")
+	}
+}
+
+// newSupervisedServer returns an unstarted server that reopens failed
+// listeners up to restarts times without waiting, and a listener to
+// supervise
+func newSupervisedServer(t *testing.T, restarts int) (*Server, net.Listener) {
+	t.Helper()
+	opts := newTestOptions(t)
+	opts.Config.ListenerRestarts = restarts
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	s.restartBackoff = time.Millisecond
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, ln
+}
+
+func TestServer_SuperviseRestartsListener(t *testing.T) {
+	s, ln := newSupervisedServer(t, 2)
+	addr := ln.Addr().String()
+
+	var served []net.Listener
+	serve := func(ln net.Listener) error {
+		served = append(served, ln)
+		if len(served) == 1 {
+			return errors.New("accept failed")
+		}
+		return nil
+	}
+	var current net.Listener
+	s.supervise("test", ln, func(ln net.Listener) { current = ln }, serve)
+
+	if len(served) != 2 || current == nil || served[1] != current {
+		t.Fatalf("served %d listeners, want the first and then a new one", len(served))
+	}
+	if current.Addr().String() != addr {
+		t.Errorf("restarted on %s, want %s", current.Addr(), addr)
+	}
+	current.Close()
+	select {
+	case err := <-s.Errors():
+		t.Errorf("restarted listener reported %v", err)
+	default:
+	}
+}
+
+func TestServer_SuperviseGivesUp(t *testing.T) {
+	s, ln := newSupervisedServer(t, 2)
+	failed := errors.New("accept failed")
+	calls := 0
+	s.supervise("test", ln, func(ln net.Listener) {}, func(net.Listener) error {
+		calls++
+		return failed
+	})
+
+	if calls != 3 {
+		t.Errorf("served %d times, want the first try and 2 restarts", calls)
+	}
+	select {
+	case err := <-s.Errors():
+		if !errors.Is(err, failed) || !strings.Contains(err.Error(), "test server") {
+			t.Errorf("error = %v, want the listener's failure", err)
+		}
+	default:
+		t.Fatal("no error after the restarts ran out")
+	}
+}
+
+func TestServer_SuperviseStopsOnShutdown(t *testing.T) {
+	s, ln := newSupervisedServer(t, 2)
+	s.restartBackoff = time.Hour
+	close(s.closing) // as Shutdown does first
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.supervise("test", ln, func(ln net.Listener) {}, func(net.Listener) error {
+			return errors.New("accept failed")
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervise kept restarting after Shutdown")
+	}
+	select {
+	case err := <-s.Errors():
+		t.Errorf("failure during shutdown reported %v", err)
+	default:
+	}
+}
+
+func TestServer_AgentALPN(t *testing.T) {
+	opts := newTestOptions(t)
+	opts.Config.AgentALPN = true
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer s.Shutdown(ctx)
+
+	// An agent reaches the SSH server through the HTTPS port by ALPN
+	session, err := client.Open(ctx, client.Options{
+		Addr:            s.HTTPSAddr().String(),
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "agent")
+		}),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{config.AgentProtocol}}}
+			return d.DialContext(ctx, network, addr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("client.Open: %v", err)
+	}
+	defer session.Close()
+
+	// Visitors still get HTTPS on the same port
+	httpsAddr := s.HTTPSAddr().String()
+	visitor := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, httpsAddr)
+		},
+	}}
+	resp, err := visitor.Get(session.URL + "/")
+	if err != nil {
+		t.Fatalf("GET %s: %v", session.URL, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "agent" {
+		t.Errorf("GET = %d %q, want 200 %q", resp.StatusCode, body, "agent")
+	}
+}
+
+func TestNewServer_ALPNHandlers(t *testing.T) {
+	opts := newTestOptions(t)
+	opts.ALPNHandlers = map[string]func(*tls.Conn){"h2": func(*tls.Conn) {}}
+	if _, err := NewServer(opts); err == nil {
+		t.Error("NewServer accepted a handler for h2")
+	}
+}